@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// assetHashLength is how many hex digits of the SHA-256 of an asset go into
+// its fingerprinted name.
+const assetHashLength = 10
+
+// AssetStore backs the assetHash and assetURL template functions, which
+// fingerprint the static files under Root so that references to them change
+// whenever their contents do.
+type AssetStore struct {
+	Root    string
+	BaseURL string
+
+	// CopyDir, if set, receives a copy of every asset referenced through
+	// assetURL, under its fingerprinted name.
+	CopyDir string
+
+	// limit is the -root the assets must be within too, which is only
+	// checked for those used, as the default Root need not be.
+	limit *pathJail
+
+	jail   *pathJail
+	mu     sync.Mutex
+	hashes map[string]string
+	used   map[string]bool
+}
+
+// NewAssetStore fingerprints the assets under root, whose URLs start with
+// baseURL, e.g. "/static/".
+func NewAssetStore(root, baseURL string) (*AssetStore, error) {
+	if root == "" {
+		root = "."
+	}
+	jail, err := newPathJail(root)
+	if err != nil {
+		return nil, err
+	}
+	return &AssetStore{
+		Root:    root,
+		BaseURL: baseURL,
+		jail:    jail,
+		hashes:  make(map[string]string),
+		used:    make(map[string]bool),
+	}, nil
+}
+
+// clean turns name into a slash-separated path relative to Root.
+func (s *AssetStore) clean(name string) (string, error) {
+	p := path.Clean("/" + filepath.ToSlash(name))[1:]
+	if p == "" {
+		return "", fmt.Errorf("asset name %q is empty", name)
+	}
+	fname := filepath.Join(s.Root, filepath.FromSlash(p))
+	if err := s.jail.Check(fname); err != nil {
+		return "", err
+	}
+	if err := s.limit.Check(fname); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// Hash is the `assetHash` template function, returning the fingerprint of the
+// asset name, relative to Root, e.g. `{{ assetHash "css/site.css" }}`.
+func (s *AssetStore) Hash(name string) (string, error) {
+	p, err := s.clean(name)
+	if err != nil {
+		return "", err
+	}
+	return s.hash(p)
+}
+
+func (s *AssetStore) hash(p string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.hashes[p]; ok {
+		return h, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.Root, filepath.FromSlash(p)))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	h := hex.EncodeToString(sum[:])[:assetHashLength]
+	s.hashes[p] = h
+	return h, nil
+}
+
+// fingerprinted inserts the hash of p before its extension, e.g.
+// "css/site.0123456789.css".
+func fingerprinted(p, hash string) string {
+	ext := path.Ext(p)
+	if ext == path.Base(p) {
+		ext = ""
+	}
+	return strings.TrimSuffix(p, ext) + "." + hash + ext
+}
+
+// URL is the `assetURL` template function, returning the cache-busted URL of
+// the asset name, e.g. `{{ assetURL "css/site.css" }}` for
+// "/static/css/site.0123456789.css".
+func (s *AssetStore) URL(name string) (string, error) {
+	p, err := s.clean(name)
+	if err != nil {
+		return "", err
+	}
+	h, err := s.hash(p)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.used[p] = true
+	s.mu.Unlock()
+	base := s.BaseURL
+	if base != "" && !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return base + fingerprinted(p, h), nil
+}
+
+// copyAssets writes a copy of every asset referenced over the run to the
+// CopyDir of the Assets, under its fingerprinted name.
+func (r *Renderer) copyAssets() error {
+	s := r.Assets
+	if s == nil || s.CopyDir == "" {
+		return nil
+	}
+	s.mu.Lock()
+	used := make([]string, 0, len(s.used))
+	for p := range s.used {
+		used = append(used, p)
+	}
+	s.mu.Unlock()
+	sort.Strings(used)
+
+	mode, err := r.outputMode("")
+	if err != nil {
+		return err
+	}
+	var onames []string
+	for _, p := range used {
+		onames = append(onames, filepath.Join(s.CopyDir, filepath.FromSlash(fingerprinted(p, s.hashes[p]))))
+	}
+	for i, p := range used {
+		if err := r.sink.Check(onames[i]); err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(filepath.Join(s.Root, filepath.FromSlash(p)))
+		if err != nil {
+			return err
+		}
+		r.logf(LogInfo, "Copying asset %s into %s", p, onames[i])
+		r.trackChange(onames[i], content)
+		if err := r.sink.WriteFile(onames[i], content, mode); err != nil {
+			return err
+		}
+		r.indexOutput(onames[i], content)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultBackupSuffix is appended to the names of backups made by -backup.
+const DefaultBackupSuffix = ".bak"
+
+// backupPolicy describes where the previous contents of overwritten outputs
+// are saved.
+type backupPolicy struct {
+	suffix string
+	dir    string
+	time   time.Time
+	done   map[string]bool
+
+	// saved holds the backup of every output that was backed up.
+	saved map[string]string
+}
+
+// path returns the name of the backup of name. Backups in a directory are
+// grouped by the time of the run, and keep the path of their output.
+func (b *backupPolicy) path(name string) (string, error) {
+	if b.dir == "" {
+		return name + b.suffix, nil
+	}
+	rel := filepath.Clean(name)
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		abs, err := filepath.Abs(rel)
+		if err != nil {
+			return "", err
+		}
+		rel = abs
+	}
+	return filepath.Join(b.dir, b.time.Format("20060102-150405"), rel) + b.suffix, nil
+}
+
+// backupFile saves the current contents of name, if it exists, before it is
+// overwritten for the first time in the run.
+func (s *fileSink) backupFile(name string) error {
+	b := s.backup
+	if b == nil || b.done[name] {
+		return nil
+	}
+	if b.done == nil {
+		b.done = make(map[string]bool)
+	}
+	b.done[name] = true
+
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("Cannot back up %q: %v", name, err)
+	}
+
+	dest, err := b.path(name)
+	if err != nil {
+		return err
+	}
+	if err := s.Check(dest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), s.dirMode); err != nil {
+		return fmt.Errorf("Cannot back up %q: %v", name, err)
+	}
+	if err := writeFileAtomic(dest, content, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("Cannot back up %q: %v", name, err)
+	}
+	if b.saved == nil {
+		b.saved = make(map[string]string)
+	}
+	b.saved[name] = dest
+	return nil
+}
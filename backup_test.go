@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+var backupTests = []struct {
+	name    string
+	suffix  string
+	dir     string
+	backups []string
+}{
+	{name: "suffix", suffix: DefaultBackupSuffix, backups: []string{"out/a.txt.bak"}},
+	{name: "other-suffix", suffix: ".orig", backups: []string{"out/a.txt.orig"}},
+	{name: "dir", dir: "backups", backups: []string{"backups/*/out/a.txt"}},
+	{name: "dir-and-suffix", suffix: ".bak", dir: "backups", backups: []string{"backups/*/out/a.txt.bak"}},
+}
+
+func TestBackup(t *testing.T) {
+	for _, test := range backupTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{"a.txt.tpl": "{{ .foo }}", "b.txt.tpl": "new", "out/a.txt": "old"} {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r := &Renderer{Inputs: []string{"a.txt.tpl", "b.txt.tpl"}, StopOnError: true, BackupSuffix: test.suffix, BackupDir: test.dir, Logger: &logRecorder{}}
+			if err := r.Execute("out/", map[string]interface{}{"foo": "bar"}); err != nil {
+				t.Fatal(err)
+			}
+			if content, err := ioutil.ReadFile("out/a.txt"); err != nil || string(content) != "bar" {
+				t.Errorf("Rendered %q, %v, expected %q", content, err, "bar")
+			}
+
+			// Only the output that was overwritten is backed up, with its
+			// previous contents and mode
+			var found []string
+			err = filepath.Walk(".", func(name string, fi os.FileInfo, err error) error {
+				if err == nil && !fi.IsDir() {
+					found = append(found, filepath.ToSlash(name))
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != 4+len(test.backups) {
+				t.Errorf("Found files %q, expected the outputs and backups %q", found, test.backups)
+			}
+			for _, pattern := range test.backups {
+				matches, err := filepath.Glob(filepath.FromSlash(pattern))
+				if err != nil || len(matches) != 1 {
+					t.Fatalf("Found backups %q, %v, expected one %s", matches, err, pattern)
+				}
+				content, err := ioutil.ReadFile(matches[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != "old" {
+					t.Errorf("Backed up %q into %s, expected %q", content, matches[0], "old")
+				}
+				if fi, err := os.Stat(matches[0]); err != nil || (fi.Mode().Perm() != 0600 && runtime.GOOS != "windows") {
+					t.Errorf("Backup %s has mode %v, %v, expected 600", matches[0], fi.Mode(), err)
+				}
+				if saved := r.backups.saved[filepath.Join("out", "a.txt")]; saved != matches[0] {
+					t.Errorf("Recorded backups %v, expected %s", r.backups.saved, matches[0])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// barcodeScale, barcodeHeight, and barcodeQuietZone are the width of the
+// modules of Code 128 barcodes, in pixels, their height, in pixels, and the
+// width of the blank margin on either side of them, in modules.
+const (
+	barcodeScale     = 2
+	barcodeHeight    = 80
+	barcodeQuietZone = 10
+)
+
+// code128Patterns are the widths of the bars and spaces of each symbol of
+// Code 128, alternating and starting with a bar, in modules. The last is the
+// stop pattern, which ends with a bar of its own.
+var code128Patterns = [...]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+// Symbols of Code 128 with a meaning of their own.
+const (
+	code128StartB = 104
+	code128Stop   = 106
+)
+
+// barcode is the `barcode` template function, encoding value into a Code 128
+// barcode, and returning it as a base64-encoded PNG image, like qrcode.
+func barcode(value string) (string, error) {
+	data, err := barcodePNG(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// barcodePNG encodes value into a Code 128 barcode as a PNG image.
+func barcodePNG(value string) ([]byte, error) {
+	modules, err := encodeCode128(value)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, barcodeImage(modules, barcodeScale, barcodeHeight, barcodeQuietZone)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeCode128 encodes value, in code set B, into the modules of a Code 128
+// barcode, true for those of bars. Code set B covers printable ASCII.
+func encodeCode128(value string) ([]bool, error) {
+	if value == "" {
+		return nil, errors.New("Cannot encode an empty barcode")
+	}
+	symbols := []int{code128StartB}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 32 || c > 126 {
+			return nil, fmt.Errorf("Cannot encode %q in a barcode, which only holds printable ASCII characters", value)
+		}
+		symbols = append(symbols, int(c)-32)
+	}
+	check := symbols[0]
+	for i, s := range symbols[1:] {
+		check += (i + 1) * s
+	}
+	symbols = append(symbols, check%103, code128Stop)
+
+	var modules []bool
+	for _, s := range symbols {
+		for i, w := range code128Patterns[s] {
+			for n := 0; n < int(w-'0'); n++ {
+				modules = append(modules, i%2 == 0)
+			}
+		}
+	}
+	return modules, nil
+}
+
+// barcodeImage draws modules with the given module width, height, and quiet
+// zone.
+func barcodeImage(modules []bool, scale, height, quiet int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, (len(modules)+2*quiet)*scale, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for x, bar := range modules {
+		if !bar {
+			continue
+		}
+		for dx := 0; dx < scale; dx++ {
+			for y := 0; y < height; y++ {
+				img.SetGray((x+quiet)*scale+dx, y, color.Gray{})
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// binarySniffLen is how much of a file is inspected to tell whether it is
+// binary.
+const binarySniffLen = 8000
+
+// isBinaryFile reports whether fn looks like a binary file rather than text.
+func isBinaryFile(fn string) (bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return isBinary(buf[:n]), nil
+}
+
+// isBinary reports whether data contains a NUL byte, or more than 30% of
+// invalid UTF-8 and control characters other than whitespace.
+func isBinary(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	suspect := 0
+	for i := 0; i < len(data); {
+		c, size := utf8.DecodeRune(data[i:])
+		switch {
+		case c == 0:
+			return true
+		case c == utf8.RuneError && size == 1:
+			// A multi-byte character cut off by the end of the sample does
+			// not count against it
+			if len(data)-i >= utf8.UTFMax {
+				suspect++
+			}
+		case c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' && c != '\b':
+			suspect++
+		}
+		i += size
+	}
+	return suspect*10 > len(data)*3
+}
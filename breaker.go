@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultBreakerBackoff is how long a tripped circuit breaker waits before
+// the template is tried again, by default. maxBreakerBackoff caps how long
+// the wait grows, unless the first one is longer already.
+const (
+	DefaultBreakerBackoff = time.Minute
+	maxBreakerBackoff     = time.Hour
+)
+
+// breakerState is how a template fared in the runs of the daemon. Failures
+// counts the runs in a row it failed in; once tripped, the template is not
+// rendered until RetryAt, leaving its last output as it was.
+type breakerState struct {
+	Input     string    `json:"input"`
+	Failures  int       `json:"failures"`
+	Tripped   bool      `json:"tripped"`
+	RetryAt   time.Time `json:"retry_at,omitempty"`
+	LastError string    `json:"last_error"`
+
+	backoff time.Duration
+}
+
+// circuitBreaker keeps the templates of the daemon that fail run after run
+// from failing every run: a template that fails does not stop the others,
+// and once it failed threshold runs in a row, it is left out of the runs
+// until its backoff expired. The next run then tries it again, and each time
+// it still fails, the backoff doubles.
+type circuitBreaker struct {
+	threshold int
+	backoff   time.Duration
+	logger    Logger
+
+	mu     sync.Mutex
+	states map[string]*breakerState
+}
+
+func newCircuitBreaker(threshold int, backoff time.Duration, logger Logger) *circuitBreaker {
+	if backoff <= 0 {
+		backoff = DefaultBreakerBackoff
+	}
+	return &circuitBreaker{threshold: threshold, backoff: backoff, logger: logger, states: make(map[string]*breakerState)}
+}
+
+// isOpen reports whether input is left out of runs, for now.
+func (b *circuitBreaker) isOpen(input string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.states[input]
+	return s != nil && s.Tripped && time.Now().Before(s.RetryAt)
+}
+
+// failure records that input failed with err, tripping its breaker after
+// enough failures, or backing off further if it was tried again.
+func (b *circuitBreaker) failure(input string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.states[input]
+	if s == nil {
+		s = &breakerState{Input: input}
+		b.states[input] = s
+	}
+	s.Failures++
+	s.LastError = err.Error()
+	switch {
+	case s.Tripped:
+		limit := maxBreakerBackoff
+		if b.backoff > limit {
+			limit = b.backoff
+		}
+		if s.backoff *= 2; s.backoff > limit {
+			s.backoff = limit
+		}
+		s.RetryAt = time.Now().Add(s.backoff)
+		logf(b.logger, LogError, "Template %s still fails, after %d runs in a row; keeping its last output, and trying again in %s: %v", input, s.Failures, s.backoff, err)
+	case s.Failures >= b.threshold:
+		s.Tripped, s.backoff = true, b.backoff
+		s.RetryAt = time.Now().Add(s.backoff)
+		logf(b.logger, LogError, "Template %s failed %d runs in a row; keeping its last output, and trying again in %s: %v", input, s.Failures, s.backoff, err)
+	default:
+		logf(b.logger, LogError, "Template %s failed, %d of %d times before it is left out of runs: %v", input, s.Failures, b.threshold, err)
+	}
+}
+
+// success records that input rendered, closing its breaker.
+func (b *circuitBreaker) success(input string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s := b.states[input]; s != nil && s.Tripped {
+		logf(b.logger, LogInfo, "Template %s renders again, after failing %d runs in a row", input, s.Failures)
+	}
+	delete(b.states, input)
+}
+
+// failing returns the state of every template that failed its last run,
+// sorted by input.
+func (b *circuitBreaker) failing() []breakerState {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	states := make([]breakerState, 0, len(b.states))
+	for _, s := range b.states {
+		states = append(states, *s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Input < states[j].Input })
+	return states
+}
+
+// tripped reports whether any breaker is tripped.
+func (b *circuitBreaker) tripped() bool {
+	for _, s := range b.failing() {
+		if s.Tripped {
+			return true
+		}
+	}
+	return false
+}
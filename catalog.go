@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// catalog holds the translated messages backing the `t` template function,
+// loaded from gettext .po files and JSON files for a single locale.
+type catalog struct {
+	locale   string
+	plural   pluralRule
+	messages map[string][]string
+	logger   Logger
+
+	mu     sync.Mutex
+	warned map[string]bool
+}
+
+// newCatalog creates an empty catalog for locale, e.g. "fr" or "pt_BR", with
+// the plural rule of its language.
+func newCatalog(locale string) (*catalog, error) {
+	plural, err := parsePluralRule(defaultPluralRule(locale))
+	if err != nil {
+		return nil, err
+	}
+	return &catalog{
+		locale:   locale,
+		plural:   plural,
+		messages: make(map[string][]string),
+		warned:   make(map[string]bool),
+	}, nil
+}
+
+// Load adds the messages of a .po or .json file to the catalog, replacing
+// those of earlier files with the same key.
+func (c *catalog) Load(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	logf(c.logger, LogInfo, "Loading messages from %s", fname)
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".po":
+		err = c.loadPO(data)
+	case ".json":
+		err = c.loadJSON(data)
+	default:
+		return fmt.Errorf("%s: message catalogs must be .po or .json files", fname)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	return nil
+}
+
+// loadJSON reads a JSON object of keys to messages. A message with plural
+// forms is an array of them, in the order of the gettext plural rule of the
+// locale, e.g. ["%d file", "%d files"] in English.
+func (c *catalog) loadJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for key, v := range raw {
+		switch v := v.(type) {
+		case string:
+			c.messages[key] = []string{v}
+		case []interface{}:
+			forms := make([]string, 0, len(v))
+			for _, f := range v {
+				s, ok := f.(string)
+				if !ok {
+					return fmt.Errorf("plural forms of %q must be strings, got %v", key, f)
+				}
+				forms = append(forms, s)
+			}
+			c.messages[key] = forms
+		default:
+			return fmt.Errorf("message %q must be a string or an array of plural forms, got %v", key, v)
+		}
+	}
+	return nil
+}
+
+// poEntry is a message of a .po file as it is being read. Continuation
+// strings are appended to the target, the string last started.
+type poEntry struct {
+	id     string
+	plural string
+	forms  map[int]*string
+	fuzzy  bool
+	target *string
+}
+
+// loadPO reads a gettext .po file. Fuzzy and untranslated messages are
+// ignored, as gettext does, and the Plural-Forms header replaces the plural
+// rule of the locale.
+func (c *catalog) loadPO(data []byte) error {
+	e := &poEntry{forms: make(map[int]*string)}
+	flush := func() error {
+		done := e
+		e = &poEntry{forms: make(map[int]*string)}
+		if done.fuzzy || len(done.forms) == 0 {
+			return nil
+		}
+		if done.id == "" {
+			return c.poHeader(*done.forms[0])
+		}
+		forms := make([]string, len(done.forms))
+		for i := range forms {
+			s, ok := done.forms[i]
+			if !ok {
+				return fmt.Errorf("message %q lacks msgstr[%d]", done.id, i)
+			}
+			if *s == "" {
+				return nil
+			}
+			forms[i] = *s
+		}
+		c.messages[done.id] = forms
+		return nil
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			if strings.HasPrefix(line, "#,") && strings.Contains(line, "fuzzy") {
+				if len(e.forms) > 0 {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+				e.fuzzy = true
+			}
+			continue
+		}
+		if strings.HasPrefix(line, `"`) {
+			if e.target == nil {
+				return fmt.Errorf("line %d: string outside of an entry", lineno)
+			}
+			s, err := strconv.Unquote(line)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineno, err)
+			}
+			*e.target += s
+			continue
+		}
+
+		keyword, rest := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			keyword, rest = line[:i], strings.TrimSpace(line[i:])
+		}
+		s, err := strconv.Unquote(rest)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+		switch {
+		case keyword == "msgctxt":
+			return fmt.Errorf("line %d: message contexts are not supported", lineno)
+		case keyword == "msgid":
+			if len(e.forms) > 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			e.id = s
+			e.target = &e.id
+		case keyword == "msgid_plural":
+			e.plural = s
+			e.target = &e.plural
+		case keyword == "msgstr" || strings.HasPrefix(keyword, "msgstr["):
+			n := 0
+			if keyword != "msgstr" {
+				n, err = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(keyword, "msgstr["), "]"))
+				if err != nil || n < 0 || !strings.HasSuffix(keyword, "]") {
+					return fmt.Errorf("line %d: invalid plural form %q", lineno, keyword)
+				}
+			}
+			e.forms[n] = &s
+			e.target = &s
+		default:
+			return fmt.Errorf("line %d: unknown keyword %q", lineno, keyword)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// poHeader reads the header entry of a .po file, taking the plural rule from
+// its Plural-Forms field, e.g. "nplurals=2; plural=(n != 1);".
+func (c *catalog) poHeader(header string) error {
+	for _, field := range strings.Split(header, "\n") {
+		i := strings.Index(field, ":")
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(field[:i]), "Plural-Forms") {
+			continue
+		}
+		for _, part := range strings.Split(field[i+1:], ";") {
+			part = strings.TrimSpace(part)
+			if !strings.HasPrefix(part, "plural=") {
+				continue
+			}
+			rule, err := parsePluralRule(strings.TrimPrefix(part, "plural="))
+			if err != nil {
+				return fmt.Errorf("invalid Plural-Forms: %v", err)
+			}
+			c.plural = rule
+		}
+	}
+	return nil
+}
+
+// T is the `t` template function, which translates the message key with the
+// catalog. Arguments are formatted into the message as with printf. For a
+// message with plural forms, the first argument is the count choosing the
+// form, e.g. `{{ t "files" .count }}`. Keys missing from the
+// catalog are logged once and used as the message itself.
+func (c *catalog) T(key string, args ...interface{}) (string, error) {
+	if c == nil {
+		return formatMessage(key, args), nil
+	}
+	forms, ok := c.messages[key]
+	if !ok {
+		c.mu.Lock()
+		if !c.warned[key] {
+			c.warned[key] = true
+			logf(c.logger, LogWarn, "No %s translation of %q", c.localeName(), key)
+		}
+		c.mu.Unlock()
+		return formatMessage(key, args), nil
+	}
+	msg := forms[0]
+	if len(forms) > 1 {
+		if len(args) == 0 {
+			return "", fmt.Errorf("message %q has plural forms, and needs a count", key)
+		}
+		n, err := pluralCount(args[0])
+		if err != nil {
+			return "", fmt.Errorf("message %q: %v", key, err)
+		}
+		i := c.plural(n)
+		if i < 0 || i >= int64(len(forms)) {
+			return "", fmt.Errorf("message %q has no plural form %d for a count of %d", key, i, n)
+		}
+		msg = forms[i]
+	}
+	return formatMessage(msg, args), nil
+}
+
+func (c *catalog) localeName() string {
+	if c.locale == "" {
+		return "default"
+	}
+	return c.locale
+}
+
+// formatMessage formats args into msg, leaving msg alone when there are none.
+func formatMessage(msg string, args []interface{}) string {
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// pluralCount converts the count given to `t` into an integer. Values files
+// hold integers, but JSON decodes numbers as floats.
+func pluralCount(v interface{}) (int64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return int64(rv.Float()), nil
+	case reflect.String:
+		return strconv.ParseInt(rv.String(), 10, 64)
+	}
+	return 0, fmt.Errorf("count must be a number, got %v", v)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// contractRef is a value path that a template uses, where it uses it.
+// Ranged is set for the value of a range.
+type contractRef struct {
+	Path   []string
+	Loc    string
+	Ranged bool
+}
+
+// contractRefs lists the value paths the templates of the inputs use, as far
+// as it can be told: the references from the top level of inputs, and from
+// within `with` there.
+func (r *Renderer) contractRefs() ([]contractRef, error) {
+	var refs []contractRef
+	err := r.eachParsedTemplate(func(t *template.Template, path string, entry, _ bool) error {
+		if !entry {
+			return nil
+		}
+		walkDots(t.Tree.Root, nil, true, func(n parse.Node, dot []string, known bool) {
+			var ident []string
+			ranged := false
+			switch tn := n.(type) {
+			case *parse.FieldNode:
+				if !known {
+					return
+				}
+				ident = tn.Ident
+			case *parse.VariableNode:
+				if len(tn.Ident) < 2 || tn.Ident[0] != "$" {
+					return
+				}
+				ident, dot = tn.Ident[1:], nil
+			case *parse.RangeNode:
+				p := tn.Pipe
+				if !known || len(p.Cmds) != 1 || len(p.Cmds[0].Args) != 1 {
+					return
+				}
+				f, ok := p.Cmds[0].Args[0].(*parse.FieldNode)
+				if !ok {
+					return
+				}
+				ident, ranged = f.Ident, true
+			default:
+				return
+			}
+			full := append(append([]string{}, dot...), ident...)
+			if r.isMetadataRef(full) {
+				return
+			}
+			refs = append(refs, contractRef{Path: full, Loc: nodeLocation(t.Tree, n, []string{path}), Ranged: ranged})
+		})
+		return nil
+	})
+	return refs, err
+}
+
+// checkContract checks that s covers the value at path, as ranged or not:
+// that every key along it is a property of the schema, or allowed by its
+// additionalProperties, with a type that has keys, or items when ranged.
+// Below a schema that says nothing of its value, anything is covered.
+func (s *Schema) checkContract(path []string, ranged bool) error {
+	cur, err := s.resolve()
+	if err != nil {
+		return err
+	}
+	for i, key := range path {
+		at := "." + strings.Join(path[:i], ".")
+		if len(cur.Type) > 0 && !cur.Type.allows("object") {
+			return fmt.Errorf("uses %s as a mapping, which the schema has as %s", at, strings.Join(cur.Type, " or "))
+		}
+		next, ok := cur.Properties[key]
+		if !ok && cur.AdditionalProperties != nil {
+			next = cur.AdditionalProperties.Schema
+			ok = next != nil
+		}
+		if !ok {
+			if len(cur.Type) == 0 && cur.Properties == nil && cur.AdditionalProperties == nil {
+				return nil
+			}
+			return fmt.Errorf("uses .%s, which is not in the schema", strings.Join(path[:i+1], "."))
+		}
+		if cur, err = next.resolve(); err != nil {
+			return err
+		}
+	}
+	if ranged && len(cur.Type) > 0 && !cur.Type.allows("array") && !cur.Type.allows("object") {
+		return fmt.Errorf("ranges over .%s, which the schema has as %s", strings.Join(path, "."), strings.Join(cur.Type, " or "))
+	}
+	return nil
+}
+
+// runContract checks the value paths the templates use against the schema
+// that the producer of their values publishes, reporting each one it does
+// not cover. It returns the process exit code.
+func runContract(r *Renderer, schemaFile string) int {
+	if r.Schema == nil {
+		r.logf(LogError, "The contract command requires -schema=FILE")
+		return 1
+	}
+	refs, err := r.contractRefs()
+	if err != nil {
+		r.logf(LogError, "%v", err)
+		return 1
+	}
+	paths := make(map[string]bool)
+	var failures []string
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		paths[strings.Join(ref.Path, ".")] = true
+		if err := r.Schema.checkContract(ref.Path, ref.Ranged); err != nil {
+			msg := fmt.Sprintf("%s: %v", ref.Loc, err)
+			if !seen[msg] {
+				seen[msg] = true
+				failures = append(failures, msg)
+			}
+		}
+	}
+	for _, msg := range failures {
+		r.logf(LogError, "%s", msg)
+	}
+	if len(failures) > 0 {
+		r.logf(LogError, "%d use(s) of values are not covered by %s", len(failures), schemaFile)
+		return 1
+	}
+	r.logf(LogInfo, "Checked %d value path(s) used by %d input(s), all covered by %s", len(paths), len(r.Inputs), schemaFile)
+	return 0
+}
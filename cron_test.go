@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var cronFieldTests = []struct {
+	name     string
+	field    int
+	value    string
+	expected []int
+	err      string
+}{
+	{name: "any-hour", field: 1, value: "*", expected: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23}},
+	{name: "single", field: 0, value: "5", expected: []int{5}},
+	{name: "list", field: 0, value: "0,15,45", expected: []int{0, 15, 45}},
+	{name: "range", field: 1, value: "9-12", expected: []int{9, 10, 11, 12}},
+	{name: "step", field: 1, value: "*/6", expected: []int{0, 6, 12, 18}},
+	{name: "range-step", field: 0, value: "10-30/10", expected: []int{10, 20, 30}},
+	{name: "start-step", field: 2, value: "25/3", expected: []int{25, 28, 31}},
+	{name: "month-names", field: 3, value: "JAN,jun-aug", expected: []int{1, 6, 7, 8}},
+	{name: "day-names", field: 4, value: "mon-fri", expected: []int{1, 2, 3, 4, 5}},
+	{name: "out-of-range", field: 0, value: "60", err: `invalid minute "60"; must be from 0 to 59`},
+	{name: "below-range", field: 2, value: "0", err: `invalid day of month "0"`},
+	{name: "unknown-name", field: 3, value: "foo", err: `invalid month "foo"`},
+	{name: "zero-step", field: 0, value: "*/0", err: "invalid step"},
+	{name: "bad-step", field: 0, value: "*/x", err: "invalid step"},
+	{name: "reversed-range", field: 1, value: "12-9", err: "invalid range"},
+	{name: "empty", field: 0, value: "", err: "invalid minute"},
+}
+
+func TestCronField(t *testing.T) {
+	for _, test := range cronFieldTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			set, err := cronFields[test.field].parse(test.value)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected parsing to fail with %q, but it succeeded", test.err)
+			}
+			var expected uint64
+			for _, v := range test.expected {
+				expected |= 1 << uint(v)
+			}
+			if set != expected {
+				t.Errorf("Parsed %q into %b, expected %b", test.value, set, expected)
+			}
+		})
+	}
+}
+
+var cronTests = []struct {
+	name     string
+	expr     string
+	from     string
+	expected string
+	err      string
+}{
+	{name: "every-six-hours", expr: "0 */6 * * *", from: "2026-03-01T07:30:00Z", expected: "2026-03-01T12:00:00Z"},
+	{name: "macro", expr: "@daily", from: "2026-03-01T07:30:00Z", expected: "2026-03-02T00:00:00Z"},
+	{name: "sunday-as-7", expr: "0 0 * * 7", from: "2026-03-02T00:00:00Z", expected: "2026-03-08T00:00:00Z"},
+	{name: "either-day", expr: "0 0 13 * fri", from: "2026-03-01T00:00:00Z", expected: "2026-03-06T00:00:00Z"},
+	{name: "end-of-month", expr: "0 0 31 * *", from: "2026-04-01T00:00:00Z", expected: "2026-05-31T00:00:00Z"},
+	{name: "never", expr: "0 0 30 feb *", from: "2026-01-01T00:00:00Z"},
+	{name: "too-few-fields", expr: "0 0 * *", err: "expected 5 fields"},
+	{name: "unknown-macro", expr: "@often", err: "expected 5 fields, or a macro"},
+	{name: "invalid-field", expr: "0 24 * * *", err: `invalid hour "24"`},
+}
+
+func TestCron(t *testing.T) {
+	for _, test := range cronTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			c, err := parseCron(test.expr)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected parsing to fail with %q, but it succeeded", test.err)
+			}
+			from, err := time.Parse(time.RFC3339, test.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := c.Next(from)
+			if test.expected == "" {
+				if !next.IsZero() {
+					t.Errorf("Scheduled at %s, expected never", next)
+				}
+				return
+			}
+			if got := next.Format(time.RFC3339); got != test.expected {
+				t.Errorf("Scheduled at %s, expected %s", got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// daemonRun describes one run of the daemon.
+type daemonRun struct {
+	ID         int        `json:"id"`
+	Trigger    string     `json:"trigger"`
+	Start      time.Time  `json:"start"`
+	DurationMS float64    `json:"duration_ms"`
+	Error      string     `json:"error,omitempty"`
+	Report     *RunReport `json:"report"`
+}
+
+// daemon renders the same templates over and over, reloading the values
+// before every run: once at startup, on the schedule if any, and on SIGHUP.
+type daemon struct {
+	r        *Renderer
+	out      string
+	load     func() (Values, error)
+	schedule *cronSchedule
+	sources  *sourceHealth
+
+	// requireValid keeps health checks failing until a run rendered every
+	// output.
+	requireValid bool
+
+	// render serializes the use of r, by runs and previews, and guards
+	// values, the values of the last run.
+	render sync.Mutex
+	values Values
+
+	// mu guards the fields below, as runs and health checks happen
+	// concurrently.
+	mu      sync.Mutex
+	running bool
+	last    *daemonRun
+	next    time.Time
+	wg      sync.WaitGroup
+
+	// outputs holds the last status of every output rendered so far, and
+	// diffs the most recent changes to them, newest first.
+	outputs map[string]daemonOutput
+	order   []string
+	diffs   []daemonDiff
+	history *runHistory
+}
+
+// trigger starts a run in the background, unless one is still going, in
+// which case it is skipped rather than queued.
+func (d *daemon) trigger(reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		logf(d.r.Logger, LogWarn, "Skipping the %s run, as the previous one is still going", reason)
+		return
+	}
+	d.running = true
+	d.wg.Add(1)
+	go d.run(reason)
+}
+
+func (d *daemon) run(reason string) {
+	defer d.wg.Done()
+	run := &daemonRun{Trigger: reason, Start: time.Now(), Report: &RunReport{}}
+	logf(d.r.Logger, LogInfo, "Starting the %s run", reason)
+
+	d.render.Lock()
+	var changes *changeTracker
+	values, err := d.load()
+	if err == nil {
+		d.values = values
+		d.r.Report = run.Report
+		err = d.r.Execute(d.out, values)
+		changes = d.r.changes
+		d.recordOutputs(run)
+	}
+	run.DurationMS = float64(time.Since(run.Start)) / float64(time.Millisecond)
+	if err != nil {
+		run.Error = err.Error()
+		logf(d.r.Logger, LogError, "The %s run failed: %v", reason, err)
+	}
+	d.recordHistory(run, values, changes)
+	d.render.Unlock()
+
+	d.mu.Lock()
+	d.running = false
+	d.last = run
+	d.mu.Unlock()
+}
+
+// health serves the status of the daemon as JSON, failing with 503 Service
+// Unavailable while the last run failed.
+func (d *daemon) health(w http.ResponseWriter, req *http.Request) {
+	d.mu.Lock()
+	status := struct {
+		Status   string         `json:"status"`
+		Running  bool           `json:"running"`
+		Schedule string         `json:"schedule,omitempty"`
+		NextRun  *time.Time     `json:"next_run,omitempty"`
+		LastRun  *daemonRun     `json:"last_run,omitempty"`
+		Failing  []breakerState `json:"failing,omitempty"`
+	}{Status: "ok", Running: d.running, LastRun: d.last, Failing: d.r.breaker.failing()}
+	if d.schedule != nil {
+		status.Schedule = d.schedule.String()
+		if !d.next.IsZero() {
+			next := d.next
+			status.NextRun = &next
+		}
+	}
+	code := http.StatusOK
+	if d.last == nil {
+		status.Status = "starting"
+	} else if d.last.Error != "" {
+		status.Status = "failing"
+		code = http.StatusServiceUnavailable
+	} else if len(status.Failing) > 0 {
+		// The rest of the templates still render
+		status.Status = "degraded"
+	} else if len(d.last.Report.incomplete()) > 0 {
+		status.Status = "incomplete"
+	}
+	if d.requireValid && status.Status != "ok" {
+		// Not ready to be used until every output is fresh
+		code = http.StatusServiceUnavailable
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	d.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
+
+// runDaemon renders until it receives SIGINT or SIGTERM, or stop is closed,
+// serving its health and status on listen if set, and waits for a run in
+// progress before returning. With requireValid, health checks fail until a
+// run rendered every output.
+func runDaemon(r *Renderer, out string, load func() (Values, error), sources *sourceHealth, schedule *cronSchedule, listen string, history int, breaker *circuitBreaker, requireValid bool, stop <-chan struct{}) int {
+	d := &daemon{r: r, out: out, load: load, schedule: schedule, sources: sources, requireValid: requireValid, outputs: make(map[string]daemonOutput), history: newRunHistory(history)}
+	r.keepContent = true
+	r.breaker = breaker
+
+	if listen != "" {
+		ln, err := net.Listen("tcp", listen)
+		if err != nil {
+			logf(r.Logger, LogError, "Cannot serve health checks: %v", err)
+			return 1
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", d.health)
+		mux.HandleFunc("/api/status", d.status)
+		mux.HandleFunc("/api/preview", d.previewAPI)
+		mux.HandleFunc("/preview", d.previewUI)
+		mux.HandleFunc("/api/runs", d.runsAPI)
+		mux.HandleFunc("/api/runs/diff", d.compareAPI)
+		mux.HandleFunc("/runs", d.runsUI)
+		mux.HandleFunc("/", d.ui)
+		logf(r.Logger, LogInfo, "Serving the status of the daemon on http://%s/, and health checks on /healthz", ln.Addr())
+		go http.Serve(ln, mux)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	d.trigger("startup")
+	for {
+		var tick <-chan time.Time
+		if d.schedule != nil {
+			next := d.schedule.Next(time.Now())
+			d.mu.Lock()
+			d.next = next
+			d.mu.Unlock()
+			if next.IsZero() {
+				logf(r.Logger, LogWarn, "The schedule %q never runs again", d.schedule)
+			} else {
+				tick = time.After(time.Until(next))
+			}
+		}
+		select {
+		case <-tick:
+			d.trigger("scheduled")
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				d.trigger("SIGHUP")
+				continue
+			}
+			logf(r.Logger, LogInfo, "Received %v, stopping once the current run is done", sig)
+			d.wg.Wait()
+			return 0
+		case <-stop:
+			logf(r.Logger, LogInfo, "Stopped by the service manager, stopping once the current run is done")
+			d.wg.Wait()
+			return 0
+		}
+	}
+}
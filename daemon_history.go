@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// DefaultDaemonHistory is how many runs the daemon keeps by default.
+const DefaultDaemonHistory = 50
+
+// historyRun is a run kept in the history of the daemon, with the checksum
+// of every output as the run left it, and of every top-level value it was
+// rendered with. Values are only kept as checksums, so that secrets among
+// them are not served.
+type historyRun struct {
+	*daemonRun
+	Sums   map[string]string `json:"sums"`
+	values map[string]string
+}
+
+// runHistory keeps the most recent runs, up to max, along with every content
+// of an output they refer to, once per checksum.
+type runHistory struct {
+	max      int
+	lastID   int
+	runs     []*historyRun
+	contents map[string][]byte
+}
+
+func newRunHistory(max int) *runHistory {
+	return &runHistory{max: max, contents: make(map[string][]byte)}
+}
+
+// find returns the run with the given ID, if it is still kept.
+func (h *runHistory) find(id int) *historyRun {
+	for _, run := range h.runs {
+		if run.ID == id {
+			return run
+		}
+	}
+	return nil
+}
+
+// add keeps run, rendered with values, and the outputs it wrote, which
+// changes recorded. Outputs it did not write are as the previous run left
+// them. The oldest runs are then forgotten, along with the contents only
+// they referred to.
+func (h *runHistory) add(run *daemonRun, values Values, changes *changeTracker) {
+	h.lastID++
+	run.ID = h.lastID
+	hr := &historyRun{daemonRun: run, Sums: make(map[string]string)}
+	if len(h.runs) > 0 {
+		for name, sum := range h.runs[len(h.runs)-1].Sums {
+			hr.Sums[name] = sum
+		}
+	}
+	if changes != nil && changes.next != nil {
+		for _, e := range run.Report.Outputs {
+			switch e.Status {
+			case "created", "updated", "unchanged":
+			default:
+				continue
+			}
+			content, ok := changes.next[e.Output]
+			if !ok {
+				continue
+			}
+			sum := sha256.Sum256(content)
+			key := hex.EncodeToString(sum[:])
+			hr.Sums[e.Output] = key
+			h.contents[key] = content
+		}
+	}
+	if values != nil {
+		hr.values = make(map[string]string, len(values))
+		for k, v := range values {
+			// Values that cannot be encoded cannot be compared either
+			if enc, err := json.Marshal(normalizeValue(v)); err == nil {
+				sum := sha256.Sum256(enc)
+				hr.values[k] = hex.EncodeToString(sum[:])
+			}
+		}
+	}
+	h.runs = append(h.runs, hr)
+
+	if len(h.runs) <= h.max {
+		return
+	}
+	h.runs = h.runs[len(h.runs)-h.max:]
+	kept := make(map[string]bool)
+	for _, run := range h.runs {
+		for _, sum := range run.Sums {
+			kept[sum] = true
+		}
+	}
+	for sum := range h.contents {
+		if !kept[sum] {
+			delete(h.contents, sum)
+		}
+	}
+}
+
+// runComparison is how the outputs, and the values, differ from one run to
+// another. Values lists the top-level values that changed, and is null if
+// either run failed to load them.
+type runComparison struct {
+	From    *historyRun `json:"from"`
+	To      *historyRun `json:"to"`
+	Values  []string    `json:"values"`
+	Outputs []runDiff   `json:"outputs"`
+}
+
+// ValuesKnown reports whether both runs loaded their values, so that they
+// could be compared.
+func (c *runComparison) ValuesKnown() bool {
+	return c.Values != nil
+}
+
+// runDiff is how an output differs from one run to another. Status is one of
+// "created", "removed", or "updated".
+type runDiff struct {
+	Output string `json:"output"`
+	Status string `json:"status"`
+	Diff   string `json:"diff"`
+
+	Rows []diffRow `json:"-"`
+}
+
+// compare returns how the runs with the IDs from and to differ.
+func (h *runHistory) compare(from, to int) (*runComparison, error) {
+	a, b := h.find(from), h.find(to)
+	if a == nil || b == nil {
+		missing := from
+		if a != nil {
+			missing = to
+		}
+		return nil, fmt.Errorf("Run %d is not in the history", missing)
+	}
+	cmp := &runComparison{From: a, To: b, Outputs: []runDiff{}}
+	if a.values != nil && b.values != nil {
+		cmp.Values = []string{}
+		for k, sum := range b.values {
+			if a.values[k] != sum {
+				cmp.Values = append(cmp.Values, k)
+			}
+		}
+		for k := range a.values {
+			if _, ok := b.values[k]; !ok {
+				cmp.Values = append(cmp.Values, k)
+			}
+		}
+		sort.Strings(cmp.Values)
+	}
+
+	var names []string
+	for name, sum := range b.Sums {
+		if a.Sums[name] != sum {
+			names = append(names, name)
+		}
+	}
+	for name := range a.Sums {
+		if _, ok := b.Sums[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var old, new []byte
+		d := runDiff{Output: name, Status: "updated"}
+		if sum, ok := a.Sums[name]; ok {
+			old = h.contents[sum]
+		} else {
+			d.Status = "created"
+		}
+		if sum, ok := b.Sums[name]; ok {
+			new = h.contents[sum]
+		} else {
+			d.Status = "removed"
+		}
+		d.Diff, _ = outputDiff(name, old, new)
+		if !isBinary(old) && !isBinary(new) {
+			d.Rows = sideBySide(old, new)
+		}
+		cmp.Outputs = append(cmp.Outputs, d)
+	}
+	return cmp, nil
+}
+
+// recordHistory keeps run in the history, with the values it loaded, if
+// any, and the changes it made, if it rendered anything.
+func (d *daemon) recordHistory(run *daemonRun, values Values, changes *changeTracker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.history.add(run, values, changes)
+}
+
+// runs returns the runs in the history, newest first.
+func (d *daemon) runs() []*historyRun {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	runs := make([]*historyRun, len(d.history.runs))
+	for i, run := range d.history.runs {
+		runs[len(runs)-1-i] = run
+	}
+	return runs
+}
+
+// comparison compares the runs named by the from and to parameters of req.
+// Without to, the last run is compared and, without from, the run before
+// to.
+func (d *daemon) comparison(req *http.Request) (*runComparison, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q := req.URL.Query()
+	to := d.history.lastID
+	if s := q.Get("to"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid run %q", s)
+		}
+		to = id
+	}
+	from := to - 1
+	if s := q.Get("from"); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid run %q", s)
+		}
+		from = id
+	}
+	return d.history.compare(from, to)
+}
+
+// runsAPI serves the runs in the history as JSON, newest first.
+func (d *daemon) runsAPI(w http.ResponseWriter, req *http.Request) {
+	data, err := json.MarshalIndent(d.runs(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// compareAPI serves the comparison of two runs as JSON.
+func (d *daemon) compareAPI(w http.ResponseWriter, req *http.Request) {
+	cmp, err := d.comparison(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	data, err := json.MarshalIndent(cmp, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// runsUI serves the history of runs, and the comparison of two of them when
+// asked for.
+func (d *daemon) runsUI(w http.ResponseWriter, req *http.Request) {
+	page := struct {
+		Runs    []*historyRun
+		Compare *runComparison
+		Error   string
+	}{Runs: d.runs()}
+	if q := req.URL.Query(); q.Get("from") != "" || q.Get("to") != "" {
+		cmp, err := d.comparison(req)
+		if err != nil {
+			page.Error = err.Error()
+		}
+		page.Compare = cmp
+	}
+
+	var buf bytes.Buffer
+	if err := daemonPages.ExecuteTemplate(&buf, "runs", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
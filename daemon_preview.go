@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// maxPreviewSize bounds the size of the values a preview is asked for.
+const maxPreviewSize = 1 << 20
+
+// daemonPreview is what the templates would render with other values.
+type daemonPreview struct {
+	Error   string          `json:"error,omitempty"`
+	Outputs []previewOutput `json:"outputs"`
+}
+
+// previewOutput is an output as a preview would render it, with its diff
+// from the file as it is, if they differ. The content of binary outputs is
+// left out.
+type previewOutput struct {
+	ReportEntry
+	Binary  bool   `json:"binary,omitempty"`
+	Content string `json:"content,omitempty"`
+	Diff    string `json:"diff,omitempty"`
+
+	Rows []diffRow `json:"-"`
+}
+
+// parsePreviewValues parses values given to a preview, as YAML or JSON.
+// Unlike -values files, they cannot include other files.
+func parsePreviewValues(data []byte) (Values, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	v := make(Values)
+	if err := v.merge("the preview", doc); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// preview renders the templates as a dry run, with override on top of the
+// values of the last run, top-level key by key. Its failures do not count
+// against the circuit breaker of the runs.
+func (d *daemon) preview(override Values) *daemonPreview {
+	d.render.Lock()
+	defer d.render.Unlock()
+	p := &daemonPreview{Outputs: []previewOutput{}}
+	values := d.values
+	if values == nil {
+		var err error
+		if values, err = d.load(); err != nil {
+			p.Error = err.Error()
+			return p
+		}
+	}
+	merged := make(Values, len(values)+len(override))
+	for k, v := range values {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+
+	r := d.r
+	logf(r.Logger, LogInfo, "Rendering a preview, without writing anything")
+	dryRun, report, breaker := r.DryRun, r.Report, r.breaker
+	defer func() { r.DryRun, r.Report, r.breaker = dryRun, report, breaker }()
+	rep := &RunReport{}
+	r.DryRun, r.Report, r.breaker = true, rep, nil
+	if err := r.Execute(d.out, merged); err != nil {
+		p.Error = err.Error()
+	}
+
+	c := r.changes
+	for _, e := range rep.Outputs {
+		if e.Status == "skipped" {
+			continue
+		}
+		o := previewOutput{ReportEntry: e}
+		if c != nil && c.next != nil {
+			if new, ok := c.next[e.Output]; ok {
+				old := c.prev[e.Output]
+				if isBinary(old) || isBinary(new) {
+					o.Binary = true
+				} else if diff, changed := outputDiff(e.Output, old, new); changed {
+					o.Content, o.Diff = string(new), diff
+					o.Rows = sideBySide(old, new)
+				} else {
+					o.Content = string(new)
+				}
+			}
+		}
+		p.Outputs = append(p.Outputs, o)
+	}
+	return p
+}
+
+// previewAPI serves a preview of the values in the body of a POST, as JSON.
+func (d *daemon) previewAPI(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Preview values by POSTing them", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPreviewSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	override, err := parsePreviewValues(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, err := json.MarshalIndent(d.preview(override), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(out, '\n'))
+}
+
+// previewUI serves the form of a preview, and its outcome once submitted,
+// with values pasted or uploaded.
+func (d *daemon) previewUI(w http.ResponseWriter, req *http.Request) {
+	page := struct {
+		Values  string
+		Preview *daemonPreview
+	}{}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		req.Body = http.MaxBytesReader(w, req.Body, maxPreviewSize)
+		if err := req.ParseMultipartForm(maxPreviewSize); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		page.Values = req.FormValue("values")
+		// Browsers send an empty file when none was chosen
+		if f, h, err := req.FormFile("file"); err == nil && h.Filename != "" {
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			page.Values = string(data)
+		}
+		if override, err := parsePreviewValues([]byte(page.Values)); err != nil {
+			page.Preview = &daemonPreview{Error: "Cannot parse the values: " + err.Error()}
+		} else {
+			page.Preview = d.preview(override)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := daemonPages.ExecuteTemplate(&buf, "preview", page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
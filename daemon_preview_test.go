@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var previewTests = []struct {
+	name     string
+	override Values
+	failed   bool
+}{
+	{name: "valid", override: Values{"port": 8080}},
+	{name: "invalid", override: Values{"port": "not-a-port"}, failed: true},
+}
+
+func TestPreviewLeavesBreakerAlone(t *testing.T) {
+	for _, test := range previewTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile("app.conf.tpl", []byte(`{{ if not (kindIs "int" .port) }}{{ fail "port must be a number" }}{{ end }}port = {{ .port }}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			breaker := newCircuitBreaker(1, time.Minute, nil)
+			r := &Renderer{FuncMap: funcMap(), Inputs: []string{"app.conf.tpl"}, StopOnError: true, breaker: breaker, keepContent: true}
+			d := &daemon{r: r, out: "out/", values: Values{"port": 80}}
+			for i := 0; i < 3; i++ {
+				p := d.preview(test.override)
+				if failed := p.Error != "" || len(p.Outputs) != 1 || p.Outputs[0].Status == "failed"; failed != test.failed {
+					t.Errorf("Preview %d failed: %t, expected %t: %+v", i, failed, test.failed, p)
+				}
+			}
+			if states := breaker.failing(); len(states) > 0 {
+				t.Errorf("Previews counted against the breaker: %+v", states)
+			}
+			if r.breaker != breaker {
+				t.Error("Preview did not restore the breaker of the runs")
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// maxDaemonDiffs bounds how many changes to outputs the daemon keeps.
+const maxDaemonDiffs = 20
+
+// daemonOutput is the last status of an output, as of the run at Time.
+type daemonOutput struct {
+	ReportEntry
+	Time time.Time `json:"time"`
+}
+
+// daemonDiff is a change a run made to an output, as a unified diff.
+type daemonDiff struct {
+	Time   time.Time `json:"time"`
+	Output string    `json:"output"`
+	Diff   string    `json:"diff"`
+}
+
+// daemonStatus is what the web UI and /api/status show of the daemon.
+type daemonStatus struct {
+	Running  bool           `json:"running"`
+	Schedule string         `json:"schedule,omitempty"`
+	NextRun  *time.Time     `json:"next_run,omitempty"`
+	LastRun  *daemonRun     `json:"last_run,omitempty"`
+	Inputs   []string       `json:"inputs"`
+	Preloads []string       `json:"preloads,omitempty"`
+	Outputs  []daemonOutput `json:"outputs"`
+	Diffs    []daemonDiff   `json:"diffs"`
+	Sources  []sourceStatus `json:"sources"`
+	Failing  []breakerState `json:"failing,omitempty"`
+}
+
+// recordOutputs keeps the status of the outputs run rendered, and the
+// changes it made to them.
+func (d *daemon) recordOutputs(run *daemonRun) {
+	var diffs []daemonDiff
+	if c := d.r.changes; c != nil && c.next != nil {
+		for _, name := range c.changed() {
+			diff, _ := outputDiff(name, c.prev[name], c.next[name])
+			diffs = append(diffs, daemonDiff{Time: run.Start, Output: name, Diff: diff})
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range run.Report.Outputs {
+		if e.Status == "skipped" {
+			continue
+		}
+		if _, ok := d.outputs[e.Output]; !ok {
+			d.order = append(d.order, e.Output)
+		}
+		d.outputs[e.Output] = daemonOutput{ReportEntry: e, Time: run.Start}
+	}
+	// Newest first, within a run in the order the outputs were written
+	d.diffs = append(diffs, d.diffs...)
+	if len(d.diffs) > maxDaemonDiffs {
+		d.diffs = d.diffs[:maxDaemonDiffs]
+	}
+}
+
+// outputDiff returns a unified diff of the output name from old to new,
+// which is nil if it did not exist, and whether they differ.
+func outputDiff(name string, old, new []byte) (string, bool) {
+	if isBinary(old) || isBinary(new) {
+		return "Binary content changed\n", !bytes.Equal(old, new)
+	}
+	var buf bytes.Buffer
+	if old == nil {
+		buf.WriteString("--- /dev/null\n")
+	} else {
+		buf.WriteString("--- a/" + name + "\n")
+	}
+	buf.WriteString("+++ b/" + name + "\n")
+	changed := unifiedHunks(&buf, old, new)
+	return buf.String(), changed
+}
+
+// snapshot returns the status of the daemon, as of now.
+func (d *daemon) snapshot() daemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := daemonStatus{
+		Running:  d.running,
+		LastRun:  d.last,
+		Inputs:   d.r.Inputs,
+		Preloads: d.r.PreloadFiles,
+		Outputs:  []daemonOutput{},
+		Diffs:    append([]daemonDiff{}, d.diffs...),
+		Sources:  d.sources.statuses(),
+		Failing:  d.r.breaker.failing(),
+	}
+	if d.schedule != nil {
+		st.Schedule = d.schedule.String()
+		if !d.next.IsZero() {
+			next := d.next
+			st.NextRun = &next
+		}
+	}
+	for _, name := range d.order {
+		st.Outputs = append(st.Outputs, d.outputs[name])
+	}
+	if st.Sources == nil {
+		st.Sources = []sourceStatus{}
+	}
+	return st
+}
+
+// status serves the status of the daemon as JSON.
+func (d *daemon) status(w http.ResponseWriter, req *http.Request) {
+	data, err := json.MarshalIndent(d.snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// ui serves a read-only page of the status of the daemon.
+func (d *daemon) ui(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	var buf bytes.Buffer
+	if err := daemonPages.ExecuteTemplate(&buf, "status", d.snapshot()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// daemonPages are the pages of the web UI, which share their head.
+var daemonPages = template.Must(template.New("daemon").Funcs(template.FuncMap{
+	"when": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+	"page": func(title string, refresh bool) interface{} {
+		return struct {
+			Title   string
+			Refresh bool
+		}{title, refresh}
+	},
+}).Parse(`
+{{- define "head" }}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{- if .Refresh }}
+<meta http-equiv="refresh" content="10">
+{{- end }}
+<title>{{ .Title }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; text-align: left; vertical-align: top; }
+pre { background: #f6f6f6; padding: 0.5em; overflow-x: auto; }
+textarea { width: 100%; font-family: monospace; }
+table.diff td { font-family: monospace; white-space: pre; border: none; }
+table.diff td.line { color: #888; text-align: right; }
+.deleted, .changed .old { background: #fdd; }
+.added, .changed .new { background: #dfd; }
+.gap td { color: #888; }
+.failed, .failing { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+{{- end }}
+
+{{- define "diff" }}
+<table class="diff">
+{{- range . }}
+{{- if eq .Kind "gap" }}
+<tr class="gap"><td class="line">&#8942;</td><td></td><td class="line">&#8942;</td><td></td></tr>
+{{- else }}
+<tr class="{{ .Kind }}"><td class="line">{{ if .OldLine }}{{ .OldLine }}{{ end }}</td><td class="old">{{ .Old }}</td><td class="line">{{ if .NewLine }}{{ .NewLine }}{{ end }}</td><td class="new">{{ .New }}</td></tr>
+{{- end }}
+{{- end }}
+</table>
+{{- end }}
+
+{{- define "status" }}
+{{- template "head" (page "tpl daemon" true) }}
+<p>
+{{- if .Running }}A run is going.{{ else }}Idle.{{ end }}
+{{- with .LastRun }} The last run, {{ .Trigger }}, started {{ when .Start }} and took {{ printf "%.0f" .DurationMS }}ms
+{{- if .Error }}, and <span class="failed">failed: {{ .Error }}</span>{{ end }}.{{ end }}
+{{- if .Schedule }} Scheduled on <code>{{ .Schedule }}</code>{{ with .NextRun }}, next at {{ when . }}{{ end }}.{{ end }}
+<a href="/runs">Compare runs</a>, or <a href="/preview">preview other values</a>.
+</p>
+
+<h2>Templates</h2>
+<table>
+<tr><th>Inputs</th><td>{{ range .Inputs }}<code>{{ . }}</code><br>{{ end }}</td></tr>
+{{- if .Preloads }}
+<tr><th>Preloads</th><td>{{ range .Preloads }}<code>{{ . }}</code><br>{{ end }}</td></tr>
+{{- end }}
+</table>
+{{- if .Failing }}
+
+<h2>Failing templates</h2>
+<table>
+<tr><th>Input</th><th>Runs failed in a row</th><th>Left out until</th><th>Last error</th></tr>
+{{- range .Failing }}
+<tr><td><code>{{ .Input }}</code></td><td>{{ .Failures }}</td><td>{{ if .Tripped }}{{ when .RetryAt }}{{ end }}</td><td class="failed">{{ .LastError }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+
+<h2>Outputs</h2>
+<table>
+<tr><th>Output</th><th>Input</th><th>Status</th><th>Bytes</th><th>Rendered</th><th>Error</th></tr>
+{{- range .Outputs }}
+<tr><td><code>{{ .Output }}</code></td><td><code>{{ .Input }}</code></td><td class="{{ .Status }}">{{ .Status }}</td><td>{{ .Bytes }}</td><td>{{ when .Time }}</td><td>{{ .Error }}</td></tr>
+{{- else }}
+<tr><td colspan="6">Nothing rendered yet</td></tr>
+{{- end }}
+</table>
+
+<h2>Values sources</h2>
+<table>
+<tr><th>Source</th><th>Loaded</th><th>Took</th><th>Status</th></tr>
+{{- range .Sources }}
+<tr><td><code>{{ .Source }}</code></td><td>{{ when .Loaded }}</td><td>{{ printf "%.0f" .DurationMS }}ms</td>
+{{- if .Error }}<td class="failing">{{ .Error }}</td>{{ else }}<td>ok</td>{{ end }}</tr>
+{{- else }}
+<tr><td colspan="4">No values sources</td></tr>
+{{- end }}
+</table>
+
+<h2>Recent changes</h2>
+{{- range .Diffs }}
+<h3><code>{{ .Output }}</code> at {{ when .Time }}</h3>
+<pre>{{ .Diff }}</pre>
+{{- else }}
+<p>No output changed yet.</p>
+{{- end }}
+</body>
+</html>
+{{ end }}
+
+{{- define "preview" }}
+{{- template "head" (page "Preview values" false) }}
+<p>Render the templates with these values on top of those of the last run, top-level key by key, and compare the outputs with the files as they are. Nothing is written. <a href="/">Back to the status</a>.</p>
+<form method="post" enctype="multipart/form-data">
+<p><textarea name="values" rows="12" placeholder="key: value">{{ .Values }}</textarea></p>
+<p>Or upload a values file: <input type="file" name="file"></p>
+<p><button type="submit">Preview</button></p>
+</form>
+{{- with .Preview }}
+{{- if .Error }}
+<p class="failed">The preview failed: {{ .Error }}</p>
+{{- end }}
+{{- range .Outputs }}
+<h2><code>{{ .Output }}</code>: <span class="{{ .Status }}">{{ .Status }}</span></h2>
+{{- if .Error }}
+<pre class="failed">{{ .Error }}</pre>
+{{- else if .Binary }}
+<p>Binary content, which is not shown.</p>
+{{- else if .Rows }}
+{{- template "diff" .Rows }}
+{{- else if eq .Status "written" }}
+<p>Not written to a file, so there is nothing to compare with.</p>
+{{- else }}
+<p>No change.</p>
+{{- end }}
+{{- end }}
+{{- end }}
+</body>
+</html>
+{{ end }}
+
+{{- define "runs" }}
+{{- template "head" (page "Run history" false) }}
+<p>Pick two runs to compare the outputs they left, and the values they were rendered with. <a href="/">Back to the status</a>.</p>
+<form method="get">
+<table>
+<tr><th>From</th><th>To</th><th>Run</th><th>Trigger</th><th>Started</th><th>Took</th><th>Outcome</th></tr>
+{{- range $i, $run := .Runs }}
+<tr><td><input type="radio" name="from" value="{{ .ID }}"{{ if eq $i 1 }} checked{{ end }}></td><td><input type="radio" name="to" value="{{ .ID }}"{{ if eq $i 0 }} checked{{ end }}></td><td>{{ .ID }}</td><td>{{ .Trigger }}</td><td>{{ when .Start }}</td><td>{{ printf "%.0f" .DurationMS }}ms</td>
+{{- if .Error }}<td class="failed">{{ .Error }}</td>{{ else }}<td>ok</td>{{ end }}</tr>
+{{- else }}
+<tr><td colspan="7">No runs yet</td></tr>
+{{- end }}
+</table>
+<p><button type="submit">Compare</button></p>
+</form>
+{{- if .Error }}
+<p class="failed">{{ .Error }}</p>
+{{- end }}
+{{- with .Compare }}
+<h2>From run {{ .From.ID }} to run {{ .To.ID }}</h2>
+{{- if .Values }}
+<p>Values that changed: {{ range $i, $k := .Values }}{{ if $i }}, {{ end }}<code>{{ $k }}</code>{{ end }}.</p>
+{{- else if .ValuesKnown }}
+<p>No value changed.</p>
+{{- end }}
+{{- range .Outputs }}
+<h3><code>{{ .Output }}</code>: <span class="{{ .Status }}">{{ .Status }}</span></h3>
+{{- if .Rows }}
+{{- template "diff" .Rows }}
+{{- else }}
+<pre>{{ .Diff }}</pre>
+{{- end }}
+{{- else }}
+<p>No output changed.</p>
+{{- end }}
+{{- end }}
+</body>
+</html>
+{{ end }}
+`))
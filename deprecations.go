@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Deprecation marks a value path, such as ".image.name", as deprecated.
+type Deprecation struct {
+	Path        string `yaml:"path"`
+	Replacement string `yaml:"replacement,omitempty"`
+	Message     string `yaml:"message,omitempty"`
+}
+
+func (d Deprecation) path() []string {
+	return splitValuePath(d.Path)
+}
+
+func (d Deprecation) String() string {
+	msg := fmt.Sprintf("value %s is deprecated", d.Path)
+	if d.Replacement != "" {
+		msg += fmt.Sprintf("; use %s instead", d.Replacement)
+	}
+	if d.Message != "" {
+		msg += ": " + d.Message
+	}
+	return msg
+}
+
+// splitValuePath splits ".a.b" into ["a", "b"].
+func splitValuePath(p string) []string {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, ".")
+}
+
+func loadDeprecations(filename string) ([]Deprecation, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read deprecations file %s: %v", filename, err)
+	}
+	var deps []Deprecation
+	if err := yaml.UnmarshalStrict(data, &deps); err != nil {
+		return nil, fmt.Errorf("cannot parse deprecations file %s: %v", filename, err)
+	}
+	for i, d := range deps {
+		if d.Path == "" {
+			return nil, fmt.Errorf("deprecation #%d in %s is missing a 'path' field", i, filename)
+		}
+	}
+	return deps, nil
+}
+
+// Deprecations lists every property marked `"deprecated": true` in the schema.
+// The non-standard `x-replacement` keyword names its replacement.
+func (s *Schema) Deprecations() []Deprecation {
+	deps := []Deprecation{}
+	s.collectDeprecations(".", &deps, 0)
+	return deps
+}
+
+func (s *Schema) collectDeprecations(path string, deps *[]Deprecation, depth int) {
+	s, err := s.resolve()
+	if err != nil || depth > 32 {
+		return
+	}
+	if s.Deprecated && path != "." {
+		*deps = append(*deps, Deprecation{Path: path, Replacement: s.Replacement, Message: s.Description})
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.Properties[name].collectDeprecations(joinValuePath(path, name), deps, depth+1)
+	}
+}
+
+// matchDeprecation returns the deprecation covering path, if any. Using a
+// value nested under a deprecated path is also deprecated.
+func matchDeprecation(deps []Deprecation, path []string) (Deprecation, bool) {
+	for _, d := range deps {
+		dp := d.path()
+		if len(dp) == 0 || len(dp) > len(path) {
+			continue
+		}
+		match := true
+		for i := range dp {
+			if dp[i] != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return d, true
+		}
+	}
+	return Deprecation{}, false
+}
+
+// checkValueDeprecations reports deprecated paths present in values.
+func (r *Renderer) checkValueDeprecations(values map[string]interface{}) error {
+	for _, d := range r.Deprecations {
+		if _, ok := lookupPath(values, d.path()); ok {
+			if err := r.deprecated("values: " + d.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTemplateDeprecations reports references to deprecated paths in every
+// template of a parsed set.
+func (r *Renderer) checkTemplateDeprecations(tpl *template.Template, inames []string) error {
+	if len(r.Deprecations) == 0 {
+		return nil
+	}
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		for _, ref := range valueRefs(t.Tree, t.Name() == tpl.Name()) {
+			if d, ok := matchDeprecation(r.Deprecations, ref.Path); ok {
+				if err := r.deprecated(nodeLocation(t.Tree, ref.Node, inames) + ": " + d.String()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deprecated logs msg once per run, or fails with it under StrictDeprecations.
+func (r *Renderer) deprecated(msg string) error {
+	if r.StrictDeprecations {
+		return fmt.Errorf("%s", msg)
+	}
+	r.warn(msg)
+	return nil
+}
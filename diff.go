@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around each hunk of a
+// unified diff.
+const diffContext = 3
+
+// diffOp is one line of an edit script: kept (' '), deleted ('-'), or
+// inserted ('+').
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits content into lines, each with its newline, reporting
+// whether the last one lacks it.
+func splitLines(content []byte) ([]string, bool) {
+	if len(content) == 0 {
+		return nil, false
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1], false
+	}
+	return lines, true
+}
+
+// diffLines computes the shortest edit script from a to b, with the
+// algorithm of Myers.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	// Walk back from the end, collecting the script in reverse
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x, y = x-1, y-1
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedHunks writes the hunks of a unified diff from old to new into buf,
+// returning false if they are the same.
+func unifiedHunks(buf *bytes.Buffer, old, new []byte) bool {
+	a, aPartial := splitLines(old)
+	b, bPartial := splitLines(new)
+	ops := diffLines(a, b)
+	changed := false
+	for _, op := range ops {
+		if op.kind != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed && aPartial == bPartial {
+		return false
+	}
+	if !changed {
+		// Only the final newline differs, so the last line is changed
+		ops[len(ops)-1].kind = '-'
+		ops = append(ops, diffOp{'+', b[len(b)-1]})
+	}
+
+	// The position of every op in a and b
+	aPos := make([]int, len(ops))
+	bPos := make([]int, len(ops))
+	ai, bi := 0, 0
+	for i, op := range ops {
+		aPos[i], bPos[i] = ai, bi
+		if op.kind != '+' {
+			ai++
+		}
+		if op.kind != '-' {
+			bi++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk over changes separated by little enough context
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		stop := end + diffContext
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		aStart, bStart := aPos[start]+1, bPos[start]+1
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, op := range ops[start:stop] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				// Only the last line of a file can lack one
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+	return true
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// diffRow is one row of a side-by-side diff: a line of the old content next
+// to a line of the new, either of which may be missing. Kind is one of
+// "same", "changed", "deleted", "added", or "gap" for unchanged lines left
+// out.
+type diffRow struct {
+	Kind             string
+	OldLine, NewLine int
+	Old, New         string
+}
+
+// sideBySide returns the rows of a side-by-side diff from old to new, with
+// diffContext unchanged lines around each change. Deleted lines are paired
+// with the lines inserted in their place.
+func sideBySide(old, new []byte) []diffRow {
+	a, _ := splitLines(old)
+	b, _ := splitLines(new)
+	ops := diffLines(a, b)
+
+	var rows []diffRow
+	ai, bi := 0, 0
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			ai, bi = ai+1, bi+1
+			rows = append(rows, diffRow{Kind: "same", OldLine: ai, NewLine: bi, Old: ops[i].line, New: ops[i].line})
+			i++
+			continue
+		}
+		var dels, adds []string
+		for ; i < len(ops) && ops[i].kind == '-'; i++ {
+			dels = append(dels, ops[i].line)
+		}
+		for ; i < len(ops) && ops[i].kind == '+'; i++ {
+			adds = append(adds, ops[i].line)
+		}
+		for j := 0; j < len(dels) || j < len(adds); j++ {
+			var row diffRow
+			switch {
+			case j < len(dels) && j < len(adds):
+				ai, bi = ai+1, bi+1
+				row = diffRow{Kind: "changed", OldLine: ai, NewLine: bi, Old: dels[j], New: adds[j]}
+			case j < len(dels):
+				ai++
+				row = diffRow{Kind: "deleted", OldLine: ai, Old: dels[j]}
+			default:
+				bi++
+				row = diffRow{Kind: "added", NewLine: bi, New: adds[j]}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	// Keep the rows near a change, replacing each run of others by a gap
+	keep := make([]bool, len(rows))
+	for i, row := range rows {
+		if row.Kind == "same" {
+			continue
+		}
+		for j := i - diffContext; j <= i+diffContext; j++ {
+			if j >= 0 && j < len(rows) {
+				keep[j] = true
+			}
+		}
+	}
+	var shown []diffRow
+	for i, row := range rows {
+		row.Old = strings.TrimRight(row.Old, "\r\n")
+		row.New = strings.TrimRight(row.New, "\r\n")
+		if keep[i] {
+			shown = append(shown, row)
+		} else if len(shown) == 0 || shown[len(shown)-1].Kind != "gap" {
+			shown = append(shown, diffRow{Kind: "gap"})
+		}
+	}
+	return shown
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// schemaDocRow describes one configurable value.
+type schemaDocRow struct {
+	path     string
+	schema   *Schema
+	required bool
+}
+
+// schemaDocs renders a Markdown reference of every value described by s.
+func schemaDocs(s *Schema) ([]byte, error) {
+	rows := []schemaDocRow{}
+	if err := collectSchemaDocs(s, ".", false, &rows, 0); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	title := s.Title
+	if title == "" {
+		title = "Values"
+	}
+	fmt.Fprintf(&buf, "# %s\n\n", title)
+	if s.Description != "" {
+		fmt.Fprintf(&buf, "%s\n\n", s.Description)
+	}
+	fmt.Fprintf(&buf, "| Value | Type | Required | Default | Description |\n")
+	fmt.Fprintf(&buf, "|-------|------|----------|---------|-------------|\n")
+	for _, row := range rows {
+		required := ""
+		if row.required {
+			required = "yes"
+		}
+		fmt.Fprintf(&buf, "| `%s` | %s | %s | %s | %s |\n",
+			row.path, schemaDocType(row.schema), required, schemaDocDefault(row.schema), schemaDocDescription(row.schema))
+	}
+	return buf.Bytes(), nil
+}
+
+func collectSchemaDocs(s *Schema, path string, required bool, rows *[]schemaDocRow, depth int) error {
+	if depth > 32 {
+		return fmt.Errorf("%s: schema is nested too deeply", path)
+	}
+	s, err := s.resolve()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if path != "." {
+		*rows = append(*rows, schemaDocRow{path: path, schema: s, required: required})
+	}
+
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		req := false
+		for _, r := range s.Required {
+			if r == name {
+				req = true
+			}
+		}
+		if err := collectSchemaDocs(s.Properties[name], joinValuePath(path, name), req, rows, depth+1); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := collectSchemaDocs(s.Items, strings.TrimSuffix(path, ".")+"[]", false, rows, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaDocType(s *Schema) string {
+	t := strings.Join(s.Type, " \\| ")
+	if len(s.Enum) > 0 {
+		vals := make([]string, len(s.Enum))
+		for i, e := range s.Enum {
+			vals[i] = fmt.Sprintf("`%v`", e)
+		}
+		t = strings.TrimSpace(t + " one of " + strings.Join(vals, ", "))
+	}
+	return t
+}
+
+func schemaDocDefault(s *Schema) string {
+	if s.Default == nil {
+		return ""
+	}
+	d, err := json.Marshal(s.Default)
+	if err != nil {
+		return ""
+	}
+	return "`" + string(d) + "`"
+}
+
+func schemaDocDescription(s *Schema) string {
+	desc := s.Description
+	if desc == "" {
+		desc = s.Title
+	}
+	desc = strings.Replace(desc, "|", "\\|", -1)
+	return strings.Join(strings.Fields(desc), " ")
+}
+
+// runDocs writes the Markdown reference for the schema in schemaFile to out,
+// and returns the process exit code.
+func runDocs(schemaFile, out string) int {
+	if schemaFile == "" {
+		logf(nil, LogError, "The docs command requires -schema=FILE")
+		return 1
+	}
+	s, err := loadSchema(schemaFile)
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	doc, err := schemaDocs(s)
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	if out == "" || out == "-" {
+		os.Stdout.Write(doc)
+		return 0
+	}
+	if err := ioutil.WriteFile(out, doc, 0644); err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	logf(nil, LogInfo, "Wrote values reference to %s", out)
+	return 0
+}
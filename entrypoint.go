@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultWaitTimeout is how long -wait-for waits before giving up.
+const DefaultWaitTimeout = time.Minute
+
+// maxWaitBackoff caps the wait between two attempts of -wait-for.
+const maxWaitBackoff = 5 * time.Second
+
+// splitEntrypointArgs splits the arguments of the entrypoint command,
+// "TEMPLATES... -- APP ARGS...", into the templates and the command of the
+// app. The flag package drops a "--" that comes right after the options, so
+// it is looked for among all of osArgs.
+func splitEntrypointArgs(args, osArgs []string) ([]string, []string, error) {
+	i := 0
+	for i < len(osArgs) && osArgs[i] != "--" {
+		i++
+	}
+	if i >= len(osArgs)-1 {
+		return nil, nil, errors.New("Usage: entrypoint [options...] <templates...> -- <command> [args...]")
+	}
+	app := osArgs[i+1:]
+	if len(app) > len(args) {
+		return nil, nil, errors.New("The entrypoint command takes the command to run after --")
+	}
+	inputs := args[:len(args)-len(app)]
+	if n := len(inputs); n > 0 && inputs[n-1] == "--" {
+		inputs = inputs[:n-1]
+	}
+	return inputs, app, nil
+}
+
+// splitWaits splits the arguments of -wait-for into the schemes of values
+// sources, e.g. "vault", and the addresses of dependencies to probe, e.g.
+// "tcp://db:5432" or "http://config-svc/healthz".
+func splitWaits(waits []string) ([]string, []string, error) {
+	var schemes, deps []string
+	for _, w := range waits {
+		if !strings.Contains(w, "://") {
+			schemes = append(schemes, w)
+			continue
+		}
+		u, err := url.Parse(w)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid -wait-for=%s: %v", w, err)
+		}
+		switch u.Scheme {
+		case "tcp":
+			if u.Hostname() == "" || u.Port() == "" {
+				return nil, nil, fmt.Errorf("Invalid -wait-for=%s; must be tcp://HOST:PORT", w)
+			}
+		case "http", "https":
+			if u.Host == "" {
+				return nil, nil, fmt.Errorf("Invalid -wait-for=%s; must name a host", w)
+			}
+		default:
+			return nil, nil, fmt.Errorf("Cannot -wait-for=%s; dependencies must be tcp, http, or https", w)
+		}
+		deps = append(deps, w)
+	}
+	return schemes, deps, nil
+}
+
+// checkWaitSchemes checks that every scheme in waits, e.g. "vault", is that
+// of one of the values sources, so that waiting on it is not a typo.
+func checkWaitSchemes(waits, sources []string) error {
+	used := make(map[string]bool)
+	for _, src := range sources {
+		ref, opts, err := splitSourceOptions(src)
+		if err != nil {
+			return err
+		}
+		for _, s := range []string{ref, opts.Fallback} {
+			scheme, _ := splitScheme(s)
+			used[scheme] = true
+		}
+	}
+	for _, w := range waits {
+		if !used[w] {
+			return fmt.Errorf("Cannot -wait-for=%s, as no values source is of that scheme", w)
+		}
+	}
+	return nil
+}
+
+// waitUntil calls try until it succeeds, waiting longer after every attempt,
+// for what to become available. It gives up with the last error once the
+// deadline, timeout after the waiting started, passed.
+func waitUntil(what string, deadline time.Time, timeout time.Duration, try func() error) error {
+	wait := time.Second
+	for {
+		err := try()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("%v (gave up waiting for %s after %s)", err, what, timeout)
+		}
+		logf(nil, LogWarn, "Waiting %s for %s: %v", wait, what, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > maxWaitBackoff {
+			wait = maxWaitBackoff
+		}
+	}
+}
+
+// waitForValues loads the values with load until it succeeds, for the
+// sources of waits to become available, as when a container starts along
+// with the secret manager it reads.
+func waitForValues(load func() (Values, error), waits []string, deadline time.Time, timeout time.Duration) (Values, error) {
+	var values Values
+	err := waitUntil(strings.Join(waits, ", "), deadline, timeout, func() error {
+		var err error
+		values, err = load()
+		return err
+	})
+	return values, err
+}
+
+// waitForDependencies probes every dependency in deps, one after the other,
+// until it responds, as the database or config service a container starts
+// along with. A tcp:// dependency responds once it accepts a connection, and
+// an http:// or https:// one once it answers a GET with a 2xx status, after
+// following redirects.
+func waitForDependencies(deps []string, deadline time.Time, timeout time.Duration) error {
+	client := &http.Client{Timeout: maxWaitBackoff}
+	for _, dep := range deps {
+		u, _ := url.Parse(dep)
+		err := waitUntil(dep, deadline, timeout, func() error {
+			if u.Scheme == "tcp" {
+				conn, err := net.DialTimeout("tcp", u.Host, maxWaitBackoff)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			}
+			resp, err := client.Get(dep)
+			if err != nil {
+				return err
+			}
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return fmt.Errorf("%s answered %s", dep, resp.Status)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		logf(nil, LogDebug, "%s is available", dep)
+	}
+	return nil
+}
+
+// runEntrypoint renders into out, then runs app, as the entrypoint of a
+// container: with the standard streams of tpl, and every signal tpl receives
+// passed on to it. It returns the exit code of app, which is 128 plus the
+// signal for an app killed by one, as shells have it, or 1 when rendering
+// failed, or tpl was signalled while rendering, in which case app is not
+// started. With requireValid, neither is it when any output was left stale
+// or missing, though rendering did not fail. The workspace is removed before
+// app starts.
+func runEntrypoint(r *Renderer, ws *Workspace, out string, values Values, app []string, requireValid bool) int {
+	sigs := make(chan os.Signal, 8)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+	if requireValid && r.Report == nil {
+		r.Report = &RunReport{}
+	}
+	err := r.Execute(out, values)
+	if cerr := ws.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logf(r.Logger, LogError, "%v", err)
+		logf(r.Logger, LogError, "Not starting %s, as rendering failed", app[0])
+		return 1
+	}
+	if incomplete := r.Report.incomplete(); requireValid && len(incomplete) > 0 {
+		for _, e := range incomplete {
+			logf(r.Logger, LogError, "%s was not rendered from %s (%s)", e.Output, e.Input, e.Status)
+		}
+		logf(r.Logger, LogError, "Not starting %s, as %d output(s) are stale or missing, with -require-valid", app[0], len(incomplete))
+		return 1
+	}
+	select {
+	case sig := <-sigs:
+		logf(r.Logger, LogWarn, "Received %v while rendering, not starting %s", sig, app[0])
+		return 1
+	default:
+	}
+
+	cmd := exec.Command(app[0], app[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		logf(r.Logger, LogError, "Cannot start %s: %v", app[0], err)
+		return 127
+	}
+	logf(r.Logger, LogDebug, "Started %s as process %d", app[0], cmd.Process.Pid)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case sig := <-sigs:
+			if err := cmd.Process.Signal(sig); err != nil {
+				logf(r.Logger, LogWarn, "Cannot pass %v on to %s: %v", sig, app[0], err)
+			}
+		case err := <-done:
+			if err == nil {
+				return 0
+			}
+			state := cmd.ProcessState
+			if state == nil {
+				logf(r.Logger, LogError, "%v", err)
+				return 1
+			}
+			if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return state.ExitCode()
+		}
+	}
+}
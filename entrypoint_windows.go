@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// forwardedSignals are the signals the entrypoint command passes on to its
+// app, as far as Windows has them.
+var forwardedSignals = []os.Signal{os.Interrupt}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envKeyPattern matches valid environment variable names.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envSafeValue matches values that need no quoting in a dotenv file or a
+// shell script.
+var envSafeValue = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+
+// envQuote quotes v for a dotenv file: in double quotes, with backslashes,
+// quotes, dollar signs, and newlines escaped.
+func envQuote(v string) string {
+	if v != "" && envSafeValue.MatchString(v) {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`", "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(v) + `"`
+}
+
+// shellQuote quotes v for a POSIX shell: in single quotes, in which nothing
+// but a single quote is special.
+func shellQuote(v string) string {
+	if v != "" && envSafeValue.MatchString(v) {
+		return v
+	}
+	return "'" + strings.Replace(v, "'", `'\''`, -1) + "'"
+}
+
+// parseEnvValue reads the value of a KEY=VALUE line, which is taken as it
+// is, unless it is quoted.
+func parseEnvValue(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if len(v) < 2 {
+		return v, nil
+	}
+	switch v[0] {
+	case '\'':
+		if v[len(v)-1] != '\'' {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return v[1 : len(v)-1], nil
+	case '"':
+		if v[len(v)-1] != '"' {
+			return "", fmt.Errorf("unterminated double quote")
+		}
+		var b strings.Builder
+		inner := v[1 : len(v)-1]
+		for i := 0; i < len(inner); i++ {
+			c := inner[i]
+			if c != '\\' || i == len(inner)-1 {
+				b.WriteByte(c)
+				continue
+			}
+			i++
+			switch inner[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(inner[i])
+			}
+		}
+		return b.String(), nil
+	}
+	return v, nil
+}
+
+// formatEnv rewrites rendered KEY=VALUE lines, in the given format, as a
+// dotenv file ("env") or a shell script exporting them ("export"), quoting
+// every value as needed. Blank lines and comments are kept, and a line of
+// `export KEY=VALUE` is read like `KEY=VALUE`.
+func formatEnv(format string, content []byte) ([]byte, error) {
+	var out bytes.Buffer
+	seen := make(map[string]int)
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			out.WriteString(trimmed + "\n")
+			continue
+		}
+		trimmed = strings.TrimPrefix(trimmed, "export ")
+		eq := strings.Index(trimmed, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d is not in the form of KEY=VALUE: %q", i+1, line)
+		}
+		key := strings.TrimSpace(trimmed[:eq])
+		if !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("line %d: %q is not a valid variable name", i+1, key)
+		}
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is already set on line %d", i+1, key, prev)
+		}
+		seen[key] = i + 1
+		value, err := parseEnvValue(trimmed[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if format == "export" {
+			fmt.Fprintf(&out, "export %s=%s\n", key, shellQuote(value))
+		} else {
+			fmt.Fprintf(&out, "%s=%s\n", key, envQuote(value))
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// envName turns a path of keys into a variable name, e.g. "DB_HOST" for
+// "db.host".
+func envName(path []string) string {
+	name := strings.ToUpper(strings.Join(path, "_"))
+	return strings.Map(func(c rune) rune {
+		if c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// flattenEnv adds a variable to vars for every scalar in v, named after its
+// path, with the items of lists numbered from 0.
+func flattenEnv(vars map[string]string, path []string, v interface{}) {
+	switch tv := normalizeValue(v).(type) {
+	case map[string]interface{}:
+		for k, e := range tv {
+			flattenEnv(vars, append(path[:len(path):len(path)], k), e)
+		}
+	case []interface{}:
+		for i, e := range tv {
+			flattenEnv(vars, append(path[:len(path):len(path)], strconv.Itoa(i)), e)
+		}
+	case nil:
+		vars[envName(path)] = ""
+	default:
+		vars[envName(path)] = fmt.Sprintf("%v", tv)
+	}
+}
+
+// toEnv is the `toEnv` template function, flattening a map of values into
+// quoted KEY=VALUE lines, e.g. `{{ toEnv .app }}` for DB_HOST from
+// `.app.db.host`. An optional prefix is prepended to every name.
+func toEnv(v interface{}, prefix ...string) (string, error) {
+	m, ok := normalizeValue(v).(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("toEnv: expected a map, not %T", v)
+	}
+	vars := make(map[string]string)
+	flattenEnv(vars, prefix, m)
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		if !envKeyPattern.MatchString(name) {
+			return "", fmt.Errorf("toEnv: %q is not a valid variable name", name)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", name, envQuote(vars[name]))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DefaultJitter is the fraction of -every by which every wait is made shorter
+// or longer at random, so that many machines started together do not render
+// in lockstep.
+const DefaultJitter = 0.1
+
+var errLocked = errors.New("another run holds the lock")
+
+// defaultLockFile is the lock file of the runs rendering into out, unless
+// -lock-file names another: one per output path, in the temporary directory,
+// so that its name does not depend on the directory tpl runs in.
+func defaultLockFile(out string) string {
+	if abs, err := filepath.Abs(out); err == nil {
+		out = abs
+	}
+	h := fnv.New32a()
+	h.Write([]byte(out))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tpl-%08x.lock", h.Sum32()))
+}
+
+// withLock runs run while holding the lock file name, unless name is "". It
+// returns errLocked without running it while another run holds the lock.
+func withLock(name string, run func() error) error {
+	if name == "" {
+		return run()
+	}
+	f, err := openLock(name)
+	if err == errLocked {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot take the lock %s: %v", name, err)
+	}
+	defer f.Close()
+	return run()
+}
+
+// jittered returns every made shorter or longer at random by up to jitter,
+// a fraction of it.
+func jittered(every time.Duration, jitter float64) time.Duration {
+	return every + time.Duration(float64(every)*jitter*(2*rand.Float64()-1))
+}
+
+// runEvery renders with run, loading the values afresh with load for every
+// run but the first, which uses values, and then waits for about every,
+// again and again. A run that fails is logged, and the next one tried as
+// usual. Each run holds the lock file lock, and is skipped while another
+// run, e.g. a second loop started by mistake, holds it. On SIGINT or SIGTERM,
+// it stops once the current run is done. It returns the process exit code.
+func runEvery(r *Renderer, values Values, load func() (Values, error), run func(Values) error, every time.Duration, jitter float64, lock string) int {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	logf(r.Logger, LogInfo, "Rendering every %s, holding %s while rendering", every, lock)
+	for n := 1; ; n++ {
+		var err error
+		if n > 1 {
+			values, err = load()
+		}
+		if err == nil {
+			err = withLock(lock, func() error { return run(values) })
+		}
+		if err == errLocked {
+			logf(r.Logger, LogWarn, "Skipping this run, as another run holds %s", lock)
+		} else if err != nil {
+			logf(r.Logger, LogError, "%v", err)
+		}
+
+		wait := jittered(every, jitter)
+		logf(r.Logger, LogDebug, "Rendering again in %s", wait)
+		select {
+		case sig := <-sigs:
+			logf(r.Logger, LogInfo, "Received %v, stopping", sig)
+			return 0
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var lockTests = []struct {
+	name string
+	lock string
+	held bool
+	ran  bool
+	err  string
+}{
+	{name: "no-lock", lock: "", ran: true},
+	{name: "free", lock: "run.lock", ran: true},
+	{name: "held", lock: "run.lock", held: true, err: errLocked.Error()},
+	{name: "missing-dir", lock: "missing/run.lock", err: "Cannot take the lock"},
+}
+
+func TestWithLock(t *testing.T) {
+	for _, test := range lockTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if test.held {
+				// Another run, as far as the lock is concerned
+				f, err := openLock(test.lock)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+			}
+
+			ran := false
+			err = withLock(test.lock, func() error {
+				ran = true
+				return nil
+			})
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+			} else if test.err != "" {
+				t.Fatalf("Expected locking to fail with %q, but it succeeded", test.err)
+			}
+			if ran != test.ran {
+				t.Errorf("Ran: %v, expected %v", ran, test.ran)
+			}
+
+			// The lock is released once the run is done
+			if test.ran && test.lock != "" {
+				f, err := openLock(test.lock)
+				if err != nil {
+					t.Fatalf("Lock was not released: %v", err)
+				}
+				f.Close()
+			}
+		})
+	}
+}
+
+func TestDefaultLockFile(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tpl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Chdir(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := defaultLockFile("out/"), defaultLockFile(filepath.Join(wd, "out"))
+	if a != b {
+		t.Errorf("Lock files of the same output differ: %s and %s", a, b)
+	}
+	if filepath.Dir(a) != filepath.Clean(os.TempDir()) {
+		t.Errorf("Lock file %s is not in the temporary directory", a)
+	}
+	if c := defaultLockFile("other/"); c == a {
+		t.Errorf("Lock files of different outputs are both %s", a)
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := jittered(time.Minute, 0.1); d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("Jittered a minute by 10%% into %s", d)
+		}
+	}
+}
@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
+	"strings"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -15,6 +15,13 @@ import (
 type execMap struct {
 	Paths     []string       `yaml:"paths,omitempty"`
 	Whitelist []*execSetting `yaml:"whitelist"`
+
+	// allowAll permits any executable on the PATH, capturing its STDOUT,
+	// when there is no whitelist.
+	allowAll bool
+
+	// logger is that of the renderer the functions are used by.
+	logger Logger
 }
 
 type execSetting struct {
@@ -73,10 +80,55 @@ func (em *execMap) Get(name string) (*execSetting, error) {
 			return s, nil
 		}
 	}
+	if em.allowAll {
+		p, err := exec.LookPath(name)
+		if err != nil {
+			return nil, err
+		}
+		return &execSetting{Name: name, Path: p, Stdout: true}, nil
+	}
 	return nil, fmt.Errorf("Executable %q is not in whitelist", name)
 }
 
-func (es *execSetting) Run(args []string, in io.Reader) (string, string, error) {
+// Func is the `exec` template function, which runs a command and returns its
+// output, e.g. `{{ exec "git" "rev-parse" "HEAD" }}`. A command that is not
+// allowed, or fails, fails the render.
+func (em *execMap) Func(name string, args ...string) (string, error) {
+	exset, err := em.Get(name)
+	if err != nil {
+		return "", fmt.Errorf("Cannot exec %q %v: %v", name, args, err)
+	}
+	var stdin io.Reader
+	if exset.Stdin {
+		if len(args) == 0 {
+			return "", fmt.Errorf("Cannot exec %q: its STDIN must be given as the last argument", name)
+		}
+		stdin = strings.NewReader(args[len(args)-1])
+		args = args[:len(args)-1]
+	}
+	stdout, stderr, err := exset.Run(args, stdin, em.logger)
+	if stderr != "" {
+		logf(em.logger, LogWarn, "exec %q %v, STDERR output was: %s", name, args, stderr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Cannot exec %q %v: %v", name, args, err)
+	}
+	if exset.Stdout {
+		return stdout, nil
+	}
+	if exset.Stderr {
+		return stderr, nil
+	}
+	return "", nil
+}
+
+// Shell is the `shell` template function, which runs script with `sh -c`. It
+// is subject to the same whitelist as `exec`, under the name "sh".
+func (em *execMap) Shell(script string) (string, error) {
+	return em.Func("sh", "-c", script)
+}
+
+func (es *execSetting) Run(args []string, in io.Reader, logger Logger) (string, string, error) {
 	msg := fmt.Sprintf("Executing %q with arguments %+v", es.Path, args)
 	cmd := exec.Command(es.Path, args...)
 	if in != nil {
@@ -88,10 +140,10 @@ func (es *execSetting) Run(args []string, in io.Reader) (string, string, error)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	log.Println(msg)
+	logf(logger, LogInfo, "%s", msg)
 	err := cmd.Run()
 	if err != nil {
-		log.Printf("Exited with error: %v", err)
+		logf(logger, LogDebug, "Exited with error: %v", err)
 	}
 	return stdout.String(), stderr.String(), err
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var execTests = []struct {
+	name     string
+	args     []string
+	template string
+	expected string
+	err      string
+}{
+	{name: "disabled", template: `{{ exec "echo" "hi" }}`, err: "The 'exec' template function is disabled"},
+	{name: "shell-disabled", template: `{{ shell "echo hi" }}`, err: "The 'shell' template function is disabled"},
+	{name: "allow-exec", args: []string{"-allow-exec"}, template: `{{ exec "echo" "hi" }}`, expected: "hi\n"},
+	{name: "allow-shell", args: []string{"-allow-exec"}, template: `{{ shell "echo hi" }}`, expected: "hi\n"},
+	{name: "whitelisted", args: []string{"-exec-map-file=exec.yaml"}, template: `{{ exec "echo" "hi" }}`, expected: "hi\n"},
+	{name: "not-whitelisted", args: []string{"-exec-map-file=exec.yaml"}, template: `{{ exec "true" }}`, err: `Executable "true" is not in whitelist`},
+	{name: "shell-not-whitelisted", args: []string{"-exec-map-file=exec.yaml"}, template: `{{ shell "echo hi" }}`, err: `Executable "sh" is not in whitelist`},
+	{name: "fails", args: []string{"-allow-exec"}, template: `{{ exec "false" }}`, err: `Cannot exec "false"`},
+	{name: "shell-fails", args: []string{"-allow-exec"}, template: `{{ shell "exit 3" }}`, err: "exit status 3"},
+	{name: "missing", args: []string{"-allow-exec"}, template: `{{ exec "tpl-test-missing" }}`, err: `Cannot exec "tpl-test-missing"`},
+}
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are Unix ones")
+	}
+	for _, test := range execTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{
+				"test.txt.tpl": test.template,
+				"exec.yaml":    "whitelist:\n  - name: echo\n    stdout: true\n",
+			} {
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args := append([]string{"-out=out/"}, test.args...)
+			err = runTpl(os.Environ(), append(args, "test.txt.tpl")...)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				if _, err := os.Stat("out/test.txt"); err == nil {
+					t.Errorf("Rendered in spite of the failing command")
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected rendering to fail with %q, but it succeeded", test.err)
+			}
+			out, err := ioutil.ReadFile("out/test.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != test.expected {
+				t.Errorf("Rendered %q, expected %q", out, test.expected)
+			}
+		})
+	}
+}
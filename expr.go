@@ -0,0 +1,693 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exprNode is a compiled expression, evaluated against the values.
+type exprNode func(v Values) (interface{}, error)
+
+// missingValueError is the error of an expression that refers to a value
+// which is missing.
+type missingValueError struct {
+	path string
+}
+
+func (e *missingValueError) Error() string {
+	return fmt.Sprintf("no value %s", e.path)
+}
+
+// parseExpr compiles an expression deriving a value from others, e.g.
+// `svc + "-" + env` or `replicas > 1 ? "ha" : "single"`. Values are named by
+// their paths, with or without a leading dot, and `$` is all of them.
+func parseExpr(expr string) (exprNode, error) {
+	p := &exprParser{src: strings.TrimSpace(expr)}
+	if p.src == "" {
+		return nil, fmt.Errorf("empty expression")
+	}
+	node, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.src[p.pos:], p.src)
+	}
+	return node, nil
+}
+
+// exprParser is a recursive descent parser of expressions, with the
+// operators and precedence of C.
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// accept consumes op if it is next, but not when it starts a longer operator
+// among longer, e.g. "<" when "<=" is next.
+func (p *exprParser) accept(op string, longer ...string) bool {
+	p.skipSpace()
+	for _, l := range longer {
+		if strings.HasPrefix(p.src[p.pos:], l) {
+			return false
+		}
+	}
+	if strings.HasPrefix(p.src[p.pos:], op) {
+		p.pos += len(op)
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s in expression %q", fmt.Sprintf(format, args...), p.src)
+}
+
+func (p *exprParser) ternary() (exprNode, error) {
+	cond, err := p.logical(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept(":") {
+		return nil, p.errorf("expected ':'")
+	}
+	els, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return func(v Values) (interface{}, error) {
+		c, err := exprBool(cond(v))
+		if err != nil {
+			return nil, err
+		}
+		if c {
+			return then(v)
+		}
+		return els(v)
+	}, nil
+}
+
+// logical parses "||", then "&&", which only evaluate their right operand
+// when the left one does not decide.
+func (p *exprParser) logical(level int) (exprNode, error) {
+	if level == 2 {
+		return p.binary(0)
+	}
+	op := []string{"||", "&&"}[level]
+	left, err := p.logical(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(op) {
+		right, err := p.logical(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l, or := left, op == "||"
+		left = func(v Values) (interface{}, error) {
+			a, err := exprBool(l(v))
+			if err != nil || a == or {
+				return a, err
+			}
+			return exprBool(right(v))
+		}
+	}
+	return left, nil
+}
+
+// exprOp is a binary operator of expressions.
+type exprOp struct {
+	op     string
+	longer []string
+	apply  func(a, b interface{}) (interface{}, error)
+}
+
+// exprOps are the binary operators but "&&" and "||", from the lowest
+// precedence up.
+var exprOps = [][]exprOp{
+	{
+		{"==", nil, func(a, b interface{}) (interface{}, error) { return exprEqual(a, b), nil }},
+		{"!=", nil, func(a, b interface{}) (interface{}, error) { return !exprEqual(a, b), nil }},
+	},
+	{
+		{"<=", nil, func(a, b interface{}) (interface{}, error) { return exprCompare("<=", a, b) }},
+		{">=", nil, func(a, b interface{}) (interface{}, error) { return exprCompare(">=", a, b) }},
+		{"<", []string{"<="}, func(a, b interface{}) (interface{}, error) { return exprCompare("<", a, b) }},
+		{">", []string{">="}, func(a, b interface{}) (interface{}, error) { return exprCompare(">", a, b) }},
+	},
+	{
+		{"+", nil, func(a, b interface{}) (interface{}, error) { return exprArith("+", a, b) }},
+		{"-", nil, func(a, b interface{}) (interface{}, error) { return exprArith("-", a, b) }},
+	},
+	{
+		{"*", nil, func(a, b interface{}) (interface{}, error) { return exprArith("*", a, b) }},
+		{"/", nil, func(a, b interface{}) (interface{}, error) { return exprArith("/", a, b) }},
+		{"%", nil, func(a, b interface{}) (interface{}, error) { return exprArith("%", a, b) }},
+	},
+}
+
+// binary parses the operators of exprOps[level] and above.
+func (p *exprParser) binary(level int) (exprNode, error) {
+	if level == len(exprOps) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op *exprOp
+		for i := range exprOps[level] {
+			if p.accept(exprOps[level][i].op, exprOps[level][i].longer...) {
+				op = &exprOps[level][i]
+				break
+			}
+		}
+		if op == nil {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l, apply := left, op.apply
+		left = func(v Values) (interface{}, error) {
+			a, err := l(v)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(v)
+			if err != nil {
+				return nil, err
+			}
+			return apply(a, b)
+		}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	switch {
+	case p.accept("!", "!="):
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v Values) (interface{}, error) {
+			b, err := exprBool(operand(v))
+			return !b, err
+		}, nil
+	case p.accept("-"):
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v Values) (interface{}, error) {
+			a, err := operand(v)
+			if err != nil {
+				return nil, err
+			}
+			return exprArith("-", 0, a)
+		}, nil
+	}
+	return p.postfix()
+}
+
+// postfix parses a primary expression followed by any number of ".key" and
+// "[index]".
+func (p *exprParser) postfix() (exprNode, error) {
+	node, path, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.pos < len(p.src) && p.src[p.pos] == '.' && p.pos+1 < len(p.src) && isIdentStart(p.src[p.pos+1]):
+			p.pos++
+			key := p.ident()
+			path += "." + key
+			node = exprIndex(node, path, exprConst(key))
+		case p.accept("["):
+			index, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept("]") {
+				return nil, p.errorf("expected ']'")
+			}
+			path += "[...]"
+			node = exprIndex(node, path, index)
+		default:
+			return node, nil
+		}
+	}
+}
+
+// primary parses a literal, a value, a call, or a parenthesized expression,
+// and returns the path it refers to, for errors.
+func (p *exprParser) primary() (exprNode, string, error) {
+	p.skipSpace()
+	if p.pos == len(p.src) {
+		return nil, "", p.errorf("unexpected end")
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.ternary()
+		if err != nil {
+			return nil, "", err
+		}
+		if !p.accept(")") {
+			return nil, "", p.errorf("expected ')'")
+		}
+		return node, "(...)", nil
+	case c == '"':
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			if p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			return nil, "", p.errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(p.src[p.pos : end+1])
+		if err != nil {
+			return nil, "", p.errorf("invalid string %s", p.src[p.pos:end+1])
+		}
+		p.pos = end + 1
+		return exprConst(s), "", nil
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		lit := p.src[start:p.pos]
+		if n, err := strconv.ParseInt(lit, 10, 64); err == nil {
+			return exprConst(int(n)), "", nil
+		}
+		f, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			return nil, "", p.errorf("invalid number %s", lit)
+		}
+		return exprConst(f), "", nil
+	case c == '$':
+		p.pos++
+		return func(v Values) (interface{}, error) { return v, nil }, "$", nil
+	case c == '.' && p.pos+1 < len(p.src) && isIdentStart(p.src[p.pos+1]):
+		p.pos++
+		key := p.ident()
+		return exprValue(key), "." + key, nil
+	case isIdentStart(c):
+		name := p.ident()
+		if p.accept("(") {
+			node, err := p.call(name)
+			return node, "", err
+		}
+		switch name {
+		case "true", "false":
+			return exprConst(name == "true"), "", nil
+		case "null":
+			return exprConst(nil), "", nil
+		}
+		return exprValue(name), "." + name, nil
+	}
+	return nil, "", p.errorf("unexpected %q", p.src[p.pos:])
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (p *exprParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) && (isIdentStart(p.src[p.pos]) || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// call parses the arguments of a call to the function name, up to the
+// closing parenthesis.
+func (p *exprParser) call(name string) (exprNode, error) {
+	var args []exprNode
+	if !p.accept(")") {
+		for {
+			arg, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.accept(")") {
+				break
+			}
+			if !p.accept(",") {
+				return nil, p.errorf("expected ',' or ')' in call to %s", name)
+			}
+		}
+	}
+
+	// default and has see whether values are missing, so they are not
+	// functions of the values of their arguments
+	switch name {
+	case "default", "has":
+		if n := map[string]int{"default": 2, "has": 1}[name]; len(args) != n {
+			return nil, p.errorf("%s takes %d arguments, not %d", name, n, len(args))
+		}
+		return func(v Values) (interface{}, error) {
+			a, err := args[0](v)
+			if _, missing := err.(*missingValueError); missing {
+				err, a = nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if name == "has" {
+				return a != nil, nil
+			}
+			if a == nil || a == "" {
+				return args[1](v)
+			}
+			return a, nil
+		}, nil
+	}
+
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, p.errorf("unknown function %s", name)
+	}
+	return func(v Values) (interface{}, error) {
+		vals := make([]interface{}, len(args))
+		for i, arg := range args {
+			val, err := arg(v)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = val
+		}
+		val, err := fn(vals)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return val, nil
+	}, nil
+}
+
+func exprConst(c interface{}) exprNode {
+	return func(Values) (interface{}, error) { return c, nil }
+}
+
+// exprValue refers to the top-level value key.
+func exprValue(key string) exprNode {
+	return exprIndex(func(v Values) (interface{}, error) { return v, nil }, "."+key, exprConst(key))
+}
+
+// exprIndex indexes the mapping or list of node with index, failing with a
+// missingValueError for path when there is nothing there.
+func exprIndex(node exprNode, path string, index exprNode) exprNode {
+	return func(v Values) (interface{}, error) {
+		c, err := node(v)
+		if err != nil {
+			return nil, err
+		}
+		i, err := index(v)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := copyMapView(c); ok {
+			val, ok := m[fmt.Sprint(i)]
+			if !ok {
+				return nil, &missingValueError{path}
+			}
+			return val, nil
+		}
+		rv := reflect.ValueOf(c)
+		if c != nil && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) {
+			n, ok := exprInt(i)
+			if !ok {
+				return nil, fmt.Errorf("cannot index %s with %v", path, i)
+			}
+			if n < 0 || n >= int64(rv.Len()) {
+				return nil, &missingValueError{path}
+			}
+			return rv.Index(int(n)).Interface(), nil
+		}
+		return nil, &missingValueError{path}
+	}
+}
+
+// copyMapView returns c as a mapping of strings, without copying it when
+// it is one already.
+func copyMapView(c interface{}) (map[string]interface{}, bool) {
+	switch m := c.(type) {
+	case map[string]interface{}:
+		return m, true
+	case Values:
+		return m, true
+	}
+	return copyMap(c)
+}
+
+func exprBool(v interface{}, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a boolean, got %v", v)
+	}
+	return b, nil
+}
+
+// exprInt returns v as an integer, if it is one.
+func exprInt(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+// exprFloat returns v as a float, if it is a number.
+func exprFloat(v interface{}) (float64, bool) {
+	if n, ok := exprInt(v); ok {
+		return float64(n), true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func exprEqual(a, b interface{}) bool {
+	if x, ok := exprFloat(a); ok {
+		y, ok := exprFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(normalizeValue(a), normalizeValue(b))
+}
+
+func exprCompare(op string, a, b interface{}) (interface{}, error) {
+	var c int
+	x, okx := exprFloat(a)
+	y, oky := exprFloat(b)
+	s, oks := a.(string)
+	t, okt := b.(string)
+	switch {
+	case okx && oky && x < y:
+		c = -1
+	case okx && oky && x > y:
+		c = 1
+	case okx && oky:
+	case oks && okt:
+		c = strings.Compare(s, t)
+	default:
+		return nil, fmt.Errorf("cannot compare %v %s %v", a, op, b)
+	}
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+// exprArith applies an arithmetic operator, on integers if both operands
+// are, or else on floats. "+" joins strings, and anything added to one.
+func exprArith(op string, a, b interface{}) (interface{}, error) {
+	_, sa := a.(string)
+	_, sb := b.(string)
+	if op == "+" && (sa || sb) {
+		return fmt.Sprint(a) + fmt.Sprint(b), nil
+	}
+	if x, ok := exprInt(a); ok {
+		if y, ok := exprInt(b); ok {
+			switch op {
+			case "+":
+				return int(x + y), nil
+			case "-":
+				return int(x - y), nil
+			case "*":
+				return int(x * y), nil
+			}
+			if y == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				return int(x / y), nil
+			}
+			return int(x % y), nil
+		}
+	}
+	x, okx := exprFloat(a)
+	y, oky := exprFloat(b)
+	if !okx || !oky {
+		return nil, fmt.Errorf("cannot compute %v %s %v", a, op, b)
+	}
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	}
+	return nil, fmt.Errorf("cannot compute %v %% %v, which are not integers", a, b)
+}
+
+// exprFuncs are the functions expressions can call, along with default and
+// has.
+var exprFuncs = map[string]func(args []interface{}) (interface{}, error){
+	"len": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		if s, ok := args[0].(string); ok {
+			return len(s), nil
+		}
+		if m, ok := copyMapView(args[0]); ok {
+			return len(m), nil
+		}
+		if rv := reflect.ValueOf(args[0]); args[0] != nil && rv.Kind() == reflect.Slice {
+			return rv.Len(), nil
+		}
+		return nil, fmt.Errorf("cannot take the length of %v", args[0])
+	},
+	"string": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		return fmt.Sprint(args[0]), nil
+	},
+	"int": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		if n, ok := exprInt(args[0]); ok {
+			return int(n), nil
+		}
+		if f, ok := exprFloat(args[0]); ok {
+			return int(f), nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(fmt.Sprint(args[0])))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", args[0])
+		}
+		return n, nil
+	},
+	"upper":      exprStringFunc(1, func(s []string) interface{} { return strings.ToUpper(s[0]) }),
+	"lower":      exprStringFunc(1, func(s []string) interface{} { return strings.ToLower(s[0]) }),
+	"trim":       exprStringFunc(1, func(s []string) interface{} { return strings.TrimSpace(s[0]) }),
+	"replace":    exprStringFunc(3, func(s []string) interface{} { return strings.Replace(s[0], s[1], s[2], -1) }),
+	"startsWith": exprStringFunc(2, func(s []string) interface{} { return strings.HasPrefix(s[0], s[1]) }),
+	"endsWith":   exprStringFunc(2, func(s []string) interface{} { return strings.HasSuffix(s[0], s[1]) }),
+	"contains":   exprStringFunc(2, func(s []string) interface{} { return strings.Contains(s[0], s[1]) }),
+	"split": exprStringFunc(2, func(s []string) interface{} {
+		var l []interface{}
+		for _, part := range strings.Split(s[0], s[1]) {
+			l = append(l, part)
+		}
+		return l
+	}),
+	"join": func(args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("takes 2 arguments")
+		}
+		rv := reflect.ValueOf(args[0])
+		if args[0] == nil || rv.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("cannot join %v, which is not a list", args[0])
+		}
+		parts := make([]string, rv.Len())
+		for i := range parts {
+			parts[i] = fmt.Sprint(rv.Index(i).Interface())
+		}
+		return strings.Join(parts, fmt.Sprint(args[1])), nil
+	},
+	"keys": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("takes 1 argument")
+		}
+		m, ok := copyMapView(args[0])
+		if !ok {
+			return nil, fmt.Errorf("cannot list the keys of %v, which is not a mapping", args[0])
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		l := make([]interface{}, len(keys))
+		for i, k := range keys {
+			l[i] = k
+		}
+		return l, nil
+	},
+}
+
+// exprStringFunc is a function of n strings.
+func exprStringFunc(n int, fn func(s []string) interface{}) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) != n {
+			return nil, fmt.Errorf("takes %d arguments, not %d", n, len(args))
+		}
+		s := make([]string, n)
+		for i, arg := range args {
+			str, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %v", arg)
+			}
+			s[i] = str
+		}
+		return fn(s), nil
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var exprValues = Values{
+	"a":    2,
+	"b":    3,
+	"f":    1.5,
+	"s":    "web",
+	"env":  "prod",
+	"t":    true,
+	"list": []interface{}{"x", "y"},
+	"m":    map[string]interface{}{"k": "v", "n": map[string]interface{}{"z": 1}},
+}
+
+var exprTests = []struct {
+	name     string
+	expr     string
+	expected string
+	err      string
+}{
+	// Precedence and associativity are those of C
+	{name: "mul-before-add", expr: "1 + 2 * 3", expected: "7"},
+	{name: "parens", expr: "(1 + 2) * 3", expected: "9"},
+	{name: "left-assoc", expr: "10 - 4 - 3", expected: "3"},
+	{name: "int-division", expr: "7 / 2", expected: "3"},
+	{name: "float-division", expr: "7.0 / 2", expected: "3.5"},
+	{name: "modulo", expr: "7 % 4", expected: "3"},
+	{name: "unary-minus", expr: "-a + b", expected: "1"},
+	{name: "compare-before-equal", expr: "a < b == true", expected: "true"},
+	{name: "and-before-or", expr: "1 + 2 == 3 && 2 < 1 || true", expected: "true"},
+	{name: "longer-operators", expr: "a <= 2 && b >= 3", expected: "true"},
+	{name: "ternary-right-assoc", expr: "false ? 1 : true ? 2 : 3", expected: "2"},
+	{name: "ternary-values", expr: "t ? s : env", expected: "web"},
+	{name: "concat", expr: `s + "-" + env`, expected: "web-prod"},
+	{name: "strict-equal", expr: `a == "2"`, expected: "false"},
+	{name: "not", expr: "!t", expected: "false"},
+
+	// Operands that do not decide are not evaluated
+	{name: "short-and", expr: "false && missing", expected: "false"},
+	{name: "short-or", expr: "true || missing", expected: "true"},
+
+	{name: "leading-dot", expr: ".m.k", expected: "v"},
+	{name: "nested", expr: "m.n.z", expected: "1"},
+	{name: "index-key", expr: `m["k"]`, expected: "v"},
+	{name: "index-list", expr: "list[1]", expected: "y"},
+	{name: "root", expr: "$.a", expected: "2"},
+	{name: "funcs", expr: `len(list) + len(s) + int("42")`, expected: "47"},
+	{name: "string-funcs", expr: `upper(s) + join(list, ",")`, expected: "WEBx,y"},
+	{name: "keys", expr: "keys(m)", expected: "[k n]"},
+
+	// Parse errors
+	{name: "empty", expr: "", err: "empty expression"},
+	{name: "dangling-operator", expr: "1 +", err: `unexpected end in expression "1 +"`},
+	{name: "unclosed-paren", expr: "(1", err: "expected ')'"},
+	{name: "missing-else", expr: "a ? 1", err: "expected ':'"},
+	{name: "trailing", expr: "1 2", err: `unexpected "2"`},
+	{name: "unterminated", expr: `"abc`, err: "unterminated string"},
+	{name: "unknown-func", expr: "foo(1)", err: "unknown function foo"},
+
+	// Evaluation errors
+	{name: "missing", expr: "missing", err: "no value .missing"},
+	{name: "missing-nested", expr: "m.nope", err: "no value .m.nope"},
+	{name: "out-of-range", expr: "list[5]", err: "no value .list[...]"},
+	{name: "division-by-zero", expr: "1 / 0", err: "division by zero"},
+	{name: "arith-types", expr: "s - 1", err: "cannot compute web - 1"},
+	{name: "compare-types", expr: "s < 1", err: "cannot compare web < 1"},
+	{name: "not-boolean", expr: "!s", err: "expected a boolean"},
+	{name: "arity", expr: "len(1, 2)", err: "len: takes 1 argument"},
+	{name: "not-int", expr: `int("x")`, err: `"x" is not an integer`},
+}
+
+func TestExpr(t *testing.T) {
+	for _, test := range exprTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			node, err := parseExpr(test.expr)
+			var got interface{}
+			if err == nil {
+				got, err = node(exprValues)
+			}
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected %q to fail with %q, but it gave %v", test.expr, test.err, got)
+			}
+			if s := fmt.Sprint(got); s != test.expected {
+				t.Errorf("Evaluated %q to %s, expected %s", test.expr, s, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// feedDateLayouts are the layouts dates of pages and feed items may be given
+// in, besides a time.Time.
+var feedDateLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02", time.RFC1123Z, time.RFC1123}
+
+// feedEntries turns a list of maps, such as the pages of a site in the
+// values, into maps with string keys.
+func feedEntries(v interface{}) ([]map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := normalizeValue(v).([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of entries, not %T", v)
+	}
+	entries := make([]map[string]interface{}, len(list))
+	for i, e := range list {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("entry %d: expected a map, not %T", i, e)
+		}
+		entries[i] = m
+	}
+	return entries, nil
+}
+
+// feedMap turns a map, such as the description of a feed, into one with
+// string keys.
+func feedMap(v interface{}) (map[string]interface{}, error) {
+	m, ok := normalizeValue(v).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a map, not %T", v)
+	}
+	return m, nil
+}
+
+// feedString returns the first of keys set in m, as a string.
+func feedString(m map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := m[k]; ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+	}
+	return ""
+}
+
+// feedDate returns the first of keys set in m, as a time.
+func feedDate(m map[string]interface{}, keys ...string) (time.Time, bool, error) {
+	for _, k := range keys {
+		switch v := m[k].(type) {
+		case nil:
+			continue
+		case time.Time:
+			return v, true, nil
+		default:
+			s := fmt.Sprintf("%v", v)
+			for _, layout := range feedDateLayouts {
+				if t, err := time.Parse(layout, s); err == nil {
+					return t, true, nil
+				}
+			}
+			return time.Time{}, false, fmt.Errorf("cannot parse %s %q as a date", k, s)
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// resolveURL resolves ref against base, unless base is blank.
+func resolveURL(base, ref string) (string, error) {
+	if base == "" {
+		return ref, nil
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(u).String(), nil
+}
+
+// marshalFeed encodes v as an indented XML document.
+func marshalFeed(v interface{}) (string, error) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(out) + "\n", nil
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty"`
+}
+
+var sitemapChangeFreqs = map[string]bool{
+	"always": true, "hourly": true, "daily": true, "weekly": true, "monthly": true, "yearly": true, "never": true,
+}
+
+// sitemap is the `sitemap` template function, returning a sitemap.xml of
+// pages, each a map with a `url` (or `loc`), relative to base unless it is
+// blank, and optionally a `lastmod` (or `date`), `changefreq`, and
+// `priority`, e.g. `{{ sitemap .site.url .pages }}`.
+func sitemap(base string, pages interface{}) (string, error) {
+	entries, err := feedEntries(pages)
+	if err != nil {
+		return "", fmt.Errorf("sitemap: %v", err)
+	}
+	set := sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9", URLs: []sitemapURL{}}
+	for i, e := range entries {
+		loc := feedString(e, "url", "loc")
+		if loc == "" {
+			return "", fmt.Errorf("sitemap: entry %d has no url", i)
+		}
+		u := sitemapURL{ChangeFreq: feedString(e, "changefreq"), Priority: feedString(e, "priority")}
+		if u.Loc, err = resolveURL(base, loc); err != nil {
+			return "", fmt.Errorf("sitemap: entry %d: %v", i, err)
+		}
+		if u.ChangeFreq != "" && !sitemapChangeFreqs[u.ChangeFreq] {
+			return "", fmt.Errorf("sitemap: entry %d has an invalid changefreq %q", i, u.ChangeFreq)
+		}
+		if u.Priority != "" {
+			if p, err := strconv.ParseFloat(u.Priority, 64); err != nil || p < 0 || p > 1 {
+				return "", fmt.Errorf("sitemap: entry %d has a priority %q outside of 0.0 to 1.0", i, u.Priority)
+			}
+		}
+		t, ok, err := feedDate(e, "lastmod", "date")
+		if err != nil {
+			return "", fmt.Errorf("sitemap: entry %d: %v", i, err)
+		}
+		if ok {
+			u.LastMod = t.Format(time.RFC3339)
+		}
+		set.URLs = append(set.URLs, u)
+	}
+	return marshalFeed(set)
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Language      string    `xml:"language,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title,omitempty"`
+	Link        string   `xml:"link,omitempty"`
+	Description string   `xml:"description,omitempty"`
+	Author      string   `xml:"author,omitempty"`
+	GUID        *rssGUID `xml:"guid,omitempty"`
+	PubDate     string   `xml:"pubDate,omitempty"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// rssFeed is the `rssFeed` template function, returning an RSS 2.0 feed of
+// a map with a `title`, `url` (or `link`), `description`, and `items`, each a
+// map with a `title`, `url`, `description` (or `summary`), `date`, `author`,
+// and `id`, e.g. `{{ rssFeed .feed }}`. Item URLs are relative to that of
+// the feed.
+func rssFeed(feed interface{}) (string, error) {
+	f, err := feedMap(feed)
+	if err != nil {
+		return "", fmt.Errorf("rssFeed: %v", err)
+	}
+	link := feedString(f, "url", "link")
+	ch := rssChannel{
+		Title:       feedString(f, "title"),
+		Link:        link,
+		Description: feedString(f, "description", "summary"),
+		Language:    feedString(f, "language"),
+		Items:       []rssItem{},
+	}
+	if ch.Title == "" || ch.Link == "" {
+		return "", fmt.Errorf("rssFeed: a feed needs a title and a url")
+	}
+	items, err := feedEntries(f["items"])
+	if err != nil {
+		return "", fmt.Errorf("rssFeed: items: %v", err)
+	}
+	var latest time.Time
+	for i, e := range items {
+		item := rssItem{
+			Title:       feedString(e, "title"),
+			Description: feedString(e, "description", "summary"),
+			Author:      feedString(e, "author"),
+		}
+		if item.Title == "" && item.Description == "" {
+			return "", fmt.Errorf("rssFeed: item %d needs a title or a description", i)
+		}
+		if ref := feedString(e, "url", "link"); ref != "" {
+			if item.Link, err = resolveURL(link, ref); err != nil {
+				return "", fmt.Errorf("rssFeed: item %d: %v", i, err)
+			}
+		}
+		if id := feedString(e, "id", "guid"); id != "" {
+			item.GUID = &rssGUID{Value: id}
+		} else if item.Link != "" {
+			item.GUID = &rssGUID{IsPermaLink: true, Value: item.Link}
+		}
+		t, ok, err := feedDate(e, "date", "pubDate", "updated")
+		if err != nil {
+			return "", fmt.Errorf("rssFeed: item %d: %v", i, err)
+		}
+		if ok {
+			item.PubDate = t.Format(time.RFC1123Z)
+			if t.After(latest) {
+				latest = t
+			}
+		}
+		ch.Items = append(ch.Items, item)
+	}
+	if !latest.IsZero() {
+		ch.LastBuildDate = latest.Format(time.RFC1123Z)
+	}
+	return marshalFeed(rssDocument{Version: "2.0", Channel: ch})
+}
+
+type atomFeedDocument struct {
+	XMLName xml.Name    `xml:"feed"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link,omitempty"`
+	Author  *atomAuthor `xml:"author,omitempty"`
+	Summary *atomText   `xml:"summary,omitempty"`
+	Content *atomText   `xml:"content,omitempty"`
+}
+
+// atomFeed is the `atomFeed` template function, returning an Atom feed of
+// the same map as rssFeed, where items may also have HTML `content`, e.g.
+// `{{ atomFeed .feed }}`. Atom requires every item to have a date, and the
+// feed is as recent as its latest item.
+func atomFeed(feed interface{}) (string, error) {
+	f, err := feedMap(feed)
+	if err != nil {
+		return "", fmt.Errorf("atomFeed: %v", err)
+	}
+	link := feedString(f, "url", "link")
+	doc := atomFeedDocument{
+		XMLNS:   "http://www.w3.org/2005/Atom",
+		Title:   feedString(f, "title"),
+		ID:      feedString(f, "id"),
+		Entries: []atomEntry{},
+	}
+	if doc.Title == "" || link == "" {
+		return "", fmt.Errorf("atomFeed: a feed needs a title and a url")
+	}
+	if doc.ID == "" {
+		doc.ID = link
+	}
+	doc.Links = []atomLink{{Href: link}}
+	if self := feedString(f, "self"); self != "" {
+		doc.Links = append(doc.Links, atomLink{Href: self, Rel: "self"})
+	}
+	if author := feedString(f, "author"); author != "" {
+		doc.Author = &atomAuthor{Name: author}
+	}
+	items, err := feedEntries(f["items"])
+	if err != nil {
+		return "", fmt.Errorf("atomFeed: items: %v", err)
+	}
+	latest, _, err := feedDate(f, "updated", "date")
+	if err != nil {
+		return "", fmt.Errorf("atomFeed: %v", err)
+	}
+	for i, e := range items {
+		entry := atomEntry{Title: feedString(e, "title")}
+		if entry.Title == "" {
+			return "", fmt.Errorf("atomFeed: item %d needs a title", i)
+		}
+		t, ok, err := feedDate(e, "updated", "date", "pubDate")
+		if err != nil {
+			return "", fmt.Errorf("atomFeed: item %d: %v", i, err)
+		}
+		if !ok {
+			return "", fmt.Errorf("atomFeed: item %d needs a date", i)
+		}
+		entry.Updated = t.Format(time.RFC3339)
+		if t.After(latest) {
+			latest = t
+		}
+		if ref := feedString(e, "url", "link"); ref != "" {
+			href, err := resolveURL(link, ref)
+			if err != nil {
+				return "", fmt.Errorf("atomFeed: item %d: %v", i, err)
+			}
+			entry.Links = []atomLink{{Href: href, Rel: "alternate"}}
+		}
+		entry.ID = feedString(e, "id", "guid")
+		if entry.ID == "" {
+			if len(entry.Links) == 0 {
+				return "", fmt.Errorf("atomFeed: item %d needs an id or a url", i)
+			}
+			entry.ID = entry.Links[0].Href
+		}
+		if author := feedString(e, "author"); author != "" {
+			entry.Author = &atomAuthor{Name: author}
+		}
+		if summary := feedString(e, "summary", "description"); summary != "" {
+			entry.Summary = &atomText{Value: summary}
+		}
+		if content := feedString(e, "content"); content != "" {
+			entry.Content = &atomText{Type: "html", Value: content}
+		}
+		doc.Entries = append(doc.Entries, entry)
+	}
+	if latest.IsZero() {
+		return "", fmt.Errorf("atomFeed: a feed needs an updated date, or items with a date")
+	}
+	doc.Updated = latest.Format(time.RFC3339)
+	if doc.Author == nil {
+		for _, entry := range doc.Entries {
+			if entry.Author == nil {
+				return "", fmt.Errorf("atomFeed: a feed needs an author, unless all of its items have one")
+			}
+		}
+	}
+	return marshalFeed(doc)
+}
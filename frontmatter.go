@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FrontMatter is an optional YAML block at the very top of a template,
+// between two `---` lines, that configures how its output is handled:
+//
+//	---
+//	onchange: systemctl reload nginx
+//	---
+//	server { ... }
+//
+// Since templates of YAML documents often start with `---` themselves, the
+// block is only treated as front matter when every key in it is one of those
+// below.
+type FrontMatter struct {
+	// OnChange lists commands to run after the output changed.
+	OnChange stringOrList `yaml:"onchange,omitempty"`
+
+	// Paginate names a list in the values, e.g. "posts", that the template
+	// is rendered once per page of, with PageSize items on each page. See
+	// DefaultPageSize.
+	Paginate string `yaml:"paginate,omitempty"`
+	PageSize int    `yaml:"page_size,omitempty"`
+
+	// Records names a JSON lines file, e.g. "people.jsonl", that the
+	// template is rendered once per record of, streaming it rather than
+	// loading it. RecordOutput, if set, is a template naming the output of
+	// each record, which it is rendered with.
+	Records      string `yaml:"records,omitempty"`
+	RecordOutput string `yaml:"record_output,omitempty"`
+
+	// Timeout, e.g. "30s", replaces -render-timeout for this template. In
+	// sandbox mode, it can only be shorter.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (fm *FrontMatter) empty() bool {
+	return len(fm.OnChange) == 0 && fm.Paginate == "" && fm.PageSize == 0 && fm.Records == "" && fm.RecordOutput == "" && fm.Timeout == 0
+}
+
+// stringOrList accepts either a single string or a list of strings.
+type stringOrList []string
+
+func (s *stringOrList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var one string
+	if err := unmarshal(&one); err == nil {
+		*s = stringOrList{one}
+		return nil
+	}
+	var many []string
+	if err := unmarshal(&many); err != nil {
+		return errors.New("expected a string or a list of strings")
+	}
+	*s = stringOrList(many)
+	return nil
+}
+
+var frontMatterDelim = []byte("---")
+
+// splitFrontMatter separates the front matter of a template from its body.
+// The front matter is replaced by a template comment spanning as many lines,
+// so that line numbers in the body stay the same. Templates without front matter are returned as
+// they are, with a nil FrontMatter.
+func splitFrontMatter(data []byte) (*FrontMatter, []byte) {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) < 2 || !bytes.Equal(bytes.TrimRight(lines[0], "\r\n"), frontMatterDelim) {
+		return nil, data
+	}
+	for i := 1; i < len(lines); i++ {
+		if !bytes.Equal(bytes.TrimRight(lines[i], "\r\n"), frontMatterDelim) {
+			continue
+		}
+		var fm FrontMatter
+		if err := yaml.UnmarshalStrict(bytes.Join(lines[1:i], nil), &fm); err != nil || fm.empty() {
+			return nil, data
+		}
+		var body bytes.Buffer
+		body.WriteString("{{/*")
+		body.Write(bytes.Repeat([]byte("\n"), i+1))
+		body.WriteString("*/}}")
+		body.Write(bytes.Join(lines[i+1:], nil))
+		return &fm, body.Bytes()
+	}
+	return nil, data
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"hash/fnv"
-	"log"
 	"strconv"
 	"strings"
 	"text/template"
@@ -14,20 +13,37 @@ import (
 
 func funcMap() template.FuncMap {
 	f := sprig.TxtFuncMap()
+	f["atomFeed"] = atomFeed
 	f["baseConvert"] = baseConvert
 	f["fnv64sum"] = fnv64sum
 	f["fromJson"] = fromJson
 	f["fromYaml"] = fromYaml
+	f["htmlEscape"] = htmlEscape
+	f["mailAddress"] = mailAddress
+	f["paginate"] = paginate
+	f["barcode"] = func(string) (string, error) { return "", errQRCodeDisabled }
+	f["barcodeFile"] = func(string, string) (string, error) { return "", errQRCodeDisabled }
+	f["qrcode"] = func(string) (string, error) { return "", errQRCodeDisabled }
+	f["qrcodeFile"] = func(string, string) (string, error) { return "", errQRCodeDisabled }
+	f["markdownToHTML"] = markdownToHTML
+	f["required"] = required
+	f["rssFeed"] = rssFeed
+	f["sitemap"] = sitemap
+	f["stripTags"] = stripTags
+	f["toEnv"] = toEnv
 	f["toYaml"] = toYaml
 	f["trimLeft"] = trimLeft
 	f["trimRight"] = trimRight
+	for name, fn := range setFuncPlaceholders {
+		f[name] = fn
+	}
 	return f
 }
 
 func baseConvert(from, to int, s string) string {
 	i, err := strconv.ParseInt(s, from, 64)
 	if err != nil {
-		log.Printf("warning: cannot parse integer base %d from string %q: %v", from, s, err)
+		logf(nil, LogWarn, "cannot parse integer base %d from string %q: %v", from, s, err)
 		return "0"
 	}
 
@@ -42,7 +58,7 @@ func fromJson(p string) interface{} {
 	var v interface{}
 	err := json.Unmarshal([]byte(p), &v)
 	if err != nil {
-		log.Printf("cannot unmarshal JSON: %v (in %q)", err, p)
+		logf(nil, LogWarn, "cannot unmarshal JSON: %v (in %q)", err, p)
 	}
 	return v
 }
@@ -51,7 +67,7 @@ func fromYaml(p string) interface{} {
 	var v interface{}
 	err := yaml.Unmarshal([]byte(p), &v)
 	if err != nil {
-		log.Printf("cannot unmarshal YAML: %v (in %q)", err, p)
+		logf(nil, LogWarn, "cannot unmarshal YAML: %v (in %q)", err, p)
 	}
 	return v
 }
@@ -59,7 +75,7 @@ func fromYaml(p string) interface{} {
 func toYaml(v interface{}) string {
 	d, err := yaml.Marshal(v)
 	if err != nil {
-		log.Printf("cannot marshal YAML: %v", err)
+		logf(nil, LogWarn, "cannot marshal YAML: %v", err)
 	}
 	return string(d)
 }
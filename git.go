@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// GitCommit describes the commit of every output file a run changed into
+// the git repository holding them.
+type GitCommit struct {
+	Message string
+
+	// Branch, if set, is created from the current HEAD and switched to
+	// before committing. It must not exist yet.
+	Branch string
+
+	// Push pushes the commit to origin, setting the upstream of Branch.
+	Push bool
+
+	// PullRequest, if set, names the forge on which a pull request, or
+	// merge request, is opened from Branch into the branch the run started
+	// on: github or gitlab. Branch is then reset and force-pushed on every
+	// run, which updates a request left open by an earlier run, and the run
+	// switches back to the branch it started on.
+	PullRequest string
+}
+
+// commitChanges commits the output files that changed, and only those, even
+// if other changes were already staged.
+func (r *Renderer) commitChanges() error {
+	if r.Git == nil || r.changes == nil {
+		return nil
+	}
+	changed := r.changes.changed()
+	if len(changed) == 0 {
+		r.logf(LogInfo, "No outputs changed, so there is nothing to commit")
+		return nil
+	}
+	if r.DryRun || r.EmitPatch {
+		r.logf(LogInfo, "Would commit %d changed outputs", len(changed))
+		return nil
+	}
+
+	paths := make([]string, len(changed))
+	for i, name := range changed {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return fmt.Errorf("Cannot commit %s: %v", name, err)
+		}
+		paths[i] = abs
+	}
+	dir := filepath.Dir(paths[0])
+
+	var base string
+	if r.Git.PullRequest != "" {
+		out, err := gitOutput(dir, "rev-parse", "--abbrev-ref", "HEAD")
+		if err != nil {
+			return err
+		}
+		if base = out; base == r.Git.Branch {
+			return fmt.Errorf("Cannot open a pull request from %s into itself; start from the branch it should be merged into", base)
+		}
+		if err := r.git(dir, "checkout", "-B", r.Git.Branch); err != nil {
+			return err
+		}
+	} else if r.Git.Branch != "" {
+		if err := r.git(dir, "checkout", "-b", r.Git.Branch); err != nil {
+			return err
+		}
+	}
+	r.logf(LogInfo, "Committing %d changed outputs", len(changed))
+	if err := r.git(dir, append([]string{"add", "--"}, paths...)...); err != nil {
+		return err
+	}
+	if err := r.git(dir, append([]string{"commit", "-m", r.Git.Message, "--"}, paths...)...); err != nil {
+		return err
+	}
+	if !r.Git.Push && r.Git.PullRequest == "" {
+		return nil
+	}
+	if r.Git.PullRequest != "" {
+		err := r.pushPullRequest(dir, base, changed)
+		if cerr := r.git(dir, "checkout", base); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	if r.Git.Branch != "" {
+		return r.git(dir, "push", "--set-upstream", "origin", r.Git.Branch)
+	}
+	return r.git(dir, "push")
+}
+
+// pushPullRequest force-pushes Branch, unless it holds what was pushed last
+// time, and makes sure a pull request is open from it.
+func (r *Renderer) pushPullRequest(dir, base string, changed []string) error {
+	pushed := "refs/remotes/origin/" + r.Git.Branch
+	if r.gitQuiet(dir, "diff", "--quiet", pushed, "HEAD") {
+		r.logf(LogInfo, "%s already holds these changes", r.Git.Branch)
+	} else if err := r.git(dir, "push", "--force", "--set-upstream", "origin", r.Git.Branch); err != nil {
+		return err
+	}
+	return r.openPullRequest(dir, base, changed)
+}
+
+// gitQuiet reports whether git succeeds in dir, discarding its output.
+func (r *Renderer) gitQuiet(dir string, args ...string) bool {
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	return c.Run() == nil
+}
+
+// gitOutput runs git in dir, and returns its output, trimmed.
+func gitOutput(dir string, args ...string) (string, error) {
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// git runs git in dir, sending its output to STDERR like that of hooks.
+func (r *Renderer) git(dir string, args ...string) error {
+	r.logf(LogDebug, "Running git %q in %s", args, dir)
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("git %s failed: %v", args[0], err)
+	}
+	return nil
+}
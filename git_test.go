@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// initRepo makes dir a git repository on branch main, with one commit, and
+// returns a func running git in it.
+func initRepo(t *testing.T, dir string) func(args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	git := func(args ...string) string {
+		t.Helper()
+		c := exec.Command("git", args...)
+		c.Dir = dir
+		out, err := c.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %q failed: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("symbolic-ref", "HEAD", "refs/heads/main")
+	git("config", "user.name", "tpl")
+	git("config", "user.email", "tpl@example.com")
+	git("config", "commit.gpgsign", "false")
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("readme\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "README")
+	git("commit", "-q", "-m", "Initial commit")
+	return git
+}
+
+var gitCommitTests = []struct {
+	name    string
+	commit  GitCommit
+	runs    []string
+	commits int
+	files   string
+	branch  string
+	err     string
+}{
+	{
+		name:    "commit",
+		commit:  GitCommit{Message: "Render"},
+		runs:    []string{"web"},
+		commits: 1,
+		files:   "out/a.txt\nout/b.txt",
+		branch:  "main",
+	},
+	{
+		name:    "unchanged",
+		commit:  GitCommit{Message: "Render"},
+		runs:    []string{"web", "web"},
+		commits: 1,
+		files:   "out/a.txt\nout/b.txt",
+		branch:  "main",
+	},
+	{
+		name:    "changed",
+		commit:  GitCommit{Message: "Render"},
+		runs:    []string{"web", "api"},
+		commits: 2,
+		files:   "out/a.txt",
+		branch:  "main",
+	},
+	{
+		name:    "branch",
+		commit:  GitCommit{Message: "Render", Branch: "render"},
+		runs:    []string{"web"},
+		commits: 1,
+		files:   "out/a.txt\nout/b.txt",
+		branch:  "render",
+	},
+	{
+		name:   "existing-branch",
+		commit: GitCommit{Message: "Render", Branch: "main"},
+		runs:   []string{"web"},
+		err:    "git checkout failed",
+	},
+}
+
+func TestGitCommit(t *testing.T) {
+	for _, test := range gitCommitTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			git := initRepo(t, tmpdir)
+			for name, content := range map[string]string{"a.txt.tpl": "{{ .name }}", "b.txt.tpl": "static", "staged.txt": "staged"} {
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Changes staged before the run are left out of its commits
+			git("add", "staged.txt")
+
+			for _, name := range test.runs {
+				commit := test.commit
+				r := &Renderer{Inputs: []string{"a.txt.tpl", "b.txt.tpl"}, StopOnError: true, Git: &commit, Logger: &logRecorder{}}
+				if err = r.Execute("out/", map[string]interface{}{"name": name}); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected committing to fail with %q, but it succeeded", test.err)
+			}
+
+			if n := git("rev-list", "--count", "HEAD"); n != strconv.Itoa(test.commits+1) {
+				t.Errorf("Made %s commits in all, expected %d after the initial one", n, test.commits)
+			}
+			if msg := git("log", "-1", "--format=%s"); msg != test.commit.Message {
+				t.Errorf("Committed with message %q, expected %q", msg, test.commit.Message)
+			}
+			if files := git("show", "--format=", "--name-only", "HEAD"); files != test.files {
+				t.Errorf("Committed %q, expected %q", files, test.files)
+			}
+			if branch := git("rev-parse", "--abbrev-ref", "HEAD"); branch != test.branch {
+				t.Errorf("Committed on %s, expected %s", branch, test.branch)
+			}
+			if staged := git("diff", "--cached", "--name-only"); staged != "staged.txt" {
+				t.Errorf("Left %q staged, expected staged.txt", staged)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// goldenCase is one directory under the tests directory. Its values.yaml is
+// layered on top of the base values, and golden/ holds the expected output
+// tree.
+type goldenCase struct {
+	name string
+	dir  string
+}
+
+func (c goldenCase) valuesFile() string { return filepath.Join(c.dir, "values.yaml") }
+func (c goldenCase) goldenDir() string  { return filepath.Join(c.dir, "golden") }
+
+func findGoldenCases(testsDir string) ([]goldenCase, error) {
+	fis, err := ioutil.ReadDir(testsDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list test cases in %s: %v", testsDir, err)
+	}
+	cases := []goldenCase{}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			cases = append(cases, goldenCase{name: fi.Name(), dir: filepath.Join(testsDir, fi.Name())})
+		}
+	}
+	return cases, nil
+}
+
+// runGoldenTests renders r's inputs once per test case and compares the result
+// with the case's golden files, or replaces them when update is set. It returns
+// the process exit code.
+func runGoldenTests(r *Renderer, base Values, loader *valuesLoader, testsDir string, update bool) int {
+	cases, err := findGoldenCases(testsDir)
+	if err != nil {
+		r.logf(LogError, "%v", err)
+		return 1
+	}
+	if len(cases) == 0 {
+		r.logf(LogError, "No test cases found in %s", testsDir)
+		return 1
+	}
+
+	failed := 0
+	for _, c := range cases {
+		if err := runGoldenCase(r, base, loader, c, update); err != nil {
+			r.logf(LogError, "FAIL %s: %v", c.name, err)
+			failed++
+			continue
+		}
+		if update {
+			r.logf(LogInfo, "updated %s", c.name)
+		} else {
+			r.logf(LogInfo, "ok   %s", c.name)
+		}
+	}
+	if failed > 0 {
+		r.logf(LogError, "%d of %d test case(s) failed", failed, len(cases))
+		return 1
+	}
+	return 0
+}
+
+func runGoldenCase(r *Renderer, base Values, loader *valuesLoader, c goldenCase, update bool) error {
+	values := make(Values)
+	for k, v := range base {
+		values[k] = v
+	}
+	if _, err := os.Stat(c.valuesFile()); err == nil {
+		if err := loader.LoadInto(values, c.valuesFile()); err != nil {
+			return err
+		}
+	}
+
+	tmpdir, err := r.Workspace.TempDir("golden-" + c.name + "-")
+	if err != nil {
+		return err
+	}
+	if !r.Workspace.keep() {
+		defer os.RemoveAll(tmpdir)
+	}
+
+	if err := r.Execute(tmpdir+string(filepath.Separator), values); err != nil {
+		return err
+	}
+
+	if update {
+		if err := os.RemoveAll(c.goldenDir()); err != nil {
+			return err
+		}
+		return copyTree(tmpdir, c.goldenDir())
+	}
+	return compareTrees(tmpdir, c.goldenDir())
+}
+
+// listTree returns the paths of all regular files under dir, relative to dir.
+func listTree(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func copyTree(src, dst string) error {
+	files, err := listTree(src)
+	if err != nil {
+		return err
+	}
+	for _, rel := range files {
+		data, err := ioutil.ReadFile(filepath.Join(src, rel))
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareTrees reports every file that is missing, unexpected, or different
+// in actual when compared to golden.
+func compareTrees(actual, golden string) error {
+	got, err := listTree(actual)
+	if err != nil {
+		return err
+	}
+	want, err := listTree(golden)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	problems := []string{}
+	seen := make(map[string]bool)
+	for _, rel := range want {
+		seen[rel] = true
+		expected, err := ioutil.ReadFile(filepath.Join(golden, rel))
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(filepath.Join(actual, rel))
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("%s was not rendered", rel))
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !bytes.Equal(content, expected) {
+			problems = append(problems, fmt.Sprintf("%s differs from its golden file", rel))
+		}
+	}
+	for _, rel := range got {
+		if !seen[rel] {
+			problems = append(problems, fmt.Sprintf("%s has no golden file", rel))
+		}
+	}
+
+	if len(problems) > 0 {
+		msg := ""
+		for _, p := range problems {
+			msg += "\n  " + p
+		}
+		return fmt.Errorf("output does not match golden files:%s", msg)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// DefaultHeader is the banner prepended to outputs when no other is given.
+const DefaultHeader = `Generated by tpl from {{ .T.Tpl.TemplatePath }} at {{ .T.Tpl.Now.UTC.Format "2006-01-02T15:04:05Z" }}. DO NOT EDIT.`
+
+// commentStyle is how a line comment is written in some file format.
+type commentStyle struct {
+	prefix, suffix string
+}
+
+// commentStyles maps output extensions to their comment syntax.
+var commentStyles = map[string]commentStyle{
+	".bash": {"# ", ""}, ".cfg": {"# ", ""}, ".conf": {"# ", ""}, ".env": {"# ", ""},
+	".hcl": {"# ", ""}, ".properties": {"# ", ""}, ".py": {"# ", ""}, ".rb": {"# ", ""},
+	".sh": {"# ", ""}, ".tf": {"# ", ""}, ".toml": {"# ", ""}, ".yaml": {"# ", ""},
+	".yml": {"# ", ""}, ".zsh": {"# ", ""},
+
+	".c": {"// ", ""}, ".cpp": {"// ", ""}, ".cs": {"// ", ""}, ".go": {"// ", ""},
+	".h": {"// ", ""}, ".java": {"// ", ""}, ".js": {"// ", ""}, ".jsonnet": {"// ", ""},
+	".kt": {"// ", ""}, ".proto": {"// ", ""}, ".rs": {"// ", ""}, ".scala": {"// ", ""},
+	".swift": {"// ", ""}, ".ts": {"// ", ""},
+
+	".htm": {"<!-- ", " -->"}, ".html": {"<!-- ", " -->"}, ".md": {"<!-- ", " -->"},
+	".svg": {"<!-- ", " -->"}, ".xml": {"<!-- ", " -->"},
+
+	".css": {"/* ", " */"}, ".ini": {"; ", ""}, ".lua": {"-- ", ""}, ".sql": {"-- ", ""},
+}
+
+// commentStyleNames maps file names without an extension to their comment
+// syntax.
+var commentStyleNames = map[string]commentStyle{
+	"Dockerfile": {"# ", ""},
+	"Makefile":   {"# ", ""},
+}
+
+// commentStyleFor returns the comment syntax of the output oname, rendered
+// from iname. Outputs to STDOUT are named after their template.
+func commentStyleFor(iname, oname string) (commentStyle, bool) {
+	name := filepath.Base(oname)
+	if oname == "-" {
+		name = strings.TrimSuffix(filepath.Base(iname), filepath.Ext(iname))
+	}
+	if cs, ok := commentStyleNames[name]; ok {
+		return cs, true
+	}
+	cs, ok := commentStyles[strings.ToLower(filepath.Ext(name))]
+	return cs, ok
+}
+
+// addHeader prepends the rendered Header, as a comment, to content. Outputs
+// whose comment syntax is unknown, such as JSON, are left alone. The header
+// goes after any `#!` or `<?xml` line, which must stay first.
+func (r *Renderer) addHeader(iname, oname string, content []byte, values map[string]interface{}) ([]byte, error) {
+	cs, ok := commentStyleFor(iname, oname)
+	if !ok {
+		r.warn(fmt.Sprintf("not adding a header to %s, whose comment syntax is unknown", oname))
+		return content, nil
+	}
+
+	if r.header == nil {
+		t, err := template.New("header").Option("missingkey=zero").Parse(r.Header)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse header: %v", err)
+		}
+		r.header = t
+	}
+	var text bytes.Buffer
+	if err := r.header.Execute(&text, values); err != nil {
+		return nil, fmt.Errorf("Cannot render header: %v", err)
+	}
+
+	var banner bytes.Buffer
+	for _, line := range strings.Split(strings.TrimRight(text.String(), "\n"), "\n") {
+		banner.WriteString(cs.prefix + line + cs.suffix + "\n")
+	}
+
+	var out bytes.Buffer
+	if bytes.HasPrefix(content, []byte("#!")) || bytes.HasPrefix(content, []byte("<?xml")) {
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			out.Write(content[:i+1])
+			content = content[i+1:]
+		} else {
+			out.Write(content)
+			out.WriteByte('\n')
+			content = nil
+		}
+	}
+	out.Write(banner.Bytes())
+	out.Write(content)
+	return out.Bytes(), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// changeTracker remembers the contents of outputs from before a run, so that
+// hooks only run for outputs that actually changed, and reports can tell
+// created, updated, and unchanged outputs apart.
+type changeTracker struct {
+	order  []string
+	before map[string]*[sha256.Size]byte
+	after  map[string][sha256.Size]byte
+	size   map[string]int
+	hooks  map[string][]string
+
+	// prev and next keep the content of outputs from before the run, and as
+	// they are about to be written, when set.
+	prev map[string][]byte
+	next map[string][]byte
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{
+		before: make(map[string]*[sha256.Size]byte),
+		after:  make(map[string][sha256.Size]byte),
+		size:   make(map[string]int),
+		hooks:  make(map[string][]string),
+	}
+}
+
+// addHooks registers commands to run once the run changed oname.
+func (r *Renderer) addHooks(oname string, cmds []string) {
+	if r.changes == nil {
+		return
+	}
+	r.changes.hooks[oname] = append(r.changes.hooks[oname], cmds...)
+}
+
+// trackChange records the content of oname from before the run, the first
+// time it is written, and the content it is about to be replaced by.
+func (r *Renderer) trackChange(oname string, content []byte) {
+	c := r.changes
+	if c == nil || (len(r.OnChange) == 0 && len(c.hooks[oname]) == 0 && r.Report == nil && r.Git == nil && r.Manifest == "") {
+		return
+	}
+	if _, ok := c.after[oname]; !ok {
+		c.order = append(c.order, oname)
+		if prev, err := ioutil.ReadFile(oname); err == nil {
+			sum := sha256.Sum256(prev)
+			c.before[oname] = &sum
+			if c.prev != nil {
+				c.prev[oname] = prev
+			}
+		}
+	}
+	c.after[oname] = sha256.Sum256(content)
+	c.size[oname] = len(content)
+	if c.next != nil {
+		// The content may be a buffer reused by the next output
+		c.next[oname] = append([]byte(nil), content...)
+	}
+}
+
+// sum returns the checksum of the final content of name, if it was tracked.
+func (c *changeTracker) sum(name string) ([sha256.Size]byte, bool) {
+	if c == nil {
+		return [sha256.Size]byte{}, false
+	}
+	sum, ok := c.after[name]
+	return sum, ok
+}
+
+// changed lists the tracked outputs whose content changed, in the order they
+// were first written.
+func (c *changeTracker) changed() []string {
+	names := []string{}
+	for _, name := range c.order {
+		if prev := c.before[name]; prev == nil || *prev != c.after[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// runHooks runs the hooks of every changed output, and then the OnChange
+// commands if any output changed. Each command runs once, even when several
+// outputs ask for it.
+func (r *Renderer) runHooks() error {
+	if r.changes == nil {
+		return nil
+	}
+	changed := r.changes.changed()
+	if len(changed) == 0 {
+		return nil
+	}
+
+	ran := make(map[string]bool)
+	for _, name := range changed {
+		for _, cmd := range r.changes.hooks[name] {
+			if ran[cmd] {
+				continue
+			}
+			ran[cmd] = true
+			if err := r.runHook(cmd, "TPL_OUTPUT="+name, "TPL_CHANGED="+strings.Join(changed, "\n")); err != nil {
+				return err
+			}
+		}
+	}
+	for _, cmd := range r.OnChange {
+		if ran[cmd] {
+			continue
+		}
+		ran[cmd] = true
+		if err := r.runHook(cmd, "TPL_CHANGED="+strings.Join(changed, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHook runs cmd with `sh -c`, sending its output to STDERR so that it
+// cannot mix with outputs written to STDOUT.
+func (r *Renderer) runHook(cmd string, env ...string) error {
+	if r.DryRun || r.EmitPatch {
+		r.logf(LogInfo, "Would run %q", cmd)
+		return nil
+	}
+	r.logf(LogInfo, "Running %q", cmd)
+	r.logf(LogDebug, "Hook environment: %q", env)
+	c := exec.Command("sh", "-c", cmd)
+	c.Env = append(os.Environ(), env...)
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("Hook %q failed: %v", cmd, err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// indexKey holds the outputs of the run in the builtins of the Index
+// template.
+const indexKey = "Outputs"
+
+// indexedOutput describes an output file of the run to the Index template.
+type indexedOutput struct {
+	// Path is relative to the directory of the index, and slash-separated,
+	// e.g. for the resources of a kustomization.yaml.
+	Path string
+
+	// Output is the path the output was written to.
+	Output string
+	Size   int
+	SHA256 string
+}
+
+// indexOutput records that content was written to oname, for the Index.
+func (r *Renderer) indexOutput(oname string, content []byte) {
+	if r.Index == "" || oname == "-" {
+		return
+	}
+	if _, ok := r.indexed[oname]; !ok {
+		r.indexOrder = append(r.indexOrder, oname)
+	}
+	sum := sha256.Sum256(content)
+	r.indexed[oname] = &indexedOutput{Output: oname, Size: len(content), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// indexCached records an output that was up to date, and so not written.
+func (r *Renderer) indexCached(oname string) {
+	if r.Index == "" {
+		return
+	}
+	fi, err := os.Stat(oname)
+	if err != nil {
+		return
+	}
+	r.indexOrder = append(r.indexOrder, oname)
+	r.indexed[oname] = &indexedOutput{Output: oname, Size: int(fi.Size()), SHA256: r.manifest.Outputs[oname].Output}
+}
+
+// renderIndex renders the Index template after every other output, with the
+// list of outputs in its Outputs builtin.
+func (r *Renderer) renderIndex(out string, data interface{}) error {
+	if r.Index == "" {
+		return nil
+	}
+	oname := r.getOutputPath(out, filepath.Base(r.Index))
+	if _, ok := r.indexed[oname]; ok {
+		return fmt.Errorf("Cannot write the index into %s, which is already an output; give an output directory", oname)
+	}
+	if oname != "-" {
+		if err := r.sink.Check(oname); err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Dir(oname)
+	outputs := make([]indexedOutput, len(r.indexOrder))
+	for i, name := range r.indexOrder {
+		outputs[i] = *r.indexed[name]
+		rel, err := filepath.Rel(dir, name)
+		if err != nil || oname == "-" {
+			rel = name
+		}
+		outputs[i].Path = filepath.ToSlash(rel)
+	}
+
+	job := renderJob{input: r.Index, output: oname}
+	values := r.jobValues(data, job)
+	m, ok := values.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot render the index %s with values that are a %T rather than a map", r.Index, data)
+	}
+	r.setBuiltin(m, indexKey, outputs)
+
+	start := time.Now()
+	inames := append(append([]string{}, r.PreloadFiles...), r.Index)
+	tpl, fm, err := r.parse(inames)
+	if err != nil {
+		r.Report.add(job, 0, err)
+		return err
+	}
+	err = r.render(m, parsedTemplate{tpl: tpl, fm: fm, took: time.Since(start)}, inames, oname)
+	r.Report.add(job, time.Since(start), err)
+	return err
+}
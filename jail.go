@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pathJail confines file operations to a root directory. A nil jail allows
+// every path.
+type pathJail struct {
+	root string
+}
+
+func newPathJail(root string) (*pathJail, error) {
+	if root == "" {
+		return nil, nil
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot resolve root %q: %v", root, err)
+	}
+	return &pathJail{root: real}, nil
+}
+
+// Check returns an error if p, after resolving symlinks, is outside the root.
+// The path need not exist yet; its nearest existing ancestor is resolved
+// instead.
+func (j *pathJail) Check(p string) error {
+	if j == nil {
+		return nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return err
+	}
+	real, err := evalExistingSymlinks(abs)
+	if err != nil {
+		return err
+	}
+	if real != j.root && !strings.HasPrefix(real, j.root+string(filepath.Separator)) {
+		return fmt.Errorf("Path %q escapes root %q", p, j.root)
+	}
+	return nil
+}
+
+// evalExistingSymlinks resolves symlinks in the longest existing prefix of
+// abs, and appends the remaining, not-yet-existing components verbatim.
+func evalExistingSymlinks(abs string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(abs)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return filepath.Join(abs, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(abs), rest)
+		abs = parent
+	}
+}
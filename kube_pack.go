@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// KubePack describes a Kubernetes ConfigMap or Secret that all outputs are
+// packed into, one data key per output file.
+type KubePack struct {
+	// Kind is either "ConfigMap" or "Secret".
+	Kind      string
+	Name      string
+	Namespace string
+	Labels    map[string]string
+}
+
+// kubeKeyPattern matches valid ConfigMap and Secret data keys.
+var kubeKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+type kubeMetadata struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type kubeManifest struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   kubeMetadata      `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	BinaryData map[string]string `yaml:"binaryData,omitempty"`
+}
+
+// kubePackSink collects outputs in memory, and writes a single manifest
+// containing them to dest when the run succeeds.
+type kubePackSink struct {
+	*memorySink
+	pack KubePack
+	dest string
+	fs   *fileSink
+}
+
+func newKubePackSink(pack KubePack, dest string, fs *fileSink) (*kubePackSink, error) {
+	switch pack.Kind {
+	case "ConfigMap", "Secret":
+	default:
+		return nil, fmt.Errorf("cannot pack outputs into a %q; must be ConfigMap or Secret", pack.Kind)
+	}
+	if pack.Name == "" {
+		return nil, fmt.Errorf("a name is required to pack outputs into a %s", pack.Kind)
+	}
+	if dest != "-" {
+		if err := fs.Check(dest); err != nil {
+			return nil, err
+		}
+	}
+	return &kubePackSink{memorySink: newMemorySink(), pack: pack, dest: dest, fs: fs}, nil
+}
+
+// manifest builds the packed manifest. Each output is keyed by its base name.
+func (s *kubePackSink) manifest() (*kubeManifest, error) {
+	m := &kubeManifest{
+		APIVersion: "v1",
+		Kind:       s.pack.Kind,
+		Metadata: kubeMetadata{
+			Name:      s.pack.Name,
+			Namespace: s.pack.Namespace,
+			Labels:    s.pack.Labels,
+		},
+		Data: make(map[string]string),
+	}
+	if s.pack.Kind == "Secret" {
+		m.Type = "Opaque"
+	}
+
+	seen := make(map[string]string)
+	for _, name := range s.names() {
+		key := path.Base(name)
+		if !kubeKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("output %q cannot be packed: %q is not a valid %s key", name, key, s.pack.Kind)
+		}
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("outputs %q and %q would both be packed under the key %q", prev, name, key)
+		}
+		seen[key] = name
+
+		content := s.entries[name].content
+		switch {
+		case s.pack.Kind == "Secret":
+			m.Data[key] = base64.StdEncoding.EncodeToString(content)
+		case utf8.Valid(content):
+			m.Data[key] = string(content)
+		default:
+			if m.BinaryData == nil {
+				m.BinaryData = make(map[string]string)
+			}
+			m.BinaryData[key] = base64.StdEncoding.EncodeToString(content)
+		}
+	}
+	return m, nil
+}
+
+func (s *kubePackSink) Close() error {
+	m, err := s.manifest()
+	if err != nil {
+		return err
+	}
+	doc, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if s.dest == "-" {
+		_, err := os.Stdout.Write(doc)
+		return err
+	}
+	if err := s.fs.WriteFile(s.dest, doc, 0644); err != nil {
+		return err
+	}
+	return s.fs.Close()
+}
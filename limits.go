@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// renderTimeout and maxOutputSize are the limits on executing each template,
+// which the Sandbox sets when they are not.
+func (r *Renderer) renderTimeout() time.Duration {
+	if r.Timeout == 0 && r.Sandbox {
+		return DefaultSandboxTimeout
+	}
+	return r.Timeout
+}
+
+func (r *Renderer) maxOutputSize() int64 {
+	if r.MaxOutputBytes == 0 && r.Sandbox {
+		return DefaultSandboxOutputSize
+	}
+	return r.MaxOutputBytes
+}
+
+// errOutputTooLarge and errTimeout fail a template that exceeded its
+// limits.
+var (
+	errOutputTooLarge = errors.New("output exceeds the maximum output size")
+	errTimeout        = errors.New("template took longer than the timeout")
+)
+
+// cappedWriter fails writes past limit bytes, or once stopped.
+type cappedWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	limit   int64
+	written int64
+	err     error
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.limit > 0 && w.written+int64(len(p)) > w.limit {
+		w.err = errOutputTooLarge
+		return 0, w.err
+	}
+	w.written += int64(len(p))
+	return w.w.Write(p)
+}
+
+func (w *cappedWriter) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// stopGuard stops an abandoned template from running on in the background:
+// once stopped, every function of its template set fails when called, which
+// unwinds the execution, as does writing.
+type stopGuard struct {
+	stopped int32
+}
+
+func (g *stopGuard) stop() {
+	if g != nil {
+		atomic.StoreInt32(&g.stopped, 1)
+	}
+}
+
+// guardFuncs has every function of tpl, those of the run overlaid with those
+// bound to tpl, fail once the returned guard is stopped. It does nothing, and
+// returns nil, for templates without a timeout.
+func (r *Renderer) guardFuncs(tpl *template.Template, fm *FrontMatter, bound template.FuncMap) *stopGuard {
+	if r.renderTimeout() <= 0 && (fm == nil || fm.Timeout <= 0) {
+		return nil
+	}
+	funcs := make(template.FuncMap, len(r.funcs)+len(bound))
+	for name, fn := range r.funcs {
+		funcs[name] = fn
+	}
+	for name, fn := range bound {
+		funcs[name] = fn
+	}
+	g := &stopGuard{}
+	for name, fn := range funcs {
+		v := reflect.ValueOf(fn)
+		if v.Kind() != reflect.Func {
+			continue
+		}
+		t := v.Type()
+		funcs[name] = reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+			if atomic.LoadInt32(&g.stopped) != 0 {
+				// text/template turns the panics of functions into errors
+				panic(errTimeout)
+			}
+			if t.IsVariadic() {
+				return v.CallSlice(args)
+			}
+			return v.Call(args)
+		}).Interface()
+	}
+	if len(funcs) > 0 {
+		tpl.Funcs(funcs)
+	}
+	return g
+}
+
+// executeTemplate executes tpl into buf within the limits of the run, or the
+// timeout of its front matter fm. A template that runs past the timeout is
+// abandoned: it can no longer write to buf, and its functions fail, so that it
+// stops at its next write or function call. One that does neither, such as an
+// empty range over a huge number, runs on until it is done.
+func (r *Renderer) executeTemplate(tpl *template.Template, fm *FrontMatter, buf *bytes.Buffer, values interface{}) error {
+	timeout, limit := r.renderTimeout(), r.maxOutputSize()
+	raise := "raise -render-timeout"
+	if fm != nil && fm.Timeout > 0 && (timeout <= 0 || fm.Timeout < timeout || !r.Sandbox) {
+		timeout, raise = fm.Timeout, "raise the timeout in its front matter"
+	}
+	if timeout <= 0 && limit <= 0 {
+		return tpl.Execute(buf, values)
+	}
+	w := &cappedWriter{w: buf, limit: limit}
+	if timeout <= 0 {
+		if err := tpl.Execute(w, values); err != errOutputTooLarge {
+			return err
+		}
+		return outputTooLarge(tpl, limit)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- tpl.Execute(w, values) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err == errOutputTooLarge {
+			return outputTooLarge(tpl, limit)
+		}
+		return err
+	case <-timer.C:
+		w.stop(errTimeout)
+		r.guards[tpl].stop()
+		return fmt.Errorf("Template %s took longer than the timeout of %s, and was abandoned; %s if it really takes this long", tpl.Name(), timeout, raise)
+	}
+}
+
+func outputTooLarge(tpl *template.Template, limit int64) error {
+	size := sizeFlag(limit)
+	return fmt.Errorf("Template %s rendered more than the limit of %s; raise -max-output-size if the output really is this large", tpl.Name(), size.String())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var limitTests = []struct {
+	name    string
+	tpl     string
+	timeout time.Duration
+	limit   int64
+	err     string
+}{
+	{name: "within", tpl: "{{ .foo }}", timeout: time.Second, limit: 1 << 10},
+	{name: "too-large", tpl: `{{ range until 1000 }}{{ $.foo }}{{ end }}`, limit: 100, err: "more than the limit"},
+	{name: "writing", tpl: `{{ range until 100000 }}{{ range until 100000 }}x{{ end }}{{ end }}`, timeout: 50 * time.Millisecond, err: "took longer than the timeout"},
+	{name: "calling", tpl: `{{ range until 100000 }}{{ range until 100000 }}{{ $x := add 1 1 }}{{ end }}{{ end }}`, timeout: 50 * time.Millisecond, err: "took longer than the timeout"},
+}
+
+func TestLimits(t *testing.T) {
+	for _, test := range limitTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile("test.txt.tpl", []byte(test.tpl), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			before := runtime.NumGoroutine()
+			r := &Renderer{FuncMap: funcMap(), Inputs: []string{"test.txt.tpl"}, StopOnError: true, Timeout: test.timeout, MaxOutputBytes: test.limit}
+			err = r.Execute("out.txt", map[string]interface{}{"foo": "bar"})
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error during execution: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error during execution; got %q, expected %q", err, test.err)
+				}
+			} else if test.err != "" {
+				t.Fatalf("Expected execution to fail with %q, but it succeeded", test.err)
+			}
+
+			// An abandoned template stops at its next write or call
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > before {
+				t.Errorf("%d goroutine(s) still running after the template was abandoned", n-before)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// CheckResult lists the problems found by Check. Errors would make a render
+// fail; warnings point at likely mistakes that would not.
+type CheckResult struct {
+	Errors   []string
+	Warnings []string
+
+	// Unreachable lists the named templates that no input invokes, directly
+	// or through other templates, which are also among the Warnings.
+	Unreachable []string
+}
+
+// OK reports whether no errors were found.
+func (c *CheckResult) OK() bool {
+	return len(c.Errors) == 0
+}
+
+// Check parses every input along with the preloads, without executing or
+// writing anything. It verifies that every `template` invocation refers to a
+// defined template and warns about definitions that no input reaches, by
+// invoking them with `template` or `include`, or through templates that do.
+// When values is non-nil, it also verifies that every value referenced from
+// the top level of an input exists in values.
+func (r *Renderer) Check(values map[string]interface{}) (*CheckResult, error) {
+	jail, err := newPathJail(r.Root)
+	if err != nil {
+		return nil, err
+	}
+	r.jail = jail
+	r.funcs = nil
+
+	jobs, err := r.plan(r.Inputs, "-")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CheckResult{}
+	definedIn := make(map[string]string)
+	reached := make(map[string]bool)
+	for _, job := range jobs {
+		if job.copy || job.link != "" {
+			continue
+		}
+		inames := append(append([]string{}, r.PreloadFiles...), job.input)
+		var page *contentPage
+		if r.isPage(job.input) {
+			if page, err = r.readPage(job.input); err != nil {
+				res.Errors = append(res.Errors, err.Error())
+				continue
+			}
+			inames[len(inames)-1] = page.layout
+		}
+		tpl, _, err := r.parse(inames)
+		if err != nil {
+			res.Errors = append(res.Errors, err.Error())
+			continue
+		}
+
+		markReached(tpl, tpl.Name(), reached)
+
+		for _, t := range tpl.Templates() {
+			if t.Tree == nil {
+				continue
+			}
+			entry := t.Name() == tpl.Name()
+			if !entry && !isFileTemplate(t.Name(), inames) {
+				if _, ok := definedIn[t.Name()]; !ok {
+					definedIn[t.Name()] = parsedFilePath(t.Tree.ParseName, inames)
+				}
+			}
+
+			for _, tn := range templateRefs(t.Tree) {
+				if tpl.Lookup(tn.Name) == nil {
+					loc := nodeLocation(t.Tree, tn, inames)
+					res.Errors = append(res.Errors, fmt.Sprintf("%s: template %q is not defined", loc, tn.Name))
+				}
+			}
+
+			if values == nil || !entry {
+				continue
+			}
+			jobValues := withDefaults(values, job.defaults)
+			if page != nil {
+				pv, _ := r.pageValues(page, jobValues)
+				jobValues = pv.(map[string]interface{})
+			}
+			for _, ref := range valueRefs(t.Tree, true) {
+				if r.isMetadataRef(ref.Path) {
+					continue
+				}
+				if _, ok := lookupPath(jobValues, ref.Path); !ok {
+					loc := nodeLocation(t.Tree, ref.Node, inames)
+					res.Errors = append(res.Errors, fmt.Sprintf("%s: value .%s is not defined", loc, strings.Join(ref.Path, ".")))
+				}
+			}
+		}
+	}
+
+	unused := []string{}
+	for name := range definedIn {
+		if !reached[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	for _, name := range unused {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("%s: template %q is defined but never used", definedIn[name], name))
+		res.Unreachable = append(res.Unreachable, name)
+	}
+	return res, nil
+}
+
+// markReached marks name, and every template it invokes with `template` or
+// `include`, directly or not, as reached.
+func markReached(tpl *template.Template, name string, reached map[string]bool) {
+	queue := []string{name}
+	for len(queue) > 0 {
+		name, queue = queue[0], queue[1:]
+		t := tpl.Lookup(name)
+		if t == nil || t.Tree == nil {
+			continue
+		}
+		var calls []string
+		for _, tn := range templateRefs(t.Tree) {
+			calls = append(calls, tn.Name)
+		}
+		calls = append(calls, includeRefs(t.Tree)...)
+		for _, call := range calls {
+			if !reached[call] {
+				reached[call] = true
+				queue = append(queue, call)
+			}
+		}
+	}
+}
+
+// isFileTemplate reports whether name is the implicit template created for
+// one of the parsed files, rather than an explicit `define`.
+func isFileTemplate(name string, inames []string) bool {
+	for _, iname := range inames {
+		if filepath.Base(iname) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeLocation formats the position of n as "path:line:col", using the full
+// path of the file it was parsed from rather than the template name.
+func nodeLocation(t *parse.Tree, n parse.Node, inames []string) string {
+	loc, _ := t.ErrorContext(n)
+	if strings.HasPrefix(loc, t.ParseName+":") {
+		loc = parsedFilePath(t.ParseName, inames) + strings.TrimPrefix(loc, t.ParseName)
+	}
+	return loc
+}
+
+// parsedFilePath maps the name text/template gives a parsed file back to the
+// path it was parsed from.
+func parsedFilePath(name string, inames []string) string {
+	for _, iname := range inames {
+		if filepath.Base(iname) == name {
+			return iname
+		}
+	}
+	return name
+}
+
+// runLint prints the result of r.Check and returns the process exit code.
+// With strictUnused, templates that no input reaches fail it too.
+func runLint(r *Renderer, values map[string]interface{}, strictUnused bool) int {
+	res, err := r.Check(values)
+	if err != nil {
+		r.logf(LogError, "%v", err)
+		return 1
+	}
+	for _, w := range res.Warnings {
+		r.logf(LogWarn, "%s", w)
+	}
+	for _, e := range res.Errors {
+		r.logf(LogError, "%s", e)
+	}
+	if !res.OK() {
+		return 1
+	}
+	if strictUnused && len(res.Unreachable) > 0 {
+		r.logf(LogError, "%d template(s) are defined but never used", len(res.Unreachable))
+		return 1
+	}
+	r.logf(LogInfo, "Checked %d input(s), no errors found", len(r.Inputs))
+	return 0
+}
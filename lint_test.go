@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var lintTests = []struct {
+	name     string
+	template string
+	values   map[string]interface{}
+	strict   bool
+	code     int
+	logged   []string
+}{
+	{name: "ok", template: "{{ .name }}", values: map[string]interface{}{"name": "web"}, logged: []string{"no errors found"}},
+	{name: "parse-error", template: "{{ .name ", code: 1, logged: []string{"test.txt.tpl:1: unclosed action"}},
+	{name: "undefined-template", template: `{{ template "missing" . }}`, code: 1, logged: []string{`test.txt.tpl:1:12: template "missing" is not defined`}},
+	{name: "missing-value", template: "{{ .name }}:{{ .port }}", values: map[string]interface{}{"name": "web"}, code: 1, logged: []string{"test.txt.tpl:1:15: value .port is not defined"}},
+	{name: "values-unchecked", template: "{{ .port }}", logged: []string{"no errors found"}},
+	{name: "unused", template: `{{ define "x" }}{{ end }}{{ .name }}`, logged: []string{`template "x" is defined but never used`, "no errors found"}},
+	{name: "strict-unused", template: `{{ define "x" }}{{ end }}{{ .name }}`, strict: true, code: 1, logged: []string{`template "x" is defined but never used`, "1 template(s) are defined but never used"}},
+}
+
+func TestLint(t *testing.T) {
+	for _, test := range lintTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile("test.txt.tpl", []byte(test.template), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var logged logRecorder
+			r := &Renderer{Inputs: []string{"test.txt.tpl"}, Logger: &logged}
+			if code := runLint(r, test.values, test.strict); code != test.code {
+				t.Errorf("Exited with %d, expected %d", code, test.code)
+			}
+			if len(logged) != len(test.logged) {
+				t.Errorf("Logged %q, expected %d messages", logged, len(test.logged))
+			}
+			for _, msg := range test.logged {
+				if !strings.Contains(strings.Join(logged, "\n"), msg) {
+					t.Errorf("Missing message %q among %q", msg, logged)
+				}
+			}
+
+			// tpl lint exits with the same status
+			args := []string{"lint"}
+			for k, v := range test.values {
+				args = append(args, fmt.Sprintf("-value=%s=%v", k, v))
+			}
+			if test.strict {
+				args = append(args, "-strict-unused")
+			}
+			err = runTpl(os.Environ(), append(args, "test.txt.tpl")...)
+			if test.code == 0 && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			} else if test.code != 0 && (err == nil || !strings.Contains(err.Error(), fmt.Sprintf("exit status %d", test.code))) {
+				t.Errorf("Expected tpl %q to exit with %d, got %v", args, test.code, err)
+			}
+		})
+	}
+}
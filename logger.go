@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a logged message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogDebug || l > LogError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// Logger receives every message logged while rendering. Messages have no
+// trailing newline.
+type Logger interface {
+	Log(level LogLevel, msg string)
+}
+
+// levelLogger is a Logger that tells which levels it logs, so that messages
+// it would drop are not formatted in the first place.
+type levelLogger interface {
+	Enabled(level LogLevel) bool
+}
+
+// NewLogger returns a Logger that writes messages of at least level min to w,
+// as lines of text or, with format "json", as one JSON object per line.
+func NewLogger(w io.Writer, min LogLevel, format string) (Logger, error) {
+	switch format {
+	case "", "text":
+		return &textLogger{min: min, l: log.New(w, "", log.LstdFlags)}, nil
+	case "json":
+		return &jsonLogger{min: min, w: w}, nil
+	}
+	return nil, fmt.Errorf("Unknown log format %q; must be text or json", format)
+}
+
+// defaultLogger is used when no other Logger is given. It logs everything but
+// debug messages through the standard logger.
+var defaultLogger Logger = &textLogger{min: LogInfo}
+
+// textLogger writes messages through a log.Logger, or the standard logger if
+// l is nil, prefixing warnings and errors with their level.
+type textLogger struct {
+	min LogLevel
+	l   *log.Logger
+}
+
+func (t *textLogger) Enabled(level LogLevel) bool {
+	return level >= t.min
+}
+
+func (t *textLogger) Log(level LogLevel, msg string) {
+	if level < t.min {
+		return
+	}
+	switch level {
+	case LogWarn:
+		msg = "warning: " + msg
+	case LogError:
+		msg = "error: " + msg
+	}
+	if t.l == nil {
+		log.Print(msg)
+		return
+	}
+	t.l.Print(msg)
+}
+
+// jsonLogger writes each message as a JSON object with its time and level.
+type jsonLogger struct {
+	min LogLevel
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (j *jsonLogger) Enabled(level LogLevel) bool {
+	return level >= j.min
+}
+
+func (j *jsonLogger) Log(level LogLevel, msg string) {
+	if level < j.min {
+		return
+	}
+	line, err := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), level.String(), msg})
+	if err != nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.w.Write(append(line, '\n'))
+}
+
+// logf formats and logs a message to l, or to defaultLogger if l is nil.
+func logf(l Logger, level LogLevel, format string, args ...interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	if ll, ok := l.(levelLogger); ok && !ll.Enabled(level) {
+		return
+	}
+	l.Log(level, fmt.Sprintf(format, args...))
+}
+
+// fatalf logs an error to defaultLogger and exits.
+func fatalf(format string, args ...interface{}) {
+	logf(nil, LogError, format, args...)
+	os.Exit(1)
+}
+
+// logf logs a message to the Renderer's Logger.
+func (r *Renderer) logf(level LogLevel, format string, args ...interface{}) {
+	logf(r.Logger, level, format, args...)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MailMessage describes a MIME message that all outputs are assembled into:
+// an output named "headers" holds header lines, a .txt and an .html output
+// are the plain text and HTML alternatives of the body, and any other output
+// is attached.
+type MailMessage struct {
+	// Headers are added to those of the "headers" output, which take
+	// precedence.
+	Headers map[string]string
+}
+
+// mailAddressHeaders hold lists of addresses, whose display names are
+// encoded on their own.
+var mailAddressHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Reply-To": true, "Sender": true,
+}
+
+// mailAddress is the `mailAddress` template function, formatting a display
+// name and address for a From or To header, e.g.
+// `{{ mailAddress "Ops Team" "ops@example.com" }}`.
+func mailAddress(name, addr string) string {
+	return (&mail.Address{Name: name, Address: addr}).String()
+}
+
+// mailSink collects outputs in memory, and writes a single MIME message
+// assembled from them to dest when the run succeeds.
+type mailSink struct {
+	*memorySink
+	msg  MailMessage
+	dest string
+	fs   *fileSink
+	now  time.Time
+}
+
+func newMailSink(msg MailMessage, dest string, fs *fileSink) (*mailSink, error) {
+	if dest != "-" {
+		if err := fs.Check(dest); err != nil {
+			return nil, err
+		}
+	}
+	return &mailSink{memorySink: newMemorySink(), msg: msg, dest: dest, fs: fs, now: time.Now()}, nil
+}
+
+// mailPart is one leaf of the message.
+type mailPart struct {
+	header  textproto.MIMEHeader
+	content []byte
+}
+
+func textPart(contentType string, content []byte) (mailPart, error) {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return mailPart{}, err
+	}
+	if err := w.Close(); err != nil {
+		return mailPart{}, err
+	}
+	return mailPart{header: h, content: buf.Bytes()}, nil
+}
+
+func attachmentPart(name string, content []byte) mailPart {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	enc := base64.StdEncoding.EncodeToString(content)
+	var buf bytes.Buffer
+	for len(enc) > 76 {
+		buf.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	buf.WriteString(enc)
+	return mailPart{header: h, content: buf.Bytes()}
+}
+
+// writeMultipart writes parts as a multipart body of the given subtype,
+// returning its content type.
+func writeMultipart(w io.Writer, subtype string, parts []mailPart) (string, error) {
+	mw := multipart.NewWriter(w)
+	for _, p := range parts {
+		pw, err := mw.CreatePart(p.header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := pw.Write(p.content); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mw.Boundary()}), nil
+}
+
+// multipartPart nests parts as a single part of the given subtype.
+func multipartPart(subtype string, parts []mailPart) (mailPart, error) {
+	var buf bytes.Buffer
+	contentType, err := writeMultipart(&buf, subtype, parts)
+	if err != nil {
+		return mailPart{}, err
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	return mailPart{header: h, content: buf.Bytes()}, nil
+}
+
+// headers returns the headers of the message, encoded for the wire.
+func (s *mailSink) headers() (textproto.MIMEHeader, error) {
+	h := textproto.MIMEHeader{}
+	for k, v := range s.msg.Headers {
+		h.Set(k, v)
+	}
+	for _, name := range s.names() {
+		if path.Base(name) != "headers" {
+			continue
+		}
+		content := bytes.TrimRight(s.entries[name].content, "\r\n")
+		r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(content), strings.NewReader("\r\n\r\n"))))
+		parsed, err := r.ReadMIMEHeader()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse mail headers from %s: %v", name, err)
+		}
+		for k, vs := range parsed {
+			h[k] = vs
+		}
+	}
+
+	for k, vs := range h {
+		for i, v := range vs {
+			if !mailAddressHeaders[k] {
+				vs[i] = mime.QEncoding.Encode("utf-8", v)
+				continue
+			}
+			addrs, err := mail.ParseAddressList(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s mail header %q: %v", k, v, err)
+			}
+			formatted := make([]string, len(addrs))
+			for j, a := range addrs {
+				formatted[j] = a.String()
+			}
+			vs[i] = strings.Join(formatted, ", ")
+		}
+	}
+	if h.Get("Date") == "" {
+		h.Set("Date", s.now.Format(time.RFC1123Z))
+	}
+	h.Set("MIME-Version", "1.0")
+	return h, nil
+}
+
+// message assembles the MIME message: a multipart/mixed of the body and the
+// attachments, if there are any, where the body is a multipart/alternative
+// when there is both a plain text and an HTML version of it.
+func (s *mailSink) message() ([]byte, error) {
+	h, err := s.headers()
+	if err != nil {
+		return nil, err
+	}
+	var text, html string
+	var body, attachments []mailPart
+	for _, name := range s.names() {
+		content := s.entries[name].content
+		switch ext := strings.ToLower(path.Ext(name)); {
+		case path.Base(name) == "headers":
+			continue
+		case ext == ".txt" && text == "":
+			text = name
+			p, err := textPart("text/plain", content)
+			if err != nil {
+				return nil, err
+			}
+			body = append([]mailPart{p}, body...)
+		case (ext == ".html" || ext == ".htm") && html == "":
+			html = name
+			p, err := textPart("text/html", content)
+			if err != nil {
+				return nil, err
+			}
+			body = append(body, p)
+		default:
+			attachments = append(attachments, attachmentPart(path.Base(name), content))
+		}
+	}
+	if len(body) == 0 && len(attachments) == 0 {
+		return nil, fmt.Errorf("Cannot assemble a mail message without any outputs")
+	}
+
+	var root mailPart
+	switch {
+	case len(body) == 2:
+		if root, err = multipartPart("alternative", body); err != nil {
+			return nil, err
+		}
+	case len(body) == 1:
+		root = body[0]
+	}
+	if len(attachments) > 0 {
+		parts := attachments
+		if len(body) > 0 {
+			parts = append([]mailPart{root}, attachments...)
+		}
+		if root, err = multipartPart("mixed", parts); err != nil {
+			return nil, err
+		}
+	}
+	for k, vs := range root.header {
+		h[k] = vs
+	}
+
+	var buf bytes.Buffer
+	keys := make(stringSorter, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(root.content)
+	return buf.Bytes(), nil
+}
+
+func (s *mailSink) Close() error {
+	msg, err := s.message()
+	if err != nil {
+		return err
+	}
+	if s.dest == "-" {
+		_, err := os.Stdout.Write(msg)
+		return err
+	}
+	if err := s.fs.WriteFile(s.dest, msg, 0644); err != nil {
+		return err
+	}
+	return s.fs.Close()
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
 // Build information
@@ -15,104 +16,922 @@ var (
 	BuildVersion string
 )
 
+// commands are the subcommands that may be given as the first argument.
+// Without one, templates are rendered. A template named like a command is
+// rendered when given as ./name, or after an option or `--`.
+var commands = map[string]string{
+	"contract":   "check that -schema, published by the producer of the values, covers every value the templates use",
+	"daemon":     "keep rendering, with freshly loaded values, on -schedule and on SIGHUP",
+	"docs":       "generate a Markdown reference of values from -schema",
+	"entrypoint": "<templates...> -- <command> [args...]: render, then run the command with every signal passed on to it, as the entrypoint of a container",
+	"lint":       "parse and check templates without rendering anything",
+	"replay":     "BUNDLE: render the run recorded with -record again, into -out",
+	"manifest":   "merge SHARD_MANIFEST...: combine the manifests of the shards of a run into -manifest, checking that they do not overlap",
+	"plugins":    "list, or doctor: list the plugins of -plugin and -plugin-dir, or check that each speaks the plugin protocol of this tpl",
+	"refactor":   "rename-value .old .new: move a value in -values and -schema, and rewrite the templates that use it; extract FILE START-END NAME: move lines into a named template",
+	"rollback":   "undo the last run recorded in -manifest, restoring the outputs it changed from their backups",
+	"run":        "render the named targets of -config, or all of them",
+	"service":    "install, uninstall, or print: manage the launchd agent of the user, -service-label, running the daemon command with the other options",
+	"stats":      "report how templates use functions, values, and named templates, and how complex each file is",
+	"test":       "render templates per test case and compare with golden files",
+	"values":     "print the merged values without rendering anything",
+	"verify":     "check the outputs recorded in -manifest for changes since they were rendered",
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "%s v%s built %s\n\n", os.Args[0], BuildVersion, BuildDate)
 	fmt.Fprintf(os.Stderr, "Usage:\n")
-	fmt.Fprintf(os.Stderr, "  %s [options...] <templates...>\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [command] [options...] <templates...>\n\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "where <templates...> may be one or more template files or directories.")
 	fmt.Fprintf(os.Stderr, "Directories are processed only single depth.")
 	fmt.Fprintf(os.Stderr, "")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	names := make(stringSorter, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name])
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "A first argument naming a command always runs it. To render a template of\n")
+	fmt.Fprintf(os.Stderr, "the same name, give it as ./name, or after an option or --.\n")
+	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "Options:\n")
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\n")
 }
 
 func main() {
-	dataFile := flag.String("values", "", "Comma-separated paths to YAML files containing values (only top-level keys are merged)")
+	command := ""
+	args := os.Args[1:]
+	shadowed := false
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			command, args = args[0], args[1:]
+			_, err := os.Lstat(command)
+			shadowed = err == nil
+		}
+	}
+
+	dataFile := flag.String("values", "", "Comma-separated paths to YAML files or secrets (vault://, awssm://, gcpsm://) containing values (only top-level keys are merged); end one in @.PATH to merge its keys at PATH instead, or in ?optional to go on without it when it fails to load")
 	execMapFile := flag.String("exec-map-file", "", "File from which exec rules can be read")
+	allowExec := flag.Bool("allow-exec", false, "Enable the exec and shell template functions; with -exec-map-file, only whitelisted commands may run")
+	allowQRCode := flag.Bool("allow-qrcode", false, "Enable the qrcode and barcode template functions, and qrcodeFile and barcodeFile")
 	onError := flag.String("on-error", "die", "What to do on render error: die, ignore")
+	allowNoValue := flag.Bool("allow-no-value", false, "Do not fail outputs containing \"<no value>\" when -on-error=die")
+	warnMissing := flag.Bool("warn-missing", false, "With -on-error=ignore, warn about each missing value rendered as a zero value")
 	outFile := flag.String("out", "-", "Output file (or '-' for STDOUT)")
+	transactional := flag.Bool("transactional", false, "Write outputs only once every template rendered successfully")
+	writeRetries := flag.Int("write-retries", 0, "Retry each write of an output that fails this many times, waiting longer each time, before failing it")
+	retryBackoff := flag.Duration("retry-backoff", DefaultRetryBackoff, "How long the first -write-retries retry waits, doubling with each retry after it")
+	strictUnused := flag.Bool("strict-unused", false, "Fail the lint command when a named template is defined but never used by any input")
+	dryRun := flag.Bool("dry-run", false, "Render and validate outputs, but only log what would be written")
+	emitPatch := flag.Bool("emit-patch", false, "Write a unified diff of the changes to outputs to STDOUT, rather than the outputs")
+	shard := flag.String("shard", "", "Render only the K-th of N disjoint shards of the outputs, as K/N, e.g. 3/8")
+	manifestFile := flag.String("manifest", "", "Record what each output was rendered from and holds in this file, and skip outputs that are up to date; the file checked by the verify command")
+	force := flag.Bool("force", false, "Render every output, even if the -manifest says it is up to date")
+	outIsDir := flag.Bool("out-is-dir", false, "Treat -out as a directory, even if it does not exist yet")
+	rootDir := flag.String("root", "", "Confine all file reads and writes to this directory")
+	schemaFile := flag.String("schema", "", "JSON Schema file the merged values must satisfy")
+	configFile := flag.String("config", DefaultConfigFile, "Config file of render targets, for the run command")
+	testsDir := flag.String("tests", "tests", "Directory of golden-file test cases, for the test command")
+	valuesFormat := flag.String("values-format", "yaml", "Format the values command prints values in: yaml, json")
+	showSources := flag.Bool("show-sources", false, "Show which source set each top-level key, for the values command")
+	updateGolden := flag.Bool("update", false, "Regenerate golden files instead of comparing, for the test command")
+	copyNonTemplates := flag.Bool("copy-non-templates", false, "Copy files in input directories without a .tpl or .tmpl extension verbatim")
+	extensions := make(stringSliceFlag, 0)
+	flag.Var(&extensions, "ext", "Template extension stripped from output names, replacing the default .tpl and .tmpl; may be repeated")
+	extensionMap := make(valueMapFlag)
+	flag.Var(&extensionMap, "ext-map", "Rewrite the end of output names in the form of from=to, e.g. .yaml.tpl=.yml")
+	prompt := flag.Bool("prompt", false, "Ask on the terminal for values passed to the required template function that are missing")
+	indexFile := flag.String("index", "", "Template rendered into the output directory after every other output, with the list of outputs in ."+DefaultBuiltinsKey+".Outputs")
+	layout := flag.String("layout", "", "Render .md inputs as pages of a static site, into .html outputs, with this template as their layout")
+	leftDelim := flag.String("left-delim", "", "Left delimiter of template actions (default \"{{\")")
+	rightDelim := flag.String("right-delim", "", "Right delimiter of template actions (default \"}}\")")
+	merge := flag.Bool("merge", false, "Deep-merge the JSON or YAML rendered by templates sharing an output into one document, instead of concatenating them")
+	addHeader := flag.Bool("header", false, "Prepend a generated-file banner to each output, as a comment")
+	headerText := flag.String("header-text", DefaultHeader, "Template of the banner added by -header")
+	legacyBuiltins := flag.Bool("legacy-builtins", false, "Inject builtins such as .Tpl at the top level of the values, as before, rather than under ."+DefaultBuiltinsKey)
+	omitBuiltins := flag.String("omit-builtins", "", "Comma-separated builtins not to inject ("+strings.Join(builtinNames, ", ")+")")
+	strictKeys := flag.Bool("strict-keys", false, "Fail when a value takes the place of a builtin, or two values sources mounted at the same path set the same key, rather than letting one win")
+	outputFormat := flag.String("output-format", "", "Rewrite rendered KEY=VALUE lines into a quoted dotenv file or shell script: env, export")
+	lineEndings := flag.String("eol", "", "Convert the line endings of rendered outputs: lf, crlf")
+	trimTrailingSpace := flag.Bool("trim-trailing-space", false, "Strip trailing spaces and tabs from each line of rendered outputs")
+	finalNewline := flag.Bool("final-newline", false, "End rendered outputs with exactly one newline")
+	binaryFiles := flag.String("binary-files", "copy", "What to do with binary files in input directories: copy, skip, render")
+	symlinks := flag.String("symlinks", "follow", "What to do with symlinks in input directories: follow, skip, preserve")
+	skipUnreadable := flag.Bool("skip-unreadable", false, "Log and skip files in input directories that cannot be read for lack of permission")
+	dirDefaults := flag.Bool("dir-defaults", false, "Load defaults.yaml and values.yaml in input directories as lowest-precedence values")
+	deprecationsFile := flag.String("deprecations", "", "YAML file listing deprecated value paths")
+	strictDeprecations := flag.Bool("strict-deprecations", false, "Fail, instead of warning, when deprecated values are used")
+	transformsFile := flag.String("transforms", "", "YAML file listing transformations (rename, compute, drop, keep) applied to the merged values before rendering")
+	derivations := make(stringSliceFlag, 0)
+	flag.Var(&derivations, "derive", "Value derived from others after -transforms, in the form of PATH: EXPR, e.g. 'fullName: svc + \"-\" + env'; may be repeated")
+	keepWorkspace := flag.Bool("keep-workspace", false, "Keep the directory of intermediate files at the end of the run, for debugging")
+	reportFormat := flag.String("report", "", "Write a report of every input and output at the end of the run, in this format: json")
+	reportFile := flag.String("report-file", "", "File to write the -report to, or '-' for STDOUT (default STDERR)")
+	quiet := flag.Bool("quiet", false, "Only log warnings and errors")
+	verbose := flag.Bool("verbose", false, "Also log debugging messages")
+	logFormat := flag.String("log-format", "text", "Format of log messages on STDERR: text, json")
+	showStats := flag.Bool("stats", false, "Print timing and usage statistics at the end of the run")
+	profileFormat := flag.String("profile-templates", "", "Print the time spent in every named template at the end of the run, as: tree, folded (stacks for flame graph tools)")
+	profileFile := flag.String("profile-file", "", "File to write the -profile-templates to, or '-' for STDOUT (default STDERR)")
+	maxIncludeDepth := flag.Int("max-include-depth", DefaultMaxIncludeDepth, "How deeply '!include' directives in values files may nest")
+
+	maxInputSize := sizeFlag(10 << 20)
+	flag.Var(&maxInputSize, "max-input-size", "Largest template that may be rendered, e.g. 512K or 10M; 0 for no limit")
+
+	sandbox := flag.Bool("sandbox", false, "Render untrusted templates, without functions that read files or run commands, and within -root")
+	renderTimeout := flag.Duration("render-timeout", 0, "Longest each template may execute for, e.g. 5s; 0 for no limit, or 10s with -sandbox")
+	maxOutputSize := sizeFlag(0)
+	flag.Var(&maxOutputSize, "max-output-size", "Largest output a template may render, e.g. 512K or 10M; 0 for no limit, or 10M with -sandbox")
+
+	var backupSuffix backupFlag
+	flag.Var(&backupSuffix, "backup", "Save overwritten outputs with this suffix appended (default "+DefaultBackupSuffix+" when given without a value)")
+	backupDir := flag.String("backup-dir", "", "Save overwritten outputs under a timestamped directory inside this one")
+
+	pipeCmds := make(stringSliceFlag, 0)
+	flag.Var(&pipeCmds, "pipe", "Command to feed each rendered output through with sh -c, e.g. 'jq .', or only those with an extension, e.g. '.go=gofmt'; may be repeated")
+
+	onChange := make(stringSliceFlag, 0)
+	flag.Var(&onChange, "onchange", "Command to run with sh -c at the end of the run, if any output file changed")
+	schedule := flag.String("schedule", "", "Cron expression, e.g. '0 */6 * * *' or @hourly, on which the daemon command renders again")
+	breakerThreshold := flag.Int("breaker", 0, "With the daemon command, keep templates that fail from failing the run, and leave one out of runs once it failed this many in a row, keeping its last output")
+	breakerBackoff := flag.Duration("breaker-backoff", DefaultBreakerBackoff, "How long -breaker leaves a template out before trying it again, doubling each time it still fails")
+	cacheTTL := flag.Duration("cache-ttl", 0, "How long secrets are kept across runs of the daemon command, and with -cache-dir across invocations, before being fetched again; 0 to fetch them every run")
+	cacheStale := flag.Duration("cache-stale", 0, "How long after -cache-ttl an expired secret is still used, while it is fetched again in the background")
+	cacheDir := flag.String("cache-dir", "", "Directory in which -cache-ttl keeps secrets on disk, readable only by the current user")
+	historySize := flag.Int("history", DefaultDaemonHistory, "How many runs the daemon command keeps, with the outputs they rendered, to compare any two of them")
+	requireValid := flag.Bool("require-valid", false, "With the entrypoint command, only start the command once every output was rendered and validated, none left stale or missing; with the daemon command, fail health checks until then")
+	var waitFor stringSliceFlag
+	flag.Var(&waitFor, "wait-for", "Before rendering, wait until the values sources of this scheme, e.g. vault, can be loaded, or a tcp://HOST:PORT or http(s):// URL responds; may be repeated")
+	waitTimeout := flag.Duration("wait-timeout", DefaultWaitTimeout, "How long -wait-for waits before giving up")
+	recordFile := flag.String("record", "", "Record the templates, values, environment, and version of tpl of the run into this .tgz bundle, for the replay command")
+	recordSecrets := flag.String("record-secrets", "tokenize", "What -record does with values from secret managers, and environment variables named like secrets: tokenize, keep")
+	nowFlag := flag.String("now", "", "Render as if at this time, in RFC 3339, e.g. 2024-05-01T12:00:00Z, instead of now")
+	hostnameFlag := flag.String("hostname", "", "Render as if on the host of this name")
+	every := flag.Duration("every", 0, "Keep rendering, with freshly loaded values, about this often, e.g. 5m, until SIGINT or SIGTERM")
+	jitter := flag.Float64("jitter", DefaultJitter, "Fraction of -every by which every wait is made shorter or longer at random")
+	lockFile := flag.String("lock-file", "", "Hold a lock on this file while rendering, skipping runs while another run holds it (default one per -out with -every)")
+	serviceLabel := flag.String("service-label", DefaultServiceLabel, "Label of the launchd agent managed by the service command")
+	windowsService := flag.String("windows-service", "", "Run the daemon command as the Windows service of this name, logging to the Application event log under it")
+	listenAddr := flag.String("listen", "", "Address on which the daemon command serves a status page at /, its status as JSON at /api/status, and health checks at /healthz, e.g. :8080")
+	gitMessage := flag.String("git-commit", "", "Commit the output files that changed into their git repository, with this message")
+	gitBranch := flag.String("git-branch", "", "With -git-commit, commit onto this new branch")
+	gitPush := flag.Bool("git-push", false, "With -git-commit, push the commit to origin")
+	gitPullRequest := flag.String("git-pull-request", "", "With -git-commit and -git-branch, push the branch and open a pull request from it on this forge: github, gitlab")
+
+	assetRoot := flag.String("asset-root", ".", "Directory of the static files fingerprinted by the assetHash and assetURL template functions")
+	assetURL := flag.String("asset-url", "/", "URL under which assetURL references the -asset-root")
+	copyAssets := flag.String("copy-assets", "", "Copy the assets referenced with assetURL into this directory, under their fingerprinted names")
+
+	readRoots := make(stringSliceFlag, 0)
+	flag.Var(&readRoots, "read-root", "Directory the readFile and includeFile template functions may read from (default: the current directory)")
+
+	plugins := make(pluginSet)
+	flag.Var(plugins, "plugin", "Register a helper binary for the plugin template function, in the form of name=path; may be repeated")
+	pluginDirName := flag.String("plugin-dir", "", "Directory of plugins providing template functions, values sources, and output sinks")
+	pluginTimeoutFlag := flag.Duration("plugin-timeout", DefaultPluginTimeout, "Longest each call of a plugin may take before it is killed; 0 for no limit")
+
+	mapFlags := make(stringSliceFlag, 0)
+	flag.Var(&mapFlags, "map", "Render a template into its own output, in the form of input=output, e.g. nginx.conf.tpl=/etc/nginx/nginx.conf; may be repeated")
 
 	preloadFiles := make(stringSliceFlag, 0)
 	flag.Var(&preloadFiles, "preload", "Additional files to preload")
 
+	validateNames := make(stringSliceFlag, 0)
+	flag.Var(&validateNames, "validate", "Check the syntax of outputs with a built-in validator before writing (json, yaml)")
+
+	validateCmds := make(stringSliceFlag, 0)
+	flag.Var(&validateCmds, "validate-cmd", "Command to validate each output before writing; {} is replaced by a file holding the output")
+
+	regoFiles := make(stringSliceFlag, 0)
+	flag.Var(&regoFiles, "rego", "Rego policy file evaluated with the opa CLI against each JSON or YAML output before writing; may be repeated")
+	regoQuery := flag.String("rego-query", DefaultRegoQuery, "Rule of the -rego policies holding the set of violation messages")
+
+	locale := flag.String("locale", "", "Locale of the -catalog messages, e.g. fr or pt_BR, which decides their plural rule")
+	catalogFiles := make(stringSliceFlag, 0)
+	flag.Var(&catalogFiles, "catalog", "Gettext .po or JSON file of messages for the t template function; may be repeated")
+
+	scanNames := make(stringSliceFlag, 0)
+	flag.Var(&scanNames, "scan", "Scan outputs with a built-in scanner before writing (secrets)")
+	scanAction := flag.String("scan-action", "block", "What to do when -scan finds something: block, warn")
+
+	fileMode := fileModeFlag(0644)
+	flag.Var(&fileMode, "mode", "Permissions of output files, before the umask is applied")
+	dirMode := fileModeFlag(0755)
+	flag.Var(&dirMode, "dir-mode", "Permissions of created output directories, before the umask is applied")
+	preserveMode := flag.Bool("preserve-mode", false, "Give each output the permissions of its template, instead of -mode")
+	ownerSpec := flag.String("owner", "", "Give outputs and created directories this USER[:GROUP], and their exact permissions")
+	syncDirs := flag.Bool("sync", false, "Sync the directories outputs were written into to disk at the end of the run")
+
+	packKind := flag.String("pack", "", "Pack all outputs into one Kubernetes manifest written to -out: configmap, secret")
+	packName := flag.String("pack-name", "", "Name of the packed ConfigMap or Secret")
+	packNamespace := flag.String("pack-namespace", "", "Namespace of the packed ConfigMap or Secret")
+	packLabels := make(valueMapFlag)
+	flag.Var(&packLabels, "pack-label", "Label of the packed ConfigMap or Secret in the form of key=value")
+
+	assembleMail := flag.Bool("mail", false, "Assemble all outputs into one MIME message written to -out")
+	mailHeaders := make(valueMapFlag)
+	flag.Var(&mailHeaders, "mail-header", "Header of the -mail message in the form of name=value")
+
 	valueMap := make(valueMapFlag)
 	flag.Var(&valueMap, "value", "Additional values to inject in the form of key=value")
 
 	// Parse command line flags
 	flag.Usage = usage
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+
+	level := LogInfo
+	if *quiet {
+		level = LogWarn
+	}
+	if *verbose {
+		level = LogDebug
+	}
+	logger, err := NewLogger(os.Stderr, level, *logFormat)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *windowsService != "" {
+		if command != "daemon" {
+			fatalf("-windows-service only applies to the daemon command")
+		}
+		if logger, err = newEventLogger(*windowsService, level); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	defaultLogger = logger
+	if shadowed {
+		logf(nil, LogWarn, "Running the %s command rather than rendering the file of that name; give it as ./%s to render it", command, command)
+	}
+
+	if command == "replay" {
+		if len(flag.Args()) != 1 {
+			fatalf("Usage: replay [options...] <bundle>")
+		}
+		ws := NewWorkspace(*keepWorkspace)
+		code := runReplay(ws, flag.Arg(0), *outFile, passedFlags("out", "keep-workspace"))
+		if err := ws.Close(); err != nil {
+			logf(nil, LogError, "%v", err)
+		}
+		os.Exit(code)
+	}
+
+	if command == "run" {
+		os.Exit(runTargets(*configFile, flag.Args(), passedFlags("config"), *dryRun))
+	}
+
+	if command == "verify" {
+		os.Exit(runVerify(*manifestFile, flag.Args()))
+	}
+
+	if command == "service" {
+		os.Exit(runService(*serviceLabel, flag.Args(), passedFlags("service-label")))
+	}
+
+	if command == "manifest" {
+		os.Exit(runManifest(*manifestFile, flag.Args()))
+	}
+
+	if command == "rollback" {
+		os.Exit(runRollback(*manifestFile, *force))
+	}
+
+	if command == "docs" {
+		os.Exit(runDocs(*schemaFile, *outFile))
+	}
 
 	dataFiles := []string{}
 	if *dataFile != "" {
 		dataFiles = strings.Split(*dataFile, ",")
 	}
 
-	allValues := make(Values)
-	for _, fname := range dataFiles {
-		if err := allValues.LoadFile(fname); err != nil {
-			log.Fatal(err)
-		}
+	policy, err := loadPolicyFromEnv()
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	jail, err := newPathJail(*rootDir)
+	if err != nil {
+		fatalf("%v", err)
 	}
 
-	if len(valueMap) > 0 {
-		log.Printf("Loading values from command line\n")
-		for km, vm := range valueMap {
-			allValues[km] = vm
+	var stats *RenderStats
+	if *showStats {
+		stats = NewRenderStats()
+	}
+
+	builtinsKey := DefaultBuiltinsKey
+	if *legacyBuiltins {
+		builtinsKey = ""
+	}
+	var omitted []string
+	if *omitBuiltins != "" {
+		for _, name := range strings.Split(*omitBuiltins, ",") {
+			if !isBuiltinName(name) {
+				fatalf("Unknown builtin %q in -omit-builtins; must be one of %s", name, strings.Join(builtinNames, ", "))
+			}
+			omitted = append(omitted, name)
 		}
 	}
 
-	if flag.NArg() < 1 {
-		usage()
-		log.Fatalln("At least one <template> path is required.")
+	if *pluginDirName != "" || len(plugins) > 0 {
+		if *sandbox {
+			fatalf("-sandbox cannot be used with -plugin or -plugin-dir")
+		}
+		if err := policy.CheckPlugins(); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	pluginTimeout = *pluginTimeoutFlag
+	discovered, err := discoverPlugins(*pluginDirName)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if command == "plugins" {
+		os.Exit(runPlugins(flag.Args(), plugins, *pluginDirName, discovered))
+	}
+	for name, path := range discovered.Funcs {
+		if _, ok := plugins[name]; !ok {
+			plugins[name] = path
+		}
 	}
 
-	fm := funcMap()
-	fm["exec"] = func(name string, args ...string) string {
-		log.Fatalf("the 'exec' template function is disabled; you must specify -exec-map-file=FILE to enable it")
-		return ""
+	loader := newValuesLoader(*maxIncludeDepth, jail)
+	loader.plugins = discovered.Sources
+	loader.strictKeys = *strictKeys
+	loader.stats = stats
+	loader.secrets = newSecretStore(policy)
+	loader.secrets.ttl, loader.secrets.stale = *cacheTTL, *cacheStale
+	loader.secrets.dir, loader.secrets.logger = *cacheDir, logger
+	loader.logger = logger
+	loader.extVars = valueMap
+	if command == "daemon" {
+		loader.health = newSourceHealth()
+	}
+	var transforms []transformStep
+	if *transformsFile != "" {
+		if transforms, err = loadTransforms(*transformsFile); err != nil {
+			fatalf("%v", err)
+		}
 	}
-	if *execMapFile != "" {
-		exmap, err := loadExecMap(*execMapFile)
+	for _, d := range derivations {
+		step, err := parseDerivation(d)
 		if err != nil {
-			log.Fatal(err)
+			fatalf("%v", err)
 		}
-		// log.Printf("%+v\n", exmap)
-		fm["exec"] = func(name string, args ...string) string {
-			exset, err := exmap.Get(name)
+		transforms = append(transforms, step)
+	}
+	loadValues := func() (Values, error) {
+		loader.secrets.reset()
+		loader.mounted = nil
+		values := make(Values)
+		for _, fname := range dataFiles {
+			ref, opts, err := splitSourceOptions(fname)
 			if err != nil {
-				log.Printf("could not exec %q %v: %v", name, args, err)
-				return ""
+				return nil, err
 			}
-			var stdin io.Reader
-			if exset.Stdin {
-				stdin = strings.NewReader(args[len(args)-1])
-				args = args[:len(args)-1]
+			for _, src := range []string{ref, opts.Fallback} {
+				if src == "" || src == "skip" || src == "cache" {
+					continue
+				}
+				scheme, _ := splitScheme(src)
+				if err := policy.CheckScheme(scheme); err != nil {
+					return nil, err
+				}
 			}
-			stdout, stderr, err := exset.Run(args, stdin)
-			if stderr != "" {
-				log.Printf("exec %q %v, STDERR output was: %s", name, args, stderr)
+			if err := loader.LoadInto(values, fname); err != nil {
+				return nil, err
 			}
-			if err != nil {
-				log.Printf("exec %q %v failed with error: %v", name, args, err)
-				return ""
+		}
+
+		if len(valueMap) > 0 {
+			logf(nil, LogInfo, "Loading values from command line")
+			for km, vm := range valueMap {
+				values[km] = vm
+				loader.sources[km] = "-value"
 			}
-			if exset.Stdout {
-				return stdout
+		}
+		if err := values.transform(transforms, loader.sources); err != nil {
+			return nil, err
+		}
+		if *strictKeys {
+			if err := checkReservedKeys(values, reservedKeys(builtinsKey, omitted), loader.sources); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	var allValues Values
+	waitSchemes, waitDeps, err := splitWaits(waitFor)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkWaitSchemes(waitSchemes, dataFiles); err != nil {
+		fatalf("%v", err)
+	}
+	waitDeadline := time.Now().Add(*waitTimeout)
+	if err := waitForDependencies(waitDeps, waitDeadline, *waitTimeout); err != nil {
+		fatalf("%v", err)
+	}
+	if len(waitSchemes) > 0 {
+		allValues, err = waitForValues(loadValues, waitSchemes, waitDeadline, *waitTimeout)
+	} else {
+		allValues, err = loadValues()
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	if command == "values" {
+		os.Exit(runValues(allValues, loader.sources, *valuesFormat, *showSources, *outFile))
+	}
+
+	mappings := []OutputMapping{}
+	for _, m := range mapFlags {
+		mapping, err := parseOutputMapping(m)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	inputs := flag.Args()
+	var refactor, app []string
+	if command == "refactor" {
+		if refactor, inputs, err = splitRefactorArgs(inputs); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if command == "entrypoint" {
+		if inputs, app, err = splitEntrypointArgs(inputs, os.Args); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	if len(inputs) < 1 && len(mappings) == 0 {
+		usage()
+		fatalf("At least one <template> path is required.")
+	}
+
+	fm := funcMap()
+	fm["secret"] = loader.secrets.Func
+	reader, err := newFileReader(readRoots, jail)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var msgs *catalog
+	if len(catalogFiles) > 0 {
+		if msgs, err = newCatalog(*locale); err != nil {
+			fatalf("%v", err)
+		}
+		msgs.logger = logger
+		for _, fname := range catalogFiles {
+			if err := msgs.Load(fname); err != nil {
+				fatalf("%v", err)
 			}
-			if exset.Stderr {
-				return stderr
+		}
+	}
+	fm["t"] = msgs.T
+	// The default -asset-root need not be within -root, unless assets are
+	// used
+	if flagPassed("asset-root") {
+		if err := jail.Check(*assetRoot); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	assets, err := NewAssetStore(*assetRoot, *assetURL)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	assets.limit = jail
+	assets.CopyDir = *copyAssets
+	fm["assetHash"] = assets.Hash
+	fm["assetURL"] = assets.URL
+	fm["readFile"] = reader.ReadFile
+	fm["includeFile"] = reader.IncludeFile
+	fm["exec"] = func(name string, args ...string) (string, error) {
+		return "", errors.New("The 'exec' template function is disabled; you must specify -allow-exec or -exec-map-file=FILE to enable it")
+	}
+	fm["shell"] = func(script string) (string, error) {
+		return "", errors.New("The 'shell' template function is disabled; you must specify -allow-exec or -exec-map-file=FILE to enable it")
+	}
+	if *sandbox && (*execMapFile != "" || *allowExec) {
+		fatalf("-sandbox cannot be used with -allow-exec or -exec-map-file")
+	}
+	if *execMapFile != "" || *allowExec {
+		exmap := &execMap{allowAll: true}
+		if *execMapFile != "" {
+			if exmap, err = loadExecMap(*execMapFile); err != nil {
+				fatalf("%v", err)
 			}
-			return ""
 		}
+		exmap.logger = logger
+		fm["exec"] = exmap.Func
+		fm["shell"] = exmap.Shell
+	}
+	fm["plugin"] = plugins.Func
+	if *allowQRCode {
+		fm["barcode"] = barcode
+		fm["barcodeFile"] = sideFileFunc(barcodePNG)
+		fm["qrcode"] = qrcode
+		fm["qrcodeFile"] = sideFileFunc(qrcodePNG)
+	}
+	var schema *Schema
+	if *schemaFile != "" {
+		if schema, err = loadSchema(*schemaFile); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	var cron *cronSchedule
+	if *schedule != "" {
+		if command != "daemon" {
+			fatalf("-schedule requires the daemon command")
+		}
+		if cron, err = parseCron(*schedule); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	var breaker *circuitBreaker
+	if *breakerThreshold > 0 {
+		if command != "daemon" {
+			fatalf("-breaker requires the daemon command")
+		}
+		breaker = newCircuitBreaker(*breakerThreshold, *breakerBackoff, logger)
+	}
+
+	ws := NewWorkspace(*keepWorkspace)
+	if command != "daemon" && command != "entrypoint" && *every == 0 {
+		// The daemon and -every stop on their own, once the current run is
+		// done, and the entrypoint passes signals on to its app
+		ws.CloseOnSignal()
 	}
+
+	// fail logs an error and exits, like fatalf, once the workspace is gone
+	fail := func(format string, args ...interface{}) {
+		if err := ws.Close(); err != nil {
+			logf(nil, LogError, "%v", err)
+		}
+		fatalf(format, args...)
+	}
+
+	validators := []Validator{}
+	for _, name := range validateNames {
+		v, err := builtinValidator(name)
+		if err != nil {
+			fail("%v", err)
+		}
+		validators = append(validators, v)
+	}
+	for _, cmdline := range validateCmds {
+		v, err := commandValidator(cmdline, ws)
+		if err != nil {
+			fail("%v", err)
+		}
+		validators = append(validators, v)
+	}
+
+	if len(regoFiles) > 0 {
+		v, err := regoValidator(regoFiles, *regoQuery, ws)
+		if err != nil {
+			fail("%v", err)
+		}
+		validators = append(validators, v)
+	}
+
+	if *requireValid && len(validators) == 0 {
+		logf(nil, LogWarn, "With -require-valid but no -validate, -validate-cmd, or -rego, outputs are only required to be rendered")
+	}
+
+	pipes := []Pipe{}
+	for _, cmd := range pipeCmds {
+		p, err := parsePipe(cmd)
+		if err != nil {
+			fail("%v", err)
+		}
+		pipes = append(pipes, p)
+	}
+
+	scanners := []Scanner{}
+	for _, name := range scanNames {
+		s, err := builtinScanner(name)
+		if err != nil {
+			fail("%v", err)
+		}
+		scanners = append(scanners, s)
+	}
+	switch *scanAction {
+	case "block", "warn":
+	default:
+		fail("Unknown -scan-action %q; must be block or warn", *scanAction)
+	}
+
+	deprecations := []Deprecation{}
+	if schema != nil {
+		deprecations = append(deprecations, schema.Deprecations()...)
+	}
+	if *deprecationsFile != "" {
+		deps, err := loadDeprecations(*deprecationsFile)
+		if err != nil {
+			fail("%v", err)
+		}
+		deprecations = append(deprecations, deps...)
+	}
+
+	switch *binaryFiles {
+	case "copy", "skip", "render":
+	default:
+		fail("Unknown -binary-files action %q; must be copy, skip, or render", *binaryFiles)
+	}
+
+	switch *outputFormat {
+	case "", "env", "export":
+	default:
+		fail("Unknown -output-format %q; must be env or export", *outputFormat)
+	}
+
+	switch *lineEndings {
+	case "", "lf", "crlf":
+	default:
+		fail("Unknown -eol %q; must be lf or crlf", *lineEndings)
+	}
+
+	switch *symlinks {
+	case "follow", "skip", "preserve":
+	default:
+		fail("Unknown -symlinks action %q; must be follow, skip, or preserve", *symlinks)
+	}
+
+	if *every != 0 && (command != "" || *every < 0) {
+		fail("-every takes a positive interval, and only works when rendering")
+	}
+	if *jitter < 0 || *jitter >= 1 {
+		fail("-jitter must be at least 0, and less than 1")
+	}
+	if *recordFile != "" && (command != "" || *every != 0) {
+		fail("-record only works when rendering once")
+	}
+	switch *recordSecrets {
+	case "tokenize", "keep":
+	default:
+		fail("Unknown -record-secrets %q; must be tokenize or keep", *recordSecrets)
+	}
+	var now time.Time
+	if *nowFlag != "" {
+		if now, err = time.Parse(time.RFC3339Nano, *nowFlag); err != nil {
+			fail("Invalid -now: %v", err)
+		}
+	}
+
+	var owner *FileOwner
+	if *ownerSpec != "" {
+		if owner, err = parseOwner(*ownerSpec); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	shardIndex, shardCount := 0, 0
+	if *shard != "" {
+		if shardIndex, shardCount, err = parseShard(*shard); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	var profile *TemplateProfile
+	switch *profileFormat {
+	case "":
+	case "tree", "folded":
+		profile = NewTemplateProfile()
+	default:
+		fail("Unknown -profile-templates format %q; must be tree or folded", *profileFormat)
+	}
+
+	var report *RunReport
+	switch *reportFormat {
+	case "":
+	case "json":
+		report = &RunReport{}
+	default:
+		fail("Unknown -report format %q; must be json", *reportFormat)
+	}
+
+	header := ""
+	if *addHeader {
+		header = *headerText
+	}
+	if builtinsKey == "" && header == DefaultHeader {
+		// The default banner finds the metadata where it was before too
+		header = strings.Replace(header, "."+DefaultBuiltinsKey+".", ".", -1)
+	}
+
+	var pack *KubePack
+	switch *packKind {
+	case "":
+	case "configmap", "secret":
+		pack = &KubePack{
+			Kind:      map[string]string{"configmap": "ConfigMap", "secret": "Secret"}[*packKind],
+			Name:      *packName,
+			Namespace: *packNamespace,
+			Labels:    packLabels,
+		}
+	default:
+		fail("Unknown -pack kind %q; must be configmap or secret", *packKind)
+	}
+
+	var msg *MailMessage
+	if *assembleMail {
+		if pack != nil {
+			fail("-mail and -pack cannot be used together")
+		}
+		msg = &MailMessage{Headers: mailHeaders}
+	}
+
+	var gitCommit *GitCommit
+	if *gitMessage != "" {
+		gitCommit = &GitCommit{Message: *gitMessage, Branch: *gitBranch, Push: *gitPush, PullRequest: *gitPullRequest}
+	} else if *gitBranch != "" || *gitPush || *gitPullRequest != "" {
+		fail("-git-branch, -git-push, and -git-pull-request require -git-commit")
+	}
+	switch *gitPullRequest {
+	case "", "github", "gitlab":
+	default:
+		fail("Unknown -git-pull-request forge %q; must be github or gitlab", *gitPullRequest)
+	}
+	if *gitPullRequest != "" && *gitBranch == "" {
+		fail("-git-pull-request requires -git-branch")
+	}
+
 	r := &Renderer{
 		FuncMap:      fm,
-		Inputs:       flag.Args(),
+		Inputs:       inputs,
+		Mappings:     mappings,
 		PreloadFiles: preloadFiles,
 		StopOnError:  (*onError != "ignore"),
+		WarnMissing:  *warnMissing,
+		AllowNoValue: *allowNoValue,
+		SkipMissing:  skipsMissing(dataFiles),
+		Policy:       policy,
+		Root:         *rootDir,
+		Schema:       schema,
+		Catalog:      msgs,
+		BuiltinsKey:  builtinsKey,
+		OmitBuiltins: omitted,
+		DirDefaults:  *dirDefaults,
+		Validators:   validators,
+		Scanners:     scanners,
+		ScanAction:   *scanAction,
+		FileMode:     os.FileMode(fileMode),
+		DirMode:      os.FileMode(dirMode),
+		PreserveMode: *preserveMode,
+		Owner:        owner,
+		SyncDirs:     *syncDirs,
+		Now:          now,
+		Hostname:     *hostnameFlag,
+
+		CopyNonTemplates: *copyNonTemplates,
+		Extensions:       extensions,
+		ExtensionMap:     extensionMap,
+		Pack:             pack,
+		Mail:             msg,
+		SinkPlugins:      discovered.Sinks,
+		Git:              gitCommit,
+		Assets:           assets,
+		Stats:            stats,
+		Profile:          profile,
+		Workspace:        ws,
+		Logger:           logger,
+		OnChange:         onChange,
+		Report:           report,
+		Layout:           *layout,
+		Index:            *indexFile,
+		Prompt:           *prompt,
+		OutIsDir:         *outIsDir,
+		DryRun:           *dryRun,
+		WriteRetries:     *writeRetries,
+		RetryBackoff:     *retryBackoff,
+		EmitPatch:        *emitPatch,
+		LeftDelim:        *leftDelim,
+		RightDelim:       *rightDelim,
+		Manifest:         *manifestFile,
+		Force:            *force,
+		Shard:            shardIndex,
+		Shards:           shardCount,
+		Transactional:    *transactional,
+		BackupSuffix:     string(backupSuffix),
+		BackupDir:        *backupDir,
+		SkipUnreadable:   *skipUnreadable,
+		BinaryFiles:      *binaryFiles,
+		Symlinks:         *symlinks,
+		LineEndings:      *lineEndings,
+		FinalNewline:     *finalNewline,
+		Pipes:            pipes,
+		OutputFormat:     *outputFormat,
+		Merge:            *merge,
+		Header:           header,
+		MaxInputSize:     int64(maxInputSize),
+		MaxOutputBytes:   int64(maxOutputSize),
+		Timeout:          *renderTimeout,
+		Sandbox:          *sandbox,
+
+		TrimTrailingSpace:  *trimTrailingSpace,
+		Deprecations:       deprecations,
+		StrictDeprecations: *strictDeprecations,
+	}
+
+	code := 0
+	switch command {
+	case "lint":
+		var sample map[string]interface{}
+		if len(dataFiles) > 0 || len(valueMap) > 0 {
+			sample = allValues
+		}
+		code = runLint(r, sample, *strictUnused)
+	case "test":
+		code = runGoldenTests(r, allValues, loader, *testsDir, *updateGolden)
+	case "contract":
+		code = runContract(r, *schemaFile)
+	case "stats":
+		code = runTemplateStats(r)
+	case "refactor":
+		code = runRefactor(r, refactor, dataFiles, *schemaFile)
+	case "entrypoint":
+		code = runEntrypoint(r, ws, *outFile, allValues, app, *requireValid)
+	case "daemon":
+		daemon := func(stop <-chan struct{}) int {
+			return runDaemon(r, *outFile, loadValues, loader.health, cron, *listenAddr, *historySize, breaker, *requireValid, stop)
+		}
+		if *windowsService == "" {
+			code = daemon(nil)
+		} else if code, err = runWindowsService(*windowsService, daemon); err != nil {
+			logf(nil, LogError, "%v", err)
+		}
+	default:
+		if *every > 0 {
+			run := func(values Values) error {
+				err := r.Execute(*outFile, values)
+				if report != nil {
+					if err != nil && report.Error == "" {
+						report.Error = err.Error()
+					}
+					if werr := writeReport(report, *reportFile, policy); werr != nil {
+						logf(nil, LogError, "%v", werr)
+					}
+				}
+				return err
+			}
+			if *lockFile == "" {
+				*lockFile = defaultLockFile(*outFile)
+			}
+			code = runEvery(r, allValues, loadValues, run, *every, *jitter, *lockFile)
+			break
+		}
+		if *recordFile != "" {
+			if r.Now.IsZero() {
+				// Without the monotonic reading, the time renders the same
+				// when replayed
+				r.Now = time.Now().Round(0)
+			}
+			if r.Hostname == "" {
+				r.Hostname, _ = os.Hostname()
+			}
+			if err := recordRun(*recordFile, inputs, allValues, loader.sources, *recordSecrets, r.Now, r.Hostname); err != nil {
+				fail("%v", err)
+			}
+			logf(nil, LogInfo, "Recorded the run into %s", *recordFile)
+		}
+		err := withLock(*lockFile, func() error { return r.Execute(*outFile, allValues) })
+		if err == errLocked {
+			err = fmt.Errorf("Cannot render, as another run holds %s", *lockFile)
+		}
+		if err != nil {
+			logf(nil, LogError, "%v", err)
+			code = 1
+		} else if stats != nil {
+			stats.Print(os.Stderr)
+		}
+		if profile != nil && err == nil {
+			if err := writeProfile(profile, *profileFormat, *profileFile); err != nil {
+				logf(nil, LogError, "%v", err)
+				code = 1
+			}
+		}
+		if report != nil {
+			if err != nil && report.Error == "" {
+				report.Error = err.Error()
+			}
+			if err := writeReport(report, *reportFile, policy); err != nil {
+				logf(nil, LogError, "%v", err)
+				code = 1
+			}
+		}
 	}
-	if err := r.Execute(*outFile, allValues); err != nil {
-		log.Fatal(err)
+	if err := ws.Close(); err != nil {
+		logf(nil, LogError, "%v", err)
 	}
+	os.Exit(code)
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs tpl itself when TPL_TEST_MAIN is set, so that tests can run
+// this binary as tpl, as replays run the binary they are run by.
+func TestMain(m *testing.M) {
+	if os.Getenv("TPL_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// tpl runs this binary as tpl with args, failing the test if it fails.
+func tpl(t *testing.T, env []string, args ...string) {
+	t.Helper()
+	if err := runTpl(env, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runTpl runs this binary as tpl with args.
+func runTpl(env []string, args ...string) error {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(env, "TPL_TEST_MAIN=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Running tpl %q failed: %v\n%s", args, err, out)
+	}
+	return nil
+}
+
+var rootTests = []struct {
+	name     string
+	args     []string
+	template string
+	fails    bool
+}{
+	{name: "without-assets", template: "{{ .name }}"},
+	{name: "asset-root-within", args: []string{"-asset-root=site/static"}, template: `{{ assetURL "app.css" }}`},
+	{name: "asset-root-outside", args: []string{"-asset-root=."}, template: "{{ .name }}", fails: true},
+	{name: "default-asset-root-within", template: `{{ assetURL "site/static/app.css" }}`},
+	{name: "default-asset-root-outside", template: `{{ assetURL "app.css" }}`, fails: true},
+}
+
+func TestRootFlag(t *testing.T) {
+	for _, test := range rootTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			// The current directory is outside of -root
+			for name, content := range map[string]string{"site/in/index.txt.tpl": test.template, "site/static/app.css": "body {}", "app.css": "body {}"} {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args := append([]string{"-root=site", "-value=name=web", "-out=site/out/"}, test.args...)
+			err = runTpl(os.Environ(), append(args, "site/in")...)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("Expected tpl %q to fail, but it succeeded", args)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat("site/out/in/index.txt"); err != nil {
+				t.Errorf("Missing output: %v", err)
+			}
+		})
+	}
+}
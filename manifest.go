@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// manifestVersion is bumped whenever what goes into the input hash changes,
+// so that manifests of older versions never match.
+const manifestVersion = 2
+
+// buildManifest records, for every output of earlier runs, a hash of what it
+// was rendered from and a hash of what was written, so that incremental runs
+// can skip outputs that would come out the same.
+type buildManifest struct {
+	Version int                      `json:"version"`
+	Outputs map[string]manifestEntry `json:"outputs"`
+	Run     *manifestRun             `json:"run,omitempty"`
+
+	// Shard is set, e.g. to "3/8", in the manifest of a sharded run, which
+	// only holds the outputs of its shard.
+	Shard string `json:"shard,omitempty"`
+}
+
+type manifestEntry struct {
+	Inputs string `json:"inputs,omitempty"`
+	Output string `json:"output"`
+}
+
+// manifestRun records the output files the last run changed, and where
+// their previous contents were backed up, for the rollback command.
+type manifestRun struct {
+	Time    time.Time        `json:"time"`
+	Changes []manifestChange `json:"changes"`
+}
+
+type manifestChange struct {
+	Path    string `json:"path"`
+	Created bool   `json:"created,omitempty"`
+	Backup  string `json:"backup,omitempty"`
+}
+
+// loadManifest reads the manifest in fname. A missing manifest is empty, and
+// an unreadable one is logged and ignored, so that everything is rendered.
+func (r *Renderer) loadManifest(fname string) *buildManifest {
+	m := &buildManifest{Version: manifestVersion, Outputs: make(map[string]manifestEntry)}
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return m
+	}
+	if err == nil {
+		var prev buildManifest
+		if err = json.Unmarshal(data, &prev); err == nil && prev.Version == manifestVersion && prev.Outputs != nil {
+			m.Outputs = prev.Outputs
+			return m
+		}
+	}
+	if err != nil {
+		r.warn(fmt.Sprintf("Ignoring manifest %s: %v", fname, err))
+	}
+	return m
+}
+
+// saveManifest writes the manifest back to fname.
+func (r *Renderer) saveManifest(fname string) error {
+	if err := r.Policy.CheckOutput(fname); err != nil {
+		return err
+	}
+	if err := r.jail.Check(fname); err != nil {
+		return err
+	}
+	r.manifest.Run = r.runRecord()
+	r.manifest.Shard = ""
+	if r.sharded() {
+		r.manifest.Shard = fmt.Sprintf("%d/%d", r.Shard, r.Shards)
+	}
+	data, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fname, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("Cannot write manifest %q: %v", fname, err)
+	}
+	return nil
+}
+
+// runRecord lists the output files changed by the run, with their backups.
+func (r *Renderer) runRecord() *manifestRun {
+	run := &manifestRun{Time: r.now, Changes: []manifestChange{}}
+	if r.changes == nil {
+		return run
+	}
+	for _, name := range r.changes.changed() {
+		change := manifestChange{Path: name, Created: r.changes.before[name] == nil}
+		if r.backups != nil {
+			change.Backup = r.backups.saved[name]
+		}
+		run.Changes = append(run.Changes, change)
+	}
+	return run
+}
+
+// manifestSettings are the settings of a run that change what an output
+// renders into, all of which are hashed into its input sum. Whatever is added
+// to a Renderer that changes rendered bytes belongs here too.
+type manifestSettings struct {
+	Manifest          int
+	Tpl               string
+	LeftDelim         string
+	RightDelim        string
+	StopOnError       bool
+	BuiltinsKey       string
+	OmitBuiltins      []string
+	Funcs             []string
+	Locale            string
+	Messages          map[string][]string
+	Pipes             []Pipe
+	OutputFormat      string
+	Merge             bool
+	Header            string
+	LineEndings       string
+	TrimTrailingSpace bool
+	FinalNewline      bool
+	Mode              os.FileMode
+}
+
+// inputSum hashes everything the output of job is rendered from: the
+// template files, the values of job without render metadata, and the
+// settings that change outputs, along with the version of tpl. It fails for
+// values that cannot be encoded.
+func (r *Renderer) inputSum(job renderJob, inames []string, data interface{}) (string, error) {
+	h := sha256.New()
+	mode, err := r.outputMode(job.input)
+	if err != nil {
+		return "", err
+	}
+	settings := manifestSettings{
+		Manifest:          manifestVersion,
+		Tpl:               BuildVersion,
+		LeftDelim:         r.LeftDelim,
+		RightDelim:        r.RightDelim,
+		StopOnError:       r.StopOnError,
+		BuiltinsKey:       r.BuiltinsKey,
+		OmitBuiltins:      r.OmitBuiltins,
+		Pipes:             r.Pipes,
+		OutputFormat:      r.OutputFormat,
+		Merge:             r.Merge,
+		Header:            r.Header,
+		LineEndings:       r.LineEndings,
+		TrimTrailingSpace: r.TrimTrailingSpace,
+		FinalNewline:      r.FinalNewline,
+		Mode:              mode,
+	}
+	for name := range r.templateFuncs() {
+		settings.Funcs = append(settings.Funcs, name)
+	}
+	sort.Strings(settings.Funcs)
+	if r.Catalog != nil {
+		settings.Locale, settings.Messages = r.Catalog.locale, r.Catalog.messages
+	}
+	enc, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	h.Write(enc)
+	h.Write([]byte{0})
+	files := inames
+	if files[len(files)-1] != job.input {
+		files = append(files[:len(files):len(files)], job.input)
+	}
+	for _, iname := range files {
+		content, err := ioutil.ReadFile(iname)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%q\x00%d\x00", iname, len(content))
+		h.Write(content)
+	}
+
+	values := data
+	if m, ok := valueMap(data); ok {
+		merged := make(map[string]interface{}, len(job.defaults)+len(m))
+		for k, v := range job.defaults {
+			merged[k] = normalizeValue(v)
+		}
+		for k, v := range m {
+			merged[k] = normalizeValue(v)
+		}
+		values = merged
+	}
+	if enc, err = json.Marshal(values); err != nil {
+		return "", err
+	}
+	h.Write(enc)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// upToDate reports whether oname was rendered from inputs with the given sum
+// by an earlier run, and still holds what that run wrote.
+func (r *Renderer) upToDate(oname, sum string) bool {
+	e, ok := r.manifest.Outputs[oname]
+	if !ok || e.Inputs == "" || e.Inputs != sum {
+		return false
+	}
+	if r.jail.Check(oname) != nil {
+		return false
+	}
+	content, err := ioutil.ReadFile(oname)
+	if err != nil {
+		return false
+	}
+	out := sha256.Sum256(content)
+	return hex.EncodeToString(out[:]) == e.Output
+}
+
+// recordOutput updates the manifest entry of oname after content was written
+// to it. Outputs whose inputs were not hashed, such as copied files, are
+// recorded without an input hash, so that they can be verified but are never
+// up to date.
+func (r *Renderer) recordOutput(oname string, content []byte) {
+	if r.manifest == nil {
+		return
+	}
+	out := sha256.Sum256(content)
+	r.manifest.Outputs[oname] = manifestEntry{Inputs: r.inputSums[oname], Output: hex.EncodeToString(out[:])}
+}
+
+// skipUnchanged hashes the inputs of job, reporting whether its output can be
+// skipped because it is up to date. Outputs shared by several jobs, or split
+// into pages, are always rendered, as are outputs whose inputs cannot be
+// hashed.
+func (r *Renderer) skipUnchanged(job renderJob, inames []string, data interface{}, shared bool) bool {
+	if r.manifest == nil || shared || job.output == "-" {
+		return false
+	}
+	sum, err := r.inputSum(job, inames, data)
+	if err != nil {
+		r.logf(LogDebug, "Not recording %s in the manifest: %v", job.output, err)
+		return false
+	}
+	r.inputSums[job.output] = sum
+	if r.Force || !r.upToDate(job.output, sum) {
+		return false
+	}
+	r.logf(LogInfo, "Skipping %s, as %s is up to date", job.input, job.output)
+	return true
+}
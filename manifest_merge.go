@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runManifest runs the manifest subcommand named first in args. The only one
+// is merge, which combines the manifests of the shards of a run into fname.
+// It returns the process exit code.
+func runManifest(fname string, args []string) int {
+	if len(args) == 0 || args[0] != "merge" {
+		logf(nil, LogError, "The manifest command takes a subcommand: merge SHARD_MANIFEST...")
+		return 1
+	}
+	if fname == "" {
+		logf(nil, LogError, "The manifest merge command requires -manifest=FILE, to write the merged manifest to")
+		return 1
+	}
+	if len(args) < 2 {
+		logf(nil, LogError, "The manifest merge command requires the manifests to merge")
+		return 1
+	}
+	if err := checkPolicyOutput(fname); err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	var shards []*buildManifest
+	for _, name := range args[1:] {
+		m, err := readManifest(name)
+		if err != nil {
+			logf(nil, LogError, "%v", err)
+			return 1
+		}
+		shards = append(shards, m)
+	}
+	merged, err := mergeManifests(args[1:], shards)
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	data, err := json.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	if err := writeFileAtomic(fname, append(data, '\n'), 0644); err != nil {
+		logf(nil, LogError, "Cannot write manifest %q: %v", fname, err)
+		return 1
+	}
+	logf(nil, LogInfo, "Merged %d output(s) from %d manifest(s) into %s", len(merged.Outputs), len(shards), fname)
+	return 0
+}
+
+// mergeManifests combines the manifests of the shards of one run, read from
+// names, into the manifest of the whole run. It fails if the manifests are of
+// shards of different runs, if a shard is missing or given twice, or if any
+// output is recorded by more than one of them, as the shards would then not
+// have been disjoint.
+func mergeManifests(names []string, shards []*buildManifest) (*buildManifest, error) {
+	count := 0
+	seen := make(map[int]string)
+	for i, m := range shards {
+		if m.Shard == "" {
+			if len(shards) > 1 {
+				return nil, fmt.Errorf("Manifest %s is not of a sharded run; render with -shard=K/N", names[i])
+			}
+			continue
+		}
+		k, n, err := parseShard(m.Shard)
+		if err != nil {
+			return nil, fmt.Errorf("Manifest %s: %v", names[i], err)
+		}
+		if count == 0 {
+			count = n
+		} else if n != count {
+			return nil, fmt.Errorf("Manifest %s is of shard %s, but %s is of one of %d shards", names[i], m.Shard, names[0], count)
+		}
+		if prev, ok := seen[k]; ok {
+			return nil, fmt.Errorf("Manifests %s and %s are both of shard %s", prev, names[i], m.Shard)
+		}
+		seen[k] = names[i]
+	}
+	var missing []string
+	for k := 1; k <= count; k++ {
+		if _, ok := seen[k]; !ok {
+			missing = append(missing, strconv.Itoa(k)+"/"+strconv.Itoa(count))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Missing the manifests of shard(s) %s", strings.Join(missing, ", "))
+	}
+
+	merged := &buildManifest{Version: manifestVersion, Outputs: make(map[string]manifestEntry)}
+	from := make(map[string]string)
+	for i, m := range shards {
+		for oname, e := range m.Outputs {
+			if prev, ok := from[oname]; ok {
+				return nil, fmt.Errorf("Output %s is recorded by both %s and %s; shards must not overlap", oname, prev, names[i])
+			}
+			from[oname] = names[i]
+			merged.Outputs[oname] = e
+		}
+		if m.Run == nil {
+			continue
+		}
+		if merged.Run == nil {
+			merged.Run = &manifestRun{Changes: []manifestChange{}}
+		}
+		if m.Run.Time.After(merged.Run.Time) {
+			merged.Run.Time = m.Run.Time
+		}
+		merged.Run.Changes = append(merged.Run.Changes, m.Run.Changes...)
+	}
+	if merged.Run != nil {
+		sort.Slice(merged.Run.Changes, func(i, j int) bool {
+			return merged.Run.Changes[i].Path < merged.Run.Changes[j].Path
+		})
+	}
+	return merged, nil
+}
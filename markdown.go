@@ -0,0 +1,544 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// markdownToHTML is the `markdownToHTML` template function, converting the
+// common subset of Markdown to HTML: headings, paragraphs, emphasis, code,
+// links, images, lists, block quotes, and rules. Raw HTML in the Markdown is
+// escaped rather than passed through, and links with schemes other than
+// http, https, and mailto are dropped, so that values cannot inject markup
+// or scripts into the page.
+func markdownToHTML(src string) string {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"))
+	return b.String()
+}
+
+var (
+	mdHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRule       = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence      = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^`\\s]*)")
+	mdQuote      = regexp.MustCompile(`^ {0,3}> ?`)
+	mdListItem   = regexp.MustCompile(`^( {0,3})([*+-]|\d{1,9}[.)])( +|$)`)
+	mdSetextLine = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+)
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// renderBlocks converts lines of Markdown into block-level HTML.
+func renderBlocks(b *strings.Builder, lines []string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			fence := m[1]
+			var code []string
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimLeft(lines[i], " "), fence) {
+					i++
+					break
+				}
+				code = append(code, lines[i])
+			}
+			if m[2] != "" {
+				fmt.Fprintf(b, "<pre><code class=\"language-%s\">", html.EscapeString(m[2]))
+			} else {
+				b.WriteString("<pre><code>")
+			}
+			for _, c := range code {
+				b.WriteString(html.EscapeString(c) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t"):
+			var code []string
+			for ; i < len(lines); i++ {
+				l := lines[i]
+				if strings.HasPrefix(l, "    ") {
+					code = append(code, l[4:])
+				} else if strings.HasPrefix(l, "\t") {
+					code = append(code, l[1:])
+				} else if isBlank(l) {
+					code = append(code, "")
+				} else {
+					break
+				}
+			}
+			for len(code) > 0 && code[len(code)-1] == "" {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>")
+			for _, c := range code {
+				b.WriteString(html.EscapeString(c) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			fmt.Fprintf(b, "<h%d>%s</h%d>\n", len(m[1]), renderInline(m[2]), len(m[1]))
+			i++
+
+		case mdRule.MatchString(line):
+			b.WriteString("<hr />\n")
+			i++
+
+		case mdQuote.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuote.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuote.ReplaceAllString(lines[i], ""))
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted)
+			b.WriteString("</blockquote>\n")
+
+		case mdListItem.MatchString(line):
+			i = renderList(b, lines, i)
+
+		default:
+			var para []string
+			for ; i < len(lines); i++ {
+				l := lines[i]
+				if isBlank(l) {
+					break
+				}
+				if len(para) > 0 && mdSetextLine.MatchString(l) {
+					level := 1
+					if strings.TrimSpace(l)[0] == '-' {
+						level = 2
+					}
+					fmt.Fprintf(b, "<h%d>%s</h%d>\n", level, renderInline(strings.Join(para, "\n")), level)
+					para = nil
+					i++
+					break
+				}
+				if len(para) > 0 && startsBlock(l) {
+					break
+				}
+				para = append(para, strings.TrimLeft(l, " "))
+			}
+			if len(para) > 0 {
+				fmt.Fprintf(b, "<p>%s</p>\n", renderInline(strings.Join(para, "\n")))
+			}
+		}
+	}
+}
+
+// startsBlock reports whether line interrupts a paragraph. Indented code and
+// ordered lists not starting at 1 do not.
+func startsBlock(line string) bool {
+	if m := mdListItem.FindStringSubmatch(line); m != nil {
+		return !isOrdered(m[2]) || strings.TrimRight(m[2], ".)") == "1"
+	}
+	return mdFence.MatchString(line) || mdHeading.MatchString(line) || mdRule.MatchString(line) || mdQuote.MatchString(line)
+}
+
+func isOrdered(marker string) bool {
+	return marker[0] >= '0' && marker[0] <= '9'
+}
+
+// renderList converts the list starting at lines[i], returning the index of
+// the first line after it. The content of each item is rendered as blocks of
+// its own, and lists without blank lines between items are tight, without
+// paragraphs around their items.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	first := mdListItem.FindStringSubmatch(lines[i])
+	ordered := isOrdered(first[2])
+	kind := first[2][len(first[2])-1:]
+
+	var items [][]string
+	loose, gap := false, false
+	for i < len(lines) {
+		m := mdListItem.FindStringSubmatch(lines[i])
+		if m == nil || isOrdered(m[2]) != ordered || !strings.HasSuffix(m[2], kind) {
+			break
+		}
+		// Blank lines between items, or between blocks of an item, make
+		// the list loose
+		loose = loose || gap
+		indent := len(m[0])
+		if m[3] == "" {
+			indent++
+		}
+		item := []string{lines[i][len(m[0]):]}
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			if isBlank(l) {
+				item = append(item, "")
+				continue
+			}
+			if lead := len(l) - len(strings.TrimLeft(l, " ")); lead >= indent {
+				item = append(item, l[indent:])
+				continue
+			}
+			// A lazy continuation of the paragraph of the item
+			if item[len(item)-1] != "" && !startsBlock(l) && !mdListItem.MatchString(l) {
+				item = append(item, strings.TrimLeft(l, " "))
+				continue
+			}
+			break
+		}
+		gap = false
+		for len(item) > 0 && item[len(item)-1] == "" {
+			item = item[:len(item)-1]
+			gap = true
+		}
+		for _, l := range item {
+			if l == "" {
+				loose = true
+			}
+		}
+		items = append(items, item)
+	}
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		if start := strings.TrimLeft(strings.TrimRight(first[2], ".)"), "0"); start != "1" {
+			if start == "" {
+				start = "0"
+			}
+			fmt.Fprintf(b, "<ol start=\"%s\">\n", start)
+			tag = ""
+		}
+	}
+	if tag != "" {
+		fmt.Fprintf(b, "<%s>\n", tag)
+	}
+	for _, item := range items {
+		var ib strings.Builder
+		renderBlocks(&ib, item)
+		content := ib.String()
+		if !loose {
+			content = unwrapParagraphs(content)
+		}
+		fmt.Fprintf(b, "<li>%s</li>\n", strings.TrimSuffix(content, "\n"))
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+var mdParagraph = regexp.MustCompile(`(?s)<p>(.*?)</p>\n`)
+
+// unwrapParagraphs removes the paragraphs around the text of a tight list
+// item.
+func unwrapParagraphs(content string) string {
+	return mdParagraph.ReplaceAllStringFunc(content, func(p string) string {
+		inner := mdParagraph.FindStringSubmatch(p)[1]
+		return inner + "\n"
+	})
+}
+
+var mdAutolink = regexp.MustCompile(`^<((?:https?://|mailto:)[^\s<>]+)>`)
+
+// renderInline converts the inline Markdown of a block into HTML, escaping
+// everything else.
+func renderInline(src string) string {
+	var b strings.Builder
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\\' && i+1 < len(src) && strings.IndexByte("\\`*_{}[]()#+-.!<>|~\"'", src[i+1]) >= 0:
+			b.WriteString(html.EscapeString(src[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			b.WriteString("<br />\n")
+			i += 2
+			continue
+
+		case c == '`':
+			run := len(src[i:]) - len(strings.TrimLeft(src[i:], "`"))
+			fence := src[i : i+run]
+			if end := findCodeEnd(src, i+run, fence); end >= 0 {
+				code := strings.Replace(src[i+run:end], "\n", " ", -1)
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+					code = code[1 : len(code)-1]
+				}
+				b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i = end + run
+				continue
+			}
+			b.WriteString(fence)
+			i += run
+			continue
+
+		case c == '!' && strings.HasPrefix(src[i+1:], "["):
+			if text, url, title, n, ok := parseLink(src[i+1:]); ok {
+				if safe, ok := safeURL(url); ok {
+					fmt.Fprintf(&b, "<img src=\"%s\" alt=\"%s\"", html.EscapeString(safe), html.EscapeString(plainText(text)))
+					if title != "" {
+						fmt.Fprintf(&b, " title=\"%s\"", html.EscapeString(title))
+					}
+					b.WriteString(" />")
+				} else {
+					b.WriteString(html.EscapeString(plainText(text)))
+				}
+				i += 1 + n
+				continue
+			}
+
+		case c == '[':
+			if text, url, title, n, ok := parseLink(src[i:]); ok {
+				if safe, ok := safeURL(url); ok {
+					fmt.Fprintf(&b, "<a href=\"%s\"", html.EscapeString(safe))
+					if title != "" {
+						fmt.Fprintf(&b, " title=\"%s\"", html.EscapeString(title))
+					}
+					fmt.Fprintf(&b, ">%s</a>", renderInline(text))
+				} else {
+					b.WriteString(renderInline(text))
+				}
+				i += n
+				continue
+			}
+
+		case c == '<':
+			if m := mdAutolink.FindStringSubmatch(src[i:]); m != nil {
+				fmt.Fprintf(&b, "<a href=\"%s\">%s</a>", html.EscapeString(m[1]), html.EscapeString(strings.TrimPrefix(m[1], "mailto:")))
+				i += len(m[0])
+				continue
+			}
+
+		case c == '*' || c == '_':
+			if n := emphasis(&b, src, i); n > 0 {
+				i += n
+				continue
+			}
+
+		case c == ' ' && strings.HasPrefix(src[i:], "  \n"):
+			b.WriteString("<br />\n")
+			i += 3
+			for i < len(src) && src[i] == ' ' {
+				i++
+			}
+			continue
+
+		case c == ' ' && strings.TrimLeft(src[i:], " ") == "":
+			// Trailing spaces of the block
+			i = len(src)
+			continue
+		}
+		// Pass any one character through, keeping runes whole
+		j := i + 1
+		for j < len(src) && src[j]&0xC0 == 0x80 {
+			j++
+		}
+		b.WriteString(html.EscapeString(src[i:j]))
+		i = j
+	}
+	return b.String()
+}
+
+// findCodeEnd finds the closing backtick run of a code span, which must be
+// exactly as long as the opening one.
+func findCodeEnd(src string, from int, fence string) int {
+	for j := from; j < len(src); {
+		if src[j] != '`' {
+			j++
+			continue
+		}
+		run := len(src[j:]) - len(strings.TrimLeft(src[j:], "`"))
+		if run == len(fence) {
+			return j
+		}
+		j += run
+	}
+	return -1
+}
+
+// parseLink parses `[text](url "title")` at the start of src, returning the
+// length of the whole link.
+func parseLink(src string) (text, url, title string, n int, ok bool) {
+	depth := 0
+	close := -1
+	for j := 0; j < len(src) && close < 0; j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				close = j
+			}
+		}
+	}
+	if close < 0 || close+1 >= len(src) || src[close+1] != '(' {
+		return "", "", "", 0, false
+	}
+	// Destinations may hold balanced parentheses
+	end, depth := -1, 0
+	for j := close + 2; j < len(src) && end < 0; j++ {
+		switch src[j] {
+		case '\\':
+			j++
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				end = j - (close + 2)
+			}
+			depth--
+		case '\n':
+			if depth > 0 {
+				return "", "", "", 0, false
+			}
+		}
+	}
+	if end < 0 {
+		return "", "", "", 0, false
+	}
+	dest := strings.TrimSpace(src[close+2 : close+2+end])
+	if k := strings.IndexAny(dest, " \t\n"); k >= 0 {
+		t := strings.TrimSpace(dest[k:])
+		if len(t) < 2 || !(t[0] == '"' && t[len(t)-1] == '"' || t[0] == '\'' && t[len(t)-1] == '\'') {
+			return "", "", "", 0, false
+		}
+		dest, title = dest[:k], t[1:len(t)-1]
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	return src[1:close], dest, title, close + 2 + end + 1, true
+}
+
+// safeURL returns url if it is relative, or has an http, https, or mailto
+// scheme.
+func safeURL(url string) (string, bool) {
+	lower := strings.ToLower(strings.TrimSpace(url))
+	colon := strings.IndexByte(lower, ':')
+	if colon < 0 || strings.ContainsAny(lower[:colon], "/?#") {
+		return url, true
+	}
+	switch lower[:colon] {
+	case "http", "https", "mailto":
+		return url, true
+	}
+	return "", false
+}
+
+// plainText drops the emphasis markers of the text of an image, for its alt
+// text.
+func plainText(text string) string {
+	return strings.NewReplacer("**", "", "__", "", "*", "", "_", "", "`", "").Replace(text)
+}
+
+// emphasis renders the emphasis or strong emphasis opening at src[i], if it
+// is closed, returning how much of src it took.
+func emphasis(b *strings.Builder, src string, i int) int {
+	c := src[i]
+	n := 1
+	if i+1 < len(src) && src[i+1] == c {
+		n = 2
+	}
+	if n == 2 && i+2 < len(src) && src[i+2] == c {
+		triple := src[i : i+3]
+		if end := strings.Index(src[i+3:], triple); end > 0 && src[i+3] != ' ' && src[i+2+end] != ' ' {
+			fmt.Fprintf(b, "<em><strong>%s</strong></em>", renderInline(src[i+3:i+3+end]))
+			return end + 6
+		}
+	}
+	delim := src[i : i+n]
+	start := i + n
+	// Opening delimiters must be followed by text, and underscores must not
+	// be inside a word
+	if start >= len(src) || src[start] == ' ' || src[start] == '\n' {
+		return 0
+	}
+	if c == '_' && i > 0 && isWordByte(src[i-1]) {
+		return 0
+	}
+	for j := start + 1; j <= len(src)-n; j++ {
+		if src[j-1] == '\\' {
+			continue
+		}
+		if src[j:j+n] != delim || src[j-1] == ' ' || src[j-1] == '\n' || src[j-1] == c {
+			continue
+		}
+		// Skip the delimiters of a nested strong emphasis
+		if n == 1 && j+1 < len(src) && src[j+1] == c {
+			j++
+			continue
+		}
+		if c == '_' && j+n < len(src) && isWordByte(src[j+n]) {
+			continue
+		}
+		tag := "em"
+		if n == 2 {
+			tag = "strong"
+		}
+		fmt.Fprintf(b, "<%s>%s</%s>", tag, renderInline(src[start:j]), tag)
+		return j + n - i
+	}
+	return 0
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// htmlEscape is the `htmlEscape` template function, escaping <, >, &, ', and
+// " so that text can be placed in HTML as it is.
+func htmlEscape(s string) string {
+	return html.EscapeString(s)
+}
+
+// stripTags is the `stripTags` template function, removing HTML tags and
+// comments from s, along with the contents of script and style elements.
+// Entities are left as they are, so that the text stays safe to place in
+// HTML.
+func stripTags(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] != '<' {
+			j := strings.IndexByte(s[i:], '<')
+			if j < 0 {
+				j = len(s) - i
+			}
+			b.WriteString(s[i : i+j])
+			i += j
+			continue
+		}
+		if strings.HasPrefix(s[i:], "<!--") {
+			end := strings.Index(s[i+4:], "-->")
+			if end < 0 {
+				break
+			}
+			i += 4 + end + 3
+			continue
+		}
+		end := strings.IndexByte(s[i:], '>')
+		if end < 0 {
+			// An unterminated tag is dropped with everything after it
+			break
+		}
+		tag := strings.ToLower(s[i+1 : i+end])
+		i += end + 1
+		for _, raw := range []string{"script", "style"} {
+			if tag == raw || strings.HasPrefix(tag, raw+" ") || strings.HasPrefix(tag, raw+"\t") || strings.HasPrefix(tag, raw+"\n") {
+				closing := strings.Index(strings.ToLower(s[i:]), "</"+raw)
+				if closing < 0 {
+					i = len(s)
+					break
+				}
+				i += closing
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+var markdownTests = []struct {
+	name     string
+	src      string
+	expected string
+}{
+	{name: "heading-emphasis", src: "# Title\n\nSome *em* and **strong** text.", expected: "<h1>Title</h1>\n<p>Some <em>em</em> and <strong>strong</strong> text.</p>\n"},
+	{name: "html-escaped", src: "a <b>c</b> & d", expected: "<p>a &lt;b&gt;c&lt;/b&gt; &amp; d</p>\n"},
+	{name: "unsafe-link", src: `[x](javascript:alert(1)) [y](https://e.com "T")`, expected: "<p>x <a href=\"https://e.com\" title=\"T\">y</a></p>\n"},
+	{name: "image", src: "![alt *x*](/i.png)", expected: "<p><img src=\"/i.png\" alt=\"alt x\" /></p>\n"},
+	{name: "tight-lists", src: "- a\n- b\n\n1. one\n2. two", expected: "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n"},
+	{name: "loose-list", src: "- a\n\n- b", expected: "<ul>\n<li><p>a</p></li>\n<li><p>b</p></li>\n</ul>\n"},
+	{name: "fenced-code", src: "```go\nx := 1 < 2\n```", expected: "<pre><code class=\"language-go\">x := 1 &lt; 2\n</code></pre>\n"},
+	{name: "indented-code", src: "    code\n    more", expected: "<pre><code>code\nmore\n</code></pre>\n"},
+	{name: "code-spans", src: "`a <b>` and ``c ` d``", expected: "<p><code>a &lt;b&gt;</code> and <code>c ` d</code></p>\n"},
+	{name: "blockquote", src: "> quote\n> more", expected: "<blockquote>\n<p>quote\nmore</p>\n</blockquote>\n"},
+	{name: "rule", src: "---", expected: "<hr />\n"},
+	{name: "intraword-underscores", src: "snake_case_word", expected: "<p>snake_case_word</p>\n"},
+}
+
+func TestMarkdownToHTML(t *testing.T) {
+	for _, test := range markdownTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			if got := markdownToHTML(test.src); got != test.expected {
+				t.Errorf("Converted %q into %q, expected %q", test.src, got, test.expected)
+			}
+		})
+	}
+}
+
+var stripTagsTests = []struct {
+	name     string
+	src      string
+	expected string
+}{
+	{name: "scripts-styles-comments", src: "<p>Hi &amp; <b>there</b></p><script>x()</script><!-- c --><style>a{}</style>end", expected: "Hi &amp; thereend"},
+	{name: "self-closing", src: "a<br/>b", expected: "ab"},
+}
+
+func TestStripTags(t *testing.T) {
+	for _, test := range stripTagsTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			if got := stripTags(test.src); got != test.expected {
+				t.Errorf("Stripped %q into %q, expected %q", test.src, got, test.expected)
+			}
+		})
+	}
+
+	if got, expected := htmlEscape(`<a href="x">'&'</a>`), "&lt;a href=&#34;x&#34;&gt;&#39;&amp;&#39;&lt;/a&gt;"; got != expected {
+		t.Errorf("Escaped into %q, expected %q", got, expected)
+	}
+}
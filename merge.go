@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// outputFragments are the rendered fragments of one output, to be merged.
+type outputFragments struct {
+	output string
+	input  string
+	values interface{}
+	mode   os.FileMode
+	docs   []interface{}
+}
+
+// fragmentIsJSON reports whether the fragments of oname, rendered from iname,
+// are JSON rather than YAML.
+func (r *Renderer) fragmentIsJSON(iname, oname string) bool {
+	name := oname
+	if name == "-" {
+		name = r.outputName(filepath.Base(iname))
+	}
+	return strings.EqualFold(filepath.Ext(name), ".json")
+}
+
+// addFragment parses content, rendered from iname, and holds it back to be
+// merged into oname.
+func (r *Renderer) addFragment(iname, oname string, content []byte, values interface{}, mode os.FileMode) error {
+	var doc interface{}
+	var err error
+	if r.fragmentIsJSON(iname, oname) {
+		err = json.Unmarshal(content, &doc)
+	} else {
+		err = yaml.Unmarshal(content, &doc)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot parse the fragment rendered from %s: %v", iname, err)
+	}
+	for _, f := range r.fragments {
+		if f.output == oname {
+			f.docs = append(f.docs, normalizeValue(doc))
+			return nil
+		}
+	}
+	r.fragments = append(r.fragments, &outputFragments{output: oname, input: iname, values: values, mode: mode, docs: []interface{}{normalizeValue(doc)}})
+	return nil
+}
+
+// deepMerge merges src into dst: maps are merged key by key, and anything
+// else in src, lists included, replaces what is in dst. Empty fragments
+// leave dst alone.
+func deepMerge(dst, src interface{}) interface{} {
+	if src == nil {
+		return dst
+	}
+	dm, ok := dst.(map[string]interface{})
+	sm, ok2 := src.(map[string]interface{})
+	if !ok || !ok2 {
+		return src
+	}
+	merged := make(map[string]interface{}, len(dm)+len(sm))
+	for k, v := range dm {
+		merged[k] = v
+	}
+	for k, v := range sm {
+		if prev, ok := merged[k]; ok {
+			merged[k] = deepMerge(prev, v)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// writeFragments merges and writes every output made of fragments, in the
+// order their first fragment was rendered.
+func (r *Renderer) writeFragments() error {
+	for _, f := range r.fragments {
+		var doc interface{}
+		for _, d := range f.docs {
+			doc = deepMerge(doc, d)
+		}
+		var content []byte
+		var err error
+		if r.fragmentIsJSON(f.input, f.output) {
+			if content, err = json.MarshalIndent(doc, "", "  "); err == nil {
+				content = append(content, '\n')
+			}
+		} else {
+			content, err = yaml.Marshal(doc)
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot merge the fragments of %s: %v", f.output, err)
+		}
+		r.logf(LogDebug, "Merged %d fragment(s) into %s", len(f.docs), f.output)
+		if err := r.finishOutput(f.input, f.output, content, f.values, f.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
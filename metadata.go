@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// metadataKey is the builtin under which templates find metadata about the
+// current render, e.g. `{{ .T.Tpl.OutputPath }}`.
+const metadataKey = "Tpl"
+
+// DefaultBuiltinsKey is the top-level value under which tpl puts the values
+// it injects itself, its builtins, so that they never collide with those of
+// the user.
+const DefaultBuiltinsKey = "T"
+
+// builtinNames are the builtins: the render metadata, the page of a
+// paginated template, the record being rendered from a JSON lines file, the
+// HTML of a Markdown page, in its layout, and the outputs of the run, in the
+// index.
+var builtinNames = []string{metadataKey, pageKey, recordKey, pageContentKey, indexKey}
+
+// reservedKeys lists the top-level values that the builtins, but those
+// omitted, take the place of: key or, without one, each of their names.
+func reservedKeys(key string, omit []string) []string {
+	var names []string
+	for _, name := range builtinNames {
+		omitted := false
+		for _, o := range omit {
+			omitted = omitted || o == name
+		}
+		if !omitted {
+			names = append(names, name)
+		}
+	}
+	if key == "" || len(names) == 0 {
+		return names
+	}
+	return []string{key}
+}
+
+// checkReservedKeys fails when values has a top-level value among reserved,
+// naming the source that set it.
+func checkReservedKeys(values Values, reserved []string, sources map[string]string) error {
+	for _, k := range reserved {
+		if _, ok := values[k]; !ok {
+			continue
+		}
+		src := sources[k]
+		if src == "" {
+			src = "a values source"
+		}
+		return fmt.Errorf("Value .%s is set by both %s and the builtins of tpl, which would take its place; with -strict-keys, rename it", k, src)
+	}
+	return nil
+}
+
+func isBuiltinName(name string) bool {
+	for _, n := range builtinNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// builtinValues holds the builtins under Renderer.BuiltinsKey, which tells
+// them apart from a user value of the same name, which they replace.
+type builtinValues map[string]interface{}
+
+// setBuiltin sets the builtin name to v in values, which is a copy of its
+// own, unless it is among OmitBuiltins.
+func (r *Renderer) setBuiltin(values map[string]interface{}, name string, v interface{}) {
+	for _, omit := range r.OmitBuiltins {
+		if omit == name {
+			return
+		}
+	}
+	if r.BuiltinsKey == "" {
+		values[name] = v
+		return
+	}
+	ns := builtinValues{name: v}
+	if prev, ok := values[r.BuiltinsKey].(builtinValues); ok {
+		for k, e := range prev {
+			if k != name {
+				ns[k] = e
+			}
+		}
+	}
+	values[r.BuiltinsKey] = ns
+}
+
+// renderMetadata describes the render of job, as seen by its template.
+func (r *Renderer) renderMetadata(job renderJob) map[string]interface{} {
+	return map[string]interface{}{
+		"Template":     filepath.Base(job.input),
+		"TemplatePath": job.input,
+		"OutputPath":   job.output,
+		"Now":          r.now,
+		"Hostname":     r.hostname,
+		"Version":      BuildVersion,
+	}
+}
+
+// jobValues returns the values job is rendered with: values layered on top
+// of the directory defaults of job, plus the metadata of job. Builtins take
+// the place of any user value of the same name. Data other than a map is
+// returned as it is.
+func (r *Renderer) jobValues(data interface{}, job renderJob) interface{} {
+	values, ok := valueMap(data)
+	if !ok {
+		return data
+	}
+	merged := make(map[string]interface{}, len(job.defaults)+len(values)+1)
+	for k, v := range job.defaults {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	r.setBuiltin(merged, metadataKey, r.renderMetadata(job))
+	return merged
+}
+
+// isMetadataRef reports whether path refers into the builtins or, at the
+// top level, the render metadata, which is always present, and whose values
+// may have methods of their own.
+func (r *Renderer) isMetadataRef(path []string) bool {
+	key := r.BuiltinsKey
+	if key == "" {
+		key = metadataKey
+	}
+	return len(path) > 0 && path[0] == key
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+)
+
+// normalizing reports whether rendered outputs are post-processed at all.
+func (r *Renderer) normalizing() bool {
+	return r.LineEndings != "" || r.FinalNewline || r.TrimTrailingSpace
+}
+
+// normalize applies LineEndings, TrimTrailingSpace, and FinalNewline to the
+// rendered content of an output. Line endings are left as they are unless
+// LineEndings is set.
+func (r *Renderer) normalize(content []byte) []byte {
+	if !r.normalizing() {
+		return content
+	}
+	lines := bytes.Split(content, []byte("\n"))
+	// The text after the last newline is not a line of its own
+	last := lines[len(lines)-1]
+	lines = lines[:len(lines)-1]
+	if len(last) > 0 {
+		lines = append(lines, last)
+	}
+	for i, line := range lines {
+		cr := bytes.HasSuffix(line, []byte("\r"))
+		if cr {
+			line = line[:len(line)-1]
+		}
+		if r.TrimTrailingSpace {
+			line = bytes.TrimRight(line, " \t")
+		}
+		switch {
+		case r.LineEndings == "crlf" || (r.LineEndings == "" && cr):
+			line = append(line[:len(line):len(line)], '\r', '\n')
+		default:
+			line = append(line[:len(line):len(line)], '\n')
+		}
+		lines[i] = line
+	}
+
+	if r.FinalNewline {
+		for len(lines) > 0 && len(bytes.TrimRight(lines[len(lines)-1], "\r\n")) == 0 {
+			lines = lines[:len(lines)-1]
+		}
+	} else if len(last) > 0 {
+		// Without FinalNewline, an unterminated last line stays so
+		n := len(lines) - 1
+		lines[n] = bytes.TrimRight(lines[n], "\r\n")
+	}
+	return bytes.Join(lines, nil)
+}
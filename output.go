@@ -0,0 +1,546 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputSink stores rendered outputs.
+type outputSink interface {
+	// Check returns an error if name may not be written.
+	Check(name string) error
+	// WriteFile stores the complete content of an output, replacing any
+	// content stored under the same name earlier in the run.
+	WriteFile(name string, content []byte, mode os.FileMode) error
+	// ReadFile returns the content stored under name earlier in the run.
+	ReadFile(name string) ([]byte, error)
+	// Close finishes a successful run.
+	Close() error
+}
+
+// symlinkSink is an outputSink that can also write symbolic links.
+type symlinkSink interface {
+	outputSink
+	Symlink(target, name string) error
+}
+
+// fileSink writes outputs directly into the filesystem.
+type fileSink struct {
+	dirMode os.FileMode
+	jail    *pathJail
+	policy  *Policy
+
+	// dirs holds the directories already created in this run.
+	dirs map[string]bool
+
+	// backup, if set, saves the previous contents of overwritten outputs.
+	backup *backupPolicy
+
+	// owner, if set, is given every output and created directory.
+	owner *FileOwner
+	// sync, if set, syncs the directories written into on Close, which
+	// unsynced holds until then.
+	sync     bool
+	unsynced map[string]bool
+}
+
+func (s *fileSink) Check(name string) error {
+	if err := s.policy.CheckOutput(name); err != nil {
+		return err
+	}
+	return s.jail.Check(name)
+}
+
+func (s *fileSink) WriteFile(name string, content []byte, mode os.FileMode) error {
+	if err := s.createDirs([]string{name}); err != nil {
+		return err
+	}
+	if err := s.backupFile(name); err != nil {
+		return err
+	}
+	tmpname, err := writeTempFile(name, content, mode)
+	if err != nil {
+		return fmt.Errorf("Cannot write output file %q: %v", name, err)
+	}
+	if err := s.replaceAttributes(tmpname, name, mode); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if err := os.Rename(tmpname, name); err != nil {
+		os.Remove(tmpname)
+		return fmt.Errorf("Cannot write output file %q: %v", name, err)
+	}
+	s.synced(filepath.Dir(name))
+	return nil
+}
+
+// Symlink replaces name with a symbolic link to target.
+func (s *fileSink) Symlink(target, name string) error {
+	if err := s.createDirs([]string{name}); err != nil {
+		return err
+	}
+	if err := s.backupFile(name); err != nil {
+		return err
+	}
+	if err := replaceSymlink(target, name); err != nil {
+		return err
+	}
+	s.synced(filepath.Dir(name))
+	return s.ownLink(name)
+}
+
+// replaceSymlink creates a symbolic link to target next to name, and then
+// renames it into place.
+func replaceSymlink(target, name string) error {
+	tmpname := filepath.Join(filepath.Dir(name), fmt.Sprintf(".%s.%d.link", filepath.Base(name), os.Getpid()))
+	if err := os.Symlink(target, tmpname); err != nil {
+		return fmt.Errorf("Cannot write symlink %q: %v", name, err)
+	}
+	if err := os.Rename(tmpname, name); err != nil {
+		os.Remove(tmpname)
+		return fmt.Errorf("Cannot write symlink %q: %v", name, err)
+	}
+	return nil
+}
+
+// createDirs creates the parent directories of every named output, once.
+func (s *fileSink) createDirs(names []string) error {
+	if s.dirs == nil {
+		s.dirs = make(map[string]bool)
+	}
+	for _, name := range names {
+		if name == "-" || !strings.Contains(name, "/") {
+			continue
+		}
+		dir := filepath.Dir(name)
+		if s.dirs[dir] {
+			continue
+		}
+		if err := s.mkdirAll(dir); err != nil {
+			return fmt.Errorf("Error creating directory for %q: %v", name, err)
+		}
+		s.dirs[dir] = true
+	}
+	return nil
+}
+
+func (s *fileSink) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (s *fileSink) Close() error {
+	return s.syncDirs()
+}
+
+// archiveFormat returns the archive format implied by the extension of out,
+// or "" if out is not an archive.
+func archiveFormat(out string) string {
+	lower := strings.ToLower(out)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// memoryEntry is one output held in memory.
+type memoryEntry struct {
+	content []byte
+	mode    os.FileMode
+}
+
+// memorySink collects outputs in memory under relative, slash-separated names.
+type memorySink struct {
+	entries map[string]*memoryEntry
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{entries: make(map[string]*memoryEntry)}
+}
+
+func (s *memorySink) Check(name string) error {
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(filepath.ToSlash(filepath.Clean(name)), "../") {
+		return fmt.Errorf("output %q must be a relative path", name)
+	}
+	return nil
+}
+
+func (s *memorySink) WriteFile(name string, content []byte, mode os.FileMode) error {
+	// Content may live in a pooled buffer, which is reused once this returns
+	content = append([]byte(nil), content...)
+	s.entries[filepath.ToSlash(filepath.Clean(name))] = &memoryEntry{content: content, mode: mode}
+	return nil
+}
+
+func (s *memorySink) ReadFile(name string) ([]byte, error) {
+	e, ok := s.entries[filepath.ToSlash(filepath.Clean(name))]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return e.content, nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+// names returns the names of all outputs, sorted.
+func (s *memorySink) names() []string {
+	names := make([]string, 0, len(s.entries))
+	for name := range s.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dryRunSink checks outputs against another sink, but only keeps them in
+// memory. When the run finishes, it lists what would have been written.
+type dryRunSink struct {
+	*memorySink
+	sink   outputSink
+	logger Logger
+	links  [][2]string
+}
+
+func newDryRunSink(sink outputSink, logger Logger) *dryRunSink {
+	return &dryRunSink{memorySink: newMemorySink(), sink: sink, logger: logger}
+}
+
+func (s *dryRunSink) Check(name string) error {
+	return s.sink.Check(name)
+}
+
+func (s *dryRunSink) Symlink(target, name string) error {
+	s.links = append(s.links, [2]string{name, target})
+	return nil
+}
+
+func (s *dryRunSink) Close() error {
+	for _, name := range s.names() {
+		logf(s.logger, LogInfo, "Would write %s (%d bytes)", name, len(s.entries[name].content))
+	}
+	for _, l := range s.links {
+		logf(s.logger, LogInfo, "Would link %s to %s", l[0], l[1])
+	}
+	return nil
+}
+
+// transactionSink stages outputs in memory, and only writes them into the
+// filesystem when the whole run succeeds. If any output then fails to be
+// written, those already moved into place are restored. Symlinks are
+// written after the files, and links pointing at other links after those.
+type transactionSink struct {
+	*memorySink
+	fs     *fileSink
+	logger Logger
+	links  map[string]string
+}
+
+func newTransactionSink(fs *fileSink, logger Logger) *transactionSink {
+	return &transactionSink{memorySink: newMemorySink(), fs: fs, logger: logger, links: make(map[string]string)}
+}
+
+func (s *transactionSink) Check(name string) error {
+	return s.fs.Check(name)
+}
+
+func (s *transactionSink) Symlink(target, name string) error {
+	name = filepath.Clean(name)
+	delete(s.entries, filepath.ToSlash(name))
+	s.links[name] = target
+	return nil
+}
+
+// linkOrder returns the names of the staged symlinks, each after any other
+// staged link its target goes through.
+func (s *transactionSink) linkOrder() []string {
+	pending := make([]string, 0, len(s.links))
+	for name := range s.links {
+		pending = append(pending, name)
+	}
+	sort.Strings(pending)
+	placed := make(map[string]bool, len(pending))
+	order := make([]string, 0, len(pending))
+	for len(pending) > 0 {
+		var next []string
+		for _, name := range pending {
+			target := s.links[name]
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(name), target)
+			}
+			if _, ok := s.links[target]; ok && target != name && !placed[target] {
+				next = append(next, name)
+				continue
+			}
+			placed[name] = true
+			order = append(order, name)
+		}
+		if len(next) == len(pending) {
+			// The links go round in a circle, so no order is better
+			return append(order, next...)
+		}
+		pending = next
+	}
+	return order
+}
+
+// previousFile is the state of an output before the run replaced it.
+type previousFile struct {
+	exists  bool
+	content []byte
+	mode    os.FileMode
+	link    string
+}
+
+// readPrevious returns the state of name before the run replaces it.
+func readPrevious(name string) previousFile {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return previousFile{}
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(name); err == nil {
+			return previousFile{exists: true, link: target}
+		}
+		return previousFile{}
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return previousFile{}
+	}
+	return previousFile{exists: true, content: content, mode: fi.Mode().Perm()}
+}
+
+func (s *transactionSink) Close() error {
+	names := s.names()
+	if err := s.fs.createDirs(names); err != nil {
+		return err
+	}
+
+	// Write every output next to its target first, so that most failures
+	// happen before anything is replaced
+	staged := make(map[string]string, len(names))
+	for _, name := range names {
+		e := s.entries[name]
+		tmpname, err := writeTempFile(name, e.content, e.mode)
+		if err != nil {
+			err = fmt.Errorf("Cannot write output file %q: %v", name, err)
+		} else if err = s.fs.replaceAttributes(tmpname, name, e.mode); err != nil {
+			os.Remove(tmpname)
+		}
+		if err != nil {
+			for _, t := range staged {
+				os.Remove(t)
+			}
+			return err
+		}
+		staged[name] = tmpname
+	}
+
+	committed := make([]string, 0, len(names)+len(s.links))
+	previous := make(map[string]previousFile, len(names)+len(s.links))
+	for _, name := range names {
+		prev := readPrevious(name)
+		err := s.fs.backupFile(name)
+		if err == nil {
+			err = os.Rename(staged[name], name)
+		}
+		if err != nil {
+			for _, n := range names[len(committed):] {
+				os.Remove(staged[n])
+			}
+			s.rollback(committed, previous)
+			return fmt.Errorf("Cannot write output file %q, restored previous outputs: %v", name, err)
+		}
+		committed = append(committed, name)
+		previous[name] = prev
+		s.fs.synced(filepath.Dir(name))
+	}
+
+	links := s.linkOrder()
+	if err := s.fs.createDirs(links); err != nil {
+		s.rollback(committed, previous)
+		return err
+	}
+	for _, name := range links {
+		prev := readPrevious(name)
+		if err := s.fs.Symlink(s.links[name], name); err != nil {
+			s.rollback(committed, previous)
+			return fmt.Errorf("%v, restored previous outputs", err)
+		}
+		committed = append(committed, name)
+		previous[name] = prev
+	}
+	return s.fs.Close()
+}
+
+// rollback restores outputs replaced by Close to their previous state.
+func (s *transactionSink) rollback(committed []string, previous map[string]previousFile) {
+	for _, name := range committed {
+		prev := previous[name]
+		if !prev.exists {
+			os.Remove(name)
+			continue
+		}
+		if prev.link != "" {
+			if err := replaceSymlink(prev.link, name); err != nil {
+				logf(s.logger, LogError, "Cannot restore %s: %v", name, err)
+			}
+			continue
+		}
+		if err := writeFileAtomic(name, prev.content, prev.mode); err != nil {
+			logf(s.logger, LogError, "Cannot restore %s: %v", name, err)
+		}
+	}
+}
+
+// archiveSink collects outputs in memory, and writes them into a single tar,
+// tar.gz, or zip archive when the run succeeds.
+type archiveSink struct {
+	*memorySink
+	path    string
+	format  string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newArchiveSink(path, format string, mode os.FileMode) *archiveSink {
+	return &archiveSink{
+		memorySink: newMemorySink(),
+		path:       path,
+		format:     format,
+		mode:       mode,
+		modTime:    time.Now(),
+	}
+}
+
+func (s *archiveSink) Close() error {
+	var buf bytes.Buffer
+	var err error
+	switch s.format {
+	case "zip":
+		err = s.writeZip(&buf)
+	case "tar.gz":
+		gz := gzip.NewWriter(&buf)
+		if err = s.writeTar(gz); err == nil {
+			err = gz.Close()
+		}
+	default:
+		err = s.writeTar(&buf)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot write archive %q: %v", s.path, err)
+	}
+	if err := writeFileAtomic(s.path, buf.Bytes(), s.mode); err != nil {
+		return fmt.Errorf("Cannot write archive %q: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *archiveSink) writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, name := range s.names() {
+		e := s.entries[name]
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     int64(e.mode.Perm()),
+			Size:     int64(len(e.content)),
+			ModTime:  s.modTime,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (s *archiveSink) writeZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, name := range s.names() {
+		e := s.entries[name]
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		hdr.SetMode(e.mode.Perm())
+		hdr.SetModTime(s.modTime)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(e.content); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeFileAtomic writes data to a temporary file next to filename, and then
+// renames it into place.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpname, err := writeTempFile(filename, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return nil
+}
+
+// writeTempFile writes data to a new temporary file next to filename, and
+// returns its name.
+func writeTempFile(filename string, data []byte, perm os.FileMode) (string, error) {
+	dir, base := filepath.Split(filename)
+	var f *os.File
+	var err error
+	for i := 0; i < 10; i++ {
+		tmpname := filepath.Join(dir, "."+base+".tpl-"+strconv.FormatInt(rand.Int63(), 36))
+		f, err = os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
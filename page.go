@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// pageExtension marks the inputs that are pages when a Layout is set.
+const pageExtension = ".md"
+
+// pageContentKey holds the HTML of a page in the values of its layout.
+const pageContentKey = "Content"
+
+// contentPage is a Markdown input, rendered as the content of a layout.
+type contentPage struct {
+	layout      string
+	frontMatter map[string]interface{}
+	content     string
+}
+
+// isPage reports whether the input fn is a page rather than a template.
+func (r *Renderer) isPage(fn string) bool {
+	return r.Layout != "" && strings.HasSuffix(fn, pageExtension)
+}
+
+// readPage reads the page fn, whose front matter may pick another layout
+// than the default, in the same directory.
+func (r *Renderer) readPage(fn string) (*contentPage, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	fm, body, err := splitPageFrontMatter(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse the front matter of %s: %v", fn, err)
+	}
+	p := &contentPage{layout: r.Layout, frontMatter: fm, content: markdownToHTML(string(body))}
+	if v, ok := fm["layout"]; ok {
+		name, ok := v.(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("The layout of %s must be a file name", fn)
+		}
+		p.layout = filepath.Join(filepath.Dir(r.Layout), filepath.FromSlash(name))
+	}
+	if err := r.jail.Check(p.layout); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// splitPageFrontMatter separates the front matter of a page from its body.
+// Unlike that of templates, it may hold any keys.
+func splitPageFrontMatter(data []byte) (map[string]interface{}, []byte, error) {
+	fm := map[string]interface{}{}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) < 2 || !bytes.Equal(bytes.TrimRight(lines[0], "\r\n"), frontMatterDelim) {
+		return fm, data, nil
+	}
+	for i := 1; i < len(lines); i++ {
+		if !bytes.Equal(bytes.TrimRight(lines[i], "\r\n"), frontMatterDelim) {
+			continue
+		}
+		if err := yaml.Unmarshal(bytes.Join(lines[1:i], nil), &fm); err != nil {
+			return nil, nil, err
+		}
+		if fm == nil {
+			fm = map[string]interface{}{}
+		}
+		for k, v := range fm {
+			fm[k] = normalizeValue(v)
+		}
+		return fm, bytes.Join(lines[i+1:], nil), nil
+	}
+	return nil, nil, fmt.Errorf("missing the closing %s", frontMatterDelim)
+}
+
+// pageValues layers the front matter and content of the page p on top of
+// the values of its job.
+func (r *Renderer) pageValues(p *contentPage, data interface{}) (interface{}, error) {
+	values, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Cannot merge front matter into values that are a %T rather than a map", data)
+	}
+	merged := make(map[string]interface{}, len(values)+len(p.frontMatter)+1)
+	for k, v := range values {
+		merged[k] = v
+	}
+	for k, v := range p.frontMatter {
+		merged[k] = v
+	}
+	r.setBuiltin(merged, pageContentKey, p.content)
+	return merged, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// DefaultPageSize is the number of items on each page of a template that
+// paginates a list without a page_size.
+const DefaultPageSize = 10
+
+// pageKey holds the page being rendered in the values of a template that
+// paginates a list.
+const pageKey = "Page"
+
+// paginate is the `paginate` template function, splitting list into pages
+// of at most size items, e.g. `{{ range paginate .posts 10 }}`.
+func paginate(list interface{}, size int) ([]interface{}, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("paginate: page size must be positive, not %d", size)
+	}
+	items, err := listItems(list)
+	if err != nil {
+		return nil, fmt.Errorf("paginate: %v", err)
+	}
+	pages := []interface{}{}
+	for start := 0; start < len(items); start += size {
+		end := start + size
+		if end > len(items) {
+			end = len(items)
+		}
+		pages = append(pages, items[start:end])
+	}
+	return pages, nil
+}
+
+// listItems returns the items of any slice or array.
+func listItems(list interface{}) ([]interface{}, error) {
+	if list == nil {
+		return nil, nil
+	}
+	if items, ok := list.([]interface{}); ok {
+		return items, nil
+	}
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list, not %T", list)
+	}
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items, nil
+}
+
+// paginated reports whether the template of fm is rendered once per page of
+// a list.
+func (fm *FrontMatter) paginated() bool {
+	return fm != nil && fm.Paginate != ""
+}
+
+// pageOutput names the output of page n of oname, e.g. "posts-2.html" for
+// "posts.html".
+func pageOutput(oname string, n int) string {
+	ext := filepath.Ext(oname)
+	if ext == filepath.Base(oname) {
+		ext = ""
+	}
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(oname, ext), n, ext)
+}
+
+// renderPages renders the template of p into one output per page of the list
+// its front matter paginates, with the page in `.Page`.
+func (r *Renderer) renderPages(data interface{}, p parsedTemplate, inames []string, oname string) error {
+	if oname == "-" {
+		return errors.New("Cannot paginate into STDOUT; give an output directory")
+	}
+	values, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot paginate values that are a %T rather than a map", data)
+	}
+	path := strings.Split(strings.TrimPrefix(p.fm.Paginate, "."), ".")
+	list, ok := lookupPath(values, path)
+	if !ok {
+		return fmt.Errorf("Cannot paginate .%s, which is not defined", strings.Join(path, "."))
+	}
+	size := p.fm.PageSize
+	if size == 0 {
+		size = DefaultPageSize
+	}
+	pages, err := paginate(list, size)
+	if err != nil {
+		return fmt.Errorf("Cannot paginate .%s: %v", strings.Join(path, "."), err)
+	}
+	if len(pages) == 0 {
+		pages = []interface{}{[]interface{}{}}
+	}
+
+	names := make([]string, len(pages))
+	for n := range pages {
+		names[n] = filepath.Base(pageOutput(oname, n+1))
+	}
+	for n, items := range pages {
+		page := map[string]interface{}{
+			"Number": n + 1,
+			"Total":  len(pages),
+			"Size":   size,
+			"Items":  items,
+			"First":  names[0],
+			"Last":   names[len(names)-1],
+			"Prev":   "",
+			"Next":   "",
+		}
+		if n > 0 {
+			page["Prev"] = names[n-1]
+		}
+		if n < len(pages)-1 {
+			page["Next"] = names[n+1]
+		}
+		merged := make(map[string]interface{}, len(values)+1)
+		for k, v := range values {
+			merged[k] = v
+		}
+		r.setBuiltin(merged, pageKey, page)
+		if err := r.render(merged, p, inames, pageOutput(oname, n+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"text/template/parse"
+)
+
+// valueRef is a reference to a path in the top-level values, e.g. `.user.name`
+// or `$.user.name`.
+type valueRef struct {
+	Path []string
+	Node parse.Node
+}
+
+// walkNodes calls fn for every node in the tree rooted at n. rootDot reports
+// whether dot still refers to the top-level values at that point; it becomes
+// false inside the body of `range` and `with`.
+func walkNodes(n parse.Node, rootDot bool, fn func(n parse.Node, rootDot bool)) {
+	if n == nil {
+		return
+	}
+	fn(n, rootDot)
+	switch tn := n.(type) {
+	case *parse.ListNode:
+		if tn == nil {
+			return
+		}
+		for _, c := range tn.Nodes {
+			walkNodes(c, rootDot, fn)
+		}
+	case *parse.ActionNode:
+		walkNodes(tn.Pipe, rootDot, fn)
+	case *parse.PipeNode:
+		if tn == nil {
+			return
+		}
+		for _, d := range tn.Decl {
+			walkNodes(d, rootDot, fn)
+		}
+		for _, c := range tn.Cmds {
+			walkNodes(c, rootDot, fn)
+		}
+	case *parse.CommandNode:
+		for _, a := range tn.Args {
+			walkNodes(a, rootDot, fn)
+		}
+	case *parse.ChainNode:
+		walkNodes(tn.Node, rootDot, fn)
+	case *parse.IfNode:
+		walkBranch(&tn.BranchNode, rootDot, rootDot, fn)
+	case *parse.RangeNode:
+		walkBranch(&tn.BranchNode, rootDot, false, fn)
+	case *parse.WithNode:
+		walkBranch(&tn.BranchNode, rootDot, false, fn)
+	case *parse.TemplateNode:
+		walkNodes(tn.Pipe, rootDot, fn)
+	}
+}
+
+func walkBranch(b *parse.BranchNode, rootDot, bodyRootDot bool, fn func(parse.Node, bool)) {
+	walkNodes(b.Pipe, rootDot, fn)
+	walkNodes(b.List, bodyRootDot, fn)
+	walkNodes(b.ElseList, rootDot, fn)
+}
+
+// walkDots walks n like walkNodes does, but passes fn the path in the
+// top-level values that dot is at, as far as `with` tells. Known is false
+// where that cannot be told, such as in range.
+func walkDots(n parse.Node, dot []string, known bool, fn func(n parse.Node, dot []string, known bool)) {
+	if n == nil {
+		return
+	}
+	fn(n, dot, known)
+	switch tn := n.(type) {
+	case *parse.ListNode:
+		if tn == nil {
+			return
+		}
+		for _, c := range tn.Nodes {
+			walkDots(c, dot, known, fn)
+		}
+	case *parse.ActionNode:
+		walkDots(tn.Pipe, dot, known, fn)
+	case *parse.PipeNode:
+		if tn == nil {
+			return
+		}
+		for _, d := range tn.Decl {
+			walkDots(d, dot, known, fn)
+		}
+		for _, c := range tn.Cmds {
+			walkDots(c, dot, known, fn)
+		}
+	case *parse.CommandNode:
+		for _, a := range tn.Args {
+			walkDots(a, dot, known, fn)
+		}
+	case *parse.ChainNode:
+		walkDots(tn.Node, dot, known, fn)
+	case *parse.IfNode:
+		walkDots(tn.Pipe, dot, known, fn)
+		walkDots(tn.List, dot, known, fn)
+		walkDots(tn.ElseList, dot, known, fn)
+	case *parse.RangeNode:
+		walkDots(tn.Pipe, dot, known, fn)
+		walkDots(tn.List, nil, false, fn)
+		walkDots(tn.ElseList, dot, known, fn)
+	case *parse.WithNode:
+		walkDots(tn.Pipe, dot, known, fn)
+		var body []string
+		bodyKnown := false
+		if known && len(tn.Pipe.Decl) == 0 && len(tn.Pipe.Cmds) == 1 && len(tn.Pipe.Cmds[0].Args) == 1 {
+			if f, ok := tn.Pipe.Cmds[0].Args[0].(*parse.FieldNode); ok {
+				body, bodyKnown = append(append([]string{}, dot...), f.Ident...), true
+			}
+		}
+		walkDots(tn.List, body, bodyKnown, fn)
+		walkDots(tn.ElseList, dot, known, fn)
+	case *parse.TemplateNode:
+		walkDots(tn.Pipe, dot, known, fn)
+	}
+}
+
+// valueRefs lists every reference to the top-level values in a tree.
+func valueRefs(t *parse.Tree, rootDot bool) []valueRef {
+	var refs []valueRef
+	if t == nil || t.Root == nil {
+		return refs
+	}
+	walkNodes(t.Root, rootDot, func(n parse.Node, rootDot bool) {
+		switch tn := n.(type) {
+		case *parse.FieldNode:
+			if rootDot {
+				refs = append(refs, valueRef{Path: tn.Ident, Node: tn})
+			}
+		case *parse.VariableNode:
+			if len(tn.Ident) > 1 && tn.Ident[0] == "$" {
+				refs = append(refs, valueRef{Path: tn.Ident[1:], Node: tn})
+			}
+		}
+	})
+	return refs
+}
+
+// templateRefs lists every `{{ template "name" }}` invocation in a tree.
+func templateRefs(t *parse.Tree) []*parse.TemplateNode {
+	var refs []*parse.TemplateNode
+	if t == nil || t.Root == nil {
+		return refs
+	}
+	walkNodes(t.Root, true, func(n parse.Node, _ bool) {
+		if tn, ok := n.(*parse.TemplateNode); ok {
+			refs = append(refs, tn)
+		}
+	})
+	return refs
+}
+
+// includeRefs lists the names of the templates rendered with
+// `{{ include "name" . }}` in a tree.
+func includeRefs(t *parse.Tree) []string {
+	var names []string
+	if t == nil || t.Root == nil {
+		return names
+	}
+	walkNodes(t.Root, true, func(n parse.Node, _ bool) {
+		cmd, ok := n.(*parse.CommandNode)
+		if !ok || len(cmd.Args) < 2 {
+			return
+		}
+		if id, ok := cmd.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "include" {
+			return
+		}
+		if s, ok := cmd.Args[1].(*parse.StringNode); ok {
+			names = append(names, s.Text)
+		}
+	})
+	return names
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// patchSink checks outputs against the filesystem, but only keeps them in
+// memory. When the run finishes, it writes a unified diff from the files as
+// they are to the outputs, which `git apply` or `patch -p1` can apply.
+type patchSink struct {
+	*memorySink
+	fs    *fileSink
+	w     io.Writer
+	links map[string]string
+}
+
+func newPatchSink(fs *fileSink, w io.Writer) *patchSink {
+	return &patchSink{memorySink: newMemorySink(), fs: fs, w: w, links: make(map[string]string)}
+}
+
+func (s *patchSink) Check(name string) error {
+	if err := s.memorySink.Check(name); err != nil {
+		return err
+	}
+	return s.fs.Check(name)
+}
+
+func (s *patchSink) Symlink(target, name string) error {
+	s.links[name] = target
+	return nil
+}
+
+func (s *patchSink) Close() error {
+	names := s.names()
+	for name := range s.links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		var content []byte
+		mode := "100644"
+		if target, ok := s.links[name]; ok {
+			content, mode = []byte(target), "120000"
+		} else {
+			e := s.entries[name]
+			content = e.content
+			if e.mode&0111 != 0 {
+				mode = "100755"
+			}
+		}
+		old, oldMode, exists, err := patchBase(name)
+		if err != nil {
+			return err
+		}
+		if bytes.IndexByte(content, 0) >= 0 || bytes.IndexByte(old, 0) >= 0 {
+			return fmt.Errorf("Cannot emit a patch of %s, which is binary", name)
+		}
+		var hunks bytes.Buffer
+		if !unifiedHunks(&hunks, old, content) && exists && oldMode == mode {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "diff --git a/%s b/%s\n", name, name)
+		switch {
+		case !exists:
+			fmt.Fprintf(&buf, "new file mode %s\n", mode)
+		case oldMode != mode:
+			fmt.Fprintf(&buf, "old mode %s\nnew mode %s\n", oldMode, mode)
+		}
+		if hunks.Len() == 0 {
+			continue
+		}
+		if exists {
+			fmt.Fprintf(&buf, "--- a/%s\n", name)
+		} else {
+			buf.WriteString("--- /dev/null\n")
+		}
+		fmt.Fprintf(&buf, "+++ b/%s\n", name)
+		buf.Write(hunks.Bytes())
+	}
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("Cannot write patch: %v", err)
+	}
+	return nil
+}
+
+// patchBase returns the content and git mode of the file at name, which the
+// patch is made against.
+func patchBase(name string) ([]byte, string, bool, error) {
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil, "", false, nil
+	}
+	if err != nil {
+		return nil, "", false, fmt.Errorf("Cannot read %q to patch it: %v", name, err)
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(name)
+		if err != nil {
+			return nil, "", false, fmt.Errorf("Cannot read %q to patch it: %v", name, err)
+		}
+		return []byte(target), "120000", true, nil
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("Cannot read %q to patch it: %v", name, err)
+	}
+	if fi.Mode()&0111 != 0 {
+		return content, "100755", true, nil
+	}
+	return content, "100644", true, nil
+}
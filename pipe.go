@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Pipe is a command, run with `sh -c`, that rendered outputs are fed through
+// on STDIN, and replaced by what it writes to STDOUT, e.g. `jq .` or `gofmt`.
+type Pipe struct {
+	// Ext, if set, restricts the pipe to outputs whose names end with it,
+	// e.g. ".json".
+	Ext     string
+	Command string
+}
+
+// parsePipe parses a -pipe flag, which is a command, optionally preceded by
+// an extension and an equals sign, e.g. ".json=jq .".
+func parsePipe(s string) (Pipe, error) {
+	p := Pipe{Command: s}
+	if i := strings.Index(s, "="); i > 0 && strings.HasPrefix(s, ".") && !strings.ContainsAny(s[:i], " \t") {
+		p.Ext, p.Command = s[:i], s[i+1:]
+	}
+	if strings.TrimSpace(p.Command) == "" {
+		return Pipe{}, fmt.Errorf("pipe command must not be blank")
+	}
+	return p, nil
+}
+
+// pipe feeds content through every pipe that applies to the output name, in
+// order.
+func (r *Renderer) pipe(name string, content []byte) ([]byte, error) {
+	for _, p := range r.Pipes {
+		if p.Ext != "" && !strings.HasSuffix(name, p.Ext) {
+			continue
+		}
+		r.logf(LogDebug, "Piping %s through %q", name, p.Command)
+		var stdout, stderr bytes.Buffer
+		c := exec.Command("sh", "-c", p.Command)
+		c.Stdin = bytes.NewReader(content)
+		c.Stdout = &stdout
+		c.Stderr = &stderr
+		if err := c.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("Cannot pipe %s through %q: %v\n%s", name, p.Command, err, msg)
+			}
+			return nil, fmt.Errorf("Cannot pipe %s through %q: %v", name, p.Command, err)
+		}
+		content = stdout.Bytes()
+	}
+	return content, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// installedPlugin is a plugin registered with -plugin, or found in the plugin
+// directory.
+type installedPlugin struct {
+	Kind string
+	Name string
+	Path string
+
+	// Legacy plugins, registered with -plugin, are called without a
+	// handshake.
+	Legacy bool
+}
+
+// installedPlugins lists the plugins registered with -plugin, and then those
+// of dir, each kind in the order of their names.
+func installedPlugins(flagged pluginSet, dir *pluginDir) []installedPlugin {
+	var list []installedPlugin
+	add := func(kind string, m map[string]string, legacy bool) {
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			list = append(list, installedPlugin{Kind: kind, Name: name, Path: m[name], Legacy: legacy})
+		}
+	}
+	add(pluginKindFunc, flagged, true)
+	add(pluginKindFunc, dir.Funcs, false)
+	add(pluginKindSource, dir.Sources, false)
+	add(pluginKindSink, dir.Sinks, false)
+	return list
+}
+
+// runPlugins runs the plugins subcommand named first in args, for the
+// plugins registered with -plugin and those found in dirName:
+//
+//	list    list every plugin, without running any
+//	doctor  shake hands with every plugin, and tell whether it is compatible
+//
+// It returns the process exit code, which for doctor is 1 if any plugin is
+// not compatible.
+func runPlugins(args []string, flagged pluginSet, dirName string, dir *pluginDir) int {
+	if len(args) != 1 {
+		logf(nil, LogError, "The plugins command takes a subcommand: list, or doctor")
+		return 1
+	}
+	list := installedPlugins(flagged, dir)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	switch args[0] {
+	case "list":
+		fmt.Fprintln(w, "KIND\tNAME\tPATH")
+		for _, p := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.Kind, p.Name, p.Path)
+		}
+	case "doctor":
+		if dirName == "" {
+			dirName = "none, without -plugin-dir"
+		}
+		logf(nil, LogInfo, "tpl speaks plugin protocol version %d; plugin directory: %s", PluginProtocolVersion, dirName)
+		failed := 0
+		fmt.Fprintln(w, "KIND\tNAME\tSTATUS\tPROTOCOL\tVERSION\tDETAILS")
+		for _, p := range list {
+			status, protocol, version, details := "ok", "-", "-", ""
+			hello, err := handshake(p.Name, p.Path)
+			if err != nil {
+				err = fmt.Errorf("handshake failed: %s", strings.TrimPrefix(err.Error(), "plugin "+p.Name+": "))
+			} else {
+				protocol = fmt.Sprintf("%d", hello.Protocol)
+				if hello.Version != "" {
+					version = hello.Version
+				}
+				err = hello.check(p.Name, p.Kind)
+				details = capabilities(hello)
+			}
+			if err != nil && p.Legacy {
+				details = "no handshake; called as registered with -plugin"
+			} else if err != nil {
+				// Only the first line of what the plugin wrote to STDERR
+				// fits into the table
+				msg := strings.TrimPrefix(err.Error(), "plugin "+p.Name+": ")
+				status, details = "incompatible", strings.SplitN(msg, "\n", 2)[0]
+				failed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Kind, p.Name, status, protocol, version, details)
+		}
+		w.Flush()
+		if failed > 0 {
+			logf(nil, LogError, "%d of %d plugin(s) are not compatible with this tpl", failed, len(list))
+			return 1
+		}
+		return 0
+	default:
+		logf(nil, LogError, "Unknown plugins subcommand %q; must be list, or doctor", args[0])
+		return 1
+	}
+	w.Flush()
+	return 0
+}
+
+// capabilities formats the capabilities of a plugin, e.g. "source v1".
+func capabilities(hello *pluginHello) string {
+	caps := make([]string, 0, len(hello.Capabilities))
+	for kind, v := range hello.Capabilities {
+		caps = append(caps, fmt.Sprintf("%s v%d", kind, v))
+	}
+	sort.Strings(caps)
+	return strings.Join(caps, ", ")
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pluginSet maps the names of plugins to the helper binaries that implement
+// them, for the `plugin` template function.
+type pluginSet map[string]string
+
+// PluginProtocolVersion is the version of the plugin protocol this tpl
+// speaks, which plugins agree on in a handshake.
+const PluginProtocolVersion = 1
+
+// DefaultPluginTimeout is how long each call of a plugin may take before it
+// is killed, unless -plugin-timeout says otherwise.
+const DefaultPluginTimeout = 30 * time.Second
+
+// pluginTimeout is how long each call of a plugin may take; 0 for no limit.
+var pluginTimeout = DefaultPluginTimeout
+
+// The kinds of plugins, and of the requests they answer.
+const (
+	pluginKindFunc   = "func"
+	pluginKindSource = "source"
+	pluginKindSink   = "sink"
+)
+
+// pluginSchemas are the versions of the requests of every kind of plugin
+// this tpl sends, which plugins support if they list them with the same
+// version among their capabilities.
+var pluginSchemas = map[string]int{pluginKindFunc: 1, pluginKindSource: 1, pluginKindSink: 1}
+
+// pluginRequest is written as JSON to the STDIN of a plugin. Protocol is the
+// version of the protocol agreed on in the handshake, if there was one.
+type pluginRequest struct {
+	Name     string        `json:"name"`
+	Args     []interface{} `json:"args"`
+	Protocol int           `json:"protocol,omitempty"`
+}
+
+// pluginHandshakeRequest asks a plugin, before anything else, which of the
+// protocol versions tpl offers it speaks, and what it is capable of.
+type pluginHandshakeRequest struct {
+	Name      string           `json:"name"`
+	Handshake pluginOfferedAPI `json:"handshake"`
+}
+
+// pluginOfferedAPI lists the protocol versions, and the versions of the
+// requests of every kind of plugin, tpl speaks, and the version of tpl.
+type pluginOfferedAPI struct {
+	Protocols []int          `json:"protocols"`
+	Schemas   map[string]int `json:"schemas"`
+	Version   string         `json:"version,omitempty"`
+}
+
+// pluginHello is the result of a handshake: the protocol version the plugin
+// chose, the kinds of requests it answers, each with the version of their
+// schema, and the version of the plugin itself.
+type pluginHello struct {
+	Protocol     int            `json:"protocol"`
+	Capabilities map[string]int `json:"capabilities"`
+	Version      string         `json:"version,omitempty"`
+}
+
+// pluginResponse is read as JSON from the STDOUT of a plugin.
+type pluginResponse struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Set registers a plugin from a -plugin flag in the form of name=path.
+func (p pluginSet) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("plugin must be in the form of name=path")
+	}
+	name, path := value[:i], value[i+1:]
+	if _, ok := p[name]; ok {
+		return fmt.Errorf("plugin %q is already registered", name)
+	}
+	p[name] = path
+	return nil
+}
+
+func (p pluginSet) String() string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name+"="+p[name])
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Func is the `plugin` template function, running the helper binary
+// registered as name with the arguments, e.g. `{{ plugin "ipam" "10.0.0.0/24" }}`.
+// The binary reads a JSON object of the name and args on STDIN, and writes
+// one with the result, or an error, on STDOUT.
+func (p pluginSet) Func(name string, args ...interface{}) (interface{}, error) {
+	path, ok := p[name]
+	if !ok {
+		return nil, fmt.Errorf("no plugin %q is registered; register it with -plugin=%s=PATH", name, name)
+	}
+	if args == nil {
+		args = []interface{}{}
+	}
+	for i, a := range args {
+		args[i] = normalizeValue(a)
+	}
+	protocol, err := pluginHandshakes.verify(name, path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(pluginRequest{Name: name, Args: args, Protocol: protocol})
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: cannot encode the arguments: %v", name, err)
+	}
+
+	return callPlugin(name, path, req)
+}
+
+// callPlugin runs the binary path of the plugin name with the JSON request
+// req on STDIN, and returns the result of its response. A plugin that takes
+// longer than pluginTimeout is killed.
+func callPlugin(name, path string, req []byte) (interface{}, error) {
+	ctx := context.Background()
+	if pluginTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pluginTimeout)
+		defer cancel()
+	}
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, path)
+	c.Stdin = bytes.NewReader(req)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("plugin %s: took longer than %s, and was killed; raise -plugin-timeout if it really takes this long", name, pluginTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("plugin %s: %v\n%s", name, err, msg)
+		}
+		return nil, fmt.Errorf("plugin %s: %v", name, err)
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("plugin %s: cannot decode its response: %v", name, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("plugin %s: %s", name, resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// handshake asks the plugin name at path for its pluginHello.
+func handshake(name, path string) (*pluginHello, error) {
+	protocols := []int{PluginProtocolVersion}
+	req, err := json.Marshal(pluginHandshakeRequest{Name: name, Handshake: pluginOfferedAPI{Protocols: protocols, Schemas: pluginSchemas, Version: BuildVersion}})
+	if err != nil {
+		return nil, err
+	}
+	result, err := callPlugin(name, path, req)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(result)
+	var hello pluginHello
+	if err := json.Unmarshal(data, &hello); err != nil || hello.Protocol == 0 {
+		return nil, fmt.Errorf("plugin %s: answered the handshake without a protocol version", name)
+	}
+	return &hello, nil
+}
+
+// check returns an error unless the plugin that said hello speaks the
+// protocol of tpl, and answers requests of kind as tpl sends them.
+func (h *pluginHello) check(name, kind string) error {
+	if h.Protocol != PluginProtocolVersion {
+		return fmt.Errorf("plugin %s: speaks protocol version %d, but tpl speaks %d", name, h.Protocol, PluginProtocolVersion)
+	}
+	v, ok := h.Capabilities[kind]
+	if !ok {
+		return fmt.Errorf("plugin %s: is not capable of being a %s plugin", name, kind)
+	}
+	if v != pluginSchemas[kind] {
+		return fmt.Errorf("plugin %s: answers version %d of %s requests, but tpl sends version %d", name, v, kind, pluginSchemas[kind])
+	}
+	return nil
+}
+
+// handshakeCache shakes hands with every plugin that requires it once, on
+// its first call, so that an incompatible plugin fails the run with why,
+// rather than with whatever it makes of a request it does not understand.
+type handshakeCache struct {
+	mu       sync.Mutex
+	kinds    map[string]string
+	verified map[string]error
+}
+
+// pluginHandshakes holds the handshakes of the plugins of the plugin
+// directory. Plugins registered with -plugin predate the handshake, and
+// are called without one.
+var pluginHandshakes = &handshakeCache{kinds: make(map[string]string), verified: make(map[string]error)}
+
+// require makes the plugin at path shake hands before its first call, as a
+// plugin of kind.
+func (c *handshakeCache) require(path, kind string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kinds[path] = kind
+}
+
+// verify shakes hands with the plugin name at path, if it requires it, and
+// returns the protocol version agreed on, or 0 for a plugin that does not
+// require a handshake.
+func (c *handshakeCache) verify(name, path string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kind, ok := c.kinds[path]
+	if !ok {
+		return 0, nil
+	}
+	err, ok := c.verified[path]
+	if !ok {
+		var hello *pluginHello
+		if hello, err = handshake(name, path); err == nil {
+			err = hello.check(name, kind)
+		}
+		c.verified[path] = err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return PluginProtocolVersion, nil
+}
+
+// pluginSourceRequest asks a values source plugin for the values of source,
+// e.g. "cmdb://hosts/web".
+type pluginSourceRequest struct {
+	Name     string `json:"name"`
+	Source   string `json:"source"`
+	Protocol int    `json:"protocol"`
+}
+
+// pluginSinkRequest hands a sink plugin every output of a run, to be stored
+// at dest, e.g. "s3://bucket/prefix".
+type pluginSinkRequest struct {
+	Name     string         `json:"name"`
+	Dest     string         `json:"dest"`
+	Outputs  []pluginOutput `json:"outputs"`
+	Protocol int            `json:"protocol"`
+}
+
+// pluginOutput is one output handed to a sink plugin, under its relative,
+// slash-separated name. Content is base64-encoded in JSON.
+type pluginOutput struct {
+	Name    string `json:"name"`
+	Content []byte `json:"content"`
+	Mode    uint32 `json:"mode"`
+}
+
+// The executables of a plugin directory are named after the kind of plugin
+// they are, and what they provide: tpl-func-NAME registers NAME for the
+// plugin template function, tpl-source-SCHEME serves values sources of
+// SCHEME://, and tpl-sink-SCHEME stores outputs written to -out=SCHEME://.
+const (
+	funcPluginPrefix   = "tpl-func-"
+	sourcePluginPrefix = "tpl-source-"
+	sinkPluginPrefix   = "tpl-sink-"
+)
+
+// pluginDir holds the plugins discovered in a plugin directory, by the names
+// and schemes they provide.
+type pluginDir struct {
+	Funcs   map[string]string
+	Sources map[string]string
+	Sinks   map[string]string
+}
+
+// discoverPlugins lists the plugins among the executables in dir, which
+// -plugin-dir named; without one, there are none. Other files are ignored.
+func discoverPlugins(dir string) (*pluginDir, error) {
+	p := &pluginDir{Funcs: make(map[string]string), Sources: make(map[string]string), Sinks: make(map[string]string)}
+	if dir == "" {
+		return p, nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read plugin directory: %v", err)
+	}
+	for _, fi := range entries {
+		if fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode().Perm()&0111 == 0) {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), ".exe")
+		path := filepath.Join(dir, fi.Name())
+		switch {
+		case strings.HasPrefix(name, funcPluginPrefix):
+			p.Funcs[strings.TrimPrefix(name, funcPluginPrefix)] = path
+			pluginHandshakes.require(path, pluginKindFunc)
+		case strings.HasPrefix(name, sourcePluginPrefix):
+			scheme := strings.TrimPrefix(name, sourcePluginPrefix)
+			if scheme == "file" || isSecretScheme(scheme) {
+				return nil, fmt.Errorf("Plugin %s cannot replace the built-in %s:// values source", path, scheme)
+			}
+			p.Sources[scheme] = path
+			pluginHandshakes.require(path, pluginKindSource)
+		case strings.HasPrefix(name, sinkPluginPrefix):
+			p.Sinks[strings.TrimPrefix(name, sinkPluginPrefix)] = path
+			pluginHandshakes.require(path, pluginKindSink)
+		}
+	}
+	return p, nil
+}
+
+// loadPluginSource fetches the values of ref from the plugin at path, which
+// must be a JSON object.
+func loadPluginSource(path, ref string) (map[string]interface{}, error) {
+	scheme, _ := splitScheme(ref)
+	protocol, err := pluginHandshakes.verify(scheme, path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(pluginSourceRequest{Name: scheme, Source: ref, Protocol: protocol})
+	if err != nil {
+		return nil, err
+	}
+	result, err := callPlugin(scheme, path, req)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Cannot load values from %s: plugin %s returned a %T rather than a JSON object", ref, scheme, result)
+	}
+	return m, nil
+}
+
+// sinkPlugin returns the binary of the sink plugin serving the scheme of out,
+// or "" if there is none.
+func (r *Renderer) sinkPlugin(out string) string {
+	if !strings.Contains(out, "://") {
+		return ""
+	}
+	scheme, _ := splitScheme(out)
+	return r.SinkPlugins[scheme]
+}
+
+// checkSinkPlugin returns an error unless the run may hand its outputs to the
+// sink plugin for dest. Nothing confines where a plugin stores them, so
+// neither sandbox mode, a jail, nor a policy restricting output roots allows
+// it, and a policy must allow plugins, and list the scheme of dest among its
+// allowed_schemes, if it lists any.
+func (r *Renderer) checkSinkPlugin(dest string) error {
+	scheme, _ := splitScheme(dest)
+	switch {
+	case r.Sandbox:
+		return fmt.Errorf("Cannot write outputs to %s through a plugin in sandbox mode", dest)
+	case r.jail != nil:
+		return fmt.Errorf("Cannot write outputs to %s through a plugin, which is outside of root %q", dest, r.jail.root)
+	}
+	if err := r.Policy.CheckPlugins(); err != nil {
+		return err
+	}
+	if r.Policy != nil && len(r.Policy.AllowedOutputRoots) > 0 {
+		return fmt.Errorf("Policy does not allow writing to %q, which is outside of every allowed output root", dest)
+	}
+	if err := r.Policy.CheckScheme(scheme); err != nil {
+		return fmt.Errorf("Policy does not allow writing outputs to %q destinations", scheme)
+	}
+	return nil
+}
+
+// pluginSink collects outputs in memory, and hands them all to a sink plugin
+// once the run succeeded.
+type pluginSink struct {
+	*memorySink
+	scheme string
+	path   string
+	dest   string
+	logger Logger
+}
+
+func newPluginSink(dest, path string, logger Logger) *pluginSink {
+	scheme, _ := splitScheme(dest)
+	return &pluginSink{memorySink: newMemorySink(), scheme: scheme, path: path, dest: dest, logger: logger}
+}
+
+func (s *pluginSink) Close() error {
+	protocol, err := pluginHandshakes.verify(s.scheme, s.path)
+	if err != nil {
+		return err
+	}
+	names := s.names()
+	req := pluginSinkRequest{Name: s.scheme, Dest: s.dest, Outputs: make([]pluginOutput, len(names)), Protocol: protocol}
+	for i, name := range names {
+		e := s.entries[name]
+		req.Outputs[i] = pluginOutput{Name: name, Content: e.content, Mode: uint32(e.mode.Perm())}
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	logf(s.logger, LogInfo, "Handing %d output(s) to plugin %s for %s", len(names), s.scheme, s.dest)
+	if _, err := callPlugin(s.scheme, s.path, data); err != nil {
+		return fmt.Errorf("Cannot write outputs to %s: %v", s.dest, err)
+	}
+	return nil
+}
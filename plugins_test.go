@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePlugin writes an executable shell script named name into dir, which
+// answers every request with response, after running script.
+func writePlugin(t *testing.T, dir, name, script, response string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	content := "#!/bin/sh\ncat >/dev/null\n" + script + "\necho '" + response + "'\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var discoveryTests = []struct {
+	name    string
+	files   map[string]os.FileMode
+	funcs   []string
+	sources []string
+	sinks   []string
+	err     string
+}{
+	{
+		name:    "kinds",
+		files:   map[string]os.FileMode{"tpl-func-ipam": 0755, "tpl-source-cmdb": 0755, "tpl-sink-blob": 0755},
+		funcs:   []string{"ipam"},
+		sources: []string{"cmdb"},
+		sinks:   []string{"blob"},
+	},
+	{
+		name:  "not-executable",
+		files: map[string]os.FileMode{"tpl-func-ipam": 0644, "README": 0755, "tpl-func-uuid": 0755},
+		funcs: []string{"uuid"},
+	},
+	{
+		name:  "replaces-builtin",
+		files: map[string]os.FileMode{"tpl-source-file": 0755},
+		err:   "cannot replace the built-in file:// values source",
+	},
+}
+
+func TestDiscoverPlugins(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugins are shell scripts")
+	}
+	for _, test := range discoveryTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, mode := range test.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), nil, mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p, err := discoverPlugins(dir)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected discovery to fail with %q, but it succeeded", test.err)
+			}
+			for kind, found := range map[string][2]interface{}{"func": {p.Funcs, test.funcs}, "source": {p.Sources, test.sources}, "sink": {p.Sinks, test.sinks}} {
+				got, expected := found[0].(map[string]string), found[1].([]string)
+				if len(got) != len(expected) {
+					t.Errorf("Discovered %d %s plugin(s), expected %v", len(got), kind, expected)
+				}
+				for _, name := range expected {
+					if got[name] != filepath.Join(dir, pluginPrefix(kind)+name) {
+						t.Errorf("Discovered %s plugin %q at %q", kind, name, got[name])
+					}
+				}
+			}
+		})
+	}
+
+	if p, err := discoverPlugins(""); err != nil || len(p.Funcs)+len(p.Sources)+len(p.Sinks) != 0 {
+		t.Errorf("Discovered %+v, %v without a plugin directory, expected nothing", p, err)
+	}
+	if _, err := discoverPlugins(filepath.Join(os.TempDir(), "tpl-test-missing")); err == nil {
+		t.Errorf("Expected a missing plugin directory to fail")
+	}
+}
+
+func pluginPrefix(kind string) string {
+	return map[string]string{"func": funcPluginPrefix, "source": sourcePluginPrefix, "sink": sinkPluginPrefix}[kind]
+}
+
+var sinkPluginTests = []struct {
+	name   string
+	change func(r *Renderer)
+	err    string
+}{
+	{name: "allowed", change: func(r *Renderer) {}},
+	{name: "policy-allows", change: func(r *Renderer) { r.Policy = &Policy{AllowPlugins: true, AllowedSchemes: []string{"file", "blob"}} }},
+	{name: "sandbox", change: func(r *Renderer) { r.Sandbox = true }, err: "in sandbox mode"},
+	{name: "root", change: func(r *Renderer) { r.Root = "." }, err: "outside of root"},
+	{name: "policy-without-plugins", change: func(r *Renderer) { r.Policy = &Policy{} }, err: "does not allow plugins"},
+	{name: "policy-output-roots", change: func(r *Renderer) { r.Policy = &Policy{AllowPlugins: true, AllowedOutputRoots: []string{"/srv"}} }, err: "outside of every allowed output root"},
+	{name: "policy-schemes", change: func(r *Renderer) { r.Policy = &Policy{AllowPlugins: true, AllowedSchemes: []string{"file"}} }, err: `"blob" destinations`},
+}
+
+func TestSinkPluginChecks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugins are shell scripts")
+	}
+	for _, test := range sinkPluginTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile("test.txt.tpl", []byte("{{ .foo }}"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			sink := writePlugin(t, tmpdir, "tpl-sink-blob", "touch handed", `{"result": null}`)
+
+			r := &Renderer{Inputs: []string{"test.txt.tpl"}, StopOnError: true, SinkPlugins: map[string]string{"blob": sink}}
+			test.change(r)
+			err = r.Execute("blob://bucket/prefix/", map[string]interface{}{"foo": "bar"})
+			_, statErr := os.Stat("handed")
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error during execution: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error during execution; got %q, expected %q", err, test.err)
+				}
+				if statErr == nil {
+					t.Errorf("Outputs were handed to the plugin in spite of %q", err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected execution to fail with %q, but it succeeded", test.err)
+			}
+			if statErr != nil {
+				t.Errorf("Outputs were not handed to the plugin")
+			}
+		})
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugins are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "tpl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writePlugin(t, dir, "slow", "exec sleep 10", `{"result": 1}`)
+
+	defer func(prev time.Duration) { pluginTimeout = prev }(pluginTimeout)
+	pluginTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err = callPlugin("slow", path, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "took longer than 100ms") {
+		t.Errorf("Expected the plugin to time out, got %v", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Plugin was only killed after %s", took)
+	}
+}
+
+var handshakeTests = []struct {
+	name     string
+	kind     string
+	response string
+	err      string
+}{
+	{name: "compatible", kind: pluginKindSource, response: `{"result": {"protocol": 1, "capabilities": {"source": 1, "sink": 1}, "version": "0.3.0"}}`},
+	{name: "protocol-mismatch", kind: pluginKindSource, response: `{"result": {"protocol": 2, "capabilities": {"source": 1}}}`, err: "speaks protocol version 2, but tpl speaks 1"},
+	{name: "schema-mismatch", kind: pluginKindSink, response: `{"result": {"protocol": 1, "capabilities": {"sink": 2}}}`, err: "answers version 2 of sink requests, but tpl sends version 1"},
+	{name: "not-capable", kind: pluginKindFunc, response: `{"result": {"protocol": 1, "capabilities": {"source": 1}}}`, err: "is not capable of being a func plugin"},
+	{name: "no-protocol", kind: pluginKindFunc, response: `{"result": {"capabilities": {"func": 1}}}`, err: "without a protocol version"},
+	{name: "refused", kind: pluginKindFunc, response: `{"error": "unknown request"}`, err: "unknown request"},
+	{name: "not-json", kind: pluginKindFunc, response: `hello`, err: "cannot decode its response"},
+}
+
+func TestPluginHandshake(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugins are shell scripts")
+	}
+	for _, test := range handshakeTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			// Each call leaves a line behind, to count the handshakes
+			path := writePlugin(t, dir, "plugin", "echo >>"+filepath.Join(dir, "calls"), test.response)
+
+			c := &handshakeCache{kinds: make(map[string]string), verified: make(map[string]error)}
+			if protocol, err := c.verify("test", path); protocol != 0 || err != nil {
+				t.Fatalf("Shook hands with a plugin that does not require it: %d, %v", protocol, err)
+			}
+			c.require(path, test.kind)
+			for i := 0; i < 2; i++ {
+				protocol, err := c.verify("test", path)
+				if err != nil {
+					if test.err == "" {
+						t.Fatalf("Unexpected error: %v", err)
+					} else if !strings.Contains(err.Error(), test.err) {
+						t.Fatalf("Different error; got %q, expected %q", err, test.err)
+					}
+				} else if test.err != "" {
+					t.Fatalf("Expected the handshake to fail with %q, but it succeeded", test.err)
+				} else if protocol != PluginProtocolVersion {
+					t.Errorf("Agreed on protocol %d, expected %d", protocol, PluginProtocolVersion)
+				}
+			}
+			calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(calls), "\n"); n != 1 {
+				t.Errorf("Shook hands %d times, expected once", n)
+			}
+		})
+	}
+}
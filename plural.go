@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pluralRule maps a count to the index of the plural form to use.
+type pluralRule func(n int64) int64
+
+// pluralRules are the gettext plural rules of languages whose rule is not
+// the English one, "n != 1".
+var pluralRules = map[string]string{
+	"ja":    "0",
+	"ko":    "0",
+	"zh":    "0",
+	"vi":    "0",
+	"th":    "0",
+	"id":    "0",
+	"ms":    "0",
+	"fr":    "n > 1",
+	"pt_BR": "n > 1",
+	"ru":    "n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2",
+	"uk":    "n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2",
+	"be":    "n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2",
+	"sr":    "n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2",
+	"hr":    "n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2",
+	"pl":    "n==1 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2",
+	"cs":    "n==1 ? 0 : n>=2 && n<=4 ? 1 : 2",
+	"sk":    "n==1 ? 0 : n>=2 && n<=4 ? 1 : 2",
+}
+
+// defaultPluralRule returns the plural rule of locale, e.g. "pt-BR" or
+// "pt_BR.UTF-8", trying the language alone when the region has none.
+func defaultPluralRule(locale string) string {
+	locale = strings.Replace(locale, "-", "_", -1)
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	if rule, ok := pluralRules[locale]; ok {
+		return rule
+	}
+	if i := strings.Index(locale, "_"); i >= 0 {
+		if rule, ok := pluralRules[strings.ToLower(locale[:i])]; ok {
+			return rule
+		}
+	}
+	if rule, ok := pluralRules[strings.ToLower(locale)]; ok {
+		return rule
+	}
+	return "n != 1"
+}
+
+// parsePluralRule compiles the C expression of a gettext plural rule, e.g.
+// "n%10==1 && n%100!=11 ? 0 : 1".
+func parsePluralRule(expr string) (pluralRule, error) {
+	p := &pluralParser{src: strings.TrimSuffix(strings.TrimSpace(expr), ";")}
+	rule, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q in plural rule %q", p.src[p.pos:], p.src)
+	}
+	return rule, nil
+}
+
+// pluralParser is a recursive descent parser of plural rules, with the
+// operators and precedence of C.
+type pluralParser struct {
+	src string
+	pos int
+}
+
+func (p *pluralParser) skipSpace() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// accept consumes op if it is next, but not when it starts a longer operator
+// among longer, e.g. "<" when "<=" is next.
+func (p *pluralParser) accept(op string, longer ...string) bool {
+	p.skipSpace()
+	for _, l := range longer {
+		if strings.HasPrefix(p.src[p.pos:], l) {
+			return false
+		}
+	}
+	if strings.HasPrefix(p.src[p.pos:], op) {
+		p.pos += len(op)
+		return true
+	}
+	return false
+}
+
+func (p *pluralParser) ternary() (pluralRule, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return cond, nil
+	}
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept(":") {
+		return nil, fmt.Errorf("expected ':' in plural rule %q", p.src)
+	}
+	els, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return func(n int64) int64 {
+		if cond(n) != 0 {
+			return then(n)
+		}
+		return els(n)
+	}, nil
+}
+
+// pluralOp is a binary operator of plural rules.
+type pluralOp struct {
+	op     string
+	longer []string
+	apply  func(a, b int64) int64
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// pluralOps are the binary operators, from the lowest precedence up.
+var pluralOps = [][]pluralOp{
+	{{"||", nil, func(a, b int64) int64 { return boolInt(a != 0 || b != 0) }}},
+	{{"&&", nil, func(a, b int64) int64 { return boolInt(a != 0 && b != 0) }}},
+	{
+		{"==", nil, func(a, b int64) int64 { return boolInt(a == b) }},
+		{"!=", nil, func(a, b int64) int64 { return boolInt(a != b) }},
+	},
+	{
+		{"<=", nil, func(a, b int64) int64 { return boolInt(a <= b) }},
+		{">=", nil, func(a, b int64) int64 { return boolInt(a >= b) }},
+		{"<", []string{"<="}, func(a, b int64) int64 { return boolInt(a < b) }},
+		{">", []string{">="}, func(a, b int64) int64 { return boolInt(a > b) }},
+	},
+	{
+		{"+", nil, func(a, b int64) int64 { return a + b }},
+		{"-", nil, func(a, b int64) int64 { return a - b }},
+	},
+	{
+		{"*", nil, func(a, b int64) int64 { return a * b }},
+		{"/", nil, func(a, b int64) int64 {
+			if b == 0 {
+				return 0
+			}
+			return a / b
+		}},
+		{"%", nil, func(a, b int64) int64 {
+			if b == 0 {
+				return 0
+			}
+			return a % b
+		}},
+	},
+}
+
+// binary parses the operators of pluralOps[level] and above.
+func (p *pluralParser) binary(level int) (pluralRule, error) {
+	if level == len(pluralOps) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op *pluralOp
+		for i := range pluralOps[level] {
+			if p.accept(pluralOps[level][i].op, pluralOps[level][i].longer...) {
+				op = &pluralOps[level][i]
+				break
+			}
+		}
+		if op == nil {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l, apply := left, op.apply
+		left = func(n int64) int64 { return apply(l(n), right(n)) }
+	}
+}
+
+func (p *pluralParser) unary() (pluralRule, error) {
+	if p.accept("!", "!=") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(n int64) int64 { return boolInt(operand(n) == 0) }, nil
+	}
+	if p.accept("(") {
+		inner, err := p.ternary()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("expected ')' in plural rule %q", p.src)
+		}
+		return inner, nil
+	}
+	p.skipSpace()
+	if p.accept("n") {
+		return func(n int64) int64 { return n }, nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.src) {
+			return nil, fmt.Errorf("unexpected end of plural rule %q", p.src)
+		}
+		return nil, fmt.Errorf("unexpected %q in plural rule %q", p.src[p.pos:], p.src)
+	}
+	var v int64
+	for _, c := range p.src[start:p.pos] {
+		v = v*10 + int64(c-'0')
+	}
+	return func(int64) int64 { return v }, nil
+}
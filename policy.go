@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// policyEnvVar names the environment variable pointing at a policy file. The
+// policy is deliberately not configurable through command line flags, so that
+// a locked-down runner can enforce it regardless of how tpl is invoked.
+const policyEnvVar = "TPL_POLICY"
+
+// Policy restricts what a run is allowed to do. An empty list places no
+// restriction on that category. Plugins, which run binaries of their own,
+// are only allowed by AllowPlugins.
+type Policy struct {
+	AllowedSchemes     []string `yaml:"allowed_schemes,omitempty"`
+	AllowedFunctions   []string `yaml:"allowed_functions,omitempty"`
+	AllowedOutputRoots []string `yaml:"allowed_output_roots,omitempty"`
+	AllowPlugins       bool     `yaml:"allow_plugins,omitempty"`
+}
+
+// loadPolicyFromEnv loads the policy file named by TPL_POLICY, if any. A nil
+// policy is returned when the variable is unset.
+func loadPolicyFromEnv() (*Policy, error) {
+	fname := os.Getenv(policyEnvVar)
+	if fname == "" {
+		return nil, nil
+	}
+	return loadPolicy(fname)
+}
+
+func loadPolicy(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read policy file %s: %v", filename, err)
+	}
+
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("Cannot parse policy file %s: %v", filename, err)
+	}
+
+	for i, root := range p.AllowedOutputRoots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("Policy output root %q: %v", root, err)
+		}
+		p.AllowedOutputRoots[i] = abs
+	}
+	return &p, nil
+}
+
+// CheckScheme returns an error if values may not be loaded using scheme.
+func (p *Policy) CheckScheme(scheme string) error {
+	if p == nil || len(p.AllowedSchemes) == 0 {
+		return nil
+	}
+	for _, s := range p.AllowedSchemes {
+		if s == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("Policy does not allow values from %q sources", scheme)
+}
+
+// CheckPlugins returns an error if the policy does not allow plugins.
+func (p *Policy) CheckPlugins() error {
+	if p == nil || p.AllowPlugins {
+		return nil
+	}
+	return errors.New("Policy does not allow plugins; set allow_plugins to use them")
+}
+
+// CheckOutput returns an error if oname lies outside of every allowed output
+// root. Writing to STDOUT is always allowed.
+func (p *Policy) CheckOutput(oname string) error {
+	if p == nil || len(p.AllowedOutputRoots) == 0 || oname == "-" {
+		return nil
+	}
+	abs, err := filepath.Abs(oname)
+	if err != nil {
+		return err
+	}
+	for _, root := range p.AllowedOutputRoots {
+		if abs == root || strings.HasPrefix(abs, root+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Policy does not allow writing to %q", oname)
+}
+
+// checkPolicyOutput returns an error if the policy named by TPL_POLICY does
+// not allow writing to oname, for commands that do not render.
+func checkPolicyOutput(oname string) error {
+	p, err := loadPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+	return p.CheckOutput(oname)
+}
+
+// FilterFuncs returns a copy of fm containing only allowed functions. Templates
+// referring to a removed function fail to parse.
+func (p *Policy) FilterFuncs(fm template.FuncMap) template.FuncMap {
+	if p == nil || len(p.AllowedFunctions) == 0 {
+		return fm
+	}
+	allowed := make(map[string]bool)
+	for _, name := range p.AllowedFunctions {
+		allowed[name] = true
+	}
+	filtered := make(template.FuncMap)
+	for name, fn := range fm {
+		if allowed[name] {
+			filtered[name] = fn
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+var policyTests = []struct {
+	name   string
+	policy string
+	check  func(p *Policy) error
+	err    string
+}{
+	{name: "no-policy", check: func(p *Policy) error { return (*Policy)(nil).CheckScheme("vault") }},
+	{name: "any-scheme", policy: "allow_plugins: true\n", check: func(p *Policy) error { return p.CheckScheme("vault") }},
+	{name: "scheme-allowed", policy: "allowed_schemes: [file, vault]\n", check: func(p *Policy) error { return p.CheckScheme("vault") }},
+	{name: "scheme-denied", policy: "allowed_schemes: [file]\n", check: func(p *Policy) error { return p.CheckScheme("vault") }, err: `Policy does not allow values from "vault" sources`},
+
+	{name: "funcs-allowed", policy: "allowed_functions: [upper]\n", check: func(p *Policy) error { return parseWithPolicy(p, `{{ upper "a" }}`) }},
+	{name: "funcs-removed", policy: "allowed_functions: [upper]\n", check: func(p *Policy) error { return parseWithPolicy(p, `{{ exec "true" }}`) }, err: `function "exec" not defined`},
+	{name: "funcs-unrestricted", policy: "allowed_schemes: [file]\n", check: func(p *Policy) error { return parseWithPolicy(p, `{{ exec "true" }}`) }},
+
+	{name: "output-within", policy: "allowed_output_roots: [out]\n", check: func(p *Policy) error { return p.CheckOutput("out/a/b.txt") }},
+	{name: "output-root", policy: "allowed_output_roots: [out]\n", check: func(p *Policy) error { return p.CheckOutput("out") }},
+	{name: "output-stdout", policy: "allowed_output_roots: [out]\n", check: func(p *Policy) error { return p.CheckOutput("-") }},
+	{name: "output-escape", policy: "allowed_output_roots: [out]\n", check: func(p *Policy) error { return p.CheckOutput("out/../b.txt") }, err: `Policy does not allow writing to "out/../b.txt"`},
+	{name: "output-sibling", policy: "allowed_output_roots: [out]\n", check: func(p *Policy) error { return p.CheckOutput("output/b.txt") }, err: "Policy does not allow writing"},
+
+	{name: "plugins-denied", policy: "allowed_schemes: [file]\n", check: func(p *Policy) error { return p.CheckPlugins() }, err: "Policy does not allow plugins"},
+	{name: "plugins-allowed", policy: "allow_plugins: true\n", check: func(p *Policy) error { return p.CheckPlugins() }},
+
+	{name: "unknown-field", policy: "allow_exec: true\n", err: "Cannot parse policy file"},
+}
+
+// parseWithPolicy parses text with the functions of tpl that p allows.
+func parseWithPolicy(p *Policy, text string) error {
+	fm := p.FilterFuncs(template.FuncMap{
+		"upper": strings.ToUpper,
+		"exec":  func(name string) string { return "" },
+	})
+	_, err := template.New("test").Funcs(fm).Parse(text)
+	return err
+}
+
+func TestPolicy(t *testing.T) {
+	for _, test := range policyTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+
+			var p *Policy
+			if test.policy != "" {
+				if err := ioutil.WriteFile("policy.yaml", []byte(test.policy), 0644); err != nil {
+					t.Fatal(err)
+				}
+				p, err = loadPolicy("policy.yaml")
+			}
+			if err == nil && test.check != nil {
+				err = test.check(p)
+			}
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected the policy to fail with %q, but it succeeded", test.err)
+			}
+		})
+	}
+}
+
+var policyOutputTests = []struct {
+	name string
+	args []string
+	err  string
+}{
+	{name: "outputs", args: []string{"-out=out/"}},
+	{name: "outputs-outside", args: []string{"-out=elsewhere/"}, err: `Policy does not allow writing to "elsewhere/test.txt"`},
+	{name: "manifest", args: []string{"-out=out/", "-manifest=out/manifest.json"}},
+	{name: "manifest-outside", args: []string{"-out=out/", "-manifest=manifest.json"}, err: `Policy does not allow writing to "manifest.json"`},
+	{name: "report", args: []string{"-out=out/", "-report=json", "-report-file=out/report.json"}},
+	{name: "report-stderr", args: []string{"-out=out/", "-report=json"}},
+	{name: "report-outside", args: []string{"-out=out/", "-report=json", "-report-file=report.json"}, err: `Policy does not allow writing to "report.json"`},
+}
+
+func TestPolicyOutputs(t *testing.T) {
+	for _, test := range policyOutputTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{
+				"policy.yaml":  "allowed_output_roots: [out]\n",
+				"test.txt.tpl": "{{ .name }}",
+			} {
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args := append([]string{"-value=name=web"}, test.args...)
+			err = runTpl(append(os.Environ(), policyEnvVar+"=policy.yaml"), append(args, "test.txt.tpl")...)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected tpl %q to fail with %q, but it succeeded", args, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// profileEnterFunc and profileExitFunc are the functions that instrumented
+// templates call around every `template` action, named so that they clash
+// with no other function.
+const (
+	profileEnterFunc = "_tplProfileEnter"
+	profileExitFunc  = "_tplProfileExit"
+)
+
+// TemplateProfile attributes the time spent rendering to every input, and
+// within it to every named template it executes, with `template`, `include`,
+// `tpl`, or `snippet`, however deeply nested.
+type TemplateProfile struct {
+	mu    sync.Mutex
+	roots map[string]*profileNode
+	stack []profileFrame
+}
+
+// profileNode is a template, as executed from the templates above it.
+type profileNode struct {
+	name     string
+	total    time.Duration
+	calls    int
+	children map[string]*profileNode
+}
+
+type profileFrame struct {
+	node  *profileNode
+	start time.Time
+}
+
+// NewTemplateProfile returns an empty profile.
+func NewTemplateProfile() *TemplateProfile {
+	return &TemplateProfile{roots: make(map[string]*profileNode)}
+}
+
+func (n *profileNode) child(name string) *profileNode {
+	c, ok := n.children[name]
+	if !ok {
+		c = &profileNode{name: name, children: make(map[string]*profileNode)}
+		n.children[name] = c
+	}
+	return c
+}
+
+// begin starts the render of the input iname, unwinding whatever the last
+// one left executing when it failed.
+func (p *TemplateProfile) begin(iname string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stack = p.stack[:0]
+	root, ok := p.roots[iname]
+	if !ok {
+		root = &profileNode{name: iname, children: make(map[string]*profileNode)}
+		p.roots[iname] = root
+	}
+	p.stack = append(p.stack, profileFrame{node: root, start: time.Now()})
+}
+
+// end ends the render begun last.
+func (p *TemplateProfile) end() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.stack) > 0 {
+		p.pop()
+	}
+}
+
+// enter starts executing the template name, within the one executing.
+func (p *TemplateProfile) enter(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.stack) == 0 {
+		return
+	}
+	node := p.stack[len(p.stack)-1].node.child(name)
+	p.stack = append(p.stack, profileFrame{node: node, start: time.Now()})
+}
+
+// exit stops executing the template entered last.
+func (p *TemplateProfile) exit() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// The frame of the input itself is only popped by end
+	if len(p.stack) > 1 {
+		p.pop()
+	}
+}
+
+func (p *TemplateProfile) pop() {
+	f := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	f.node.total += time.Since(f.start)
+	f.node.calls++
+}
+
+// instrument rewrites every template of tpl to report to the profile when
+// it executes another with `template`.
+func (p *TemplateProfile) instrument(tpl *template.Template) {
+	if p == nil {
+		return
+	}
+	tpl.Funcs(template.FuncMap{
+		profileEnterFunc: func(name string) string { p.enter(name); return "" },
+		profileExitFunc:  func() string { p.exit(); return "" },
+	})
+	for _, t := range tpl.Templates() {
+		p.instrumentTree(t.Tree)
+	}
+}
+
+// instrumentTree rewrites tree, which belongs to a template set that is
+// already instrumented.
+func (p *TemplateProfile) instrumentTree(tree *parse.Tree) {
+	if p != nil && tree != nil {
+		instrumentList(tree, tree.Root)
+	}
+}
+
+// instrumentList surrounds every `template` action within list with calls
+// to the profile, which render nothing.
+func instrumentList(tree *parse.Tree, list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+	var nodes []parse.Node
+	for _, n := range list.Nodes {
+		switch tn := n.(type) {
+		case *parse.TemplateNode:
+			nodes = append(nodes, profileCall(tree, tn.Pos, profileEnterFunc, tn.Name), n, profileCall(tree, tn.Pos, profileExitFunc, ""))
+			continue
+		case *parse.IfNode:
+			instrumentList(tree, tn.List)
+			instrumentList(tree, tn.ElseList)
+		case *parse.RangeNode:
+			instrumentList(tree, tn.List)
+			instrumentList(tree, tn.ElseList)
+		case *parse.WithNode:
+			instrumentList(tree, tn.List)
+			instrumentList(tree, tn.ElseList)
+		case *parse.ListNode:
+			instrumentList(tree, tn)
+		}
+		nodes = append(nodes, n)
+	}
+	list.Nodes = nodes
+}
+
+// profileCall returns an action calling fn, with arg if it is set.
+func profileCall(tree *parse.Tree, pos parse.Pos, fn, arg string) *parse.ActionNode {
+	args := []parse.Node{parse.NewIdentifier(fn).SetTree(tree).SetPos(pos)}
+	if arg != "" {
+		args = append(args, &parse.StringNode{NodeType: parse.NodeString, Pos: pos, Quoted: fmt.Sprintf("%q", arg), Text: arg})
+	}
+	cmd := &parse.CommandNode{NodeType: parse.NodeCommand, Pos: pos, Args: args}
+	pipe := &parse.PipeNode{NodeType: parse.NodePipe, Pos: pos, Cmds: []*parse.CommandNode{cmd}}
+	return &parse.ActionNode{NodeType: parse.NodeAction, Pos: pos, Pipe: pipe}
+}
+
+// sortedChildren returns the children of n, slowest first.
+func (n *profileNode) sortedChildren() []*profileNode {
+	children := make([]*profileNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].total != children[j].total {
+			return children[i].total > children[j].total
+		}
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+// self is the time spent in n, but not in the templates it executed.
+func (n *profileNode) self() time.Duration {
+	d := n.total
+	for _, c := range n.children {
+		d -= c.total
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Print writes the profile to w, in format: "tree", a tree of the inputs
+// and the templates they execute, slowest first, with their total and own
+// times, or "folded", the folded stacks that flame graph tools take, with
+// the time spent in each stack itself, in microseconds.
+func (p *TemplateProfile) Print(w io.Writer, format string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	root := &profileNode{children: p.roots}
+	switch format {
+	case "tree":
+		fmt.Fprintf(w, "Template profile:\n")
+		fmt.Fprintf(w, "  %12s  %12s  %6s\n", "total", "self", "calls")
+		var walk func(n *profileNode, depth int)
+		walk = func(n *profileNode, depth int) {
+			fmt.Fprintf(w, "  %12v  %12v  %6d  %s%s\n", n.total.Round(time.Microsecond), n.self().Round(time.Microsecond), n.calls, strings.Repeat("  ", depth), n.name)
+			for _, c := range n.sortedChildren() {
+				walk(c, depth+1)
+			}
+		}
+		for _, n := range root.sortedChildren() {
+			walk(n, 0)
+		}
+	case "folded":
+		var lines []string
+		var walk func(n *profileNode, stack string)
+		walk = func(n *profileNode, stack string) {
+			// Semicolons separate the frames, and spaces the count
+			stack += strings.NewReplacer(";", ":", " ", "_").Replace(n.name)
+			if us := n.self().Microseconds(); us > 0 {
+				lines = append(lines, fmt.Sprintf("%s %d", stack, us))
+			}
+			for _, c := range n.children {
+				walk(c, stack+";")
+			}
+		}
+		for _, n := range root.children {
+			walk(n, "")
+		}
+		sort.Strings(lines)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	default:
+		return fmt.Errorf("Unknown profile format %q; must be tree or folded", format)
+	}
+	return nil
+}
+
+// writeProfile prints p in format to fname, to STDOUT if it is "-", or else
+// to STDERR.
+func writeProfile(p *TemplateProfile, format, fname string) error {
+	var buf bytes.Buffer
+	if err := p.Print(&buf, format); err != nil {
+		return err
+	}
+	if fname != "" && fname != "-" {
+		if err := writeFileAtomic(fname, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("Cannot write template profile %q: %v", fname, err)
+		}
+		return nil
+	}
+	var w io.Writer = os.Stderr
+	if fname == "-" {
+		w = os.Stdout
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
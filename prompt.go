@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/template/parse"
+)
+
+// required is the `required` template function, failing the template with
+// message when value is missing or empty, e.g.
+// `{{ required "The project name" .name }}` or
+// `{{ .name | required "The project name" }}`.
+func required(message string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, errors.New(message)
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+// requiredRef is the value passed to a `required` call.
+type requiredRef struct {
+	Path    []string
+	Message string
+}
+
+// requiredRefs lists the values in the top-level values passed to `required`
+// in a tree, either as its last argument or through a pipeline.
+func requiredRefs(t *parse.Tree) []requiredRef {
+	var refs []requiredRef
+	if t == nil || t.Root == nil {
+		return refs
+	}
+	walkNodes(t.Root, true, func(n parse.Node, rootDot bool) {
+		pipe, ok := n.(*parse.PipeNode)
+		if !ok || pipe == nil {
+			return
+		}
+		for i, cmd := range pipe.Cmds {
+			if len(cmd.Args) < 2 || len(cmd.Args) > 3 {
+				continue
+			}
+			if id, ok := cmd.Args[0].(*parse.IdentifierNode); !ok || id.Ident != "required" {
+				continue
+			}
+			msg, ok := cmd.Args[1].(*parse.StringNode)
+			if !ok {
+				continue
+			}
+			var arg parse.Node
+			if len(cmd.Args) == 3 {
+				arg = cmd.Args[2]
+			} else if i > 0 && len(pipe.Cmds[i-1].Args) == 1 {
+				arg = pipe.Cmds[i-1].Args[0]
+			}
+			switch a := arg.(type) {
+			case *parse.FieldNode:
+				if rootDot {
+					refs = append(refs, requiredRef{Path: a.Ident, Message: msg.Text})
+				}
+			case *parse.VariableNode:
+				if len(a.Ident) > 1 && a.Ident[0] == "$" {
+					refs = append(refs, requiredRef{Path: a.Ident[1:], Message: msg.Text})
+				}
+			}
+		}
+	})
+	return refs
+}
+
+// promptSecretPattern matches the paths of values that are read without
+// echoing them to the terminal.
+var promptSecretPattern = regexp.MustCompile(`(?i)pass|secret|token|key|credential`)
+
+// isTerminal reports whether STDIN is a terminal, rather than a file, a
+// pipe, or another device such as /dev/null, which stty cannot configure.
+func isTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0 && stty("-g") == nil
+}
+
+// requiredValues fills in every value passed to `required` in the parsed
+// templates that is missing from the values, so that `required` fails with
+// its message rather than the template failing on the missing key. With
+// Prompt set and a terminal on STDIN, values that are missing or empty are
+// asked for instead.
+func (r *Renderer) requiredValues(jobs []renderJob, parsed []parsedTemplate, data interface{}) (interface{}, error) {
+	values, ok := valueMap(data)
+	if !ok {
+		return data, nil
+	}
+	prompt := r.Prompt && isTerminal()
+	var in *bufio.Reader
+	if prompt {
+		in = bufio.NewReader(os.Stdin)
+	}
+	seen := make(map[string]bool)
+	var filled map[string]interface{}
+	for i, p := range parsed {
+		if p.tpl == nil {
+			continue
+		}
+		for _, t := range p.tpl.Templates() {
+			for _, ref := range requiredRefs(t.Tree) {
+				key := strings.Join(ref.Path, ".")
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				current := values
+				if filled != nil {
+					current = filled
+				}
+				current = withDefaults(current, jobs[i].defaults)
+				v, ok := lookupPath(current, ref.Path)
+				if ok && (!prompt || (v != nil && v != "")) {
+					continue
+				}
+				var answer interface{}
+				if prompt {
+					var err error
+					if answer, err = promptValue(in, ref.Message, promptSecretPattern.MatchString(key)); err != nil {
+						return nil, err
+					}
+				} else if _, ok := lookupPath(current, ref.Path[:len(ref.Path)-1]); !ok {
+					// Adding the parents would change what other templates
+					// see of them
+					continue
+				}
+				if filled == nil {
+					filled = make(map[string]interface{}, len(values)+1)
+					for k, v := range values {
+						filled[k] = v
+					}
+				}
+				setPath(filled, ref.Path, answer)
+			}
+		}
+	}
+	if filled == nil {
+		return data, nil
+	}
+	return filled, nil
+}
+
+// promptValue asks for a single line on the terminal, without echoing it
+// when hidden is set.
+func promptValue(in *bufio.Reader, message string, hidden bool) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", message)
+	if hidden {
+		if err := stty("-echo"); err != nil {
+			return "", fmt.Errorf("Cannot hide the input of %q: %v", message, err)
+		}
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("Cannot read %q: %v", message, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(arg string) error {
+	c := exec.Command("stty", arg)
+	c.Stdin = os.Stdin
+	return c.Run()
+}
+
+// setPath sets the value at path in m, copying the maps along the way rather
+// than changing them.
+func setPath(m map[string]interface{}, path []string, v interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next := make(map[string]interface{})
+		if prev, ok := normalizeValue(m[key]).(map[string]interface{}); ok {
+			next = prev
+		}
+		m[key] = next
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var forgeClient = &http.Client{Timeout: 30 * time.Second}
+
+// remotePattern matches the host and repository path of a git remote, in
+// the scp-like form of git@host:owner/repo.git or as an ssh://, git://, or
+// https:// URL.
+var remotePattern = regexp.MustCompile(`^(?:[a-z+]+://)?(?:[^@/]+@)?([^:/]+)(?::\d+)?[:/](.+?)(?:\.git)?/?$`)
+
+// parseRemote returns the host and repository path, e.g. "github.com" and
+// "owner/repo", of a git remote URL.
+func parseRemote(remote string) (string, string, error) {
+	m := remotePattern.FindStringSubmatch(remote)
+	if m == nil || !strings.Contains(m[2], "/") {
+		return "", "", fmt.Errorf("Cannot tell the repository of the git remote %q", remote)
+	}
+	return m[1], m[2], nil
+}
+
+// openPullRequest opens a pull request from Branch into base on the forge
+// hosting origin, unless one is already open, which the push updated.
+func (r *Renderer) openPullRequest(dir, base string, changed []string) error {
+	remote, err := gitOutput(dir, "remote", "get-url", "origin")
+	if err != nil {
+		return err
+	}
+	host, repo, err := parseRemote(remote)
+	if err != nil {
+		return err
+	}
+
+	msg := strings.SplitN(strings.TrimSpace(r.Git.Message), "\n", 2)
+	var body strings.Builder
+	if len(msg) > 1 {
+		body.WriteString(strings.TrimSpace(msg[1]) + "\n\n")
+	}
+	body.WriteString("Rendered by tpl, which changed:\n\n")
+	for _, name := range changed {
+		fmt.Fprintf(&body, "- `%s`\n", name)
+	}
+
+	var link string
+	switch r.Git.PullRequest {
+	case "github":
+		link, err = openGitHubPullRequest(host, repo, r.Git.Branch, base, msg[0], body.String())
+	case "gitlab":
+		link, err = openGitLabMergeRequest(host, repo, r.Git.Branch, base, msg[0], body.String())
+	default:
+		err = fmt.Errorf("unknown forge %q; must be github or gitlab", r.Git.PullRequest)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot open a pull request for %s: %v", r.Git.Branch, err)
+	}
+	r.logf(LogInfo, "Pull request: %s", link)
+	return nil
+}
+
+// openGitHubPullRequest opens a pull request through the GitHub API, at
+// GITHUB_API_URL if set, with the token in GITHUB_TOKEN. Repositories not on
+// github.com are taken to be on GitHub Enterprise.
+func openGitHubPullRequest(host, repo, head, base, title, body string) (string, error) {
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+		if host != "github.com" {
+			api = "https://" + host + "/api/v3"
+		}
+	}
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		return "", fmt.Errorf("no GitHub token; set GITHUB_TOKEN")
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}, "Accept": {"application/vnd.github+json"}}
+	endpoint := strings.TrimSuffix(api, "/") + "/repos/" + repo + "/pulls"
+
+	owner := strings.SplitN(repo, "/", 2)[0]
+	var open []struct {
+		URL string `json:"html_url"`
+	}
+	query := url.Values{"head": {owner + ":" + head}, "base": {base}, "state": {"open"}}
+	if err := forgeRequest("GET", endpoint+"?"+query.Encode(), header, nil, &open); err != nil {
+		return "", err
+	}
+	if len(open) > 0 {
+		return open[0].URL, nil
+	}
+
+	var created struct {
+		URL string `json:"html_url"`
+	}
+	req := map[string]string{"title": title, "head": head, "base": base, "body": body}
+	if err := forgeRequest("POST", endpoint, header, req, &created); err != nil {
+		return "", err
+	}
+	return created.URL, nil
+}
+
+// openGitLabMergeRequest opens a merge request through the GitLab API of
+// host, with the token in GITLAB_TOKEN.
+func openGitLabMergeRequest(host, repo, source, target, title, description string) (string, error) {
+	token := os.Getenv("GITLAB_TOKEN")
+	if token == "" {
+		return "", fmt.Errorf("no GitLab token; set GITLAB_TOKEN")
+	}
+	header := http.Header{"Private-Token": {token}}
+	endpoint := "https://" + host + "/api/v4/projects/" + url.PathEscape(repo) + "/merge_requests"
+
+	var open []struct {
+		URL string `json:"web_url"`
+	}
+	query := url.Values{"source_branch": {source}, "target_branch": {target}, "state": {"opened"}}
+	if err := forgeRequest("GET", endpoint+"?"+query.Encode(), header, nil, &open); err != nil {
+		return "", err
+	}
+	if len(open) > 0 {
+		return open[0].URL, nil
+	}
+
+	var created struct {
+		URL string `json:"web_url"`
+	}
+	req := map[string]string{"title": title, "source_branch": source, "target_branch": target, "description": description}
+	if err := forgeRequest("POST", endpoint, header, req, &created); err != nil {
+		return "", err
+	}
+	return created.URL, nil
+}
+
+// forgeRequest sends a JSON request to a forge API, and decodes its JSON
+// response into out.
+func forgeRequest(method, endpoint string, header http.Header, in, out interface{}) error {
+	var payload bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&payload).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := forgeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var failure struct {
+			Message json.RawMessage `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if len(failure.Message) > 0 {
+			return fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, failure.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, req.URL.Path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("unexpected response to %s %s (%s): %v", method, req.URL.Path, resp.Status, err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var pullRequestTests = []struct {
+	name   string
+	branch string
+	// rendered commits the output of "web" onto main before the runs
+	rendered bool
+	open     string
+	runs     []string
+	posts    int
+	pushes   int
+	err      string
+}{
+	{name: "opens", branch: "tpl/render", runs: []string{"web"}, posts: 1, pushes: 1},
+	{name: "already-open", branch: "tpl/render", open: "https://github.com/owner/repo/pull/7", runs: []string{"web"}, pushes: 1},
+	// A run with the same changes leaves the branch as it was pushed, and
+	// one with new ones replaces it
+	{name: "same-changes", branch: "tpl/render", open: "https://github.com/owner/repo/pull/7", runs: []string{"web", "web"}, pushes: 1},
+	{name: "new-changes", branch: "tpl/render", open: "https://github.com/owner/repo/pull/7", runs: []string{"web", "api"}, pushes: 2},
+	{name: "no-changes", branch: "tpl/render", rendered: true, runs: []string{"web"}},
+	{name: "into-itself", branch: "main", runs: []string{"web"}, err: "Cannot open a pull request from main into itself"},
+}
+
+func TestPullRequest(t *testing.T) {
+	for _, test := range pullRequestTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			git := initRepo(t, tmpdir)
+			// The forge of origin is told by its URL, but pushes go to a
+			// local repository
+			remote := filepath.Join(tmpdir, "..", filepath.Base(tmpdir)+"-origin.git")
+			if out, err := exec.Command("git", "init", "-q", "--bare", remote).CombinedOutput(); err != nil {
+				t.Fatalf("git init failed: %v\n%s", err, out)
+			}
+			defer os.RemoveAll(remote)
+			git("remote", "add", "origin", "https://github.com/owner/repo.git")
+			git("config", "remote.origin.pushurl", remote)
+			if err := ioutil.WriteFile("a.txt.tpl", []byte("{{ .name }}"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.rendered {
+				if err := os.Mkdir("out", 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join("out", "a.txt"), []byte("web"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				git("add", "out")
+				git("commit", "-q", "-m", "Render")
+			}
+			git("push", "-q", "origin", "main")
+
+			var posted []map[string]string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/repos/owner/repo/pulls" || req.Header.Get("Authorization") != "Bearer t0ken" {
+					t.Errorf("Requested %s %s with %q", req.Method, req.URL.Path, req.Header.Get("Authorization"))
+				}
+				if req.Method == "GET" {
+					if head, base := req.URL.Query().Get("head"), req.URL.Query().Get("base"); head != "owner:"+test.branch || base != "main" {
+						t.Errorf("Looked for pull requests from %s into %s", head, base)
+					}
+					if test.open == "" {
+						fmt.Fprint(w, `[]`)
+					} else {
+						fmt.Fprintf(w, `[{"html_url": %q}]`, test.open)
+					}
+					return
+				}
+				var pr map[string]string
+				if err := json.NewDecoder(req.Body).Decode(&pr); err != nil {
+					t.Error(err)
+				}
+				posted = append(posted, pr)
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"html_url": "https://github.com/owner/repo/pull/8"}`)
+			}))
+			defer server.Close()
+			defer setenv(t, "GITHUB_API_URL", server.URL)()
+			defer setenv(t, "GITHUB_TOKEN", "t0ken")()
+
+			for _, name := range test.runs {
+				commit := &GitCommit{Message: "Render\n\nWith new values.", Branch: test.branch, PullRequest: "github"}
+				r := &Renderer{Inputs: []string{"a.txt.tpl"}, StopOnError: true, Git: commit, Logger: &logRecorder{}}
+				if err = r.Execute("out/", map[string]interface{}{"name": name}); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected the pull request to fail with %q, but it succeeded", test.err)
+			}
+
+			if branch := git("rev-parse", "--abbrev-ref", "HEAD"); branch != "main" {
+				t.Errorf("Left the repository on %s, expected main", branch)
+			}
+			if len(posted) != test.posts {
+				t.Fatalf("Opened %d pull requests, expected %d", len(posted), test.posts)
+			}
+			for _, pr := range posted {
+				if pr["title"] != "Render" || pr["head"] != test.branch || pr["base"] != "main" {
+					t.Errorf("Opened %q from %s into %s", pr["title"], pr["head"], pr["base"])
+				}
+				if !strings.HasPrefix(pr["body"], "With new values.\n\n") || !strings.Contains(pr["body"], "- `out/a.txt`") {
+					t.Errorf("Opened a pull request saying %q", pr["body"])
+				}
+			}
+
+			// Each push replaces the branch, with a single commit on main
+			if test.pushes == 0 {
+				if branches := git("branch", "--all", "--list", "*"+test.branch); branches != "" {
+					t.Errorf("Made branches %q without changes", branches)
+				}
+				return
+			}
+			c := exec.Command("git", "rev-list", "--count", "main.."+test.branch)
+			c.Dir = remote
+			out, err := c.Output()
+			if err != nil {
+				t.Fatalf("Branch %s was not pushed: %v", test.branch, err)
+			}
+			if n := strings.TrimSpace(string(out)); n != "1" {
+				t.Errorf("Pushed %s commits onto main, expected 1", n)
+			}
+			if reflog := git("reflog", "--format=%s", "refs/remotes/origin/"+test.branch); len(strings.Split(reflog, "\n")) != test.pushes {
+				t.Errorf("Pushed %q, expected %d pushes", reflog, test.pushes)
+			}
+		})
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// qrcodeScale and qrcodeQuietZone are the size of modules in the PNG images
+// of QR codes, in pixels, and the width of the blank margin around them, in
+// modules.
+const (
+	qrcodeScale     = 8
+	qrcodeQuietZone = 4
+)
+
+var errQRCodeDisabled = errors.New("The 'qrcode' and 'barcode' template functions are disabled; you must specify -allow-qrcode to enable them")
+
+// qrcode is the `qrcode` template function, encoding value into a QR code
+// with medium error correction, and returning it as a base64-encoded PNG
+// image, e.g. `<img src="data:image/png;base64,{{ qrcode .url }}">`.
+func qrcode(value string) (string, error) {
+	data, err := qrcodePNG(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// qrcodePNG encodes value into a QR code as a PNG image.
+func qrcodePNG(value string) ([]byte, error) {
+	q, err := encodeQR([]byte(value))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, q.image(qrcodeScale, qrcodeQuietZone)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sideFileFunc is the image of a value, such as qrcodePNG, behind a template
+// function like `qrcodeFile`, which bindSideFileFuncs binds to the run so
+// that it writes the image into a side file of the output being rendered.
+type sideFileFunc func(value string) ([]byte, error)
+
+// bindSideFileFuncs gives tpl a function writing side files for each of the
+// template functions that is a sideFileFunc, and returns them.
+func (r *Renderer) bindSideFileFuncs(tpl *template.Template) template.FuncMap {
+	bound := template.FuncMap{}
+	for name, fn := range r.funcs {
+		if image, ok := fn.(sideFileFunc); ok {
+			name := name
+			bound[name] = func(fname, value string) (string, error) {
+				data, err := image(value)
+				if err != nil {
+					return "", err
+				}
+				return fname, r.writeSideFile(name, fname, data)
+			}
+		}
+	}
+	bound = r.Stats.countFuncs(bound)
+	if len(bound) > 0 {
+		tpl.Funcs(bound)
+	}
+	return bound
+}
+
+// writeSideFile writes data into fname, relative to the directory of the
+// output being rendered, as a file of its own, e.g. an image the output
+// refers to by that name.
+func (r *Renderer) writeSideFile(fn, fname string, data []byte) error {
+	if r.rendering == "" || r.rendering == "-" {
+		return fmt.Errorf("%s cannot write %s next to STDOUT; give an output file or directory", fn, fname)
+	}
+	clean := filepath.Clean(filepath.FromSlash(fname))
+	if fname == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s cannot write %q, which must be a relative path below the output directory", fn, fname)
+	}
+	oname := filepath.Join(filepath.Dir(r.rendering), clean)
+	if oname == r.rendering || r.written[oname] {
+		return fmt.Errorf("%s cannot write %s, which is already an output of the run", fn, oname)
+	}
+	if err := r.sink.Check(oname); err != nil {
+		return err
+	}
+	mode, err := r.outputMode("")
+	if err != nil {
+		return err
+	}
+	r.logf(LogInfo, "Writing %s into %s", fn, oname)
+	return r.writeOutput(oname, data, mode)
+}
+
+// Error correction of QR codes at the medium level, indexed by version: the
+// number of codewords of each block, and the number of blocks.
+var (
+	qrECCPerBlock = [41]int{-1,
+		10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrECCBlocks = [41]int{-1,
+		1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// qrFormatBitsM are the format bits of the medium error correction level.
+const qrFormatBitsM = 0
+
+// qrCode is a QR code as it is being drawn, indexed by row and column.
+type qrCode struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// qrRawModules is the number of modules holding data and error correction
+// in a QR code of version, including the remainder bits.
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[version]*qrECCBlocks[version]
+}
+
+// encodeQR encodes data in byte mode into the smallest QR code that fits it.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if len(data) < 1<<uint(countBits) && 4+countBits+8*len(data) <= qrDataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("%d bytes are too many for a QR code", len(data))
+	}
+
+	var bits qrBits
+	bits.append(0x4, 4)
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i>>3] |= 1 << uint(7-i&7)
+		}
+	}
+
+	q := newQRCode(version)
+	q.drawFunctionPatterns()
+	q.drawCodewords(q.addECC(codewords))
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+// qrBits is a sequence of bits, most significant first.
+type qrBits []bool
+
+func (b *qrBits) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>uint(i)&1 != 0)
+	}
+}
+
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	q := &qrCode{version: version, size: size}
+	q.modules = make([][]bool, size)
+	q.function = make([][]bool, size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	return q
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns() {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	pos := q.alignmentPositions()
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			q.drawAlignment(pos[i], pos[j])
+		}
+	}
+	// Reserve the format bits, which depend on the mask
+	q.drawFormatBits(0)
+	q.drawVersion()
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// drawFinder draws a finder pattern and its separator around (x, y).
+func (q *qrCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= q.size || yy < 0 || yy >= q.size {
+				continue
+			}
+			dist := maxInt(absInt(dx), absInt(dy))
+			q.set(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (q *qrCode) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.set(x+dx, y+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions are the centers of alignment patterns along each axis.
+func (q *qrCode) alignmentPositions() []int {
+	if q.version == 1 {
+		return nil
+	}
+	n := q.version/7 + 2
+	step := (q.version*8 + n*3 + 5) / (n*4 - 4) * 2
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, q.size-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+func (q *qrCode) drawFormatBits(mask int) {
+	data := qrFormatBitsM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+func (q *qrCode) drawVersion() {
+	if q.version < 7 {
+		return
+	}
+	rem := q.version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := q.version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 != 0
+		a, b := q.size-11+i%3, i/3
+		q.set(a, b, dark)
+		q.set(b, a, dark)
+	}
+}
+
+// addECC splits data into blocks, appends the Reed-Solomon error correction
+// of each, and interleaves them.
+func (q *qrCode) addECC(data []byte) []byte {
+	numBlocks := qrECCBlocks[q.version]
+	eccLen := qrECCPerBlock[q.version]
+	raw := qrRawModules(q.version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(block, divisor)
+		if i < numShort {
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	var out []byte
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			// Short blocks have a placeholder where long ones have data
+			if i != shortLen-eccLen || j >= numShort {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+// drawCodewords places data in the zigzag order of QR codes, skipping
+// function modules.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>uint(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by mask. Applying a mask twice
+// undoes it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// qrFinderLike are the runs of modules that look like finder patterns.
+var qrFinderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// penalty scores how hard the code is to scan, for choosing a mask.
+func (q *qrCode) penalty() int {
+	p := 0
+	line := make([]bool, q.size)
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < q.size; a++ {
+			for b := 0; b < q.size; b++ {
+				if pass == 0 {
+					line[b] = q.modules[a][b]
+				} else {
+					line[b] = q.modules[b][a]
+				}
+			}
+			// Runs of five or more modules of the same color
+			run := 1
+			for b := 1; b <= q.size; b++ {
+				if b < q.size && line[b] == line[b-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+			for b := 0; b+len(qrFinderLike[0]) <= q.size; b++ {
+				for _, pattern := range qrFinderLike {
+					match := true
+					for k, dark := range pattern {
+						if line[b+k] != dark {
+							match = false
+							break
+						}
+					}
+					if match {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			c := q.modules[y][x]
+			if c {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size && c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+				p += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	p += ((absInt(dark*20-total*10)+total-1)/total - 1) * 10
+	return p
+}
+
+// image draws the code with the given module size and quiet zone.
+func (q *qrCode) image(scale, quiet int) image.Image {
+	n := (q.size + 2*quiet) * scale
+	img := image.NewGray(image.Rect(0, 0, n, n))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+quiet)*scale+dx, (y+quiet)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+var qrcodeTests = []struct {
+	name    string
+	value   string
+	version int
+	err     string
+}{
+	{name: "short", value: "hello", version: 1},
+	{name: "url", value: "otpauth://totp/tpl:alice?secret=JBSWY3DPEHPK3PXP&issuer=tpl", version: 4},
+	{name: "too-long", value: strings.Repeat("x", 3000), err: "too many"},
+}
+
+func TestQRCode(t *testing.T) {
+	for _, test := range qrcodeTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			q, err := encodeQR([]byte(test.value))
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected encoding to fail with %q, but it succeeded", test.err)
+			}
+			if q.version != test.version || q.size != 17+4*test.version {
+				t.Errorf("Encoded as version %d of size %d, expected version %d", q.version, q.size, test.version)
+			}
+			// Every corner but the bottom right has a finder pattern, whose
+			// center is dark and ring of light modules is around it
+			for _, c := range [][2]int{{0, 0}, {q.size - 7, 0}, {0, q.size - 7}} {
+				if !q.modules[c[1]+3][c[0]+3] || q.modules[c[1]+1][c[0]+1] || !q.modules[c[1]][c[0]] {
+					t.Errorf("Missing finder pattern at %v", c)
+				}
+			}
+
+			enc, err := qrcode(test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := base64.StdEncoding.DecodeString(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := (q.size + 2*qrcodeQuietZone) * qrcodeScale; img.Bounds().Dx() != n || img.Bounds().Dy() != n {
+				t.Errorf("Image is %v, expected %dx%d", img.Bounds(), n, n)
+			}
+		})
+	}
+}
+
+var barcodeTests = []struct {
+	name  string
+	value string
+	check int
+	err   string
+}{
+	{name: "text", value: "PJJ123C", check: 55},
+	{name: "single", value: "A", check: (code128StartB + 33) % 103},
+	{name: "empty", value: "", err: "empty"},
+	{name: "non-ascii", value: "café", err: "printable ASCII"},
+}
+
+func TestBarcode(t *testing.T) {
+	for i, p := range code128Patterns {
+		sum, bars := 0, 0
+		for j, w := range p {
+			sum += int(w - '0')
+			if j%2 == 0 {
+				bars += int(w - '0')
+			}
+		}
+		if want := 11; i == code128Stop {
+			if sum != 13 {
+				t.Errorf("Stop pattern is %d modules wide, expected 13", sum)
+			}
+		} else if sum != want || bars%2 != 0 {
+			t.Errorf("Pattern of symbol %d is %d modules wide with %d in bars, expected %d with an even number", i, sum, bars, want)
+		}
+	}
+
+	for _, test := range barcodeTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			modules, err := encodeCode128(test.value)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected encoding to fail with %q, but it succeeded", test.err)
+			}
+			if n := 11*(len(test.value)+3) + 2; len(modules) != n {
+				t.Fatalf("Encoded into %d modules, expected %d", len(modules), n)
+			}
+			if got := modulePattern(modules[:11]); got != code128Patterns[code128StartB] {
+				t.Errorf("Starts with %s, expected the start B pattern %s", got, code128Patterns[code128StartB])
+			}
+			at := len(modules) - 13 - 11
+			if got := modulePattern(modules[at : at+11]); got != code128Patterns[test.check] {
+				t.Errorf("Check symbol is %s, expected %s of symbol %d", got, code128Patterns[test.check], test.check)
+			}
+		})
+	}
+}
+
+// modulePattern returns the widths of the runs of bars and spaces of modules.
+func modulePattern(modules []bool) string {
+	var widths []byte
+	n := 1
+	for i := 1; i <= len(modules); i++ {
+		if i < len(modules) && modules[i] == modules[i-1] {
+			n++
+			continue
+		}
+		widths = append(widths, byte('0'+n))
+		n = 1
+	}
+	return string(widths)
+}
+
+var sideFileTests = []struct {
+	name string
+	tpl  string
+	out  string
+	file string
+	err  string
+}{
+	{name: "next-to-output", tpl: `<img src="{{ qrcodeFile "img/wifi.png" .foo }}">`, out: "out/", file: "out/page.html"},
+	{name: "barcode", tpl: `{{ barcodeFile "code.png" .foo }}`, out: "out/", file: "out/page.html"},
+	{name: "stdout", tpl: `{{ qrcodeFile "wifi.png" .foo }}`, out: "-", err: "next to STDOUT"},
+	{name: "escapes", tpl: `{{ qrcodeFile "../wifi.png" .foo }}`, out: "out/", err: "relative path below"},
+	{name: "over-output", tpl: `{{ qrcodeFile "page.html" .foo }}`, out: "out/", err: "already an output"},
+}
+
+func TestSideFiles(t *testing.T) {
+	for _, test := range sideFileTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile("page.html.tpl", []byte(test.tpl), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			fm := template.FuncMap{"qrcodeFile": sideFileFunc(qrcodePNG), "barcodeFile": sideFileFunc(barcodePNG)}
+			r := &Renderer{FuncMap: fm, Inputs: []string{"page.html.tpl"}, StopOnError: true}
+			err = r.Execute(test.out, map[string]interface{}{"foo": "bar"})
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error during execution: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error during execution; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected execution to fail with %q, but it succeeded", test.err)
+			}
+
+			page, err := ioutil.ReadFile(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(string(page), `<img src="`), `">`)
+			data, err := ioutil.ReadFile("out/" + name)
+			if err != nil {
+				t.Fatalf("Side file %s of %q is missing: %v", name, page, err)
+			}
+			if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+				t.Errorf("Side file %s is not a PNG image: %v", name, err)
+			}
+		})
+	}
+}
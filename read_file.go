@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileReader backs the readFile and includeFile template functions, which
+// may only read files inside a set of root directories.
+type fileReader struct {
+	roots []string
+	jails []*pathJail
+	jail  *pathJail
+}
+
+// newFileReader confines reads to roots, or to the current directory when
+// there are none. jail, if set, applies on top of the roots.
+func newFileReader(roots []string, jail *pathJail) (*fileReader, error) {
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	fr := &fileReader{roots: roots, jail: jail}
+	for _, root := range roots {
+		j, err := newPathJail(root)
+		if err != nil {
+			return nil, err
+		}
+		fr.jails = append(fr.jails, j)
+	}
+	return fr, nil
+}
+
+// resolve finds name in the first root that contains it. Absolute names must
+// lie within one of the roots.
+func (fr *fileReader) resolve(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		for _, j := range fr.jails {
+			if j.Check(name) == nil {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("%s is outside of the read roots %v", name, fr.roots)
+	}
+	for i, root := range fr.roots {
+		p := filepath.Join(root, name)
+		if fr.jails[i].Check(p) != nil {
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s was not found in the read roots %v", name, fr.roots)
+}
+
+// ReadFile is the `readFile` template function, returning the contents of a
+// file verbatim, e.g. `{{ readFile "certs/ca.pem" }}`.
+func (fr *fileReader) ReadFile(name string) (string, error) {
+	p, err := fr.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if err := fr.jail.Check(p); err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// IncludeFile is the `includeFile` template function. It is readFile without
+// the final newline, so that its result can be piped into `indent`, e.g.
+// `{{ includeFile "snippet.txt" | indent 4 }}`.
+func (fr *fileReader) IncludeFile(name string) (string, error) {
+	content, err := fr.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(content, "\n"), nil
+}
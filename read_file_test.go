@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+var readFileTests = []struct {
+	name     string
+	roots    []string
+	jail     string
+	file     string
+	abs      bool
+	include  bool
+	link     bool
+	expected string
+	err      string
+}{
+	{name: "default-root", file: "secret.txt", expected: "secret\n"},
+	{name: "first-root", roots: []string{"a", "b"}, file: "x.txt", expected: "a-x\n"},
+	{name: "second-root", roots: []string{"a", "b"}, file: "y.txt", expected: "b-y\n"},
+	{name: "include", roots: []string{"a", "b"}, file: "y.txt", include: true, expected: "b-y"},
+	{name: "not-found", roots: []string{"a", "b"}, file: "z.txt", err: "z.txt was not found in the read roots [a b]"},
+	{name: "parent", roots: []string{"a"}, file: "../secret.txt", err: "../secret.txt was not found in the read roots [a]"},
+	{name: "parent-in-second-root", roots: []string{"a", "b"}, file: "../secret.txt", err: "was not found"},
+	{name: "absolute", roots: []string{"a", "b"}, file: "b/y.txt", abs: true, expected: "b-y\n"},
+	{name: "absolute-outside", roots: []string{"a", "b"}, file: "secret.txt", abs: true, err: "is outside of the read roots [a b]"},
+	{name: "symlink-within", roots: []string{"a"}, file: "inner.txt", link: true, expected: "a-x\n"},
+	{name: "symlink-escape", roots: []string{"a"}, file: "evil.txt", link: true, err: "evil.txt was not found in the read roots [a]"},
+	{name: "root-jail", roots: []string{"a", "b"}, jail: "a", file: "y.txt", err: "escapes root"},
+}
+
+func TestReadFile(t *testing.T) {
+	for _, test := range readFileTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			if test.link && runtime.GOOS == "windows" {
+				t.Skip("symlinks need privileges")
+			}
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{"a/x.txt": "a-x\n", "b/x.txt": "b-x\n", "b/y.txt": "b-y\n", "secret.txt": "secret\n"} {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.link {
+				if err := os.Symlink("x.txt", filepath.Join("a", "inner.txt")); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(filepath.Join("..", "secret.txt"), filepath.Join("a", "evil.txt")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var jail *pathJail
+			if test.jail != "" {
+				if jail, err = newPathJail(test.jail); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fr, err := newFileReader(test.roots, jail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := test.file
+			if test.abs {
+				name = filepath.Join(tmpdir, filepath.FromSlash(name))
+			}
+			read := fr.ReadFile
+			if test.include {
+				read = fr.IncludeFile
+			}
+			got, err := read(name)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected reading %s to fail with %q, but it read %q", name, test.err, got)
+			}
+			if got != test.expected {
+				t.Errorf("Read %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
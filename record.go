@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The files of a bundle: the description of the run, its merged values, and
+// the files it read, under bundleFiles.
+const (
+	bundleRun    = "run.json"
+	bundleValues = "values.json"
+	bundleFiles  = "files/"
+)
+
+// recordedRun describes a recorded run, for its replay. Args are the flags it
+// was given, but those that the replay replaces or that have side effects,
+// with the paths among them rewritten into the files of the bundle.
+type recordedRun struct {
+	Version   string    `json:"version"`
+	BuildDate string    `json:"build_date,omitempty"`
+	Platform  string    `json:"platform"`
+	Time      time.Time `json:"time"`
+	Hostname  string    `json:"hostname"`
+	Dir       string    `json:"dir"`
+	Args      []string  `json:"args"`
+	Inputs    []string  `json:"inputs"`
+	Env       []string  `json:"env"`
+
+	// Secrets is "tokenize" or "keep", as -record-secrets asked; Tokenized
+	// lists the values and environment variables that were tokenized.
+	Secrets   string   `json:"secrets"`
+	Tokenized []string `json:"tokenized,omitempty"`
+}
+
+// recordSkippedFlags are the flags a recording leaves out: those replaced by
+// the values, time, host name, and output of the replay, and those that
+// would have it write anywhere but into the output, or wait for anything.
+var recordSkippedFlags = []string{
+	"values", "value", "transforms", "derive", "config", "out", "record", "record-secrets", "now", "hostname",
+	"wait-for", "wait-timeout", "every", "jitter", "lock-file", "prompt", "owner", "sync",
+	"onchange", "git-commit", "git-branch", "git-push", "git-pull-request", "manifest", "backup", "backup-dir", "report-file",
+}
+
+// recordedPathFlags are the flags naming files or directories that the run
+// reads, which a recording copies into its bundle.
+var recordedPathFlags = []string{"preload", "layout", "schema", "catalog", "deprecations", "rego", "exec-map-file", "read-root", "asset-root"}
+
+// secretEnvPattern matches the names of environment variables that likely
+// hold secrets, which are tokenized.
+var secretEnvPattern = regexp.MustCompile(`(?i)secret|token|passw|credential|private|api_?key|auth`)
+
+// bundlePath returns where the file or directory name read by the run is
+// kept in a bundle, relative to its files: name itself for a path inside the
+// working directory, and under _root/ for any other.
+func bundlePath(name string) (string, error) {
+	clean := filepath.ToSlash(filepath.Clean(name))
+	if !filepath.IsAbs(name) && clean != ".." && !strings.HasPrefix(clean, "../") {
+		return clean, nil
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	abs = strings.Replace(filepath.ToSlash(abs), ":", "", 1)
+	return "_root/" + strings.TrimLeft(abs, "/"), nil
+}
+
+// tokenizer replaces secrets with tokens, the same token for the same
+// secret, so that templates comparing them render alike, but not derived
+// from the secret, so that the bundle does not leak them.
+type tokenizer struct {
+	tokens map[string]string
+}
+
+func (t *tokenizer) token(secret string) string {
+	if tok, ok := t.tokens[secret]; ok {
+		return tok
+	}
+	tok := fmt.Sprintf("tokenized-secret-%d", len(t.tokens)+1)
+	t.tokens[secret] = tok
+	return tok
+}
+
+// tokenize replaces every string within v with its token.
+func (t *tokenizer) tokenize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return t.token(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = t.tokenize(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = t.tokenize(e)
+		}
+		return l
+	}
+	return v
+}
+
+// bundleWriter writes the entries of a bundle into a gzipped tarball.
+type bundleWriter struct {
+	tw    *tar.Writer
+	added map[string]bool
+}
+
+func (w *bundleWriter) writeFile(name string, content []byte, mode os.FileMode) error {
+	if w.added[name] {
+		return nil
+	}
+	w.added[name] = true
+	hdr := &tar.Header{Name: name, Mode: int64(mode.Perm()), Size: int64(len(content)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(content)
+	return err
+}
+
+// addPath adds the file name, or every file within the directory name, to
+// the files of the bundle, and returns where it is kept.
+func (w *bundleWriter) addPath(name string) (string, error) {
+	kept, err := bundlePath(name)
+	if err != nil {
+		return "", err
+	}
+	err = filepath.Walk(name, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(name, fname)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		return w.writeFile(path.Join(bundleFiles, kept, filepath.ToSlash(rel)), content, fi.Mode())
+	})
+	if err != nil {
+		return "", fmt.Errorf("Cannot record %s: %v", name, err)
+	}
+	return kept, nil
+}
+
+// recordRun writes a bundle of the run about to render inputs with values
+// into fname: the templates and other files it reads, its values, with those
+// from secrets tokenized unless secrets is "keep", its environment, and the
+// version of tpl, for `tpl replay` to render it again elsewhere. now and
+// hostname are those the run renders with.
+func recordRun(fname string, inputs []string, values Values, sources map[string]string, secrets string, now time.Time, hostname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("Cannot record the run: %v", err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	w := &bundleWriter{tw: tar.NewWriter(gz), added: make(map[string]bool)}
+
+	dir, _ := os.Getwd()
+	run := recordedRun{
+		Version:   BuildVersion,
+		BuildDate: BuildDate,
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Time:      now,
+		Hostname:  hostname,
+		Dir:       dir,
+		Args:      []string{},
+		Secrets:   secrets,
+	}
+	for _, input := range inputs {
+		kept, err := w.addPath(input)
+		if err != nil {
+			return err
+		}
+		run.Inputs = append(run.Inputs, kept)
+	}
+	var ferr error
+	visitPassedFlags(recordSkippedFlags, func(name, value string) {
+		if _, err := os.Stat(value); err == nil && isRecordedPathFlag(name) && ferr == nil {
+			value, ferr = w.addPath(value)
+		}
+		run.Args = append(run.Args, fmt.Sprintf("-%s=%s", name, value))
+	})
+	if ferr != nil {
+		return ferr
+	}
+
+	tok := &tokenizer{tokens: make(map[string]string)}
+	recorded := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		v = normalizeValue(v)
+		if scheme, _ := splitScheme(sources[k]); isSecretScheme(scheme) && secrets != "keep" {
+			v = tok.tokenize(v)
+			run.Tokenized = append(run.Tokenized, "."+k)
+		}
+		recorded[k] = v
+	}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 && secrets != "keep" && secretEnvPattern.MatchString(kv[:i]) {
+			run.Tokenized = append(run.Tokenized, "$"+kv[:i])
+			kv = kv[:i+1] + tok.token(kv[i+1:])
+		}
+		run.Env = append(run.Env, kv)
+	}
+	sort.Strings(run.Tokenized)
+
+	data, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot record the values: %v", err)
+	}
+	if err := w.writeFile(bundleValues, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(run, "", "  "); err != nil {
+		return err
+	}
+	if err := w.writeFile(bundleRun, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func isRecordedPathFlag(name string) bool {
+	for _, n := range recordedPathFlags {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runReplay renders the run recorded in the bundle fname again, into out,
+// with extra arguments added to those it was recorded with. The bundle is
+// unpacked into the workspace, where the run renders with its values, time,
+// host name, and environment, as they were recorded. It returns the process
+// exit code.
+func runReplay(ws *Workspace, fname, out string, extra []string) int {
+	dir, err := ws.TempDir("replay-")
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	if err := unpackBundle(fname, dir); err != nil {
+		logf(nil, LogError, "Cannot unpack %s: %v", fname, err)
+		return 1
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleRun))
+	if err != nil {
+		logf(nil, LogError, "%s is not a bundle of a recorded run: %v", fname, err)
+		return 1
+	}
+	var run recordedRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		logf(nil, LogError, "Cannot read %s of %s: %v", bundleRun, fname, err)
+		return 1
+	}
+	if run.Version != BuildVersion {
+		logf(nil, LogWarn, "%s was recorded with tpl %s, but this is tpl %s; the render may differ", fname, displayVersion(run.Version), displayVersion(BuildVersion))
+	}
+	if platform := runtime.GOOS + "/" + runtime.GOARCH; run.Platform != platform {
+		logf(nil, LogWarn, "%s was recorded on %s, but this is %s", fname, run.Platform, platform)
+	}
+	if len(run.Tokenized) > 0 {
+		logf(nil, LogInfo, "Replaying with tokenized secrets: %s", strings.Join(run.Tokenized, ", "))
+	}
+	if out != "-" {
+		// The replay runs in the bundle, but renders where it was asked to
+		abs, err := filepath.Abs(out)
+		if err != nil {
+			logf(nil, LogError, "%v", err)
+			return 1
+		}
+		if strings.HasSuffix(out, "/") || strings.HasSuffix(out, string(filepath.Separator)) {
+			abs += string(filepath.Separator)
+		}
+		out = abs
+	}
+
+	args := append([]string(nil), run.Args...)
+	args = append(args,
+		"-values="+filepath.Join(dir, bundleValues),
+		"-now="+run.Time.Format(time.RFC3339Nano),
+		"-hostname="+run.Hostname,
+		"-out="+out)
+	args = append(append(args, extra...), "--")
+	args = append(args, run.Inputs...)
+	self, err := os.Executable()
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	logf(nil, LogInfo, "Replaying the run recorded in %s at %s on %s, from %s", fname, run.Time.Format(time.RFC3339), run.Hostname, run.Dir)
+	logf(nil, LogDebug, "Replay arguments: %q", args)
+	cmd := exec.Command(self, args...)
+	cmd.Dir = filepath.Join(dir, bundleFiles)
+	cmd.Env = run.Env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if cmd.ProcessState != nil {
+			return cmd.ProcessState.ExitCode()
+		}
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	return 0
+}
+
+// unpackBundle unpacks the bundle fname into dir, refusing entries that
+// would land outside of it.
+func unpackBundle(fname, dir string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, content, os.FileMode(hdr.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+}
+
+// displayVersion is version, or "(development)" for a build without one.
+func displayVersion(version string) string {
+	if version == "" {
+		return "(development)"
+	}
+	return version
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var replayTests = []struct {
+	name  string
+	args  []string
+	env   []string
+	files map[string]string
+}{
+	{
+		name: "metadata",
+		env:  []string{"TPL_TEST_GREETING=hello", "TZ=Europe/Paris"},
+		files: map[string]string{
+			"in/test.txt.tpl": `{{ .name }} {{ env "TPL_TEST_GREETING" }} {{ .T.Tpl.Now }} {{ .T.Tpl.Hostname }}`,
+		},
+	},
+	{
+		name: "preload",
+		args: []string{"-preload=helpers.tpl"},
+		files: map[string]string{
+			"helpers.tpl":     `{{ define "greet" }}hello {{ . }}{{ end }}`,
+			"in/test.txt.tpl": `{{ template "greet" .name }}`,
+		},
+	},
+	{
+		name: "dir-defaults",
+		args: []string{"-dir-defaults"},
+		files: map[string]string{
+			"in/sub/defaults.yaml": "port: 8080\n",
+			"in/sub/test.txt.tpl":  `{{ .name }}:{{ .port }}`,
+		},
+	},
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	for _, test := range replayTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			files := map[string]string{"values.yaml": "name: web\n"}
+			for name, content := range test.files {
+				files[name] = content
+			}
+			for name, content := range files {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args := append([]string{"-record=bundle.tgz", "-values=values.yaml", "-out=recorded/"}, test.args...)
+			tpl(t, append(os.Environ(), test.env...), append(args, "in")...)
+
+			// The replay renders from the bundle alone, in the environment it
+			// recorded
+			for name := range files {
+				if err := ioutil.WriteFile(name, []byte("{{ changed }}"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tpl(t, os.Environ(), "replay", "-out=replayed/", "bundle.tgz")
+
+			recorded, replayed := readTree(t, "recorded"), readTree(t, "replayed")
+			if len(recorded) == 0 || len(recorded) != len(replayed) {
+				t.Errorf("Replayed %d outputs, expected the %d recorded", len(replayed), len(recorded))
+			}
+			for name, content := range recorded {
+				if replayed[name] != content {
+					t.Errorf("Replayed %s as %q, expected %q", name, replayed[name], content)
+				}
+			}
+		})
+	}
+}
+
+// readTree returns the contents of the files under dir, by their paths
+// relative to it.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, name)
+		files[rel] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
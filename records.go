@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// recordKey holds the record being rendered in the values of a template that
+// is rendered once per record of a JSON lines file.
+const recordKey = "Record"
+
+// streamsRecords reports whether the template of fm is rendered once per
+// record of a JSON lines file.
+func (fm *FrontMatter) streamsRecords() bool {
+	return fm != nil && fm.Records != ""
+}
+
+// recordOutputName names the output of record n of oname, rendering the
+// record_output template of the front matter, if any, with the record,
+// within the directory of oname. Without one, outputs are numbered after the
+// record, as pages are.
+func recordOutputName(oname string, name *template.Template, n int, record interface{}) (string, error) {
+	if name == nil {
+		return pageOutput(oname, n), nil
+	}
+	var buf bytes.Buffer
+	if err := name.Execute(&buf, record); err != nil {
+		return "", err
+	}
+	base := strings.TrimSpace(buf.String())
+	if base == "" {
+		return "", errors.New("record_output rendered a blank name")
+	}
+	return filepath.Join(filepath.Dir(oname), filepath.FromSlash(base)), nil
+}
+
+// renderRecords renders the template of p once per record of the JSON lines
+// file its front matter names, with the record in `.Record`. Records are
+// read, rendered, and let go of one at a time, so the file can be far larger
+// than what fits in memory. Blank lines are skipped. Into STDOUT, the outputs
+// follow one another. A sharded run renders the records of its shard.
+func (r *Renderer) renderRecords(data interface{}, p parsedTemplate, inames []string, oname string) error {
+	if p.fm.paginated() {
+		return errors.New("Cannot both paginate a list and render once per record")
+	}
+	values, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot render records over values that are a %T rather than a map", data)
+	}
+	var name *template.Template
+	if p.fm.RecordOutput != "" {
+		if oname == "-" {
+			return errors.New("Cannot name the outputs of records rendered into STDOUT")
+		}
+		var err error
+		name, err = template.New("record_output").Funcs(funcMap()).Option("missingkey=error").Parse(p.fm.RecordOutput)
+		if err != nil {
+			return fmt.Errorf("Invalid record_output: %v", err)
+		}
+	}
+
+	fname := p.fm.Records
+	if err := r.jail.Check(fname); err != nil {
+		return err
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return fmt.Errorf("Cannot read records: %v", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	n := 0
+	for line := 1; ; line++ {
+		text, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Cannot read records from %s: %v", fname, err)
+		}
+		if len(bytes.TrimSpace(text)) > 0 {
+			n++
+			if r.inRecordShard(n) {
+				var record interface{}
+				if uerr := yaml.Unmarshal(text, &record); uerr != nil {
+					return fmt.Errorf("Cannot parse record on line %d of %s: %v", line, fname, uerr)
+				}
+				record = normalizeValue(record)
+				out := oname
+				if oname != "-" {
+					var nerr error
+					if out, nerr = recordOutputName(oname, name, n, record); nerr != nil {
+						return fmt.Errorf("Cannot name the output of the record on line %d of %s: %v", line, fname, nerr)
+					}
+				}
+				merged := make(map[string]interface{}, len(values)+1)
+				for k, v := range values {
+					merged[k] = v
+				}
+				r.setBuiltin(merged, recordKey, record)
+				if rerr := r.render(merged, p, inames, out); rerr != nil {
+					return fmt.Errorf("Cannot render the record on line %d of %s: %v", line, fname, rerr)
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
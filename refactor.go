@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// refactorings are the refactors the refactor command makes, with the
+// arguments each takes before the templates.
+var refactorings = map[string]string{
+	"extract":      "file lines name",
+	"rename-value": ".old.path .new.path",
+}
+
+// splitRefactorArgs splits the arguments of the refactor command into the
+// refactor with its own arguments, and the templates.
+func splitRefactorArgs(args []string) ([]string, []string, error) {
+	names := make([]string, 0, len(refactorings))
+	for name := range refactorings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("The refactor command requires one of: %s", strings.Join(names, ", "))
+	}
+	usage, ok := refactorings[args[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unknown refactor %q; expected one of: %s", args[0], strings.Join(names, ", "))
+	}
+	n := 1 + len(strings.Fields(usage))
+	if len(args) < n {
+		return nil, nil, fmt.Errorf("Usage: refactor %s %s <templates...>", args[0], usage)
+	}
+	if args[0] == "extract" && len(args) == n {
+		// The file to extract from is all there is to parse
+		return args[:n], args[1:2], nil
+	}
+	return args[:n], args[n:], nil
+}
+
+// refactoring collects the edits a refactor makes to files, so that they
+// are all written at once, or shown as a diff.
+type refactoring struct {
+	before map[string][]byte
+	after  map[string][]byte
+}
+
+func newRefactoring() *refactoring {
+	return &refactoring{before: make(map[string][]byte), after: make(map[string][]byte)}
+}
+
+// read returns the content of fname, with the edits made so far.
+func (f *refactoring) read(fname string) ([]byte, error) {
+	if content, ok := f.after[fname]; ok {
+		return content, nil
+	}
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	f.before[fname] = content
+	f.after[fname] = content
+	return content, nil
+}
+
+func (f *refactoring) write(fname string, content []byte) {
+	f.after[fname] = content
+}
+
+// changed lists the files whose content was edited, sorted.
+func (f *refactoring) changed() []string {
+	var names []string
+	for name, content := range f.after {
+		if !bytes.Equal(content, f.before[name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// apply writes the edited files, or with dryRun, writes a unified diff of
+// them to w instead.
+func (f *refactoring) apply(w io.Writer, dryRun bool, logger Logger) error {
+	names := f.changed()
+	if dryRun {
+		var buf bytes.Buffer
+		for _, name := range names {
+			fmt.Fprintf(&buf, "--- a/%s\n+++ b/%s\n", name, name)
+			unifiedHunks(&buf, f.before[name], f.after[name])
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err == nil {
+			err = writeFileAtomic(name, f.after[name], fi.Mode().Perm())
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot write %s: %v", name, err)
+		}
+		logf(logger, LogInfo, "Rewrote %s", name)
+	}
+	return nil
+}
+
+// runRefactor makes the refactor named in args to the inputs of r, and to
+// the values and schema files. It returns the process exit code.
+func runRefactor(r *Renderer, args, valuesFiles []string, schemaFile string) int {
+	f := newRefactoring()
+	var err error
+	switch args[0] {
+	case "rename-value":
+		err = r.renameValue(f, args[1], args[2], valuesFiles, schemaFile)
+	case "extract":
+		err = r.extractTemplate(f, args[1], args[2], args[3])
+	}
+	if err == nil {
+		if len(f.changed()) == 0 {
+			r.logf(LogInfo, "Nothing to change")
+			return 0
+		}
+		err = f.apply(os.Stdout, r.DryRun, r.Logger)
+	}
+	if err != nil {
+		r.logf(LogError, "%v", err)
+		return 1
+	}
+	return 0
+}
+
+// valuePathPattern matches the value paths a refactor accepts, which are
+// fields that templates can refer to as `.a.b`.
+var valuePathPattern = regexp.MustCompile(`^(\.[A-Za-z_][A-Za-z0-9_]*)+$`)
+
+// renameValue moves the value at the path from to the path to, in the
+// values files and schema, and rewrites every reference to it, or to a value
+// under it, in the templates.
+func (r *Renderer) renameValue(f *refactoring, from, to string, valuesFiles []string, schemaFile string) error {
+	for _, p := range []string{from, to} {
+		if !valuePathPattern.MatchString(p) {
+			return fmt.Errorf("Cannot rename %s to %s: %q is not a value path such as .a.b", from, to, p)
+		}
+	}
+	oldPath, newPath := splitValuePath(from), splitValuePath(to)
+	if hasPathPrefix(newPath, oldPath) {
+		return fmt.Errorf("Cannot rename %s to %s, which is under it", from, to)
+	}
+
+	edits := make(map[string][]textEdit)
+	err := r.eachParsedTemplate(func(t *template.Template, path string, entry, _ bool) error {
+		refs, err := r.valueRefEdits(f, t.Tree, path, entry, oldPath, newPath)
+		edits[path] = append(edits[path], refs...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for path, e := range edits {
+		if len(e) > 0 {
+			content, _ := f.read(path)
+			f.write(path, applyEdits(content, e))
+		}
+	}
+
+	if r.DirDefaults {
+		for _, in := range r.Inputs {
+			filepath.Walk(in, func(fname string, fi os.FileInfo, err error) error {
+				if err == nil && fname != in && fi.Mode().IsRegular() && isDirDefaultsFile(fi.Name()) {
+					valuesFiles = append(valuesFiles, fname)
+				}
+				return nil
+			})
+		}
+	}
+	for _, src := range valuesFiles {
+		src, opts, _ := splitSourceOptions(src)
+		scheme, fname := splitScheme(src)
+		if scheme != "file" || fname == "-" {
+			r.logf(LogWarn, "Cannot rename %s in %s, which is not a file", from, src)
+			continue
+		}
+		if opts.reshapes() {
+			r.logf(LogWarn, "Cannot rename %s in %s, whose values are mounted or renamed", from, src)
+			continue
+		}
+		content, err := f.read(fname)
+		if err != nil {
+			return fmt.Errorf("Cannot read values file %s: %v", fname, err)
+		}
+		rename := renameYAMLValue
+		if strings.EqualFold(filepath.Ext(fname), ".json") {
+			rename = renameJSONValue
+		}
+		content, _, err = rename(content, oldPath, newPath)
+		if err != nil {
+			return fmt.Errorf("Cannot rename %s in %s: %v", from, fname, err)
+		}
+		f.write(fname, content)
+	}
+
+	if schemaFile != "" {
+		content, err := f.read(schemaFile)
+		if err != nil {
+			return fmt.Errorf("Cannot read schema %s: %v", schemaFile, err)
+		}
+		if content, err = renameSchemaValue(content, oldPath, newPath, r.Logger); err != nil {
+			return fmt.Errorf("Cannot rename %s in schema %s: %v", from, schemaFile, err)
+		}
+		f.write(schemaFile, content)
+	}
+	return nil
+}
+
+// textEdit replaces the bytes of a file from start to end.
+type textEdit struct {
+	start, end int
+	text       string
+}
+
+// applyEdits makes edits to content, where they may not overlap, but the
+// same edit may be made more than once.
+func applyEdits(content []byte, edits []textEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	out := append([]byte{}, content...)
+	last := -1
+	for _, e := range edits {
+		if e.start == last {
+			continue
+		}
+		last = e.start
+		// Edits made so far were all later in the file, so the offsets of
+		// this one still hold
+		out = append(out[:e.start:e.start], append([]byte(e.text), out[e.end:]...)...)
+	}
+	return out
+}
+
+// valueRefEdits lists the edits that rewrite the references to the value
+// at oldPath in tree, which was parsed from the file at path, to newPath.
+// References whose dot may not be the top-level values, such as in a
+// `define`, are only warned about.
+func (r *Renderer) valueRefEdits(f *refactoring, tree *parse.Tree, path string, entry bool, oldPath, newPath []string) ([]textEdit, error) {
+	src, err := f.read(path)
+	if err != nil {
+		return nil, err
+	}
+	// Positions in the tree are offsets in the body after any front matter
+	_, body := splitFrontMatter(src)
+	shift := len(src) - len(body)
+
+	var edits []textEdit
+	oldLen := len(strings.Join(oldPath, ".")) + 1
+	replacement := "." + strings.Join(newPath, ".")
+	walkDots(tree.Root, nil, entry, func(n parse.Node, dot []string, known bool) {
+		var token string
+		var ident []string
+		switch tn := n.(type) {
+		case *parse.FieldNode:
+			ident = tn.Ident
+		case *parse.VariableNode:
+			if len(tn.Ident) < 2 || tn.Ident[0] != "$" {
+				return
+			}
+			// Only in an entry template is $ the top-level values, even
+			// within range and with
+			token, ident, dot, known = "$", tn.Ident[1:], nil, entry
+		default:
+			return
+		}
+		full := append(append([]string{}, dot...), ident...)
+		loc := nodeLocation(tree, n, []string{path})
+		switch {
+		case !known && hasPathPrefix(ident, oldPath):
+			r.logf(LogWarn, "%s: not renaming %s.%s, whose dot may not be the top-level values", loc, token, strings.Join(ident, "."))
+			return
+		case !known || !hasPathPrefix(full, oldPath) || hasPathPrefix(dot, oldPath):
+			// With a dot under the old path, the with it comes from is what
+			// is renamed
+			return
+		case len(dot) > 0:
+			r.logf(LogWarn, "%s: not renaming .%s, which is .%s within with; rename it by hand", loc, strings.Join(ident, "."), strings.Join(full, "."))
+			return
+		}
+		token += "." + strings.Join(ident, ".")
+		// A node is at the position of its token, or of its last field
+		pos := int(n.Position()) + shift
+		for k := 0; k <= len(token) && pos-k >= 0; k++ {
+			start := pos - k
+			end := start + len(token)
+			if end > len(src) || string(src[start:end]) != token || end < len(src) && isIdentByte(src[end]) {
+				continue
+			}
+			if token[0] == '$' {
+				start++
+			}
+			edits = append(edits, textEdit{start: start, end: start + oldLen, text: replacement})
+			return
+		}
+		r.logf(LogWarn, "%s: cannot find %s to rename it", loc, token)
+	})
+	return edits, nil
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// hasPathPrefix reports whether the value path p is prefix, or is under it.
+func hasPathPrefix(p, prefix []string) bool {
+	if len(p) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if p[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// renameSchemaValue moves the property describing the value at oldPath in
+// a JSON Schema to newPath, along with whether it is required, and rewrites
+// the x-replacement of deprecated values that point under it.
+func renameSchemaValue(content []byte, oldPath, newPath []string, logger Logger) ([]byte, error) {
+	doc, err := parseOrderedJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := doc.(*jsonObject)
+	if !ok {
+		return content, nil
+	}
+	changed := renameReplacements(root, oldPath, newPath)
+
+	from := root
+	for i, key := range oldPath[:len(oldPath)-1] {
+		if from = schemaProperty(from, key, false); from == nil {
+			break
+		}
+		if ref, ok := from.get("$ref"); ok {
+			logf(logger, LogWarn, "Not renaming .%s in the schema, as .%s is a $ref to %v", strings.Join(oldPath, "."), strings.Join(oldPath[:i+1], "."), ref)
+			from = nil
+			break
+		}
+	}
+	var props *jsonObject
+	if from != nil {
+		props = from.object("properties", false)
+	}
+	var prop interface{}
+	if props != nil {
+		prop, ok = props.get(oldPath[len(oldPath)-1])
+	}
+	if !ok || props == nil {
+		if !changed {
+			return content, nil
+		}
+		return formatOrderedJSON(root, jsonIndent(content)), nil
+	}
+
+	to := root
+	for _, key := range newPath[:len(newPath)-1] {
+		if to = schemaProperty(to, key, true); to == nil {
+			return nil, fmt.Errorf(".%s is not described by an object", strings.Join(newPath, "."))
+		}
+	}
+	oldKey, newKey := oldPath[len(oldPath)-1], newPath[len(newPath)-1]
+	toProps := to.object("properties", true)
+	if toProps == nil {
+		return nil, fmt.Errorf("the properties of .%s are not an object", strings.Join(newPath[:len(newPath)-1], "."))
+	}
+	if _, ok := toProps.get(newKey); ok {
+		return nil, fmt.Errorf(".%s is already described", strings.Join(newPath, "."))
+	}
+	if props == toProps {
+		props.rename(oldKey, newKey)
+		renameRequired(from, oldKey, newKey)
+	} else {
+		props.remove(oldKey)
+		toProps.set(newKey, prop)
+		if renameRequired(from, oldKey, "") {
+			renameRequired(to, "", newKey)
+		}
+	}
+	return formatOrderedJSON(root, jsonIndent(content)), nil
+}
+
+// schemaProperty returns the schema of the property key of an object
+// schema, creating an object schema for it if create is set.
+func schemaProperty(s *jsonObject, key string, create bool) *jsonObject {
+	props := s.object("properties", create)
+	if props == nil {
+		return nil
+	}
+	if _, ok := props.get(key); !ok && create {
+		prop := &jsonObject{values: make(map[string]interface{})}
+		prop.set("type", "object")
+		props.set(key, prop)
+	}
+	return props.object(key, false)
+}
+
+// renameRequired replaces oldKey in the required properties of s with
+// newKey, reporting whether it was one. An empty oldKey adds newKey, and an
+// empty newKey drops oldKey.
+func renameRequired(s *jsonObject, oldKey, newKey string) bool {
+	list, _ := s.values["required"].(*jsonList)
+	if list == nil {
+		if oldKey != "" {
+			return false
+		}
+		list = &jsonList{inline: true}
+	}
+	items := append([]interface{}{}, list.items...)
+	found := oldKey == ""
+	for i, item := range items {
+		if item == oldKey {
+			items, found = append(items[:i], items[i+1:]...), true
+			if newKey != "" {
+				items = append(items[:i], append([]interface{}{newKey}, items[i:]...)...)
+			}
+			break
+		}
+	}
+	if oldKey == "" {
+		items = append(items, newKey)
+	}
+	if !found {
+		return false
+	}
+	if len(items) == 0 {
+		s.remove("required")
+	} else {
+		s.set("required", &jsonList{items: items, inline: list.inline})
+	}
+	return true
+}
+
+// renameReplacements rewrites every x-replacement under v that points at
+// or under oldPath, reporting whether any did.
+func renameReplacements(v interface{}, oldPath, newPath []string) bool {
+	changed := false
+	switch tv := v.(type) {
+	case *jsonObject:
+		for _, key := range tv.keys {
+			if s, ok := tv.values[key].(string); ok && key == "x-replacement" {
+				if p := splitValuePath(s); valuePathPattern.MatchString(s) && hasPathPrefix(p, oldPath) {
+					tv.set(key, "."+strings.Join(append(append([]string{}, newPath...), p[len(oldPath):]...), "."))
+					changed = true
+				}
+				continue
+			}
+			if renameReplacements(tv.values[key], oldPath, newPath) {
+				changed = true
+			}
+		}
+	case *jsonList:
+		for _, item := range tv.items {
+			if renameReplacements(item, oldPath, newPath) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
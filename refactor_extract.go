@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// parseLineRange parses "START-END", or a single line, into the 1-based
+// lines it spans.
+func parseLineRange(s string) (int, int, error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	start, err1 := strconv.Atoi(lo)
+	end, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || start < 1 || end < start {
+		return 0, 0, fmt.Errorf("Invalid line range %q; must be in the form of START-END", s)
+	}
+	return start, end, nil
+}
+
+// parseStandalone parses text on its own, without checking that the
+// functions it calls exist, and returns its trees by name.
+func (r *Renderer) parseStandalone(name, text string) (map[string]*parse.Tree, error) {
+	left, right := r.LeftDelim, r.RightDelim
+	t := parse.New(name)
+	t.Mode = parse.SkipFuncCheck
+	trees := make(map[string]*parse.Tree)
+	if _, err := t.Parse(text, left, right, trees); err != nil {
+		return nil, err
+	}
+	return trees, nil
+}
+
+// extractTemplate moves the lines from start to end of the file fname into
+// a new template called name, defined at the end of the first -preload file
+// or, without any, at the end of fname itself. The lines are replaced with
+// an invocation of the template, passed the dot they were rendered with.
+//
+// Indented lines are defined without their indentation, and put back in
+// place with `include` and `indent`; others are invoked with `template`.
+func (r *Renderer) extractTemplate(f *refactoring, fname, lines, name string) error {
+	start, end, err := parseLineRange(lines)
+	if err != nil {
+		return err
+	}
+	defined := false
+	err = r.eachParsedTemplate(func(t *template.Template, _ string, _, _ bool) error {
+		if t.Name() == name {
+			defined = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if defined {
+		return fmt.Errorf("Cannot extract into template %q, which is already defined", name)
+	}
+
+	src, err := f.read(fname)
+	if err != nil {
+		return err
+	}
+	all := strings.SplitAfter(string(src), "\n")
+	if all[len(all)-1] == "" {
+		all = all[:len(all)-1]
+	}
+	if end > len(all) {
+		return fmt.Errorf("Cannot extract lines %d-%d from %s, which has %d lines", start, end, fname, len(all))
+	}
+	if fm, body := splitFrontMatter(src); fm != nil {
+		// The front matter is replaced by a comment ending in "*/}}", after
+		// which the body is as in the file
+		tail := body[bytes.Index(body, []byte("*/}}"))+4:]
+		if fmLines := bytes.Count(src[:len(src)-len(tail)], []byte("\n")); start <= fmLines {
+			return fmt.Errorf("Cannot extract lines %d-%d from %s, as its front matter ends on line %d", start, end, fname, fmLines)
+		}
+	}
+	block := strings.Join(all[start-1:end], "")
+	if strings.TrimSpace(block) == "" {
+		return fmt.Errorf("Cannot extract lines %d-%d from %s, which are blank", start, end, fname)
+	}
+	if err := r.checkExtractable(src, fname, block, start, end); err != nil {
+		return fmt.Errorf("Cannot extract lines %d-%d from %s: %v", start, end, fname, err)
+	}
+
+	left, right := r.LeftDelim, r.RightDelim
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	// The template goes without the newline ending the last line, which is
+	// kept after its invocation instead
+	body := strings.TrimSuffix(strings.TrimSuffix(block, "\n"), "\r")
+	newline := block[len(body):]
+	trimmed := strings.TrimLeft(body, " \t")
+	trimLeft := strings.HasPrefix(trimmed, left+"- ")
+	trimRight := strings.HasSuffix(strings.TrimRight(body, " \t"), " -"+right)
+
+	call := fmt.Sprintf("template %q .", name)
+	if indent := blockIndent(body); indent > 0 && !trimLeft && !trimRight {
+		var dedented []string
+		for _, line := range strings.Split(body, "\n") {
+			dedented = append(dedented, line[indent:])
+		}
+		body = strings.Join(dedented, "\n")
+		call = fmt.Sprintf("include %q . | indent %d", name, indent)
+	}
+	open, close := left+" ", " "+right
+	if trimLeft {
+		open = left + "- "
+	}
+	if trimRight {
+		close = " -" + right
+	}
+
+	content := append([]byte(strings.Join(all[:start-1], "")+open+call+close+newline), strings.Join(all[end:], "")...)
+	helpers := fname
+	if len(r.PreloadFiles) > 0 {
+		f.write(fname, content)
+		helpers = r.PreloadFiles[0]
+		if content, err = f.read(helpers); err != nil {
+			return err
+		}
+	}
+	// Trim markers keep the template as it was, when they trim nothing of
+	// it
+	define := fmt.Sprintf("%s define %q %s%s%s end", left, name, right, body, left)
+	if body == strings.TrimSpace(body) {
+		define = fmt.Sprintf("%s define %q -%s\n%s\n%s- end", left, name, right, body, left)
+	}
+	if helpers == fname {
+		// Nothing may be added around the template, as the rest of the file
+		// is rendered too
+		define += " -" + right + "\n"
+	} else {
+		define += " " + right + "\n"
+		if len(content) > 0 {
+			if content[len(content)-1] != '\n' {
+				content = append(content, '\n')
+			}
+			content = append(content, '\n')
+		}
+	}
+	f.write(helpers, append(content, define...))
+	return nil
+}
+
+// checkExtractable checks that block, the lines from start to end of src,
+// stands on its own as a template, which renders the same wherever it is
+// invoked from.
+func (r *Renderer) checkExtractable(src []byte, fname, block string, start, end int) error {
+	trees, err := r.parseStandalone(fname, block)
+	if err != nil {
+		return fmt.Errorf("the lines are not a template on their own: %v", err)
+	}
+	if len(trees) > 1 {
+		return fmt.Errorf("the lines define templates")
+	}
+	tree := trees[fname]
+	if tree == nil || tree.Root == nil {
+		return nil
+	}
+
+	// Variables declared before the lines already fail to parse
+	usesRoot := false
+	walkNodes(tree.Root, true, func(n parse.Node, _ bool) {
+		if v, ok := n.(*parse.VariableNode); ok && v.Ident[0] == "$" {
+			usesRoot = true
+		}
+	})
+	if !usesRoot {
+		return nil
+	}
+
+	// Within the template, $ is the dot it is invoked with, which is only
+	// the top-level values when the lines are at the top level of the file
+	_, body := splitFrontMatter(src)
+	all, err := r.parseStandalone(fname, string(body))
+	if err != nil {
+		return err
+	}
+	shift := len(src) - len(body)
+	from := len(strings.Join(strings.SplitAfter(string(src), "\n")[:start-1], "")) - shift
+	to := from + len(block)
+	// The first node walked within the lines is at their top level
+	walked, atRoot := false, false
+	walkNodes(all[fname].Root, true, func(n parse.Node, rootDot bool) {
+		if l, ok := n.(*parse.ListNode); ok && l == nil {
+			return
+		}
+		if pos := int(n.Position()); !walked && pos >= from && pos < to {
+			walked, atRoot = true, rootDot
+		}
+	})
+	if !atRoot {
+		return fmt.Errorf("the lines use $, which the template would not see as the top-level values")
+	}
+	return nil
+}
+
+// blockIndent returns the indentation that every non-blank line of block
+// starts with, or 0 if some are blank, as indent would pad those.
+func blockIndent(block string) int {
+	indent := -1
+	for _, line := range strings.Split(block, "\n") {
+		n := len(line) - len(strings.TrimLeft(line, " "))
+		if n == len(line) {
+			return 0
+		}
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent < 0 {
+		return 0
+	}
+	return indent
+}
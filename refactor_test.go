@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var renameValueTests = []struct {
+	name     string
+	from, to string
+	files    map[string]string
+	warnings []string
+	err      string
+}{
+	{
+		name: "everywhere",
+		from: ".image.name",
+		to:   ".image.repository",
+		files: map[string]string{
+			"in/app.yaml.tpl": "image: {{ .image.repository }}:{{ .image.tag }}\n{{ with .image }}{{ .name }}{{ end }}\n{{ $.image.repository }} {{ .image.namespace }}\n{{ define \"x\" }}{{ .image.name }}{{ end }}\n",
+			"values.yaml":     "image:\n  repository: nginx\n  tag: 1\n",
+			"schema.json":     `{"type": "object", "properties": {"image": {"type": "object", "properties": {"repository": {"type": "string"}}, "required": ["repository"]}}}` + "\n",
+		},
+		// References under with, or in a define, are only warned about
+		warnings: []string{
+			"in/app.yaml.tpl:2:20: not renaming .name, which is .image.name within with",
+			"in/app.yaml.tpl:4:25: not renaming .image.name, whose dot may not be the top-level values",
+		},
+	},
+	{name: "under-itself", from: ".image", to: ".image.x", err: "which is under it"},
+	{name: "not-a-path", from: "image", to: ".x", err: `"image" is not a value path`},
+}
+
+func TestRenameValue(t *testing.T) {
+	for _, test := range renameValueTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir("in", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{
+				"in/app.yaml.tpl": "image: {{ .image.name }}:{{ .image.tag }}\n{{ with .image }}{{ .name }}{{ end }}\n{{ $.image.name }} {{ .image.namespace }}\n{{ define \"x\" }}{{ .image.name }}{{ end }}\n",
+				"values.yaml":     "image:\n  name: nginx\n  tag: 1\n",
+				"schema.json":     `{"type": "object", "properties": {"image": {"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}}}` + "\n",
+			} {
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var logged logRecorder
+			r := &Renderer{Inputs: []string{"in"}, Logger: &logged}
+			f := newRefactoring()
+			err = r.renameValue(f, test.from, test.to, []string{"values.yaml"}, "schema.json")
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected renaming to fail with %q, but it succeeded", test.err)
+			}
+			if changed := f.changed(); len(changed) != len(test.files) {
+				t.Errorf("Changed %v, expected %d files", changed, len(test.files))
+			}
+			for name, expected := range test.files {
+				if got := string(f.after[name]); got != expected {
+					t.Errorf("Rewrote %s into %q, expected %q", name, got, expected)
+				}
+			}
+			if len(logged) != len(test.warnings) {
+				t.Errorf("Logged %q, expected %d warnings", logged, len(test.warnings))
+			}
+			for _, w := range test.warnings {
+				if !strings.Contains(strings.Join(logged, "\n"), w) {
+					t.Errorf("Missing warning %q among %q", w, logged)
+				}
+			}
+		})
+	}
+}
+
+// logRecorder keeps every message logged to it.
+type logRecorder []string
+
+func (l *logRecorder) Log(level LogLevel, msg string) {
+	*l = append(*l, msg)
+}
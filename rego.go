@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultRegoQuery is the rule evaluated against outputs by -rego, following
+// the conftest convention of a `deny` set of messages in package main.
+const DefaultRegoQuery = "data.main.deny"
+
+// regoValidator evaluates the Rego policies in files against each JSON or
+// YAML output with the opa CLI. Every document of an output is evaluated on
+// its own, as the `input`, and every message in the result of query is a
+// violation. Temporary files are created in ws.
+func regoValidator(files []string, query string, ws *Workspace) (Validator, error) {
+	opa, err := exec.LookPath("opa")
+	if err != nil {
+		return nil, fmt.Errorf("evaluating Rego policies requires the opa CLI: %v", err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			return nil, err
+		}
+	}
+	return func(path string, content []byte) error {
+		docs, err := decodeDocuments(path, content)
+		if err != nil {
+			return err
+		}
+		var violations []string
+		for _, doc := range docs {
+			msgs, err := evalRego(opa, files, query, doc, ws)
+			if err != nil {
+				return err
+			}
+			violations = append(violations, msgs...)
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("policy violations:\n  %s", strings.Join(violations, "\n  "))
+		}
+		return nil
+	}, nil
+}
+
+// decodeDocuments decodes every document of a JSON or YAML output. Outputs
+// with other extensions have none.
+func decodeDocuments(path string, content []byte) ([]interface{}, error) {
+	var docs []interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(content))
+		for {
+			var v interface{}
+			if err := dec.Decode(&v); err == io.EOF {
+				return docs, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid JSON: %v", err)
+			}
+			docs = append(docs, v)
+		}
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(content))
+		for {
+			var v interface{}
+			if err := dec.Decode(&v); err == io.EOF {
+				return docs, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid YAML: %v", err)
+			}
+			if v != nil {
+				docs = append(docs, normalizeValue(v))
+			}
+		}
+	}
+	return nil, nil
+}
+
+// evalRego runs `opa eval` with doc as the input, returning the messages the
+// query evaluates to.
+func evalRego(opa string, files []string, query string, doc interface{}, ws *Workspace) ([]string, error) {
+	input, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ws.TempFile("rego-input-*.json")
+	if err != nil {
+		return nil, err
+	}
+	tmpname := tmp.Name()
+	if !ws.keep() {
+		defer os.Remove(tmpname)
+	}
+	_, err = tmp.Write(input)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"eval", "--format", "json", "--input", tmpname}
+	for _, f := range files {
+		args = append(args, "--data", f)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(opa, append(args, query)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("opa eval failed: %v\n%s", err, strings.TrimSpace(stderr.String()+stdout.String()))
+	}
+
+	var res struct {
+		Result []struct {
+			Expressions []struct {
+				Value interface{} `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		return nil, fmt.Errorf("unexpected output from opa eval: %v", err)
+	}
+	var msgs []string
+	for _, r := range res.Result {
+		for _, e := range r.Expressions {
+			values, ok := e.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s must be a set of messages, got %v", query, e.Value)
+			}
+			for _, v := range values {
+				if s, ok := v.(string); ok {
+					msgs = append(msgs, s)
+				} else if b, err := json.Marshal(v); err == nil {
+					msgs = append(msgs, string(b))
+				}
+			}
+		}
+	}
+	return msgs, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing/fstest"
+)
+
+// RenderFS renders every input as Execute would into the current directory,
+// but keeps the outputs in memory and returns them as a file system, keyed
+// by their slash-separated relative paths. Nothing is written to disk, which
+// makes it easy to test a repository of templates:
+//
+//	fsys, err := r.RenderFS(values)
+//	if err != nil { ... }
+//	got := string(fsys["app/config.yaml"].Data)
+//
+// Hooks do not run, as no output file changes.
+func (r *Renderer) RenderFS(data interface{}) (fstest.MapFS, error) {
+	mem := newMemorySink()
+	r.memory = mem
+	defer func() { r.memory = nil }()
+	if err := r.Execute("."+string(filepath.Separator), data); err != nil {
+		return nil, err
+	}
+
+	fsys := make(fstest.MapFS, len(mem.entries))
+	for name, e := range mem.entries {
+		fsys[name] = &fstest.MapFile{Data: e.content, Mode: e.mode, ModTime: r.now}
+	}
+	return fsys, nil
+}
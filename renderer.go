@@ -1,15 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 )
 
 // Renderer will render a set of inputs.
@@ -18,133 +19,1105 @@ type Renderer struct {
 	Inputs       []string
 	PreloadFiles []string
 	StopOnError  bool
-}
 
-// Execute applies a dataset against all inputs and writes output.
-func (r *Renderer) Execute(out string, values map[string]interface{}) error {
-	return r.execute(r.Inputs, out, values)
+	// Mappings are rendered after the Inputs, each into its own output
+	// rather than one under the output path given to Execute, so that a
+	// single run can update files scattered across the filesystem.
+	Mappings []OutputMapping
+
+	// LeftDelim and RightDelim, if set, replace the "{{" and "}}" action
+	// delimiters of templates, e.g. for outputs that are full of braces.
+	LeftDelim  string
+	RightDelim string
+
+	// Policy, if set, restricts the functions available to templates and
+	// the paths outputs may be written to.
+	Policy *Policy
+
+	// Root, if set, confines every template read and output write to the
+	// given directory.
+	Root string
+
+	// Catalog, if set, holds the messages the t function translates, which
+	// the Manifest takes into account.
+	Catalog *catalog
+
+	// Schema, if set, validates values before any template executes.
+	Schema *Schema
+
+	// BuiltinsKey is the top-level value under which templates find the
+	// builtins, the values tpl injects, e.g. "T" for `.T.Tpl.OutputPath`.
+	// Without it, each builtin is a top-level value of its own, as in
+	// `.Tpl.OutputPath`. OmitBuiltins lists those not to inject; see
+	// builtinNames.
+	BuiltinsKey  string
+	OmitBuiltins []string
+
+	// DirDefaults loads any defaults.yaml and values.yaml found in an input
+	// directory as the lowest-precedence values for templates in that
+	// directory and below. Those files are not rendered themselves.
+	DirDefaults bool
+
+	// CopyNonTemplates copies files found in input directories that lack a
+	// template extension verbatim, instead of rendering them.
+	CopyNonTemplates bool
+
+	// Extensions, if set, replaces the template extensions (".tpl" and
+	// ".tmpl") stripped from template names to form output names.
+	Extensions []string
+
+	// ExtensionMap rewrites the end of output names, e.g. ".yaml.tpl" to
+	// ".yml", taking precedence over Extensions. The longest matching
+	// suffix wins.
+	ExtensionMap map[string]string
+
+	// FileMode and DirMode are the permissions of created files and
+	// directories, before the umask is applied. They default to 0644 and 0755.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// PreserveMode gives each output the permissions of the template it was
+	// rendered from, so that an executable script template renders into an
+	// executable script.
+	PreserveMode bool
+
+	// Owner, if set, is given every output and created directory, which are
+	// then given their permissions exactly, regardless of the umask.
+	Owner *FileOwner
+
+	// SyncDirs syncs every directory outputs were written into at the end of
+	// the run, so that they are durable once it finished.
+	SyncDirs bool
+
+	// Now and Hostname, if set, replace the time and host name of the run in
+	// the render metadata, as when replaying a recorded run.
+	Now      time.Time
+	Hostname string
+
+	// Validators are run against every output before it is written. Any
+	// error fails the run, leaving the previous file contents in place.
+	Validators []Validator
+
+	// Scanners are run against every output before it is written, after the
+	// Validators. What they find fails the run, or with a ScanAction of
+	// "warn", is only logged.
+	Scanners   []Scanner
+	ScanAction string
+
+	// AllowNoValue disables the check, made when StopOnError is set, that
+	// fails any output containing the literal "<no value>" text/template
+	// renders for nil values.
+	AllowNoValue bool
+
+	// WarnMissing logs a warning for every value referenced by a template
+	// that is missing, when StopOnError is not set and a zero value would be
+	// silently rendered in its place.
+	WarnMissing bool
+
+	// SkipMissing leaves the outputs of templates that use a top-level value
+	// that is missing as they are, instead of rendering them, such as when
+	// an optional values source failed to load.
+	SkipMissing bool
+
+	// Deprecations lists value paths that should no longer be used. Values
+	// and template references using them are logged as warnings, or fail
+	// the run under StrictDeprecations.
+	Deprecations       []Deprecation
+	StrictDeprecations bool
+
+	// Git, if set, commits the output files that changed at the end of
+	// the run, after any hooks.
+	Git *GitCommit
+
+	// Pack, if set, packs all outputs into a single Kubernetes manifest,
+	// which is written to the output path.
+	Pack *KubePack
+
+	// Mail, if set, assembles all outputs into a single MIME message, which
+	// is written to the output path.
+	Mail *MailMessage
+
+	// SinkPlugins maps schemes of the output path, e.g. "s3" for
+	// s3://bucket/prefix, to the plugins storing all outputs there.
+	SinkPlugins map[string]string
+
+	// Assets, if set, are the static files fingerprinted by the assetHash and
+	// assetURL template functions, which are copied into its CopyDir at the
+	// end of the run.
+	Assets *AssetStore
+
+	// Stats, if set, collects timings and counts over the run.
+	Stats *RenderStats
+
+	// Profile, if set, attributes the time spent rendering to the named
+	// templates that inputs execute.
+	Profile *TemplateProfile
+
+	// Logger, if set, receives every message logged over the course of a
+	// run, instead of the standard logger.
+	Logger Logger
+
+	// Report, if set, is filled in with the outcome of every input over the
+	// course of Execute.
+	Report *RunReport
+
+	// OnChange lists commands to run, with `sh -c`, at the end of a run in
+	// which any output file changed. Templates may also declare commands to
+	// run when their own output changed in their front matter.
+	OnChange []string
+
+	// Workspace, if set, holds the intermediate files of the run.
+	Workspace *Workspace
+
+	// Pipes are run over every rendered output, before the Header is added
+	// and it is normalized. Copied files are left alone.
+	Pipes []Pipe
+
+	// OutputFormat, if set to "env" or "export", reads every rendered output
+	// as KEY=VALUE lines and rewrites them, quoted as needed, into a dotenv
+	// file or a shell script exporting them. This happens after the Pipes.
+	OutputFormat string
+
+	// Merge parses every rendered output as a JSON or YAML fragment, by its
+	// extension, and deep-merges the fragments of each output, in order,
+	// into one document that is written once every template has rendered,
+	// rather than concatenating them.
+	Merge bool
+
+	// Header, if set, is rendered with the values of each output and
+	// prepended to it as a comment, using the comment syntax of the output's
+	// extension. See DefaultHeader.
+	Header string
+
+	// LineEndings, if set to "lf" or "crlf", converts the line endings of
+	// rendered outputs. TrimTrailingSpace strips spaces and tabs from the end
+	// of each line, and FinalNewline makes outputs end in exactly one
+	// newline. Copied files are left alone.
+	LineEndings       string
+	TrimTrailingSpace bool
+	FinalNewline      bool
+
+	// BinaryFiles decides what happens to binary files found in input
+	// directories, which would be corrupted by rendering them: "copy" them
+	// verbatim (the default), "skip" them, or "render" them anyway.
+	BinaryFiles string
+
+	// Symlinks decides what happens to symbolic links found in input
+	// directories: "follow" them (the default), "skip" them, or "preserve"
+	// them as links with the same target in the output tree. Links back to a
+	// directory being walked are always skipped.
+	Symlinks string
+
+	// MaxInputSize, if positive, fails the run before anything is rendered
+	// when a template is larger than this many bytes.
+	MaxInputSize int64
+
+	// SkipUnreadable logs and skips files and directories found in input
+	// directories that cannot be read for lack of permission, instead of
+	// failing the run.
+	SkipUnreadable bool
+
+	// BackupSuffix and BackupDir, if either is set, save the previous
+	// contents of every output file about to be overwritten. Backups are
+	// written next to their output with BackupSuffix appended, or under a
+	// directory named after the time of the run inside BackupDir.
+	BackupSuffix string
+	BackupDir    string
+
+	// Transactional holds every output back until all templates have
+	// rendered successfully, so that a failed run leaves previous outputs
+	// untouched. Outputs written to STDOUT are not held back.
+	Transactional bool
+
+	// WriteRetries, if positive, is how many more times a write that failed
+	// is attempted before the output fails, waiting RetryBackoff, or
+	// DefaultRetryBackoff, after the first attempt and twice as long after
+	// each one after it.
+	WriteRetries int
+	RetryBackoff time.Duration
+
+	// DryRun renders and validates every output without writing any of
+	// them, logging what would have been written instead.
+	DryRun bool
+
+	// EmitPatch renders every output without writing any of them, writing a
+	// unified diff from the files as they are to STDOUT instead, e.g. for
+	// `git apply`.
+	EmitPatch bool
+
+	// Manifest, if set, names a file recording a hash of what every output
+	// file was rendered from. Outputs whose templates, values, and settings
+	// are unchanged since, and whose contents were left alone, are not
+	// rendered again unless Force is set. What templates read by other means,
+	// such as readFile, exec, or the time, is not taken into account.
+	Manifest string
+	Force    bool
+
+	// Shard and Shards, if Shards is more than one, render only the Shard-th,
+	// counting from 1, of Shards disjoint parts of the outputs, and of the
+	// records of templates rendered once per record, so that runs on many
+	// machines render one tree between them. The manifest notes the shard.
+	Shard  int
+	Shards int
+
+	// Sandbox renders untrusted templates: functions that read files, the
+	// environment, or secrets, or that run commands, fail when called; reads
+	// and writes are confined to Root, or the current directory; templates
+	// cannot declare hooks in their front matter, nor can symlinks be
+	// preserved. Each template is also limited by a Timeout and
+	// MaxOutputBytes, which default to DefaultSandboxTimeout and
+	// DefaultSandboxOutputSize.
+	Sandbox bool
+
+	// Timeout and MaxOutputBytes, if positive, fail a template that executes
+	// for longer, or renders more bytes, than this, such as one with an
+	// accidentally unbounded range. A template that runs out of time is
+	// abandoned, and stops at its next write or function call.
+	Timeout        time.Duration
+	MaxOutputBytes int64
+
+	// Prompt asks on the terminal, before anything is rendered, for every
+	// value passed to the `required` function that is missing or empty,
+	// instead of failing. Values with a name like a password, secret, token,
+	// or key are read without being echoed.
+	Prompt bool
+
+	// Layout, if set, turns Markdown inputs with a .md extension into pages
+	// of a static site: each is rendered into an .html output by the Layout
+	// template, or another template next to it named by the `layout` key of
+	// its front matter. The rest of the front matter is layered on top of
+	// the values, and the page converted to HTML is the Content builtin, e.g.
+	// `.T.Content` under BuiltinsKey.
+	Layout string
+
+	// Index, if set, is a template rendered after every other output, into
+	// the output directory, with the list of output files of the run in
+	// the Outputs builtin, e.g. for a summary page or a kustomization.yaml.
+	Index string
+
+	// OutIsDir treats the output path as a directory even when it does not
+	// exist yet, instead of as a file.
+	OutIsDir bool
+
+	jail        *pathJail
+	outIsDir    bool
+	now         time.Time
+	hostname    string
+	header      *template.Template
+	changes     *changeTracker
+	preloadList string
+	funcs       template.FuncMap
+	sink        outputSink
+	memory      *memorySink
+	canLink     bool
+	retries     *retrySink
+	backups     *backupPolicy
+	written     map[string]bool
+	warned      map[string]bool
+	manifest    *buildManifest
+	inputSums   map[string]string
+	indexed     map[string]*indexedOutput
+	indexOrder  []string
+	fragments   []*outputFragments
+
+	// rendering is the output being rendered, which side files are written
+	// next to.
+	rendering string
+
+	// guards stop the templates with a timeout once they are abandoned.
+	guards map[*template.Template]*stopGuard
+
+	// breaker, if set, keeps templates that fail from failing the run, and
+	// leaves those that fail again and again out of it.
+	breaker *circuitBreaker
+
+	// keepContent keeps the outputs from before and after every run in the
+	// change tracker, for the daemon to show diffs of.
+	keepContent bool
 }
 
-func (r *Renderer) execute(inputs []string, out string, values map[string]interface{}) error {
-	// Do not order inputs, which may have been provided in a specific order
-	// from the command line
-	for _, fn := range inputs {
-		f, err := os.Open(fn)
-		if err != nil {
+// Execute applies a dataset against all inputs and writes output. When out
+// names a .tar, .tar.gz, .tgz, or .zip file, all outputs are written into
+// that archive under their relative paths.
+//
+// The dataset is usually a map[string]interface{} or Values. Any other data,
+// such as a struct, is handed to templates as it is; directory defaults and
+// render metadata then cannot be merged into it, and the Schema and
+// Deprecations are checked against its JSON encoding.
+func (r *Renderer) Execute(out string, data interface{}) error {
+	root := r.Root
+	if r.Sandbox {
+		if root == "" {
+			root = "."
+		}
+		if r.Symlinks == "preserve" {
+			return errors.New("Cannot preserve symlinks in sandbox mode")
+		}
+	}
+	jail, err := newPathJail(root)
+	if err != nil {
+		return err
+	}
+	r.jail = jail
+	r.funcs = nil
+	fs := &fileSink{dirMode: r.dirMode(), jail: jail, policy: r.Policy, owner: r.Owner, sync: r.SyncDirs}
+	if r.BackupSuffix != "" || r.BackupDir != "" {
+		fs.backup = &backupPolicy{suffix: r.BackupSuffix, dir: r.BackupDir, time: time.Now()}
+	}
+	r.backups = fs.backup
+	r.sink = fs
+	if r.memory != nil {
+		r.sink = r.memory
+	} else if r.Pack != nil {
+		if r.sink, err = newKubePackSink(*r.Pack, out, fs); err != nil {
+			return err
+		}
+		out = "." + string(filepath.Separator)
+	} else if r.Mail != nil {
+		if r.sink, err = newMailSink(*r.Mail, out, fs); err != nil {
+			return err
+		}
+		out = "." + string(filepath.Separator)
+	} else if path := r.sinkPlugin(out); path != "" {
+		if err := r.checkSinkPlugin(out); err != nil {
 			return err
 		}
+		r.sink = newPluginSink(out, path, r.Logger)
+		out = "." + string(filepath.Separator)
+	} else if format := archiveFormat(out); format != "" {
+		if err := r.sink.Check(out); err != nil {
+			return err
+		}
+		mode, _ := r.outputMode("")
+		r.sink = newArchiveSink(out, format, mode)
+		out = "." + string(filepath.Separator)
+	}
+	r.changes = nil
+	if r.sink == fs {
+		r.changes = newChangeTracker()
+		if r.keepContent {
+			r.changes.prev = make(map[string][]byte)
+			r.changes.next = make(map[string][]byte)
+		}
+	}
+	if r.Transactional && r.sink == fs {
+		r.sink = newTransactionSink(fs, r.Logger)
+	}
+	r.canLink = false
+	if _, ok := r.sink.(symlinkSink); ok {
+		r.canLink = true
+	}
+	if r.Git != nil && r.changes == nil {
+		return errors.New("Cannot commit outputs that are not written into files")
+	}
+	r.retries = nil
+	if r.WriteRetries > 0 {
+		r.retries = newRetrySink(r.sink, r.WriteRetries, r.RetryBackoff, r.Logger)
+		r.sink = r.retries
+	}
+	if r.EmitPatch {
+		if r.changes == nil {
+			return errors.New("Cannot emit a patch of outputs that are not written into files")
+		}
+		r.sink = newPatchSink(fs, os.Stdout)
+		r.canLink = true
+	} else if r.DryRun {
+		r.sink = newDryRunSink(r.sink, r.Logger)
+	}
+	r.written = make(map[string]bool)
+	r.warned = make(map[string]bool)
+	r.manifest = nil
+	r.inputSums = make(map[string]string)
+	r.indexed = make(map[string]*indexedOutput)
+	r.guards = make(map[*template.Template]*stopGuard)
+	r.fragments = nil
+	r.indexOrder = nil
+	if r.Manifest != "" {
+		if r.changes != nil {
+			r.manifest = r.loadManifest(r.Manifest)
+		} else {
+			r.warn("Ignoring the manifest, as outputs are not written to files")
+		}
+	}
+	r.resolveOutput(out)
+	r.now, r.hostname = r.Now, r.Hostname
+	if r.now.IsZero() {
+		r.now = time.Now()
+	}
+	if r.hostname == "" {
+		r.hostname, _ = os.Hostname()
+	}
+	r.header = nil
 
-		fi, err := f.Stat()
+	values, isMap := valueMap(data)
+	if !isMap && (r.Schema != nil || len(r.Deprecations) > 0) {
+		plain, err := plainData(data)
 		if err != nil {
 			return err
 		}
+		values, _ = plain.(map[string]interface{})
+	}
+	if r.Schema != nil {
+		if errs := r.Schema.Validate(values); len(errs) > 0 {
+			msgs := make([]string, len(errs))
+			for i, err := range errs {
+				msgs[i] = "  " + err.Error()
+			}
+			return fmt.Errorf("Values do not match schema:\n%s", strings.Join(msgs, "\n"))
+		}
+	}
+	if err := r.checkValueDeprecations(values); err != nil {
+		return err
+	}
 
-		// Render files directly
-		if !fi.IsDir() {
-			withPreloads := make([]string, 0)
-			for _, lib := range r.PreloadFiles {
-				withPreloads = append(withPreloads, lib)
+	if r.Report != nil {
+		*r.Report = RunReport{Outputs: []ReportEntry{}}
+	}
+	jobs, err := r.plan(r.Inputs, out)
+	if err != nil {
+		return err
+	}
+	if jobs, err = r.conditionalJobs(jobs, data); err != nil {
+		return err
+	}
+	if err := r.checkPlan(jobs, out); err != nil {
+		return err
+	}
+	jobs = r.shardJobs(jobs, out)
+	r.logf(LogDebug, "Planned %d output(s) from %d input(s)", len(jobs), len(r.Inputs))
+	if !isMap {
+		for _, job := range jobs {
+			if len(job.defaults) > 0 {
+				return fmt.Errorf("Cannot apply directory defaults to %s, because the values are a %T rather than a map; disable DirDefaults", job.input, data)
 			}
-			withPreloads = append(withPreloads, fn)
+		}
+	}
+	if r.sink == fs {
+		outputs := make([]string, len(jobs))
+		for i, job := range jobs {
+			outputs[i] = job.output
+		}
+		if err := fs.createDirs(outputs); err != nil {
+			return err
+		}
+	}
+	err = r.execute(jobs, data)
+	if err == nil {
+		err = r.writeFragments()
+	}
+	if err == nil {
+		err = r.copyAssets()
+	}
+	if err == nil {
+		err = r.renderIndex(out, data)
+	}
+	if err == nil {
+		err = r.sink.Close()
+	}
+	if err == nil && r.manifest != nil && !r.DryRun && !r.EmitPatch {
+		err = r.saveManifest(r.Manifest)
+	}
+	if err == nil {
+		err = r.runHooks()
+	}
+	if err == nil {
+		err = r.commitChanges()
+	}
+	r.finishReport(err)
+	return err
+}
 
-			err := r.render(values, withPreloads, r.getOutputPath(out, path.Base(fn)))
-			if err != nil {
-				return err
+// resolveOutput determines, once per run, whether out names a directory.
+func (r *Renderer) resolveOutput(out string) {
+	r.outIsDir = false
+	if out == "" || out == "-" || strings.HasSuffix(out, "/") {
+		return
+	}
+	if r.OutIsDir {
+		r.outIsDir = true
+		return
+	}
+	if fi, err := os.Stat(out); err == nil && fi.IsDir() {
+		r.outIsDir = true
+	}
+}
+
+// dirDefaultsFiles are loaded from input directories when DirDefaults is set,
+// in this order.
+var dirDefaultsFiles = []string{"defaults.yaml", "values.yaml"}
+
+func isDirDefaultsFile(name string) bool {
+	for _, d := range dirDefaultsFiles {
+		if name == d {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDirDefaults layers the defaults files found in dir on top of the
+// defaults inherited from its parents.
+func (r *Renderer) loadDirDefaults(dir string, inherited map[string]interface{}) (map[string]interface{}, error) {
+	layered := make(Values)
+	for k, v := range inherited {
+		layered[k] = v
+	}
+	loader := newValuesLoader(DefaultMaxIncludeDepth, r.jail)
+	loader.logger = r.Logger
+	for _, name := range dirDefaultsFiles {
+		fn := filepath.Join(dir, name)
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			continue
+		}
+		if err := loader.LoadInto(layered, fn); err != nil {
+			return nil, err
+		}
+	}
+	return layered, nil
+}
+
+// withDefaults returns values layered on top of defaults.
+func withDefaults(values, defaults map[string]interface{}) map[string]interface{} {
+	if len(defaults) == 0 {
+		return values
+	}
+	merged := make(map[string]interface{}, len(defaults)+len(values))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return merged
+}
+
+// execute renders or copies each job in order.
+func (r *Renderer) execute(jobs []renderJob, values interface{}) error {
+	// Every render shares one list of template files, ending with the
+	// preloads plus the current input
+	inames := make([]string, len(r.PreloadFiles)+1)
+	copy(inames, r.PreloadFiles)
+	r.preloadList = ""
+	for _, lib := range r.PreloadFiles {
+		r.preloadList += lib + ", "
+	}
+
+	// Parse every template before rendering any, so that all of their
+	// syntax errors are reported at once
+	parsed := make([]parsedTemplate, len(jobs))
+	failed := make(map[int]error)
+	tripped := make(map[int]bool)
+	uses := make(map[string]int)
+	for i, job := range jobs {
+		if job.copy || job.link != "" {
+			continue
+		}
+		if r.breaker.isOpen(job.input) {
+			tripped[i] = true
+			continue
+		}
+		inames[len(inames)-1] = job.input
+		start := time.Now()
+		var page *contentPage
+		if r.isPage(job.input) {
+			var err error
+			if page, err = r.readPage(job.input); err != nil {
+				failed[i] = err
+				continue
 			}
+			inames[len(inames)-1] = page.layout
+		}
+		tpl, fm, err := r.parse(inames)
+		if err != nil {
+			failed[i] = err
 			continue
 		}
+		parsed[i] = parsedTemplate{tpl: tpl, fm: fm, page: page, took: time.Since(start)}
+		uses[job.output]++
+	}
+	if len(failed) > 0 && r.breaker == nil {
+		for i, job := range jobs {
+			if err, ok := failed[i]; ok {
+				r.Report.add(job, 0, err)
+			} else {
+				r.Report.skip(jobs[i : i+1])
+			}
+		}
+		return parseErrors(jobs, failed)
+	}
+	values, err := r.requiredValues(jobs, parsed, values)
+	if err != nil {
+		return err
+	}
 
-		// Loop through each file in a directory and render it
-		eis, err := f.Readdirnames(-1)
+	for i, job := range jobs {
+		if tripped[i] {
+			r.Report.tripped(job)
+			continue
+		}
+		if err, ok := failed[i]; ok {
+			// Only with a breaker do templates that failed to parse not
+			// stop the run
+			r.Report.add(job, 0, err)
+			r.breaker.failure(job.input, err)
+			continue
+		}
+		start := time.Now()
+		var err error
+		if job.copy {
+			err = r.copyFile(job.input, job.output, job.mode)
+		} else if job.link != "" {
+			err = r.linkFile(job.input, job.output, job.link)
+		} else {
+			inames[len(inames)-1] = job.input
+			page := parsed[i].page
+			if page != nil {
+				inames[len(inames)-1] = page.layout
+			}
+			paged := parsed[i].fm.paginated() || parsed[i].fm.streamsRecords()
+			if r.skipUnchanged(job, inames, values, paged || uses[job.output] > 1) {
+				r.Report.cached(job)
+				r.indexCached(job.output)
+				continue
+			}
+			data := r.jobValues(values, job)
+			if page != nil {
+				data, err = r.pageValues(page, data)
+			}
+			if missing := missingValues(parsed[i].tpl, data); err == nil && r.SkipMissing && len(missing) > 0 {
+				r.warn(fmt.Sprintf("Leaving %s as it is, as %s uses %s, which is missing", job.output, job.input, strings.Join(missing, ", ")))
+				r.Report.unavailable(job)
+				continue
+			}
+			if err == nil && parsed[i].fm.streamsRecords() {
+				err = r.renderRecords(data, parsed[i], inames, job.output)
+			} else if err == nil && paged {
+				err = r.renderPages(data, parsed[i], inames, job.output)
+			} else if err == nil {
+				err = r.render(data, parsed[i], inames, job.output)
+			}
+			if err != nil && page != nil {
+				err = fmt.Errorf("Cannot render page %s: %v", job.input, err)
+			}
+			start = start.Add(-parsed[i].took)
+		}
+		r.Report.add(job, time.Since(start), err)
+		if r.breaker != nil && !job.copy && job.link == "" {
+			if err != nil {
+				r.breaker.failure(job.input, err)
+				continue
+			}
+			r.breaker.success(job.input)
+		}
 		if err != nil {
+			r.Report.skip(jobs[i+1:])
 			return err
 		}
+	}
+	return nil
+}
+
+// templateExtensions are stripped from template names to form output names,
+// unless Extensions is set.
+var templateExtensions = []string{".tpl", ".tmpl"}
+
+func (r *Renderer) templateExtensions() []string {
+	if len(r.Extensions) > 0 {
+		return r.Extensions
+	}
+	return templateExtensions
+}
 
-		// Pluck out absolute path names; unlike inputs, these are safe to sort,
-		// because they were generated values
-		names := stringSorter{}
-		for _, ei := range eis {
-			names = append(names, filepath.Join(f.Name(), ei))
+func (r *Renderer) isTemplateFile(name string) bool {
+	for _, ext := range r.templateExtensions() {
+		if strings.HasSuffix(name, ext) {
+			return true
 		}
-		sort.Sort(names)
+	}
+	return false
+}
 
-		outpath := out
-		if strings.HasSuffix(out, "/") {
-			outpath = outpath + path.Base(f.Name()) + "/"
+// outputName turns the file name of an input into that of its output: the
+// longest matching suffix of ExtensionMap is replaced, or else any template
+// extension is stripped.
+func (r *Renderer) outputName(fn string) string {
+	from := ""
+	for suffix := range r.ExtensionMap {
+		if len(suffix) > len(from) && strings.HasSuffix(fn, suffix) && len(suffix) < len(fn) {
+			from = suffix
 		}
+	}
+	if from != "" {
+		return strings.TrimSuffix(fn, from) + r.ExtensionMap[from]
+	}
+	if r.isPage(fn) {
+		return strings.TrimSuffix(fn, pageExtension) + ".html"
+	}
+	for _, ext := range r.templateExtensions() {
+		if strings.HasSuffix(fn, ext) {
+			return strings.TrimSuffix(fn, ext)
+		}
+	}
+	return fn
+}
 
-		err = r.execute(names, outpath, values)
-		if err != nil {
+// copyFile copies iname to oname without treating it as a template.
+func (r *Renderer) copyFile(iname, oname string, mode os.FileMode) error {
+	if oname == "" {
+		return errors.New("Output name cannot be blank")
+	}
+	if oname != "-" {
+		if err := r.sink.Check(oname); err != nil {
 			return err
 		}
+	}
+	content, err := ioutil.ReadFile(iname)
+	if err != nil {
+		return err
+	}
+	r.logf(LogInfo, "Copying %s into %s", iname, oname)
+	return r.writeOutput(oname, content, mode)
+}
 
+// linkFile reproduces the symlink iname as oname, pointing at target.
+func (r *Renderer) linkFile(iname, oname, target string) error {
+	if err := r.sink.Check(oname); err != nil {
+		return err
 	}
-	return nil
+	r.logf(LogInfo, "Linking %s to %s", oname, target)
+	return r.sink.(symlinkSink).Symlink(target, oname)
 }
 
+// getOutputPath names the output of fn under base. A base without a trailing
+// slash is always the output path of the run, which is a directory only when
+// resolveOutput found it to be one.
 func (r *Renderer) getOutputPath(base, fn string) string {
 	if base == "" || base == "-" {
 		return "-"
 	}
-	if strings.HasSuffix(fn, ".tpl") {
-		fn = strings.TrimSuffix(fn, ".tpl")
-	} else if strings.HasSuffix(fn, ".tmpl") {
-		fn = strings.TrimSuffix(fn, ".tmpl")
-	}
-	if strings.HasSuffix(base, "/") {
-		return filepath.Join(base, fn)
-	}
-	if f, err := os.Open(base); err == nil {
-		if fi, err := f.Stat(); err == nil {
-			if fi.IsDir() {
-				return filepath.Join(base, fn)
-			}
-		}
+	if r.outIsDir || strings.HasSuffix(base, "/") {
+		return filepath.Join(base, r.outputName(fn))
 	}
 	return base
 }
 
-func (r *Renderer) render(values map[string]interface{}, inames []string, oname string) error {
+func (r *Renderer) render(values interface{}, p parsedTemplate, inames []string, oname string) error {
 	if oname == "" {
 		return errors.New("Output name cannot be blank")
 	}
 
-	var out *os.File
-	var err error
+	// Preloads were checked when the run was planned
+	iname := inames[len(inames)-1]
+	if err := r.jail.Check(iname); err != nil {
+		return err
+	}
+	if oname != "-" {
+		if err := r.sink.Check(oname); err != nil {
+			return err
+		}
+	}
+
 	if oname == "-" {
-		out = os.Stdout
-		log.Printf("Rendering [%s] to STDOUT\n", strings.Join(inames, ", "))
+		r.logf(LogInfo, "Rendering [%s%s] to STDOUT", r.preloadList, iname)
 	} else {
-		if strings.Contains(oname, "/") {
-			if err := os.MkdirAll(path.Dir(oname), 0755); err != nil {
-				return fmt.Errorf("Error creating directory for %q: %v", oname, err)
+		r.logf(LogInfo, "Rendering [%s%s] into %s", r.preloadList, iname, oname)
+	}
+	start := time.Now().Add(-p.took)
+
+	tpl, fm := p.tpl, p.fm
+	if fm != nil && oname != "-" {
+		r.addHooks(oname, fm.OnChange)
+	}
+	if err := r.checkTemplateDeprecations(tpl, inames); err != nil {
+		return err
+	}
+	if m, ok := values.(map[string]interface{}); ok && r.WarnMissing && !r.StopOnError {
+		r.warnMissingValues(tpl, inames, m)
+	}
+
+	if r.StopOnError {
+		tpl.Option("missingkey=error")
+	} else {
+		tpl.Option("missingkey=zero")
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	r.Profile.begin(iname)
+	r.rendering = oname
+	err := r.executeTemplate(tpl, fm, buf, values)
+	r.rendering = ""
+	r.Profile.end()
+	if err != nil {
+		return withSource(err, inames)
+	}
+	r.Stats.addTemplate(iname, time.Since(start))
+	mode, err := r.outputMode(iname)
+	if err != nil {
+		return err
+	}
+	content := buf.Bytes()
+	if len(r.Pipes) > 0 {
+		name := oname
+		if name == "-" {
+			name = r.outputName(filepath.Base(iname))
+		}
+		if content, err = r.pipe(name, content); err != nil {
+			return err
+		}
+	}
+	if r.OutputFormat != "" {
+		if content, err = formatEnv(r.OutputFormat, content); err != nil {
+			return fmt.Errorf("Cannot format %s as %s: %v", iname, r.OutputFormat, err)
+		}
+	}
+	if r.Merge {
+		return r.addFragment(iname, oname, content, values, mode)
+	}
+	return r.finishOutput(iname, oname, content, values, mode)
+}
+
+// finishOutput adds the header to the rendered content of oname, normalizes
+// it, and writes it.
+func (r *Renderer) finishOutput(iname, oname string, content []byte, values interface{}, mode os.FileMode) error {
+	if r.Header != "" && !r.written[oname] {
+		hv, ok := values.(map[string]interface{})
+		if !ok {
+			hv = make(map[string]interface{})
+			r.setBuiltin(hv, metadataKey, r.renderMetadata(renderJob{input: iname, output: oname}))
+		}
+		var err error
+		if content, err = r.addHeader(iname, oname, content, hv); err != nil {
+			return err
+		}
+	}
+	content = r.normalize(content)
+	return r.writeOutput(oname, content, mode)
+}
+
+// bufferPool holds the buffers templates are executed into, which are only
+// needed until their output has been written.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// maxPooledBuffer keeps unusually large buffers from being held on to.
+const maxPooledBuffer = 1 << 20
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// warnMissingValues warns about each value referenced in tpl that is missing
+// from values, along with the location of the reference.
+func (r *Renderer) warnMissingValues(tpl *template.Template, inames []string, values map[string]interface{}) {
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		for _, ref := range valueRefs(t.Tree, t.Name() == tpl.Name()) {
+			if r.isMetadataRef(ref.Path) {
+				continue
+			}
+			if _, ok := lookupPath(values, ref.Path); !ok {
+				r.warn(fmt.Sprintf("%s: value .%s is missing; rendering its zero value", nodeLocation(t.Tree, ref.Node, inames), strings.Join(ref.Path, ".")))
 			}
 		}
+	}
+}
 
-		out, err = os.OpenFile(oname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+// warn logs msg as a warning, once per run.
+func (r *Renderer) warn(msg string) {
+	if r.warned[msg] {
+		return
+	}
+	r.warned[msg] = true
+	r.logf(LogWarn, "%s", msg)
+}
+
+// outputMode returns the permissions of an output rendered from iname.
+func (r *Renderer) outputMode(iname string) (os.FileMode, error) {
+	if r.PreserveMode && iname != "" {
+		fi, err := os.Stat(iname)
 		if err != nil {
-			return fmt.Errorf("Cannot open output file %q: %v", oname, err)
+			return 0, err
+		}
+		return fi.Mode().Perm(), nil
+	}
+	if r.FileMode != 0 {
+		return r.FileMode, nil
+	}
+	return 0644, nil
+}
+
+func (r *Renderer) dirMode() os.FileMode {
+	if r.DirMode != 0 {
+		return r.DirMode
+	}
+	return 0755
+}
+
+// writeOutput validates and writes content to oname. The first write to an
+// output in a run replaces the file; later writes to the same output append
+// to it. Files are replaced atomically, so a failed validation leaves the
+// previous contents untouched.
+func (r *Renderer) writeOutput(oname string, content []byte, mode os.FileMode) error {
+	if oname != "-" && r.written[oname] {
+		existing, err := r.sink.ReadFile(oname)
+		if err != nil {
+			return err
+		}
+		content = append(existing, content...)
+	}
+
+	if r.StopOnError && !r.AllowNoValue {
+		if err := checkNoValue(content); err != nil {
+			return fmt.Errorf("Validation of %s failed: %v", oname, err)
+		}
+	}
+	for _, v := range r.Validators {
+		if err := v(oname, content); err != nil {
+			return fmt.Errorf("Validation of %s failed: %v", oname, err)
+		}
+	}
+	if err := r.scan(oname, content, mode); err != nil {
+		return err
+	}
+
+	if oname == "-" {
+		if r.EmitPatch {
+			return errors.New("Cannot emit a patch of STDOUT; give an output file or directory")
+		}
+		if r.DryRun {
+			r.logf(LogInfo, "Would write STDOUT (%d bytes)", len(content))
+			return nil
 		}
+		_, err := os.Stdout.Write(content)
+		return err
+	}
 
-		log.Printf("Rendering [%s] into %s\n", strings.Join(inames, ", "), oname)
-		defer func() { out.Sync(); out.Close() }()
+	r.trackChange(oname, content)
+	if err := r.sink.WriteFile(oname, content, mode); err != nil {
+		return err
 	}
+	r.recordOutput(oname, content)
+	r.indexOutput(oname, content)
+	r.written[oname] = true
+	r.Stats.addOutput(oname, len(content))
+	return nil
+}
 
-	tpl := template.New(filepath.Base(inames[len(inames)-1]))
+// parse parses inames into one template set, named after the last file. Like
+// template.ParseFiles, each file defines a template named after its base
+// name. It also returns the front matter of the last file, if any.
+func (r *Renderer) parse(inames []string) (*template.Template, *FrontMatter, error) {
+	tpl := template.New(filepath.Base(inames[len(inames)-1])).Delims(r.LeftDelim, r.RightDelim)
 	if r.FuncMap != nil {
-		tpl.Funcs(r.FuncMap)
+		tpl.Funcs(r.templateFuncs())
 	}
 
-	_, err = tpl.ParseFiles(inames...)
-	if err != nil {
-		return fmt.Errorf("Cannot parse templates [%s]: %v", strings.Join(inames, ", "), err)
+	var fm *FrontMatter
+	for _, iname := range inames {
+		data, err := ioutil.ReadFile(iname)
+		if err != nil {
+			return nil, nil, &parseError{file: iname, inames: inames, err: err}
+		}
+		_, data = splitWhen(data, r.LeftDelim, r.RightDelim)
+		var body []byte
+		fm, body = splitFrontMatter(data)
+		if fm != nil && len(fm.OnChange) > 0 && r.Sandbox {
+			return nil, nil, &parseError{file: iname, inames: inames, err: errors.New("hooks in front matter are not allowed in sandbox mode")}
+		}
+
+		t := tpl
+		if name := filepath.Base(iname); name != tpl.Name() {
+			t = tpl.New(name)
+		}
+		if _, err := t.Parse(string(body)); err != nil {
+			return nil, nil, &parseError{file: iname, inames: inames, err: withSource(err, inames)}
+		}
+	}
+	bound := r.bindSetFuncs(tpl)
+	for name, fn := range r.bindSideFileFuncs(tpl) {
+		bound[name] = fn
+	}
+	if guard := r.guardFuncs(tpl, fm, bound); guard != nil {
+		if r.guards == nil {
+			r.guards = make(map[*template.Template]*stopGuard)
+		}
+		r.guards[tpl] = guard
 	}
+	r.Profile.instrument(tpl)
+	return tpl, fm, nil
+}
 
-	if r.StopOnError {
-		tpl.Option("missingkey=error")
-	} else {
-		tpl.Option("missingkey=zero")
+// templateFuncs returns the functions templates may call, once the policy,
+// and sandbox mode, removed those they may not.
+func (r *Renderer) templateFuncs() template.FuncMap {
+	if r.funcs == nil && r.FuncMap != nil {
+		fm := r.Policy.FilterFuncs(r.FuncMap)
+		if r.Sandbox {
+			fm = sandboxFuncs(fm)
+		}
+		r.funcs = r.Stats.countFuncs(fm)
 	}
+	return r.funcs
+}
+
+// parsedTemplate is the template set of a job, parsed ahead of rendering.
+type parsedTemplate struct {
+	tpl  *template.Template
+	fm   *FrontMatter
+	page *contentPage
+	took time.Duration
+}
+
+// parseError is the failure to read or parse file, one of the files of a
+// template set.
+type parseError struct {
+	file   string
+	inames []string
+	err    error
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("Cannot parse templates [%s]: %v", strings.Join(e.inames, ", "), e.err)
+}
 
-	return tpl.Execute(out, values)
+// parseErrors combines the parse errors of jobs into one error, listing each
+// broken file once, even if it is a preload shared by every job.
+func parseErrors(jobs []renderJob, failed map[int]error) error {
+	if len(failed) == 1 {
+		for _, err := range failed {
+			return err
+		}
+	}
+	seen := make(map[string]bool)
+	msgs := []string{}
+	for i := range jobs {
+		err, ok := failed[i]
+		if !ok {
+			continue
+		}
+		msg := err.Error()
+		if pe, ok := err.(*parseError); ok {
+			msg = fmt.Sprintf("%s: %v", pe.file, pe.err)
+			if _, ok := pe.err.(*sourceError); ok {
+				msg = pe.err.Error()
+			}
+		}
+		if !seen[msg] {
+			seen[msg] = true
+			msgs = append(msgs, "  "+strings.Replace(msg, "\n", "\n  ", -1))
+		}
+	}
+	return fmt.Errorf("Cannot parse %d template(s):\n%s", len(failed), strings.Join(msgs, "\n"))
 }
@@ -4,8 +4,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/blang/vfs"
 	tpl "github.com/ripta/tpl"
@@ -24,9 +26,28 @@ type fileSpec struct {
 type fileTest struct {
 	name      string
 	ins       []fileSpec
+	root      string
+	outIsDir  bool
+	data      interface{}
+	exts      []string
+	extMap    map[string]string
+	eol       string
+	trim      bool
 	render    renderSpec
 	renderErr string
 	outs      []fileSpec
+
+	dirDefaults      bool
+	copyNonTemplates bool
+}
+
+type structData struct {
+	Name string
+	Tags []string
+}
+
+func (d structData) Joined() string {
+	return strings.Join(d.Tags, ",")
 }
 
 var fileTests = []fileTest{
@@ -44,6 +65,58 @@ var fileTests = []fileTest{
 			{"out.txt", "bar-baz"},
 		},
 	},
+	// Render with custom template extensions and extension rewriting
+	{
+		name: "extensions",
+		ins: []fileSpec{
+			{"in/a.txt.gotmpl", "{{.foo}}"},
+			{"in/b.yaml.gotmpl", "b: {{.foo}}"},
+			{"in/c.txt.tpl", "{{.foo}}"},
+		},
+		exts:             []string{".gotmpl"},
+		extMap:           map[string]string{".yaml.gotmpl": ".yml"},
+		copyNonTemplates: true,
+		render: renderSpec{
+			[]string{"in"},
+			"out/",
+		},
+		outs: []fileSpec{
+			{"out/in/a.txt", "bar"},
+			{"out/in/b.yml", "b: bar"},
+			{"out/in/c.txt.tpl", "{{.foo}}"},
+		},
+	},
+	// Render with normalized line endings and whitespace
+	{
+		name: "normalize",
+		ins: []fileSpec{
+			{"in/test.ini.tpl", "[{{.foo}}]  \nkey = 1\t\r\n\n\n"},
+		},
+		eol:  "crlf",
+		trim: true,
+		render: renderSpec{
+			[]string{"in/test.ini.tpl"},
+			"out.ini",
+		},
+		outs: []fileSpec{
+			{"out.ini", "[bar]\r\nkey = 1\r\n"},
+		},
+	},
+	// Render typed data, calling its methods
+	{
+		name: "struct-data",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "{{ .Name }} has {{ len .Tags }} tags: {{ .Joined }}"},
+		},
+		data: structData{Name: "app", Tags: []string{"a", "b"}},
+		render: renderSpec{
+			[]string{"in/test.txt.tpl"},
+			"out.txt",
+		},
+		outs: []fileSpec{
+			{"out.txt", "app has 2 tags: a,b"},
+		},
+	},
 	// Fails to render, because key is missing
 	{
 		name: "fail-missing-key",
@@ -56,6 +129,30 @@ var fileTests = []fileTest{
 		},
 		renderErr: `map has no entry for key "hello"`,
 	},
+	// Fails to render, showing where in the template
+	{
+		name: "fail-source-context",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "one\ntwo {{.foo}}\n\tthree {{ .hello }}\nfour\n"},
+		},
+		render: renderSpec{
+			[]string{"in/test.txt.tpl"},
+			"out.txt",
+		},
+		renderErr: "in/test.txt.tpl:3:10: executing \"test.txt.tpl\" at <.hello>: map has no entry for key \"hello\"\n  1 | one\n  2 | two {{.foo}}\n  3 | \tthree {{ .hello }}\n    | \t         ^\n  4 | four",
+	},
+	// Fails to render, because a nil value renders as "<no value>"
+	{
+		name: "fail-no-value",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "{{.foo}}\n{{.empty}}"},
+		},
+		render: renderSpec{
+			[]string{"in/test.txt.tpl"},
+			"out.txt",
+		},
+		renderErr: `output contains "<no value>" on line 2`,
+	},
 	// Render an explicit list of input files to an output directory
 	// (a trailing slash in `out/`)
 	{
@@ -138,9 +235,144 @@ var fileTests = []fileTest{
 			{"out/in/rather/deep/nested/dirs/test3.txt", "#3-2.34"},
 		},
 	},
+	// Directory defaults are the lowest-precedence layer, and are inherited
+	// by nested directories
+	{
+		name: "dir-defaults",
+		ins: []fileSpec{
+			{"in/defaults.yaml", "foo: default\ncolor: red\nsize: small"},
+			{"in/test1.txt.tpl", "#1-{{.foo}}-{{.color}}-{{.size}}"},
+			{"in/nested/values.yaml", "size: large"},
+			{"in/nested/test2.txt.tpl", "#2-{{.foo}}-{{.color}}-{{.size}}"},
+		},
+		dirDefaults: true,
+		render: renderSpec{
+			[]string{"in"},
+			"out/",
+		},
+		outs: []fileSpec{
+			{"out/in/test1.txt", "#1-bar-red-small"},
+			{"out/in/nested/test2.txt", "#2-bar-red-large"},
+		},
+	},
+	// Files without a template extension in directories are copied verbatim
+	{
+		name: "copy-non-templates",
+		ins: []fileSpec{
+			{"in/test1.txt.tpl", "#1-{{.foo}}"},
+			{"in/raw.pem", "{{ not a template"},
+		},
+		copyNonTemplates: true,
+		render: renderSpec{
+			[]string{"in"},
+			"out/",
+		},
+		outs: []fileSpec{
+			{"out/in/test1.txt", "#1-bar"},
+			{"out/in/raw.pem", "{{ not a template"},
+		},
+	},
+	// Render metadata is available under .Tpl
+	{
+		name: "metadata",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "{{.Tpl.Template}} into {{.Tpl.OutputPath}}"},
+		},
+		render: renderSpec{
+			[]string{"in/test.txt.tpl"},
+			"out.txt",
+		},
+		outs: []fileSpec{
+			{"out.txt", "test.txt.tpl into out.txt"},
+		},
+	},
+	// Front matter is not part of the output
+	{
+		name: "front-matter",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "---\nonchange: \"true\"\n---\n{{.foo}}"},
+		},
+		render: renderSpec{
+			[]string{"in/test.txt.tpl"},
+			"out.txt",
+		},
+		outs: []fileSpec{
+			{"out.txt", "bar"},
+		},
+	},
+	// Render into a directory that does not exist yet
+	{
+		name: "out-is-dir",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "{{.foo}}"},
+		},
+		outIsDir: true,
+		render: renderSpec{
+			[]string{"in/test.txt.tpl"},
+			"out",
+		},
+		outs: []fileSpec{
+			{"out/test.txt", "bar"},
+		},
+	},
+	// Copy binary files in directories verbatim, even with a template extension
+	{
+		name: "copy-binary",
+		ins: []fileSpec{
+			{"in/blob.bin.tpl", "\x00{{ not a template"},
+		},
+		render: renderSpec{
+			[]string{"in"},
+			"out/",
+		},
+		outs: []fileSpec{
+			{"out/in/blob.bin", "\x00{{ not a template"},
+		},
+	},
+	// Fails before rendering, because two templates share an output
+	{
+		name: "fail-conflict",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "{{.foo}}"},
+			{"in/test.txt.tmpl", "{{.foo}}"},
+		},
+		render: renderSpec{
+			[]string{"in"},
+			"out/",
+		},
+		renderErr: `would be written to out/in/test.txt`,
+	},
+	// Fails before rendering, reporting every template that cannot be parsed
+	{
+		name: "fail-parse-all",
+		ins: []fileSpec{
+			{"in/a.txt.tpl", "{{ .foo }"},
+			{"in/b.txt.tpl", "{{.foo}}"},
+			{"in/c.txt.tpl", "{{ end }}"},
+		},
+		render: renderSpec{
+			[]string{"in"},
+			"out/",
+		},
+		renderErr: "Cannot parse 2 template(s):\n  in/a.txt.tpl:1: unexpected \"}\" in operand\n    1 | {{ .foo }\n  in/c.txt.tpl:1: unexpected {{end}}\n    1 | {{ end }}",
+	},
+	// Fails to write outside of the root directory
+	{
+		name: "root-escape",
+		ins: []fileSpec{
+			{"in/test.txt.tpl", "{{.foo}}"},
+		},
+		root: "in",
+		render: renderSpec{
+			[]string{"in/test.txt.tpl"},
+			"out.txt",
+		},
+		renderErr: `escapes root`,
+	},
 }
 
 var staticValues = map[string]interface{}{
+	"empty": nil,
 	"foo":   "bar",
 	"price": 2.34,
 	"user": map[string]string{
@@ -171,10 +403,24 @@ func TestRendering(t *testing.T) {
 			}
 
 			r := &tpl.Renderer{
-				Inputs:      test.render.ins,
-				StopOnError: true,
+				Inputs:       test.render.ins,
+				Root:         test.root,
+				OutIsDir:     test.outIsDir,
+				Extensions:   test.exts,
+				ExtensionMap: test.extMap,
+				LineEndings:  test.eol,
+				FinalNewline: test.trim,
+
+				TrimTrailingSpace: test.trim,
+				DirDefaults:       test.dirDefaults,
+				CopyNonTemplates:  test.copyNonTemplates,
+				StopOnError:       true,
+			}
+			var data interface{} = staticValues
+			if test.data != nil {
+				data = test.data
 			}
-			err = r.Execute(test.render.out, staticValues)
+			err = r.Execute(test.render.out, data)
 			if err != nil {
 				if test.renderErr == "" {
 					t.Errorf("Unexpected error during execution: %v", err)
@@ -256,3 +502,235 @@ func writeFile(t *testing.T, fp, content string) {
 		t.Error(err)
 	}
 }
+
+func BenchmarkRenderDirectory(b *testing.B) {
+	tmpdir, err := ioutil.TempDir("", "tpl-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Chdir(tmpdir); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		fp := filepath.Join("in", string(rune('a'+i%26)), strconv.Itoa(i)+".txt.tpl")
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fp, []byte("{{.foo}} {{.user.name}}\n"), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := &tpl.Renderer{Inputs: []string{"in"}, StopOnError: true}
+		if err := r.Execute("out/", staticValues); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRenderFS(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tpl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Chdir(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, "in/test.txt.tpl", "{{.foo}}-baz")
+	writeFile(t, "in/deep/test.yaml.tpl", "name: {{.user.name}}")
+
+	r := &tpl.Renderer{Inputs: []string{"in"}, StopOnError: true}
+	fsys, err := r.RenderFS(staticValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "in/test.txt", "in/deep/test.yaml"); err != nil {
+		t.Error(err)
+	}
+	if got := string(fsys["in/deep/test.yaml"].Data); got != "name: ripta" {
+		t.Errorf("Rendered in/deep/test.yaml as %q", got)
+	}
+	if _, err := os.Stat("in/test.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written to disk, got %v", err)
+	}
+}
+
+func TestReplacedOutputKeepsMode(t *testing.T) {
+	tests := []struct {
+		name          string
+		transactional bool
+	}{
+		{"direct", false},
+		{"transactional", true},
+	}
+	for _, test := range tests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, "in/secret.txt.tpl", "{{.foo}}")
+			writeFile(t, "out/in/secret.txt", "old")
+			if err := os.Chmod("out/in/secret.txt", 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			r := &tpl.Renderer{Inputs: []string{"in"}, StopOnError: true, Transactional: test.transactional}
+			if err := r.Execute("out/", staticValues); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat("out/in/secret.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := fi.Mode().Perm(); mode != 0600 {
+				t.Errorf("Replaced output has mode %o, expected 600", mode)
+			}
+		})
+	}
+}
+
+func TestTransactionalFailureLeavesOutputs(t *testing.T) {
+	tests := []struct {
+		name          string
+		transactional bool
+		expected      map[string]string
+	}{
+		// Outputs before the failing template are written, and those after
+		// it are not
+		{"direct", false, map[string]string{"a.txt": "bar", "b.txt": "new", "d.txt": "old"}},
+		{"transactional", true, map[string]string{"b.txt": "old", "d.txt": "old"}},
+	}
+	for _, test := range tests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, "in/a.txt.tpl", "{{.foo}}")
+			writeFile(t, "in/b.txt.tpl", "new")
+			writeFile(t, "in/c.txt.tpl", "{{.foo.bar}}")
+			writeFile(t, "in/d.txt.tpl", "new")
+			writeFile(t, "out/in/b.txt", "old")
+			writeFile(t, "out/in/d.txt", "old")
+
+			r := &tpl.Renderer{Inputs: []string{"in"}, StopOnError: true, Transactional: test.transactional}
+			if err := r.Execute("out/", staticValues); err == nil {
+				t.Fatal("Expected the run to fail on in/c.txt.tpl, but it succeeded")
+			}
+			entries, err := ioutil.ReadDir("out/in")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(test.expected) {
+				t.Errorf("Left %d files in out/in, expected %d", len(entries), len(test.expected))
+			}
+			for _, fi := range entries {
+				content, err := ioutil.ReadFile(filepath.Join("out/in", fi.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if expected, ok := test.expected[fi.Name()]; !ok {
+					t.Errorf("Unexpected file %s", fi.Name())
+				} else if string(content) != expected {
+					t.Errorf("Left %s with %q, expected %q", fi.Name(), content, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestRendersAgainOnChangedSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(r *tpl.Renderer)
+		expected string
+	}{
+		{"unchanged", func(r *tpl.Renderer) {}, "bar <<.foo>>"},
+		{"delims", func(r *tpl.Renderer) { r.LeftDelim, r.RightDelim = "<<", ">>" }, "{{.foo}} bar"},
+		{"final-newline", func(r *tpl.Renderer) { r.FinalNewline = true }, "bar <<.foo>>\n"},
+	}
+	for _, test := range tests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, "in/test.txt.tpl", "{{.foo}} <<.foo>>")
+
+			r := &tpl.Renderer{Inputs: []string{"in"}, StopOnError: true, Manifest: "manifest.json"}
+			if err := r.Execute("out/", staticValues); err != nil {
+				t.Fatal(err)
+			}
+			test.change(r)
+			if err := r.Execute("out/", staticValues); err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadFile("out/in/test.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("Rendered %q, expected %q", content, test.expected)
+			}
+		})
+	}
+}
+
+func TestIndexOutputsAreBuiltin(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		index    string
+		expected string
+	}{
+		{"builtins-key", "T", "{{ range .T.Outputs }}{{ .Path }} {{ end }}{{ .Outputs }}", "in/test.txt user"},
+		{"legacy", "", "{{ range .Outputs }}{{ .Path }} {{ end }}", "in/test.txt "},
+	}
+	for _, test := range tests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, "in/test.txt.tpl", "{{.foo}}")
+			writeFile(t, "index.txt.tpl", test.index)
+
+			r := &tpl.Renderer{Inputs: []string{"in"}, StopOnError: true, Index: "index.txt.tpl", BuiltinsKey: test.key}
+			if err := r.Execute("out/", map[string]interface{}{"foo": "bar", "Outputs": "user"}); err != nil {
+				t.Fatal(err)
+			}
+			content, err := ioutil.ReadFile("out/index.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("Rendered %q, expected %q", content, test.expected)
+			}
+		})
+	}
+}
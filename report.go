@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// RunReport is a machine-readable account of a run, listing every input in
+// the order it was rendered.
+type RunReport struct {
+	Outputs []ReportEntry `json:"outputs"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// ReportEntry describes the render of one input. Status is one of:
+//
+//	created      the output did not exist before
+//	updated      the output existed with other contents
+//	unchanged    the output existed with the same contents
+//	written      the output went to STDOUT, an archive, or a manifest
+//	failed       rendering or writing the output failed
+//	skipped      the run failed before the input was rendered
+//	cached       the output was up to date according to the manifest
+//	unavailable  the template uses values that are missing, and its output
+//	             was left as it was
+//	tripped      the template failed too many runs in a row to be rendered,
+//	             and its output was left as it was
+//
+// Bytes and SHA256 describe the complete output, which may include the
+// renders of other inputs written to the same output. Retries counts the
+// failed attempts at writing the output that were retried.
+type ReportEntry struct {
+	Input      string  `json:"input"`
+	Output     string  `json:"output"`
+	Status     string  `json:"status"`
+	Bytes      int     `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	SHA256     string  `json:"sha256,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Retries    int     `json:"retries,omitempty"`
+}
+
+func (rep *RunReport) add(job renderJob, d time.Duration, err error) {
+	if rep == nil {
+		return
+	}
+	e := ReportEntry{
+		Input:      job.input,
+		Output:     job.output,
+		DurationMS: float64(d) / float64(time.Millisecond),
+	}
+	if err != nil {
+		e.Status = "failed"
+		e.Error = err.Error()
+	}
+	rep.Outputs = append(rep.Outputs, e)
+}
+
+func (rep *RunReport) skip(jobs []renderJob) {
+	if rep == nil {
+		return
+	}
+	for _, job := range jobs {
+		rep.Outputs = append(rep.Outputs, ReportEntry{Input: job.input, Output: job.output, Status: "skipped"})
+	}
+}
+
+func (rep *RunReport) cached(job renderJob) {
+	if rep == nil {
+		return
+	}
+	rep.Outputs = append(rep.Outputs, ReportEntry{Input: job.input, Output: job.output, Status: "cached"})
+}
+
+func (rep *RunReport) tripped(job renderJob) {
+	if rep == nil {
+		return
+	}
+	rep.Outputs = append(rep.Outputs, ReportEntry{Input: job.input, Output: job.output, Status: "tripped"})
+}
+
+func (rep *RunReport) unavailable(job renderJob) {
+	if rep == nil {
+		return
+	}
+	rep.Outputs = append(rep.Outputs, ReportEntry{Input: job.input, Output: job.output, Status: "unavailable"})
+}
+
+// incomplete lists the outputs that the run did not render, nor validate, and
+// which are therefore stale or missing: those that failed, were skipped, or
+// were left as they were.
+func (rep *RunReport) incomplete() []ReportEntry {
+	if rep == nil {
+		return nil
+	}
+	var entries []ReportEntry
+	for _, e := range rep.Outputs {
+		switch e.Status {
+		case "failed", "skipped", "unavailable", "tripped":
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// finishReport fills in the status, size, and checksum of every output once
+// the run is over. When a transactional run failed, no output was written.
+func (r *Renderer) finishReport(runErr error) {
+	rep := r.Report
+	if rep == nil {
+		return
+	}
+	if runErr != nil {
+		rep.Error = runErr.Error()
+	}
+	c := r.changes
+	for i := range rep.Outputs {
+		e := &rep.Outputs[i]
+		if r.retries != nil {
+			e.Retries = r.retries.retried[e.Output]
+		}
+		if e.Status != "" {
+			continue
+		}
+		if runErr != nil && r.Transactional {
+			e.Status = "skipped"
+			continue
+		}
+		sum, tracked := c.sum(e.Output)
+		if !tracked {
+			e.Status = "written"
+			continue
+		}
+		e.SHA256 = hex.EncodeToString(sum[:])
+		e.Bytes = c.size[e.Output]
+		switch prev := c.before[e.Output]; {
+		case prev == nil:
+			e.Status = "created"
+		case *prev != sum:
+			e.Status = "updated"
+		default:
+			e.Status = "unchanged"
+		}
+	}
+}
+
+// writeReport writes rep as indented JSON to fname, if policy allows it, or
+// to STDERR for "".
+func writeReport(rep *RunReport, fname string, policy *Policy) error {
+	if fname != "" {
+		if err := policy.CheckOutput(fname); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	var w io.Writer = os.Stderr
+	if fname == "-" {
+		w = os.Stdout
+	} else if fname != "" {
+		if err := writeFileAtomic(fname, data, 0644); err != nil {
+			return fmt.Errorf("Cannot write report %q: %v", fname, err)
+		}
+		return nil
+	}
+	_, err = w.Write(data)
+	return err
+}
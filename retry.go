@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultRetryBackoff is how long the first retry of a failed write waits,
+// doubling with every attempt after it.
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// maxRetryBackoff caps the wait between two attempts at a write.
+const maxRetryBackoff = 30 * time.Second
+
+// retrySink retries the writes of another sink that fail, such as those of
+// a flaky network filesystem, waiting longer after every attempt.
+type retrySink struct {
+	sink    outputSink
+	retries int
+	backoff time.Duration
+	logger  Logger
+
+	// retried counts the failed attempts at every output that was written
+	// in the end, or not.
+	retried map[string]int
+}
+
+func newRetrySink(sink outputSink, retries int, backoff time.Duration, logger Logger) *retrySink {
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	return &retrySink{sink: sink, retries: retries, backoff: backoff, logger: logger, retried: make(map[string]int)}
+}
+
+// retry calls write until it succeeds, or has failed once more than the
+// number of retries.
+func (s *retrySink) retry(name string, write func() error) error {
+	wait := s.backoff
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || attempt == s.retries {
+			if err != nil && attempt > 0 {
+				return fmt.Errorf("%v (after %d attempts)", err, attempt+1)
+			}
+			return err
+		}
+		s.retried[name]++
+		logf(s.logger, LogWarn, "Retrying %s in %s: %v", name, wait, err)
+		time.Sleep(wait)
+		if wait *= 2; wait > maxRetryBackoff {
+			wait = maxRetryBackoff
+		}
+	}
+}
+
+func (s *retrySink) Check(name string) error {
+	return s.sink.Check(name)
+}
+
+func (s *retrySink) WriteFile(name string, content []byte, mode os.FileMode) error {
+	return s.retry(name, func() error {
+		return s.sink.WriteFile(name, content, mode)
+	})
+}
+
+func (s *retrySink) ReadFile(name string) ([]byte, error) {
+	return s.sink.ReadFile(name)
+}
+
+func (s *retrySink) Symlink(target, name string) error {
+	links, ok := s.sink.(symlinkSink)
+	if !ok {
+		return errors.New("Cannot write symlinks here")
+	}
+	return s.retry(name, func() error {
+		return links.Symlink(target, name)
+	})
+}
+
+// Close retries finishing the run, which is when transactional runs and
+// archives write their outputs.
+func (s *retrySink) Close() error {
+	return s.retry("the outputs", s.sink.Close)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// runRollback undoes the last run recorded in the manifest in fname: output
+// files it created are removed, and those it changed are restored from their
+// backups. Nothing is touched unless every change can be undone, and outputs
+// modified since the run are left alone unless force is set. It returns the
+// process exit code.
+func runRollback(fname string, force bool) int {
+	if fname == "" {
+		logf(nil, LogError, "The rollback command requires -manifest=FILE")
+		return 1
+	}
+	if err := checkPolicyOutput(fname); err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	m, err := readManifest(fname)
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	if m.Run == nil || len(m.Run.Changes) == 0 {
+		logf(nil, LogInfo, "%s records no changed outputs to roll back", fname)
+		return 0
+	}
+
+	failed := false
+	for _, c := range m.Run.Changes {
+		if e, ok := m.Outputs[c.Path]; ok && !force {
+			status, err := verifyOutput(c.Path, e)
+			if err != nil {
+				logf(nil, LogError, "%v", err)
+				failed = true
+				continue
+			}
+			if status == "modified" {
+				logf(nil, LogError, "%s was modified since it was rendered; roll back with -force to undo that too", c.Path)
+				failed = true
+				continue
+			}
+		}
+		if c.Created {
+			continue
+		}
+		if c.Backup == "" {
+			logf(nil, LogError, "%s was not backed up; render with -backup or -backup-dir to be able to roll back", c.Path)
+			failed = true
+		} else if _, err := os.Stat(c.Backup); err != nil {
+			logf(nil, LogError, "Cannot restore %s: %v", c.Path, err)
+			failed = true
+		}
+	}
+	if failed {
+		logf(nil, LogError, "Not rolling back the run of %s", m.Run.Time.Format("2006-01-02 15:04:05"))
+		return 1
+	}
+
+	for _, c := range m.Run.Changes {
+		if c.Created {
+			if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+				logf(nil, LogError, "Cannot remove %s: %v", c.Path, err)
+				return 1
+			}
+			fmt.Printf("removed\t%s\n", c.Path)
+		} else {
+			fi, err := os.Stat(c.Backup)
+			if err != nil {
+				logf(nil, LogError, "Cannot restore %s: %v", c.Path, err)
+				return 1
+			}
+			content, err := ioutil.ReadFile(c.Backup)
+			if err == nil {
+				err = writeFileAtomic(c.Path, content, fi.Mode().Perm())
+			}
+			if err != nil {
+				logf(nil, LogError, "Cannot restore %s: %v", c.Path, err)
+				return 1
+			}
+			fmt.Printf("restored\t%s\n", c.Path)
+		}
+		// Outputs are no longer what the manifest says they were rendered
+		// from, and must be rendered again
+		delete(m.Outputs, c.Path)
+	}
+
+	logf(nil, LogInfo, "Rolled back %d output(s) to before the run of %s", len(m.Run.Changes), m.Run.Time.Format("2006-01-02 15:04:05"))
+	m.Run = nil
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(fname, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		logf(nil, LogError, "Cannot write manifest %q: %v", fname, err)
+		return 1
+	}
+	return 0
+}
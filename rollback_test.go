@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var rollbackTests = []struct {
+	name     string
+	render   []string
+	modify   bool
+	force    bool
+	expected map[string]string
+	err      string
+}{
+	{
+		name:     "restores",
+		render:   []string{"-backup"},
+		expected: map[string]string{"out/a.txt": "old"},
+	},
+	{
+		name:     "backup-dir",
+		render:   []string{"-backup-dir=backups"},
+		expected: map[string]string{"out/a.txt": "old"},
+	},
+	{
+		name:     "modified",
+		render:   []string{"-backup"},
+		modify:   true,
+		expected: map[string]string{"out/a.txt": "edited", "out/b.txt": "new"},
+		err:      "out/a.txt was modified since it was rendered",
+	},
+	{
+		name:     "forced",
+		render:   []string{"-backup"},
+		modify:   true,
+		force:    true,
+		expected: map[string]string{"out/a.txt": "old"},
+	},
+	{
+		name:     "not-backed-up",
+		expected: map[string]string{"out/a.txt": "new", "out/b.txt": "new"},
+		err:      "out/a.txt was not backed up",
+	},
+}
+
+func TestRollback(t *testing.T) {
+	for _, test := range rollbackTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{"in/a.txt.tpl": "{{ .v }}", "in/b.txt.tpl": "{{ .v }}", "out/a.txt": "old"} {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// b.txt is created by the run, and a.txt overwritten
+			args := append([]string{"-manifest=manifest.json", "-value=v=new", "-out=out/"}, test.render...)
+			tpl(t, os.Environ(), append(args, "in/a.txt.tpl", "in/b.txt.tpl")...)
+			if test.modify {
+				if err := ioutil.WriteFile("out/a.txt", []byte("edited"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			args = []string{"rollback", "-manifest=manifest.json"}
+			if test.force {
+				args = append(args, "-force")
+			}
+			err = runTpl(os.Environ(), args...)
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+			} else if test.err != "" {
+				t.Fatalf("Expected the rollback to fail with %q, but it succeeded", test.err)
+			}
+
+			// Nothing is touched when any change cannot be undone
+			for _, name := range []string{"out/a.txt", "out/b.txt"} {
+				content, err := ioutil.ReadFile(name)
+				expected, ok := test.expected[name]
+				if !ok {
+					if !os.IsNotExist(err) {
+						t.Errorf("Left %s behind: %v", name, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != expected {
+					t.Errorf("Left %s with %q, expected %q", name, content, expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// DefaultSandboxTimeout and DefaultSandboxOutputSize cap the execution of each
+// template under Sandbox, unless Timeout or MaxOutputBytes is set.
+const (
+	DefaultSandboxTimeout    = 10 * time.Second
+	DefaultSandboxOutputSize = 10 << 20
+)
+
+// sandboxDisabledFuncs reach outside of the templates and their values: they
+// read files, the environment, or secrets, resolve hosts, or run commands,
+// plugins included.
+var sandboxDisabledFuncs = []string{
+	"assetHash",
+	"assetURL",
+	"env",
+	"exec",
+	"expandenv",
+	"getHostByName",
+	"includeFile",
+	"plugin",
+	"readFile",
+	"secret",
+	"shell",
+}
+
+// sandboxFuncs returns a copy of fm in which every function disabled by the
+// sandbox fails when called.
+func sandboxFuncs(fm template.FuncMap) template.FuncMap {
+	sandboxed := make(template.FuncMap, len(fm))
+	for name, fn := range fm {
+		sandboxed[name] = fn
+	}
+	for _, name := range sandboxDisabledFuncs {
+		if _, ok := fm[name]; !ok {
+			continue
+		}
+		err := fmt.Errorf("the '%s' template function is disabled in sandbox mode", name)
+		sandboxed[name] = func(...interface{}) (string, error) { return "", err }
+	}
+	return sandboxed
+}
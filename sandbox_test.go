@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/sprig"
+)
+
+// TestSandboxDisabledFuncs renders a call of every function the sandbox
+// disables, each of which must fail with the sandbox error.
+func TestSandboxDisabledFuncs(t *testing.T) {
+	for _, name := range sandboxDisabledFuncs {
+		name := name // range capture
+		t.Run(name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile("test.txt.tpl", []byte(`{{ `+name+` "test.txt.tpl" }}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err = runTpl(os.Environ(), "-sandbox", "-out=out/", "test.txt.tpl")
+			expected := "the '" + name + "' template function is disabled in sandbox mode"
+			if _, ok := sprig.TxtFuncMap()[name]; !ok && name == "getHostByName" {
+				// Only newer versions of Sprig have it
+				expected = `function "` + name + `" not defined`
+			}
+			if err == nil {
+				t.Fatalf("Expected %s to fail with %q, but it succeeded", name, expected)
+			} else if !strings.Contains(err.Error(), expected) {
+				t.Fatalf("Different error; got %q, expected %q", err, expected)
+			}
+		})
+	}
+}
+
+var sandboxSideFileTests = []struct {
+	name     string
+	template string
+	link     bool
+	err      string
+}{
+	{name: "within", template: `{{ qrcodeFile "code.png" "hi" }}`},
+	{name: "below", template: `{{ barcodeFile "img/code.png" "hi" }}`},
+	{name: "parent", template: `{{ qrcodeFile "../code.png" "hi" }}`, err: "must be a relative path below the output directory"},
+	{name: "symlink", template: `{{ qrcodeFile "img/code.png" "hi" }}`, link: true, err: "escapes root"},
+}
+
+// TestSandboxSideFiles checks that the side files of qrcodeFile and
+// barcodeFile, which the sandbox allows, are confined to the root as outputs
+// are.
+func TestSandboxSideFiles(t *testing.T) {
+	for _, test := range sandboxSideFileTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			if test.link && runtime.GOOS == "windows" {
+				t.Skip("symlinks need privileges")
+			}
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile("test.txt.tpl", []byte(test.template), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.link {
+				outside, err := ioutil.TempDir("", "tpl-test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(outside)
+				if err := os.Mkdir("out", 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(outside, filepath.Join("out", "img")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = runTpl(os.Environ(), "-sandbox", "-allow-qrcode", "-out=out/", "test.txt.tpl")
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected the side file to fail with %q, but it succeeded", test.err)
+			}
+			out, err := ioutil.ReadFile(filepath.Join("out", "test.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join("out", string(out))); err != nil {
+				t.Errorf("Missing side file: %v", err)
+			}
+		})
+	}
+}
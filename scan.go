@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Finding is something a Scanner flagged in an output. It never holds the
+// flagged text itself, which may be a live credential.
+type Finding struct {
+	Line int
+	Rule string
+}
+
+// Scanner inspects the rendered content of an output before it is written.
+// The path is the output path, or "-" for STDOUT, and mode the permissions it
+// is about to be written with.
+type Scanner func(path string, content []byte, mode os.FileMode) []Finding
+
+// builtinScanner returns the named scanner.
+func builtinScanner(name string) (Scanner, error) {
+	switch name {
+	case "secrets":
+		return scanSecrets, nil
+	}
+	return nil, fmt.Errorf("unknown scanner %q; must be one of: secrets", name)
+}
+
+// secretRule is a pattern that credentials of some kind match.
+type secretRule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{"AWS access key ID", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z]+ )?PRIVATE KEY-----`)},
+	{"GitHub token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Stripe live key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+}
+
+// scanSecrets is the `secrets` scanner, which flags well-known kinds of
+// credentials in outputs that anyone could read. Outputs written without
+// world read permission, e.g. with -mode=0600, are assumed to be meant to
+// hold secrets.
+func scanSecrets(path string, content []byte, mode os.FileMode) []Finding {
+	if path != "-" && mode&0004 == 0 {
+		return nil
+	}
+	var findings []Finding
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		for _, rule := range secretRules {
+			if rule.pattern.Match(line) {
+				findings = append(findings, Finding{Line: i + 1, Rule: rule.name})
+			}
+		}
+	}
+	return findings
+}
+
+// scan runs the Scanners against an output, failing or warning about what
+// they find according to ScanAction.
+func (r *Renderer) scan(oname string, content []byte, mode os.FileMode) error {
+	var msgs []string
+	for _, s := range r.Scanners {
+		for _, f := range s(oname, content, mode) {
+			msgs = append(msgs, fmt.Sprintf("line %d: possible %s", f.Line, f.Rule))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	name := oname
+	if name == "-" {
+		name = "STDOUT"
+	}
+	if r.ScanAction == "warn" {
+		for _, msg := range msgs {
+			r.warn(fmt.Sprintf("%s, %s", name, msg))
+		}
+		return nil
+	}
+	return fmt.Errorf("Scan of %s failed:\n  %s", name, strings.Join(msgs, "\n  "))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is the subset of JSON Schema used to validate values before any
+// template executes.
+type Schema struct {
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Default     interface{}        `json:"default,omitempty"`
+	Ref         string             `json:"$ref,omitempty"`
+	Type        schemaTypes        `json:"type,omitempty"`
+	Enum        []interface{}      `json:"enum,omitempty"`
+	Const       interface{}        `json:"const,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Definitions map[string]*Schema `json:"definitions,omitempty"`
+	Defs        map[string]*Schema `json:"$defs,omitempty"`
+
+	AdditionalProperties *schemaOrBool `json:"additionalProperties,omitempty"`
+
+	Minimum          *float64 `json:"minimum,omitempty"`
+	Maximum          *float64 `json:"maximum,omitempty"`
+	ExclusiveMinimum *float64 `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum *float64 `json:"exclusiveMaximum,omitempty"`
+	MinLength        *int     `json:"minLength,omitempty"`
+	MaxLength        *int     `json:"maxLength,omitempty"`
+	Pattern          string   `json:"pattern,omitempty"`
+	MinItems         *int     `json:"minItems,omitempty"`
+	MaxItems         *int     `json:"maxItems,omitempty"`
+
+	Deprecated  bool   `json:"deprecated,omitempty"`
+	Replacement string `json:"x-replacement,omitempty"`
+
+	pattern *regexp.Regexp
+	root    *Schema
+}
+
+// schemaTypes accepts both `"type": "string"` and `"type": ["string", "null"]`.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("Schema type must be a string or list of strings")
+	}
+	*t = schemaTypes(many)
+	return nil
+}
+
+// schemaOrBool accepts either a boolean or a nested schema.
+type schemaOrBool struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (s *schemaOrBool) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Allowed); err == nil {
+		return nil
+	}
+	s.Allowed = true
+	return json.Unmarshal(data, &s.Schema)
+}
+
+func loadSchema(filename string) (*Schema, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read schema %s: %v", filename, err)
+	}
+	s, err := parseSchema(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse schema %s: %v", filename, err)
+	}
+	return s, nil
+}
+
+func parseSchema(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if err := s.compile(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) compile(root *Schema) error {
+	if s == nil {
+		return nil
+	}
+	s.root = root
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	children := []*Schema{s.Items}
+	for _, m := range []map[string]*Schema{s.Properties, s.Definitions, s.Defs} {
+		for _, c := range m {
+			children = append(children, c)
+		}
+	}
+	if s.AdditionalProperties != nil {
+		children = append(children, s.AdditionalProperties.Schema)
+	}
+	for _, c := range children {
+		if err := c.compile(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve follows a local `$ref`, e.g. "#/definitions/port".
+func (s *Schema) resolve() (*Schema, error) {
+	seen := 0
+	for s.Ref != "" {
+		if seen++; seen > 32 {
+			return nil, fmt.Errorf("$ref %q is too deeply nested", s.Ref)
+		}
+		var defs map[string]*Schema
+		var name string
+		switch {
+		case strings.HasPrefix(s.Ref, "#/definitions/"):
+			defs, name = s.root.Definitions, strings.TrimPrefix(s.Ref, "#/definitions/")
+		case strings.HasPrefix(s.Ref, "#/$defs/"):
+			defs, name = s.root.Defs, strings.TrimPrefix(s.Ref, "#/$defs/")
+		default:
+			return nil, fmt.Errorf("Unsupported $ref %q", s.Ref)
+		}
+		next, ok := defs[name]
+		if !ok {
+			return nil, fmt.Errorf("$ref %q not found", s.Ref)
+		}
+		s = next
+	}
+	return s, nil
+}
+
+// Validate checks v against the schema, returning one error per violation.
+// Each error is prefixed with the path of the offending value.
+func (s *Schema) Validate(v interface{}) []error {
+	var errs []error
+	s.validate(".", v, &errs)
+	return errs
+}
+
+func (s *Schema) validate(path string, v interface{}, errs *[]error) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	s, err := s.resolve()
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+
+	v = normalizeValue(v)
+	kind := schemaTypeOf(v)
+	if len(s.Type) > 0 && !s.Type.allows(kind) {
+		fail("expected %s, got %s", strings.Join(s.Type, " or "), kind)
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if schemaEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value %v is not one of %v", v, s.Enum)
+		}
+	}
+	if s.Const != nil && !schemaEqual(s.Const, v) {
+		fail("value %v must be %v", v, s.Const)
+	}
+
+	switch tv := v.(type) {
+	case string:
+		n := len([]rune(tv))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("length %d is shorter than %d", n, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("length %d is longer than %d", n, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(tv) {
+			fail("%q does not match pattern %q", tv, s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && tv < *s.Minimum {
+			fail("%v is less than minimum %v", tv, *s.Minimum)
+		}
+		if s.Maximum != nil && tv > *s.Maximum {
+			fail("%v is greater than maximum %v", tv, *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && tv <= *s.ExclusiveMinimum {
+			fail("%v must be greater than %v", tv, *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && tv >= *s.ExclusiveMaximum {
+			fail("%v must be less than %v", tv, *s.ExclusiveMaximum)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(tv) < *s.MinItems {
+			fail("has %d items, expected at least %d", len(tv), *s.MinItems)
+		}
+		if s.MaxItems != nil && len(tv) > *s.MaxItems {
+			fail("has %d items, expected at most %d", len(tv), *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range tv {
+				s.Items.validate(fmt.Sprintf("%s[%d]", strings.TrimSuffix(path, "."), i), item, errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, req := range s.Required {
+			if _, ok := tv[req]; !ok {
+				fail("missing required key %q", req)
+			}
+		}
+		keys := make([]string, 0, len(tv))
+		for k := range tv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := joinValuePath(path, k)
+			if ps, ok := s.Properties[k]; ok {
+				ps.validate(child, tv[k], errs)
+				continue
+			}
+			if ap := s.AdditionalProperties; ap != nil {
+				if !ap.Allowed {
+					fail("unexpected key %q", k)
+				} else if ap.Schema != nil {
+					ap.Schema.validate(child, tv[k], errs)
+				}
+			}
+		}
+	}
+}
+
+func (t schemaTypes) allows(kind string) bool {
+	for _, want := range t {
+		if want == kind {
+			return true
+		}
+		if want == "number" && kind == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaTypeOf names the JSON Schema type of a normalized value.
+func schemaTypeOf(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if tv == math.Trunc(tv) && !math.IsInf(tv, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func schemaEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeValue(a), normalizeValue(b))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var schemaTests = []struct {
+	name   string
+	schema string
+	values string
+	errs   []string
+	err    string
+}{
+	// Types
+	{name: "type", schema: `{"type": "string"}`, values: `web`},
+	{name: "type-mismatch", schema: `{"type": "string"}`, values: `1`, errs: []string{".: expected string, got integer"}},
+	{name: "type-list", schema: `{"type": ["string", "null"]}`, values: `~`},
+	{name: "integer-is-number", schema: `{"type": "number"}`, values: `3`},
+	{name: "number-is-not-integer", schema: `{"type": "integer"}`, values: `1.5`, errs: []string{".: expected integer, got number"}},
+	{name: "object", schema: `{"type": "object"}`, values: `{a: 1}`},
+	{name: "array", schema: `{"type": "object"}`, values: `[1]`, errs: []string{".: expected object, got array"}},
+	{name: "boolean", schema: `{"type": "boolean"}`, values: `"true"`, errs: []string{".: expected boolean, got string"}},
+
+	// Required keys, and paths of nested errors
+	{
+		name:   "required",
+		schema: `{"type": "object", "required": ["name", "port"]}`,
+		values: `{name: web}`,
+		errs:   []string{`.: missing required key "port"`},
+	},
+	{
+		name:   "nested-path",
+		schema: `{"properties": {"db": {"properties": {"hosts": {"items": {"properties": {"port": {"type": "integer"}}, "required": ["host"]}}}}}}`,
+		values: `{db: {hosts: [{host: a, port: 1}, {port: x}]}}`,
+		errs:   []string{`.db.hosts[1]: missing required key "host"`, ".db.hosts[1].port: expected integer, got string"},
+	},
+	{
+		name:   "every-error",
+		schema: `{"properties": {"b": {"type": "string"}, "a": {"type": "string"}}}`,
+		values: `{a: 1, b: 2}`,
+		errs:   []string{".a: expected string, got integer", ".b: expected string, got integer"},
+	},
+
+	// Enum and const
+	{name: "enum", schema: `{"enum": ["dev", "prod", 1]}`, values: `1`},
+	{name: "enum-mismatch", schema: `{"enum": ["dev", "prod"]}`, values: `test`, errs: []string{".: value test is not one of [dev prod]"}},
+	{name: "const", schema: `{"const": {"a": [1]}}`, values: `{a: [1]}`},
+	{name: "const-mismatch", schema: `{"const": "x"}`, values: `z`, errs: []string{".: value z must be x"}},
+
+	// Strings, numbers and arrays
+	{name: "min-length", schema: `{"minLength": 3}`, values: `éé`, errs: []string{".: length 2 is shorter than 3"}},
+	{name: "max-length", schema: `{"maxLength": 2}`, values: `abc`, errs: []string{".: length 3 is longer than 2"}},
+	{name: "pattern", schema: `{"pattern": "^[a-z]+$"}`, values: `Web`, errs: []string{`.: "Web" does not match pattern "^[a-z]+$"`}},
+	{name: "minimum", schema: `{"minimum": 1, "maximum": 10}`, values: `0`, errs: []string{".: 0 is less than minimum 1"}},
+	{name: "maximum", schema: `{"minimum": 1, "maximum": 10}`, values: `11`, errs: []string{".: 11 is greater than maximum 10"}},
+	{name: "exclusive", schema: `{"exclusiveMinimum": 1, "exclusiveMaximum": 2}`, values: `2`, errs: []string{".: 2 must be less than 2"}},
+	{name: "items", schema: `{"minItems": 2, "items": {"type": "string"}}`, values: `[1]`, errs: []string{".: has 1 items, expected at least 2", "[0]: expected string, got integer"}},
+	{name: "max-items", schema: `{"maxItems": 1}`, values: `[1, 2]`, errs: []string{".: has 2 items, expected at most 1"}},
+
+	// Additional properties
+	{name: "additional", schema: `{"properties": {"a": {}}}`, values: `{a: 1, b: 2}`},
+	{name: "no-additional", schema: `{"properties": {"a": {}}, "additionalProperties": false}`, values: `{a: 1, b: 2}`, errs: []string{`.: unexpected key "b"`}},
+	{name: "additional-schema", schema: `{"additionalProperties": {"type": "string"}}`, values: `{a: x, b: 2}`, errs: []string{".b: expected string, got integer"}},
+
+	// References
+	{name: "ref", schema: `{"properties": {"port": {"$ref": "#/definitions/port"}}, "definitions": {"port": {"type": "integer"}}}`, values: `{port: http}`, errs: []string{".port: expected integer, got string"}},
+	{name: "ref-defs", schema: `{"$ref": "#/$defs/name", "$defs": {"name": {"$ref": "#/$defs/str"}, "str": {"type": "string"}}}`, values: `web`},
+	{name: "ref-missing", schema: `{"$ref": "#/definitions/port"}`, values: `1`, errs: []string{`.: $ref "#/definitions/port" not found`}},
+	{name: "ref-unsupported", schema: `{"$ref": "other.json#/port"}`, values: `1`, errs: []string{`.: Unsupported $ref "other.json#/port"`}},
+	{name: "ref-loop", schema: `{"$ref": "#/definitions/a", "definitions": {"a": {"$ref": "#/definitions/a"}}}`, values: `1`, errs: []string{`.: $ref "#/definitions/a" is too deeply nested`}},
+
+	// Errors in the schema itself
+	{name: "bad-json", schema: `{"type": }`, err: "invalid character"},
+	{name: "bad-type", schema: `{"type": 1}`, err: "Schema type must be a string or list of strings"},
+	{name: "bad-pattern", schema: `{"properties": {"a": {"pattern": "("}}}`, err: `Invalid pattern "("`},
+}
+
+func TestSchema(t *testing.T) {
+	for _, test := range schemaTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			s, err := parseSchema([]byte(test.schema))
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected the schema to fail with %q, but it parsed", test.err)
+			}
+
+			var v interface{}
+			if err := yaml.Unmarshal([]byte(test.values), &v); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, err := range s.Validate(v) {
+				got = append(got, err.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(test.errs, "\n") {
+				t.Errorf("Validated with errors %q, expected %q", got, test.errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cachedSecret is a secret kept across runs, as fetched at Fetched.
+type cachedSecret struct {
+	Ref     string      `json:"ref"`
+	Fetched time.Time   `json:"fetched"`
+	Value   interface{} `json:"value"`
+
+	refreshing bool
+}
+
+// cachePath returns the file ref is cached in, inside the cache directory.
+func (s *secretStore) cachePath(ref string) string {
+	sum := sha256.Sum256([]byte(ref))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// cached returns the cached response for ref, from memory or else from the
+// cache directory, if any. The store must be locked.
+func (s *secretStore) cached(ref string) *cachedSecret {
+	if c, ok := s.responses[ref]; ok {
+		return c
+	}
+	if s.dir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.cachePath(ref))
+	if err != nil {
+		return nil
+	}
+	var c cachedSecret
+	if err := json.Unmarshal(data, &c); err != nil || c.Ref != ref {
+		logf(s.logger, LogWarn, "Ignoring the cached response for %s, which cannot be read", ref)
+		return nil
+	}
+	s.responses[ref] = &c
+	return &c
+}
+
+// store caches v as the response for ref, fetched now. The store must be
+// locked.
+func (s *secretStore) store(ref string, v interface{}) {
+	c := &cachedSecret{Ref: ref, Fetched: time.Now(), Value: v}
+	s.responses[ref] = c
+	if s.dir == "" {
+		return
+	}
+	data, err := json.Marshal(c)
+	if err == nil {
+		// Only the user running tpl may read the secrets
+		if err = os.MkdirAll(s.dir, 0700); err == nil {
+			err = writeFileAtomic(s.cachePath(ref), data, 0600)
+		}
+	}
+	if err != nil {
+		logf(s.logger, LogWarn, "Cannot cache the response for %s in %s: %v", ref, s.dir, err)
+	}
+}
+
+// revalidate fetches ref again, replacing its stale response once it was.
+func (s *secretStore) revalidate(ref string, backend secretBackend, path string) {
+	v, err := backend(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.responses[ref]; c != nil {
+		c.refreshing = false
+	}
+	if err != nil {
+		logf(s.logger, LogWarn, "Cannot fetch secret %s again, using the stale one until it expires: %v", ref, err)
+		return
+	}
+	s.store(ref, v)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSecretBackend serves the secrets of the "test" scheme, counting the
+// calls made to it.
+type testSecretBackend struct {
+	mu    sync.Mutex
+	calls int
+	value string
+	err   error
+}
+
+func (b *testSecretBackend) fetch(path string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if b.err != nil {
+		return nil, b.err
+	}
+	return map[string]interface{}{"password": b.value}, nil
+}
+
+func (b *testSecretBackend) set(value string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.value, b.err = value, err
+}
+
+func (b *testSecretBackend) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls
+}
+
+var secretCacheTests = []struct {
+	name  string
+	ttl   time.Duration
+	stale time.Duration
+	// age is how long ago the cached secret was fetched, before the second
+	// run; the backend then fails with err.
+	age      time.Duration
+	err      error
+	expected string
+	calls    int
+}{
+	{name: "no-ttl", age: time.Minute, expected: "new", calls: 2},
+	{name: "fresh", ttl: time.Hour, age: 30 * time.Minute, expected: "old", calls: 1},
+	{name: "stale", ttl: time.Hour, stale: time.Hour, age: 90 * time.Minute, expected: "old", calls: 2},
+	{name: "stale-fails", ttl: time.Hour, stale: time.Hour, age: 90 * time.Minute, err: errors.New("unavailable"), expected: "old", calls: 2},
+	{name: "expired", ttl: time.Hour, stale: time.Hour, age: 3 * time.Hour, expected: "new", calls: 2},
+}
+
+func TestSecretCache(t *testing.T) {
+	for _, test := range secretCacheTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			backend := &testSecretBackend{value: "old"}
+			secretBackends["test"] = backend.fetch
+			defer delete(secretBackends, "test")
+
+			s := newSecretStore(nil)
+			s.ttl, s.stale, s.logger = test.ttl, test.stale, &logRecorder{}
+			if _, err := s.Fetch("test://app"); err != nil {
+				t.Fatal(err)
+			}
+			s.mu.Lock()
+			if c := s.responses["test://app"]; c != nil {
+				c.Fetched = time.Now().Add(-test.age)
+			}
+			s.mu.Unlock()
+
+			backend.set("new", test.err)
+			s.reset()
+			v, err := s.Fetch("test://app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := v.(map[string]interface{})["password"]; got != test.expected {
+				t.Errorf("Fetched %q, expected %q", got, test.expected)
+			}
+			// A stale secret is fetched again in the background
+			for i := 0; i < 100 && backend.count() < test.calls; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if calls := backend.count(); calls != test.calls {
+				t.Errorf("Fetched the secret %d times, expected %d", calls, test.calls)
+			}
+			if test.stale == 0 {
+				return
+			}
+
+			// Once fetched again, the next run has the new secret, unless
+			// fetching it failed
+			expected := "new"
+			if test.err != nil {
+				expected = "old"
+			}
+			for i := 0; i < 100; i++ {
+				s.mu.Lock()
+				refreshing := s.responses["test://app"].refreshing
+				s.mu.Unlock()
+				if !refreshing {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			s.reset()
+			if v, err = s.Fetch("test://app"); err != nil {
+				t.Fatal(err)
+			}
+			if got := v.(map[string]interface{})["password"]; got != expected {
+				t.Errorf("Fetched %q after revalidating, expected %q", got, expected)
+			}
+		})
+	}
+}
+
+func TestSecretCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tpl-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := &testSecretBackend{value: "old"}
+	secretBackends["test"] = backend.fetch
+	defer delete(secretBackends, "test")
+
+	s := newSecretStore(nil)
+	s.ttl, s.dir = time.Hour, filepath.Join(dir, "cache")
+	if _, err := s.Fetch("test://app"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(s.cachePath("test://app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 && runtime.GOOS != "windows" {
+		t.Errorf("Cached the secret with mode %o, expected 600", mode)
+	}
+
+	// Another process finds the secret in the cache directory
+	backend.set("new", nil)
+	restarted := newSecretStore(nil)
+	restarted.ttl, restarted.dir = time.Hour, s.dir
+	v, err := restarted.Fetch("test://app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.(map[string]interface{})["password"]; got != "old" || backend.count() != 1 {
+		t.Errorf("Fetched %q in %d calls, expected the cached secret", got, backend.count())
+	}
+}
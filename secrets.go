@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretBackend fetches the secret at path, returning its decoded contents:
+// a map for structured secrets, or a string otherwise.
+type secretBackend func(path string) (interface{}, error)
+
+// secretBackends maps value source schemes to the secret managers serving
+// them.
+var secretBackends = map[string]secretBackend{
+	"vault": fetchVaultSecret,
+	"awssm": fetchAWSSecret,
+	"gcpsm": fetchGCPSecret,
+}
+
+func isSecretScheme(scheme string) bool {
+	_, ok := secretBackends[scheme]
+	return ok
+}
+
+// secretStore fetches secrets on demand and keeps them in memory for the rest
+// of the run, so that each secret is requested at most once. Secrets are
+// never written to disk, unless they are cached in dir.
+type secretStore struct {
+	policy *Policy
+
+	// ttl and stale, if ttl is positive, keep secrets across runs: for ttl
+	// after they were fetched, and then for stale while they are fetched
+	// again in the background. With dir, they are also kept on disk, across
+	// restarts.
+	ttl    time.Duration
+	stale  time.Duration
+	dir    string
+	logger Logger
+
+	mu        sync.Mutex
+	cache     map[string]interface{}
+	responses map[string]*cachedSecret
+
+	// fetching holds the secrets being fetched, which others asking for
+	// them wait for, rather than fetching them too.
+	fetching map[string]*secretFetch
+}
+
+// secretFetch is a secret being fetched, whose value and err are set once
+// done is closed.
+type secretFetch struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func newSecretStore(policy *Policy) *secretStore {
+	return &secretStore{policy: policy, cache: make(map[string]interface{}), responses: make(map[string]*cachedSecret), fetching: make(map[string]*secretFetch)}
+}
+
+// reset starts a new run, in which secrets are fetched again unless cached
+// across runs.
+func (s *secretStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = make(map[string]interface{})
+}
+
+// Fetch returns the contents of the secret ref, e.g. "vault://secret/app".
+func (s *secretStore) Fetch(ref string) (interface{}, error) {
+	return s.fetch(ref, s.ttl, s.stale)
+}
+
+// fetch returns the contents of the secret ref, from the cache if it was
+// fetched less than ttl ago, or stale after that. A stale secret is fetched
+// again in the background, for the runs after this one.
+func (s *secretStore) fetch(ref string, ttl, stale time.Duration) (interface{}, error) {
+	scheme, path := splitScheme(ref)
+	backend, ok := secretBackends[scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported secret source %q", ref)
+	}
+	if err := s.policy.CheckScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if v, ok := s.cache[ref]; ok {
+		s.mu.Unlock()
+		return v, nil
+	}
+	if c := s.cached(ref); c != nil && ttl > 0 {
+		switch age := time.Since(c.Fetched); {
+		case age < ttl:
+			logf(s.logger, LogDebug, "Using secret %s from the cache, fetched %s ago", ref, age.Round(time.Second))
+			s.cache[ref] = c.Value
+			s.mu.Unlock()
+			return c.Value, nil
+		case age < ttl+stale:
+			logf(s.logger, LogDebug, "Using secret %s from the cache, fetched %s ago, while fetching it again", ref, age.Round(time.Second))
+			if !c.refreshing {
+				c.refreshing = true
+				go s.revalidate(ref, backend, path)
+			}
+			s.cache[ref] = c.Value
+			s.mu.Unlock()
+			return c.Value, nil
+		}
+	}
+	if f, ok := s.fetching[ref]; ok {
+		s.mu.Unlock()
+		<-f.done
+		return f.value, f.err
+	}
+	f := &secretFetch{done: make(chan struct{})}
+	s.fetching[ref] = f
+	s.mu.Unlock()
+
+	// The store is not locked while the backend answers, which may take a
+	// while, so that other secrets can be fetched meanwhile
+	v, err := backend(path)
+	s.mu.Lock()
+	delete(s.fetching, ref)
+	if err != nil {
+		v, err = nil, fmt.Errorf("Cannot fetch secret %s: %v", ref, err)
+	} else {
+		s.cache[ref] = v
+		if ttl > 0 {
+			s.store(ref, v)
+		}
+	}
+	s.mu.Unlock()
+	f.value, f.err = v, err
+	close(f.done)
+	return v, err
+}
+
+// Func is the `secret` template function. With keys, it returns the value at
+// that path within a structured secret, e.g.
+// `{{ secret "vault://secret/app" "db" "password" }}`.
+func (s *secretStore) Func(ref string, keys ...string) (interface{}, error) {
+	v, err := s.Fetch(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return v, nil
+	}
+	found, ok := lookupPath(v, keys)
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %q", ref, strings.Join(keys, "."))
+	}
+	return found, nil
+}
+
+// decodeSecret decodes a JSON object secret into a map, and leaves any other
+// secret as a string.
+func decodeSecret(payload string) interface{} {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &m); err == nil {
+		return m
+	}
+	return payload
+}
+
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchVaultSecret reads a secret through the Vault HTTP API, using the same
+// VAULT_ADDR, VAULT_TOKEN, and VAULT_NAMESPACE environment variables as the
+// vault CLI. Secrets from version 2 of the KV engine are unwrapped.
+func fetchVaultSecret(path string) (interface{}, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		addr = "https://127.0.0.1:8200"
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if data, err := ioutil.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(data))
+			}
+		}
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no Vault token; set VAULT_TOKEN or log in with the vault CLI")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("unexpected response from Vault (%s): %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(body.Errors) > 0 {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.Join(body.Errors, "; "))
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	return data, nil
+}
+
+// fetchAWSSecret reads a secret from AWS Secrets Manager with the aws CLI,
+// which takes care of credentials and region.
+func fetchAWSSecret(id string) (interface{}, error) {
+	out, err := runSecretCommand("aws", "secretsmanager", "get-secret-value", "--secret-id", id, "--query", "SecretString", "--output", "text")
+	if err != nil {
+		return nil, err
+	}
+	return decodeSecret(strings.TrimSuffix(out, "\n")), nil
+}
+
+// fetchGCPSecret reads a secret from GCP Secret Manager with the gcloud CLI.
+// The path is project/secret or project/secret/version; the latest version
+// is used by default.
+func fetchGCPSecret(path string) (interface{}, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("expected project/secret[/version], got %q", path)
+	}
+	version := "latest"
+	if len(parts) == 3 {
+		version = parts[2]
+	}
+	out, err := runSecretCommand("gcloud", "secrets", "versions", "access", version, "--secret", parts[1], "--project", parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return decodeSecret(out), nil
+}
+
+// runSecretCommand runs a secrets manager CLI, capturing its output in memory.
+func runSecretCommand(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s failed: %v: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("%s failed: %v", name, err)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var vaultTests = []struct {
+	name     string
+	token    string
+	status   int
+	response string
+	expected string
+	err      string
+}{
+	{name: "kv-v1", token: "t0ken", status: http.StatusOK, response: `{"data": {"password": "s3cret"}}`, expected: "map[password:s3cret]"},
+	{name: "kv-v2", token: "t0ken", status: http.StatusOK, response: `{"data": {"data": {"password": "s3cret"}, "metadata": {"version": 3}}}`, expected: "map[password:s3cret]"},
+	{name: "denied", token: "t0ken", status: http.StatusForbidden, response: `{"errors": ["permission denied"]}`, err: "Cannot fetch secret vault://secret/data/app: 403 Forbidden: permission denied"},
+	{name: "not-found", token: "t0ken", status: http.StatusNotFound, response: `{"errors": []}`, err: "404 Not Found"},
+	{name: "not-json", token: "t0ken", status: http.StatusBadGateway, response: `<html>`, err: "unexpected response from Vault (502 Bad Gateway)"},
+	{name: "no-token", err: "no Vault token"},
+}
+
+func TestVaultSecret(t *testing.T) {
+	for _, test := range vaultTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			home, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(home)
+
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				requests++
+				if req.URL.Path != "/v1/secret/data/app" {
+					t.Errorf("Requested %s, expected /v1/secret/data/app", req.URL.Path)
+				}
+				if token, ns := req.Header.Get("X-Vault-Token"), req.Header.Get("X-Vault-Namespace"); token != test.token || ns != "team" {
+					t.Errorf("Requested with token %q in namespace %q", token, ns)
+				}
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.response)
+			}))
+			defer server.Close()
+			defer setenv(t, "VAULT_ADDR", server.URL+"/")()
+			defer setenv(t, "VAULT_TOKEN", test.token)()
+			defer setenv(t, "VAULT_NAMESPACE", "team")()
+			// Without a token, none is read from the home directory either
+			defer setenv(t, "HOME", home)()
+			defer setenv(t, "USERPROFILE", home)()
+
+			s := newSecretStore(nil)
+			for i := 0; i < 2; i++ {
+				v, err := s.Fetch("vault://secret/data/app")
+				if err != nil {
+					if test.err == "" {
+						t.Fatalf("Unexpected error: %v", err)
+					} else if !strings.Contains(err.Error(), test.err) {
+						t.Fatalf("Different error; got %q, expected %q", err, test.err)
+					}
+					return
+				} else if test.err != "" {
+					t.Fatalf("Expected fetching to fail with %q, but it got %v", test.err, v)
+				}
+				if got := fmt.Sprint(v); got != test.expected {
+					t.Errorf("Fetched %s, expected %s", got, test.expected)
+				}
+			}
+			if requests != 1 {
+				t.Errorf("Requested the secret %d times, expected once per run", requests)
+			}
+		})
+	}
+}
+
+func TestSecretFetchUnlocked(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+	var calls sync.WaitGroup
+	calls.Add(1)
+	count := 0
+	secretBackends["test"] = func(path string) (interface{}, error) {
+		if path == "slow" {
+			count++
+			calls.Done()
+			<-release
+		}
+		return path, nil
+	}
+	defer delete(secretBackends, "test")
+
+	s := newSecretStore(nil)
+	results := make(chan interface{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			v, _ := s.Fetch("test://slow")
+			results <- v
+		}()
+	}
+	calls.Wait()
+
+	// Other secrets are fetched while the slow one is
+	fetched := make(chan interface{})
+	go func() {
+		v, _ := s.Fetch("test://fast")
+		fetched <- v
+	}()
+	select {
+	case v := <-fetched:
+		if v != "fast" {
+			t.Errorf("Fetched %v, expected fast", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fetching a secret waited for another one")
+	}
+
+	unblock()
+	for i := 0; i < 2; i++ {
+		if v := <-results; v != "slow" {
+			t.Errorf("Fetched %v, expected slow", v)
+		}
+	}
+	if count != 1 {
+		t.Errorf("Fetched the slow secret %d times, expected once", count)
+	}
+}
+
+// setenv sets the environment variable name to value, or unsets it for "",
+// and returns a func restoring it.
+func setenv(t *testing.T, name, value string) func() {
+	t.Helper()
+	prev, ok := os.LookupEnv(name)
+	var err error
+	if value == "" {
+		err = os.Unsetenv(name)
+	} else {
+		err = os.Setenv(name, value)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if ok {
+			os.Setenv(name, prev)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DefaultServiceLabel is the launchd label of the agent the service command
+// installs, unless -service-label is given.
+const DefaultServiceLabel = "com.github.ripta.tpl"
+
+// launchAgent is a per-user launchd agent running the daemon command.
+type launchAgent struct {
+	Label   string
+	Args    []string
+	Dir     string
+	LogFile string
+}
+
+// newLaunchAgent describes the agent label, running the daemon command of
+// this executable with args, in the current directory, so that relative
+// paths among args keep working, and logging into the Logs of the user.
+func newLaunchAgent(label string, args []string) (*launchAgent, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot tell where tpl is installed: %v", err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return &launchAgent{
+		Label:   label,
+		Args:    append([]string{exe, "daemon"}, args...),
+		Dir:     dir,
+		LogFile: filepath.Join(home, "Library", "Logs", "tpl", label+".log"),
+	}, nil
+}
+
+// plistPath is where launchd finds the agents of the user.
+func (a *launchAgent) plistPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", a.Label+".plist"), nil
+}
+
+// plist returns the property list of the agent. launchd starts it at login,
+// and starts it again, at most every 30 seconds, whenever it exits with an
+// error, but not after it stopped on SIGTERM, which it sends on unload.
+func (a *launchAgent) plist() []byte {
+	var buf bytes.Buffer
+	str := func(s string) {
+		buf.WriteString("<string>")
+		xml.EscapeText(&buf, []byte(s))
+		buf.WriteString("</string>")
+	}
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	`)
+	str(a.Label)
+	buf.WriteString("\n\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range a.Args {
+		buf.WriteString("\t\t")
+		str(arg)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\t</array>\n\t<key>WorkingDirectory</key>\n\t")
+	str(a.Dir)
+	buf.WriteString(`
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer>30</integer>
+	<key>ProcessType</key>
+	<string>Background</string>
+	<key>StandardOutPath</key>
+	`)
+	str(a.LogFile)
+	buf.WriteString("\n\t<key>StandardErrorPath</key>\n\t")
+	str(a.LogFile)
+	buf.WriteString("\n</dict>\n</plist>\n")
+	return buf.Bytes()
+}
+
+// runService runs the service subcommand named first in args, for the agent
+// label running the daemon with daemonArgs followed by the rest of args:
+//
+//	install    write the agent into ~/Library/LaunchAgents
+//	uninstall  remove it
+//	print      print it to STDOUT
+//
+// It returns the process exit code.
+func runService(label string, args, daemonArgs []string) int {
+	if len(args) == 0 {
+		logf(nil, LogError, "The service command takes a subcommand: install, uninstall, or print")
+		return 1
+	}
+	agent, err := newLaunchAgent(label, append(daemonArgs, args[1:]...))
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	path, err := agent.plistPath()
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	target := fmt.Sprintf("gui/%d", os.Getuid())
+	switch args[0] {
+	case "print":
+		os.Stdout.Write(agent.plist())
+	case "install":
+		for _, dir := range []string{filepath.Dir(path), filepath.Dir(agent.LogFile)} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				logf(nil, LogError, "%v", err)
+				return 1
+			}
+		}
+		if err := writeFileAtomic(path, agent.plist(), 0644); err != nil {
+			logf(nil, LogError, "Cannot write %s: %v", path, err)
+			return 1
+		}
+		logf(nil, LogInfo, "Installed %s, logging into %s; start it with: launchctl bootstrap %s %s", path, agent.LogFile, target, path)
+	case "uninstall":
+		if err := os.Remove(path); err != nil {
+			logf(nil, LogError, "%v", err)
+			return 1
+		}
+		logf(nil, LogInfo, "Removed %s; if it is running, stop it with: launchctl bootout %s/%s", path, target, label)
+	default:
+		logf(nil, LogError, "Unknown service subcommand %q; must be install, uninstall, or print", args[0])
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+var errNotWindows = errors.New("-windows-service is only supported on Windows")
+
+// runWindowsService fails, as there are no Windows services but on Windows.
+func runWindowsService(name string, run func(stop <-chan struct{}) int) (int, error) {
+	return 1, errNotWindows
+}
+
+// newEventLogger fails, as there is no event log but on Windows.
+func newEventLogger(source string, min LogLevel) (Logger, error) {
+	return nil, errNotWindows
+}
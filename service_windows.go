@@ -0,0 +1,184 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSource          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEvent                  = advapi32.NewProc("ReportEventW")
+)
+
+// The constants of the service control manager and the event log that are
+// used below, from winsvc.h and winnt.h.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop     = 1
+	serviceControlShutdown = 5
+
+	errorCallNotImplemented          = 120
+	errorFailedServiceControllerConn = 1063
+	errorServiceSpecificError        = 1066
+
+	eventlogErrorType       = 0x1
+	eventlogWarningType     = 0x2
+	eventlogInformationType = 0x4
+)
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// windowsService is the one service the process runs as. The service
+// control manager calls back into it on threads of its own.
+type windowsService struct {
+	name   *uint16
+	run    func(stop <-chan struct{}) int
+	handle uintptr
+	stop   chan struct{}
+	once   sync.Once
+	code   int
+}
+
+var theService *windowsService
+
+// runWindowsService runs the daemon, run, as the Windows service name, with
+// the service control manager, until it is stopped, when stop is closed. It
+// returns the exit code of run, or fails when the process was not started by
+// the service control manager.
+func runWindowsService(name string, run func(stop <-chan struct{}) int) (int, error) {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 1, err
+	}
+	theService = &windowsService{name: p, run: run, stop: make(chan struct{})}
+	table := []serviceTableEntry{
+		{name: p, proc: syscall.NewCallback(serviceMain)},
+		{},
+	}
+	ok, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0])))
+	if ok == 0 {
+		if errno, isErrno := err.(syscall.Errno); isErrno && errno == errorFailedServiceControllerConn {
+			return 1, fmt.Errorf("Not started by the service control manager; run -windows-service=%s as a service, e.g. created with sc.exe", name)
+		}
+		return 1, fmt.Errorf("Cannot connect to the service control manager: %v", err)
+	}
+	return theService.code, nil
+}
+
+// serviceMain is the ServiceMain of the service, which the service control
+// manager calls once the dispatcher connected.
+func serviceMain(argc uintptr, argv uintptr) uintptr {
+	s := theService
+	s.handle, _, _ = procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(s.name)), syscall.NewCallback(serviceHandler), 0)
+	if s.handle == 0 {
+		return 0
+	}
+	s.setStatus(serviceStartPending, 0, 0)
+	s.setStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, 0)
+	s.code = s.run(s.stop)
+	s.setStatus(serviceStopped, 0, s.code)
+	return 0
+}
+
+// serviceHandler is the HandlerEx of the service, which stops the daemon when
+// the service is stopped, or Windows shuts down.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	s := theService
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		s.setStatus(serviceStopPending, 0, 0)
+		s.once.Do(func() { close(s.stop) })
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+func (s *windowsService) setStatus(state, accepts uint32, code int) {
+	st := serviceStatus{serviceType: serviceWin32OwnProcess, currentState: state, controlsAccepted: accepts}
+	if code != 0 {
+		st.win32ExitCode = errorServiceSpecificError
+		st.serviceSpecificExitCode = uint32(code)
+	}
+	if state == serviceStartPending || state == serviceStopPending {
+		// The daemon waits for a run in progress before stopping
+		st.waitHint = 30000
+	}
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&st)))
+}
+
+// eventLogger writes messages of at least min to the Application event log,
+// under its source.
+type eventLogger struct {
+	min    LogLevel
+	handle uintptr
+}
+
+// newEventLogger returns a Logger writing to the Application event log under
+// source, which should be registered beforehand, e.g. with New-EventLog, for
+// the Event Viewer to show messages without complaint.
+func newEventLogger(source string, min LogLevel) (Logger, error) {
+	p, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(p)))
+	if h == 0 {
+		return nil, fmt.Errorf("Cannot open the event log for %s: %v", source, err)
+	}
+	return &eventLogger{min: min, handle: h}, nil
+}
+
+func (e *eventLogger) Enabled(level LogLevel) bool {
+	return level >= e.min
+}
+
+func (e *eventLogger) Log(level LogLevel, msg string) {
+	if level < e.min {
+		return
+	}
+	typ := eventlogInformationType
+	switch level {
+	case LogWarn:
+		typ = eventlogWarningType
+	case LogError:
+		typ = eventlogErrorType
+	}
+	p, err := syscall.UTF16PtrFromString(msg)
+	if err != nil {
+		return
+	}
+	strs := []*uint16{p}
+	procReportEvent.Call(e.handle, uintptr(typ), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+}
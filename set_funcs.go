@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"text/template"
+)
+
+const (
+	// snippetSizeLimit bounds the total size of the snippets defined in one
+	// render.
+	snippetSizeLimit = 1 << 20
+
+	// nestLimit bounds how deeply snippet, include, and tpl may render
+	// templates within each other, including themselves.
+	nestLimit = 32
+)
+
+var errSetFuncUnbound = errors.New("only available while rendering")
+
+// setFuncPlaceholders stand in for the template functions that render
+// templates of the set they are called from, so that templates using them
+// parse. bindSetFuncs then gives each template set its own.
+var setFuncPlaceholders = template.FuncMap{
+	"defineFrom": func(interface{}) (string, error) { return "", errSetFuncUnbound },
+	"snippet":    func(string, ...interface{}) (string, error) { return "", errSetFuncUnbound },
+	"include":    func(string, interface{}) (string, error) { return "", errSetFuncUnbound },
+	"tpl":        func(string, interface{}) (string, error) { return "", errSetFuncUnbound },
+}
+
+// setFuncs are the functions bound to one template set.
+type setFuncs struct {
+	tpl     *template.Template
+	profile *TemplateProfile
+	files   map[string]bool
+	defined map[string]bool
+	size    int
+	depth   int
+
+	// tooDeep is the error of templates nesting too deeply, which is passed
+	// up as it is rather than wrapped once per level.
+	tooDeep error
+}
+
+// bindSetFuncs gives tpl its own set functions, of those that are allowed,
+// and returns them.
+func (r *Renderer) bindSetFuncs(tpl *template.Template) template.FuncMap {
+	s := &setFuncs{tpl: tpl, profile: r.Profile, files: make(map[string]bool), defined: make(map[string]bool)}
+	for _, t := range tpl.Templates() {
+		s.files[t.Name()] = true
+	}
+	bound := template.FuncMap{"defineFrom": s.Define, "snippet": s.Invoke, "include": s.Include, "tpl": s.Tpl}
+	for name := range bound {
+		if _, ok := r.funcs[name]; !ok {
+			delete(bound, name)
+		}
+	}
+	bound = r.Stats.countFuncs(bound)
+	if len(bound) > 0 {
+		tpl.Funcs(bound)
+	}
+	return bound
+}
+
+// execute renders the template name of the set with data, guarding against
+// templates nesting too deeply.
+func (s *setFuncs) execute(name string, data interface{}) (string, error) {
+	shown := name
+	if name == tplName {
+		shown = "tpl"
+	}
+	if s.depth >= nestLimit {
+		s.tooDeep = fmt.Errorf("template %q nests more than %d templates deep", shown, nestLimit)
+		return "", s.tooDeep
+	}
+	s.depth++
+	defer func() {
+		if s.depth--; s.depth == 0 {
+			s.tooDeep = nil
+		}
+	}()
+
+	s.profile.enter(shown)
+	defer s.profile.exit()
+
+	var buf bytes.Buffer
+	if err := s.tpl.ExecuteTemplate(&buf, name, data); err != nil {
+		if s.tooDeep != nil {
+			return "", s.tooDeep
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Define is the `defineFrom` template function. It defines a template for
+// every entry in a map of names to template bodies, such as a snippet library
+// kept in values, e.g. `{{ defineFrom .snippets }}`. It renders nothing.
+func (s *setFuncs) Define(snippets interface{}) (string, error) {
+	m, ok := normalizeValue(snippets).(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("defineFrom expects a map of names to templates, got %T", snippets)
+	}
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		body, ok := m[name].(string)
+		if !ok {
+			return "", fmt.Errorf("snippet %q must be a string, got %T", name, m[name])
+		}
+		if s.files[name] {
+			return "", fmt.Errorf("snippet %q would replace the template of the same name", name)
+		}
+		if s.size += len(body); s.size > snippetSizeLimit {
+			return "", fmt.Errorf("snippets are larger than the limit of %d bytes", snippetSizeLimit)
+		}
+		if _, err := s.tpl.New(name).Parse(body); err != nil {
+			return "", fmt.Errorf("snippet %q: %v", name, err)
+		}
+		s.defined[name] = true
+	}
+	return "", nil
+}
+
+// Invoke is the `snippet` template function, which renders a snippet defined
+// by defineFrom with the given data, or with no data, e.g.
+// `{{ snippet "greeting" .user }}`.
+func (s *setFuncs) Invoke(name string, data ...interface{}) (string, error) {
+	if !s.defined[name] {
+		return "", fmt.Errorf("snippet %q is not defined; call defineFrom first", name)
+	}
+	if len(data) > 1 {
+		return "", fmt.Errorf("snippet %q takes at most one argument, got %d", name, len(data))
+	}
+	var arg interface{}
+	if len(data) == 1 {
+		arg = data[0]
+	}
+	return s.execute(name, arg)
+}
+
+// Include is the `include` template function. It renders the named template
+// into a string, which unlike the output of the `template` action can be
+// piped through other functions, e.g. `{{ include "labels" . | nindent 4 }}`.
+func (s *setFuncs) Include(name string, data interface{}) (string, error) {
+	if s.tpl.Lookup(name) == nil {
+		return "", fmt.Errorf("template %q is not defined", name)
+	}
+	return s.execute(name, data)
+}
+
+// tplName is the name under which the text given to `tpl` is parsed, which
+// no file can have.
+const tplName = "\x00tpl"
+
+// Tpl is the `tpl` template function, which renders text, such as a value, as
+// a template with access to the templates of the set, e.g.
+// `{{ tpl .message . }}`.
+func (s *setFuncs) Tpl(text string, data interface{}) (string, error) {
+	if s.size += len(text); s.size > snippetSizeLimit {
+		return "", fmt.Errorf("templates given to tpl are larger than the limit of %d bytes", snippetSizeLimit)
+	}
+	t, err := s.tpl.New(tplName).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("tpl: %v", err)
+	}
+	s.profile.instrumentTree(t.Tree)
+	return s.execute(tplName, data)
+}
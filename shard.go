@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseShard parses a -shard flag, "K/N", into the shard K, counting from 1,
+// of N shards.
+func parseShard(s string) (int, int, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) == 2 {
+		k, kerr := strconv.Atoi(parts[0])
+		n, nerr := strconv.Atoi(parts[1])
+		if kerr == nil && nerr == nil && n > 0 && k >= 1 && k <= n {
+			return k, n, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("Invalid shard %q; must be in the form of K/N, with K from 1 to N", s)
+}
+
+// sharded reports whether the run renders only one shard of its outputs.
+func (r *Renderer) sharded() bool {
+	return r.Shards > 1
+}
+
+// inShard reports whether the item key belongs to the shard of the run. Every
+// run with the same Shards puts each key in the same shard, whatever the
+// machine, so that the shards are disjoint and, together, render everything.
+func (r *Renderer) inShard(key string) bool {
+	if !r.sharded() {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%uint32(r.Shards)) == r.Shard-1
+}
+
+// inRecordShard reports whether record n, counting from 1, of a JSON lines
+// file belongs to the shard of the run.
+func (r *Renderer) inRecordShard(n int) bool {
+	return !r.sharded() || (n-1)%r.Shards == r.Shard-1
+}
+
+// shardJobs keeps the jobs of the shard of the run, by their output within
+// out, so that all jobs rendering into one output, as fragments, fall in the
+// same shard, wherever each shard renders. Templates rendered once per record
+// of a JSON lines file are kept in every shard, which each render their own
+// records.
+func (r *Renderer) shardJobs(jobs []renderJob, out string) []renderJob {
+	if !r.sharded() {
+		return jobs
+	}
+	var kept []renderJob
+	for _, job := range jobs {
+		if r.inShard(shardKey(job, out)) || r.streamsRecordsFile(job) {
+			kept = append(kept, job)
+		}
+	}
+	r.logf(LogInfo, "Rendering shard %d/%d: %d of %d output(s)", r.Shard, r.Shards, len(kept), len(jobs))
+	return kept
+}
+
+// shardKey is what the shard of job is told by: its output, relative to out
+// if it is within it, or its input when rendered into STDOUT.
+func shardKey(job renderJob, out string) string {
+	if job.output == "-" {
+		return filepath.ToSlash(job.input)
+	}
+	if rel, err := filepath.Rel(out, job.output); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(job.output)
+}
+
+// streamsRecordsFile reports whether the template of job is rendered once per
+// record, as far as its front matter can be told before it is parsed.
+func (r *Renderer) streamsRecordsFile(job renderJob) bool {
+	if job.copy || job.link != "" || r.isPage(job.input) {
+		return false
+	}
+	data, err := ioutil.ReadFile(job.input)
+	if err != nil {
+		return false
+	}
+	fm, _ := splitFrontMatter(data)
+	return fm.streamsRecords()
+}
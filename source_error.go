@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sourceContextLines is how many lines around a failing line are shown.
+const sourceContextLines = 2
+
+// templateErrorPattern matches the location text/template puts at the start
+// of parse errors ("template: NAME:LINE: ...") and execution errors
+// ("template: NAME:LINE:COL: ...").
+var templateErrorPattern = regexp.MustCompile(`(?s)^template: (.+?):(\d+)(?::(\d+))?: (.*)$`)
+
+// sourceError is a template error located in the file it came from, with
+// the surrounding source.
+type sourceError struct {
+	file    string
+	line    int
+	col     int // -1 when only the line is known
+	msg     string
+	snippet string
+}
+
+func (e *sourceError) Error() string {
+	loc := fmt.Sprintf("%s:%d", e.file, e.line)
+	if e.col >= 0 {
+		loc += fmt.Sprintf(":%d", e.col)
+	}
+	if e.snippet == "" {
+		return loc + ": " + e.msg
+	}
+	return loc + ": " + e.msg + "\n" + e.snippet
+}
+
+// withSource replaces the location of a text/template error with the path of
+// the file it refers to, among inames, followed by the lines around it and a
+// caret under the failing action. Other errors are returned as they are.
+func withSource(err error, inames []string) error {
+	m := templateErrorPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	e := &sourceError{file: parsedFilePath(m[1], inames), col: -1, msg: m[4]}
+	e.line, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		e.col, _ = strconv.Atoi(m[3])
+	}
+	if data, rerr := ioutil.ReadFile(e.file); rerr == nil {
+		e.snippet = sourceSnippet(string(data), e.line, e.col)
+	}
+	return e
+}
+
+// sourceSnippet formats the lines of src around line, numbered, with a caret
+// under the byte col of line when col is known.
+func sourceSnippet(src string, line, col int) string {
+	lines := strings.Split(src, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	first, last := line-sourceContextLines, line+sourceContextLines
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+	if last > line && last == len(lines) && lines[last-1] == "" {
+		last--
+	}
+
+	width := len(strconv.Itoa(last))
+	var b strings.Builder
+	for n := first; n <= last; n++ {
+		text := lines[n-1]
+		fmt.Fprintf(&b, "  %*d | %s\n", width, n, text)
+		if n != line || col < 0 || col > len(text) {
+			continue
+		}
+		// Keep tabs, so that the caret lines up however they are shown
+		pad := []rune{}
+		for _, c := range text[:col] {
+			if c == '\t' {
+				pad = append(pad, '\t')
+			} else {
+				pad = append(pad, ' ')
+			}
+		}
+		fmt.Fprintf(&b, "  %*s | %s^\n", width, "", string(pad))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
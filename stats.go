@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// statsTopN is how many entries of each ranking are printed.
+const statsTopN = 10
+
+// RenderStats collects timings and counts over a run.
+type RenderStats struct {
+	mu        sync.Mutex
+	templates map[string]time.Duration
+	outputs   map[string]int
+	funcs     map[string]int
+	sources   map[string]time.Duration
+}
+
+// NewRenderStats returns an empty set of statistics.
+func NewRenderStats() *RenderStats {
+	return &RenderStats{
+		templates: make(map[string]time.Duration),
+		outputs:   make(map[string]int),
+		funcs:     make(map[string]int),
+		sources:   make(map[string]time.Duration),
+	}
+}
+
+func (s *RenderStats) addTemplate(name string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.templates[name] += d
+	s.mu.Unlock()
+}
+
+func (s *RenderStats) addOutput(name string, size int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.outputs[name] = size
+	s.mu.Unlock()
+}
+
+func (s *RenderStats) addFunc(name string) {
+	s.mu.Lock()
+	s.funcs[name]++
+	s.mu.Unlock()
+}
+
+func (s *RenderStats) addSource(name string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.sources[name] += d
+	s.mu.Unlock()
+}
+
+// countFuncs wraps every function in fm so that calls are counted.
+func (s *RenderStats) countFuncs(fm template.FuncMap) template.FuncMap {
+	if s == nil {
+		return fm
+	}
+	counted := make(template.FuncMap, len(fm))
+	for name, fn := range fm {
+		counted[name] = s.countingFunc(name, fn)
+	}
+	return counted
+}
+
+func (s *RenderStats) countingFunc(name string, fn interface{}) interface{} {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return fn
+	}
+	t := v.Type()
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		s.addFunc(name)
+		if t.IsVariadic() {
+			return v.CallSlice(args)
+		}
+		return v.Call(args)
+	}).Interface()
+}
+
+type statsEntry struct {
+	name  string
+	value int64
+}
+
+func rankDurations(m map[string]time.Duration) []statsEntry {
+	entries := make([]statsEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, statsEntry{k, int64(v)})
+	}
+	return rankEntries(entries)
+}
+
+func rankCounts(m map[string]int) []statsEntry {
+	entries := make([]statsEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, statsEntry{k, int64(v)})
+	}
+	return rankEntries(entries)
+}
+
+// rankEntries sorts entries by descending value, then name, and keeps the top.
+func rankEntries(entries []statsEntry) []statsEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].value != entries[j].value {
+			return entries[i].value > entries[j].value
+		}
+		return entries[i].name < entries[j].name
+	})
+	if len(entries) > statsTopN {
+		entries = entries[:statsTopN]
+	}
+	return entries
+}
+
+// Print writes a human-readable summary of the statistics to w.
+func (s *RenderStats) Print(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "Slowest templates:\n")
+	for _, e := range rankDurations(s.templates) {
+		fmt.Fprintf(w, "  %12v  %s\n", time.Duration(e.value), e.name)
+	}
+	fmt.Fprintf(w, "Largest outputs:\n")
+	for _, e := range rankCounts(s.outputs) {
+		fmt.Fprintf(w, "  %10d B  %s\n", e.value, e.name)
+	}
+	fmt.Fprintf(w, "Most-used functions:\n")
+	for _, e := range rankCounts(s.funcs) {
+		fmt.Fprintf(w, "  %12d  %s\n", e.value, e.name)
+	}
+	fmt.Fprintf(w, "Values sources:\n")
+	for _, e := range rankDurations(s.sources) {
+		fmt.Fprintf(w, "  %12v  %s\n", time.Duration(e.value), e.name)
+	}
+}
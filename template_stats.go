@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"text/template/parse"
+)
+
+// TemplateStats describes how a set of templates is written, as reported
+// by the stats command.
+type TemplateStats struct {
+	// Funcs and Values count the calls of every function, and the
+	// references to every path in the top-level values.
+	Funcs  map[string]int
+	Values map[string]int
+
+	// Templates counts the invocations of every named template, through
+	// either `template` or `include`.
+	Templates map[string]int
+
+	// DefinedIn holds the file every named template is defined in.
+	DefinedIn map[string]string
+
+	Files []FileStats
+}
+
+// FileStats measures the complexity of a template file.
+type FileStats struct {
+	Path  string
+	Lines int
+
+	// Actions counts every {{ }} action, and Branches those of them that
+	// are an if, range, or with.
+	Actions  int
+	Branches int
+
+	// Depth is how deeply if, range, and with nest inside one another.
+	Depth int
+
+	// Defines counts the named templates the file defines.
+	Defines int
+}
+
+// Unused lists the named templates that are never invoked, sorted.
+func (s *TemplateStats) Unused() []string {
+	var names []string
+	for name := range s.DefinedIn {
+		if s.Templates[name] == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Analyze parses every input along with the preloads, without executing
+// anything, and measures them.
+func (r *Renderer) Analyze() (*TemplateStats, error) {
+	stats := &TemplateStats{
+		Funcs:     make(map[string]int),
+		Values:    make(map[string]int),
+		Templates: make(map[string]int),
+		DefinedIn: make(map[string]string),
+	}
+	files := make(map[string]*FileStats)
+	err := r.eachParsedTemplate(func(t *template.Template, path string, entry, defined bool) error {
+		fs, ok := files[path]
+		if !ok {
+			fs = &FileStats{Path: path}
+			if content, err := ioutil.ReadFile(path); err == nil {
+				fs.Lines = bytes.Count(content, []byte("\n"))
+				if len(content) > 0 && content[len(content)-1] != '\n' {
+					fs.Lines++
+				}
+			}
+			files[path] = fs
+		}
+		if defined {
+			fs.Defines++
+			if _, ok := stats.DefinedIn[t.Name()]; !ok {
+				stats.DefinedIn[t.Name()] = path
+			}
+		}
+		stats.measure(t.Tree, fs, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fs := range files {
+		stats.Files = append(stats.Files, *fs)
+	}
+	sort.Slice(stats.Files, func(i, j int) bool {
+		return stats.Files[i].Path < stats.Files[j].Path
+	})
+	return stats, nil
+}
+
+// eachParsedTemplate parses every input along with the preloads, without
+// executing anything, and calls fn once for every template of every file it
+// parsed, with the path of that file. Entry is set for the template of an
+// input, and defined for those of a `define`.
+func (r *Renderer) eachParsedTemplate(fn func(t *template.Template, path string, entry, defined bool) error) error {
+	jail, err := newPathJail(r.Root)
+	if err != nil {
+		return err
+	}
+	r.jail = jail
+	r.funcs = nil
+
+	jobs, err := r.plan(r.Inputs, "-")
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, job := range jobs {
+		if job.copy || job.link != "" {
+			continue
+		}
+		inames := append(append([]string{}, r.PreloadFiles...), job.input)
+		if r.isPage(job.input) {
+			page, err := r.readPage(job.input)
+			if err != nil {
+				return err
+			}
+			inames[len(inames)-1] = page.layout
+		}
+		tpl, _, err := r.parse(inames)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range tpl.Templates() {
+			if t.Tree == nil {
+				continue
+			}
+			path := parsedFilePath(t.Tree.ParseName, inames)
+			// Preloads and layouts are parsed along with every input, but
+			// only count once
+			key := path + "\x00" + t.Name()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			entry := t.Name() == tpl.Name()
+			if err := fn(t, path, entry, !entry && !isFileTemplate(t.Name(), inames)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// measure adds what tree uses to the stats, and its complexity to fs. Dot is
+// the top-level values in entry templates only.
+func (s *TemplateStats) measure(tree *parse.Tree, fs *FileStats, entry bool) {
+	walkNodes(tree.Root, entry, func(n parse.Node, _ bool) {
+		switch tn := n.(type) {
+		case *parse.ActionNode, *parse.TemplateNode:
+			fs.Actions++
+		case *parse.IfNode, *parse.RangeNode, *parse.WithNode:
+			fs.Actions++
+			fs.Branches++
+		case *parse.IdentifierNode:
+			s.Funcs[tn.Ident]++
+		}
+	})
+	for _, ref := range valueRefs(tree, entry) {
+		s.Values["."+strings.Join(ref.Path, ".")]++
+	}
+	for _, tn := range templateRefs(tree) {
+		s.Templates[tn.Name]++
+	}
+	for _, name := range includeRefs(tree) {
+		s.Templates[name]++
+	}
+	if d := nestingDepth(tree.Root); d > fs.Depth {
+		fs.Depth = d
+	}
+}
+
+// nestingDepth returns how deeply if, range, and with nest under n.
+func nestingDepth(n parse.Node) int {
+	depth := 0
+	switch tn := n.(type) {
+	case *parse.ListNode:
+		if tn == nil {
+			return 0
+		}
+		for _, c := range tn.Nodes {
+			if d := nestingDepth(c); d > depth {
+				depth = d
+			}
+		}
+		return depth
+	case *parse.IfNode:
+		return 1 + branchDepth(&tn.BranchNode)
+	case *parse.RangeNode:
+		return 1 + branchDepth(&tn.BranchNode)
+	case *parse.WithNode:
+		return 1 + branchDepth(&tn.BranchNode)
+	}
+	return 0
+}
+
+func branchDepth(b *parse.BranchNode) int {
+	depth := nestingDepth(b.List)
+	if b.ElseList != nil {
+		// An else if nests as deep as the if it continues
+		if d := nestingDepth(b.ElseList); d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// runTemplateStats prints the stats of the inputs of r, and returns the
+// process exit code.
+func runTemplateStats(r *Renderer) int {
+	stats, err := r.Analyze()
+	if err != nil {
+		r.logf(LogError, "%v", err)
+		return 1
+	}
+	if err := stats.Print(os.Stdout); err != nil {
+		r.logf(LogError, "%v", err)
+		return 1
+	}
+	return 0
+}
+
+// Print writes the stats as tables, most used first.
+func (s *TemplateStats) Print(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	printCounts(w, "FUNCTION", s.Funcs)
+	printCounts(w, "VALUE", s.Values)
+
+	named := make(map[string]int, len(s.DefinedIn))
+	for name := range s.DefinedIn {
+		named[name] = s.Templates[name]
+	}
+	printCounts(w, "TEMPLATE", named)
+
+	fmt.Fprintln(w, "FILE\tLINES\tACTIONS\tBRANCHES\tDEPTH\tDEFINES")
+	for _, fs := range s.Files {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", fs.Path, fs.Lines, fs.Actions, fs.Branches, fs.Depth, fs.Defines)
+	}
+	if unused := s.Unused(); len(unused) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "NEVER INVOKED\tDEFINED IN")
+		for _, name := range unused {
+			fmt.Fprintf(w, "%s\t%s\n", name, s.DefinedIn[name])
+		}
+	}
+	return w.Flush()
+}
+
+// printCounts writes a table of counts, most first, and then by name.
+func printCounts(w io.Writer, title string, counts map[string]int) {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintf(w, "%s\tUSES\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%d\n", name, counts[name])
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultConfigFile is the config file of named render targets read by the
+// run command.
+const DefaultConfigFile = "tpl.yaml"
+
+// runConfig is a config file of named render targets, of the groups they are
+// rendered in, and of the transformations applied to the values of every one
+// of them.
+type runConfig struct {
+	Targets    map[string]runTarget `yaml:"targets"`
+	Groups     []runGroup           `yaml:"groups"`
+	Transforms []transformStep      `yaml:"transforms"`
+}
+
+// runGroup is a named group of targets, rendered in order, one group after
+// the other. Pre commands run before the targets of the group, post commands
+// after all of them were rendered, and onchange commands after that, if any
+// of their outputs changed.
+type runGroup struct {
+	Name     string   `yaml:"name"`
+	Targets  []string `yaml:"targets"`
+	Pre      []string `yaml:"pre"`
+	Post     []string `yaml:"post"`
+	OnChange []string `yaml:"onchange"`
+}
+
+// runTarget is one render of a config file, holding what would otherwise be
+// given on the command line.
+type runTarget struct {
+	Inputs     []string               `yaml:"inputs"`
+	Preload    []string               `yaml:"preload"`
+	Values     []string               `yaml:"values"`
+	Value      map[string]string      `yaml:"value"`
+	Out        string                 `yaml:"out"`
+	Delimiters []string               `yaml:"delimiters"`
+	Options    map[string]interface{} `yaml:"options"`
+}
+
+func loadRunConfig(fname string) (*runConfig, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var c runConfig
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return nil, fmt.Errorf("Cannot parse %s: %v", fname, err)
+	}
+	if len(c.Targets) == 0 {
+		return nil, fmt.Errorf("%s defines no targets", fname)
+	}
+	if err := c.checkGroups(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return &c, nil
+}
+
+// checkGroups checks that every group has a name of its own, which is not
+// that of a target, and only lists targets that exist, and are in no other
+// group.
+func (c *runConfig) checkGroups() error {
+	names := make(map[string]bool)
+	grouped := make(map[string]string)
+	for i, g := range c.Groups {
+		if g.Name == "" {
+			return fmt.Errorf("group %d has no name", i+1)
+		}
+		if names[g.Name] {
+			return fmt.Errorf("group %q is defined twice", g.Name)
+		}
+		if _, ok := c.Targets[g.Name]; ok {
+			return fmt.Errorf("group %q has the name of a target", g.Name)
+		}
+		names[g.Name] = true
+		if len(g.Targets) == 0 {
+			return fmt.Errorf("group %q lists no targets", g.Name)
+		}
+		for _, t := range g.Targets {
+			if _, ok := c.Targets[t]; !ok {
+				return fmt.Errorf("group %q lists no target %q", g.Name, t)
+			}
+			if other, ok := grouped[t]; ok {
+				return fmt.Errorf("target %q is in both groups %q and %q", t, other, g.Name)
+			}
+			grouped[t] = g.Name
+		}
+	}
+	return nil
+}
+
+// group returns the group called name, if any.
+func (c *runConfig) group(name string) *runGroup {
+	for i := range c.Groups {
+		if c.Groups[i].Name == name {
+			return &c.Groups[i]
+		}
+	}
+	return nil
+}
+
+// plan returns what the run command renders for names: each group named, and
+// each target named, on its own, in the order they are given. Without names,
+// it is every group, in the order of the config file, and then every target
+// in no group, in the order of their names.
+func (c *runConfig) plan(names []string) ([]runGroup, error) {
+	var plan []runGroup
+	for _, name := range names {
+		if g := c.group(name); g != nil {
+			plan = append(plan, *g)
+		} else if _, ok := c.Targets[name]; ok {
+			plan = append(plan, runGroup{Targets: []string{name}})
+		} else {
+			return nil, fmt.Errorf("defines no target or group %q", name)
+		}
+	}
+	if len(names) > 0 {
+		return plan, nil
+	}
+	grouped := make(map[string]bool)
+	for _, g := range c.Groups {
+		plan = append(plan, g)
+		for _, t := range g.Targets {
+			grouped[t] = true
+		}
+	}
+	for name := range c.Targets {
+		if !grouped[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		plan = append(plan, runGroup{Targets: []string{name}})
+	}
+	return plan, nil
+}
+
+// args translates t into command line arguments, placing extra before the
+// inputs. Options are named after flags, and a list gives a flag once per
+// item.
+func (t runTarget) args(extra []string) ([]string, error) {
+	if len(t.Inputs) == 0 {
+		return nil, fmt.Errorf("no inputs")
+	}
+	var args []string
+	names := make(stringSorter, 0, len(t.Options))
+	for name := range t.Options {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+		switch v := t.Options[name].(type) {
+		case []interface{}:
+			for _, item := range v {
+				args = append(args, fmt.Sprintf("-%s=%v", name, item))
+			}
+		case nil:
+		default:
+			args = append(args, fmt.Sprintf("-%s=%v", name, v))
+		}
+	}
+	for _, p := range t.Preload {
+		args = append(args, "-preload="+p)
+	}
+	if len(t.Values) > 0 {
+		args = append(args, "-values="+strings.Join(t.Values, ","))
+	}
+	keys := make(stringSorter, 0, len(t.Value))
+	for k := range t.Value {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("-value=%s=%s", k, t.Value[k]))
+	}
+	if t.Out != "" {
+		args = append(args, "-out="+t.Out)
+	}
+	switch len(t.Delimiters) {
+	case 0:
+	case 2:
+		args = append(args, "-left-delim="+t.Delimiters[0], "-right-delim="+t.Delimiters[1])
+	default:
+		return nil, fmt.Errorf("delimiters must be a left and a right delimiter")
+	}
+	args = append(args, extra...)
+	return append(append(args, "--"), t.Inputs...), nil
+}
+
+// runTargets renders the named targets and groups of the config file in
+// fname, or all of them, stopping at the first that fails. Each target runs
+// as its own tpl process in the directory of the config file, with extra
+// arguments from the command line added to its own. With dryRun, the
+// commands of groups are logged instead of run. It returns the process exit
+// code.
+func runTargets(fname string, names, extra []string, dryRun bool) int {
+	c, err := loadRunConfig(fname)
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	plan, err := c.plan(names)
+	if err != nil {
+		logf(nil, LogError, "%s %v", fname, err)
+		return 1
+	}
+	self, err := os.Executable()
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	dir := filepath.Dir(fname)
+	for _, g := range plan {
+		if g.Name != "" {
+			logf(nil, LogInfo, "Running group %s", g.Name)
+		}
+		if err := runGroupCommands(g.Pre, dir, dryRun, "TPL_GROUP="+g.Name); err != nil {
+			logf(nil, LogError, "Group %s: %v", g.Name, err)
+			return 1
+		}
+		var changed []string
+		for _, name := range g.Targets {
+			var err error
+			if len(g.OnChange) > 0 {
+				var ch []string
+				ch, err = c.runTargetChanges(self, fname, name, extra)
+				changed = append(changed, ch...)
+			} else {
+				err = c.runTarget(self, fname, name, extra)
+			}
+			if err != nil {
+				logf(nil, LogError, "Target %s of %s: %v", name, fname, err)
+				return 1
+			}
+		}
+		if err := runGroupCommands(g.Post, dir, dryRun, "TPL_GROUP="+g.Name); err != nil {
+			logf(nil, LogError, "Group %s: %v", g.Name, err)
+			return 1
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if err := runGroupCommands(g.OnChange, dir, dryRun, "TPL_GROUP="+g.Name, "TPL_CHANGED="+strings.Join(changed, "\n")); err != nil {
+			logf(nil, LogError, "Group %s: %v", g.Name, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// runTarget renders the target called name, running self in the directory of
+// the config file in fname.
+func (c *runConfig) runTarget(self, fname, name string, extra []string) error {
+	target := c.Targets[name]
+	if _, ok := target.Options["transforms"]; !ok && len(c.Transforms) > 0 {
+		// The transforms of the config file apply, unless the target names
+		// its own
+		extra = append([]string{"-transforms=" + filepath.Base(fname)}, extra...)
+	}
+	args, err := target.args(extra)
+	if err != nil {
+		return err
+	}
+	logf(nil, LogInfo, "Running target %s", name)
+	cmd := exec.Command(self, args...)
+	cmd.Dir = filepath.Dir(fname)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed: %v", err)
+	}
+	return nil
+}
+
+// runTargetChanges renders the target called name like runTarget, and
+// returns the outputs it created or updated, as told by its run report.
+func (c *runConfig) runTargetChanges(self, fname, name string, extra []string) ([]string, error) {
+	for _, opt := range []string{"report", "report-file"} {
+		if _, ok := c.Targets[name].Options[opt]; ok {
+			return nil, fmt.Errorf("cannot tell which outputs changed, for onchange commands, when the target sets -%s", opt)
+		}
+	}
+	for _, arg := range extra {
+		if strings.HasPrefix(arg, "-report=") || strings.HasPrefix(arg, "-report-file=") {
+			return nil, errors.New("cannot tell which outputs changed, for onchange commands, with -report")
+		}
+	}
+	f, err := ioutil.TempFile("", "tpl-report-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	extra = append(append([]string(nil), extra...), "-report=json", "-report-file="+f.Name())
+	if err := c.runTarget(self, fname, name, extra); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	var rep RunReport
+	if err := json.Unmarshal(data, &rep); err != nil {
+		return nil, fmt.Errorf("Cannot read the report of the run: %v", err)
+	}
+	var changed []string
+	for _, e := range rep.Outputs {
+		if e.Status == "created" || e.Status == "updated" {
+			changed = append(changed, e.Output)
+		}
+	}
+	return changed, nil
+}
+
+// runGroupCommands runs each of cmds with `sh -c` in dir, with env added to
+// its environment, and its output sent to STDERR, as hooks are. With dryRun,
+// they are logged instead.
+func runGroupCommands(cmds []string, dir string, dryRun bool, env ...string) error {
+	for _, cmd := range cmds {
+		if dryRun {
+			logf(nil, LogInfo, "Would run %q", cmd)
+			continue
+		}
+		logf(nil, LogInfo, "Running %q", cmd)
+		c := exec.Command("sh", "-c", cmd)
+		c.Dir = dir
+		c.Env = append(os.Environ(), env...)
+		c.Stdout = os.Stderr
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("Command %q failed: %v", cmd, err)
+		}
+	}
+	return nil
+}
+
+// passedFlags returns the flags set on the command line, but those in skip,
+// as arguments.
+func passedFlags(skip ...string) []string {
+	var args []string
+	visitPassedFlags(skip, func(name, value string) {
+		args = append(args, fmt.Sprintf("-%s=%s", name, value))
+	})
+	return args
+}
+
+// flagPassed reports whether the flag name was set on the command line.
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		passed = passed || f.Name == name
+	})
+	return passed
+}
+
+// visitPassedFlags calls fn with every flag set on the command line, but
+// those in skip, once per value of flags that may be repeated.
+func visitPassedFlags(skip []string, fn func(name, value string)) {
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range skip {
+			if f.Name == name {
+				return
+			}
+		}
+		if fv, ok := f.Value.(*stringSliceFlag); ok {
+			for _, v := range *fv {
+				fn(f.Name, v)
+			}
+			return
+		}
+		if fv, ok := f.Value.(*valueMapFlag); ok {
+			for k, v := range *fv {
+				fn(f.Name, fmt.Sprintf("%s=%v", k, v))
+			}
+			return
+		}
+		fn(f.Name, f.Value.String())
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// transformStep is one step of the transformations applied to the merged
+// values before anything is rendered, so that templates see the same values
+// however their sources shape them. Each step does exactly one of:
+//
+//	rename:  {from: .db_pass, to: .db.password}   move a value
+//	compute: {path: .url, template: "..."}        derive a value
+//	compute: {path: .url, expr: "..."}
+//	drop:    [.debug, .legacy]                    remove values
+//	keep:    [.app, .db]                          remove all other values
+type transformStep struct {
+	Rename  *renameTransform  `yaml:"rename"`
+	Compute *computeTransform `yaml:"compute"`
+	Drop    []string          `yaml:"drop"`
+	Keep    []string          `yaml:"keep"`
+
+	// origin names the step in errors, and source in the sources of the
+	// values it sets
+	origin string
+	source string
+}
+
+type renameTransform struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// computeTransform sets the value at Path to Template, rendered with the
+// values as the earlier steps left them, or to what Expr evaluates to; see
+// parseExpr.
+type computeTransform struct {
+	Path     string `yaml:"path"`
+	Template string `yaml:"template"`
+	Expr     string `yaml:"expr"`
+
+	tpl  *template.Template
+	expr exprNode
+}
+
+// loadTransforms reads the steps listed in filename, either on their own or
+// under the `transforms` key of a config file of render targets.
+func loadTransforms(filename string) ([]transformStep, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read transforms file %s: %v", filename, err)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("cannot parse transforms file %s: %v", filename, err)
+	}
+	var steps []transformStep
+	if _, ok := doc.(map[interface{}]interface{}); ok {
+		var c runConfig
+		err = yaml.UnmarshalStrict(data, &c)
+		steps = c.Transforms
+	} else {
+		err = yaml.UnmarshalStrict(data, &steps)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse transforms file %s: %v", filename, err)
+	}
+	for i := range steps {
+		if err := steps[i].check(); err != nil {
+			return nil, fmt.Errorf("transform #%d in %s %v", i, filename, err)
+		}
+		steps[i].origin = fmt.Sprintf("Transform #%d in %s", i, filename)
+		steps[i].source = filename
+	}
+	return steps, nil
+}
+
+// parseDerivation parses a -derive flag, "PATH: EXPR", into the step
+// computing the value at PATH.
+func parseDerivation(s string) (transformStep, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return transformStep{}, fmt.Errorf("Invalid derivation %q; must be in the form of PATH: EXPR", s)
+	}
+	path := strings.TrimSpace(s[:i])
+	step := transformStep{
+		Compute: &computeTransform{Path: path, Expr: s[i+1:]},
+		origin:  "-derive",
+		source:  "-derive",
+	}
+	if err := step.check(); err != nil {
+		return transformStep{}, fmt.Errorf("Derivation of %s %v", path, err)
+	}
+	return step, nil
+}
+
+// check checks that the step does one thing, with all it needs to, and
+// parses its template.
+func (s *transformStep) check() error {
+	n := 0
+	for _, set := range []bool{s.Rename != nil, s.Compute != nil, s.Drop != nil, s.Keep != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("must have exactly one of 'rename', 'compute', 'drop', or 'keep'")
+	}
+	var paths []string
+	switch {
+	case s.Rename != nil:
+		paths = []string{s.Rename.From, s.Rename.To}
+	case s.Compute != nil:
+		paths = []string{s.Compute.Path}
+		var err error
+		switch {
+		case (s.Compute.Template == "") == (s.Compute.Expr == ""):
+			return fmt.Errorf("must compute with exactly one of 'template' or 'expr'")
+		case s.Compute.Expr != "":
+			if s.Compute.expr, err = parseExpr(s.Compute.Expr); err != nil {
+				return fmt.Errorf("has an invalid expression: %v", err)
+			}
+		default:
+			s.Compute.tpl, err = template.New(s.Compute.Path).Funcs(funcMap()).Option("missingkey=error").Parse(s.Compute.Template)
+			if err != nil {
+				return fmt.Errorf("has an invalid template: %v", err)
+			}
+		}
+	case s.Drop != nil:
+		paths = s.Drop
+	default:
+		paths = s.Keep
+	}
+	for _, p := range paths {
+		if len(splitValuePath(p)) == 0 {
+			return fmt.Errorf("is missing a value path, e.g. .a.b")
+		}
+	}
+	return nil
+}
+
+// transform applies steps, in order, to v, recording in sources where the
+// values they set came from.
+func (v Values) transform(steps []transformStep, sources map[string]string) error {
+	for _, s := range steps {
+		switch {
+		case s.Rename != nil:
+			from, to := splitValuePath(s.Rename.From), splitValuePath(s.Rename.To)
+			val, ok := takeValue(v, from)
+			if !ok {
+				return fmt.Errorf("%s cannot rename %s, which is missing", s.origin, s.Rename.From)
+			}
+			setValue(v, to, val)
+			sources[to[0]] = s.source
+		case s.Compute != nil:
+			val, err := s.Compute.compute(v)
+			if err != nil {
+				return fmt.Errorf("%s cannot compute %s: %v", s.origin, s.Compute.Path, err)
+			}
+			path := splitValuePath(s.Compute.Path)
+			setValue(v, path, val)
+			sources[path[0]] = s.source
+		case s.Drop != nil:
+			for _, p := range s.Drop {
+				takeValue(v, splitValuePath(p))
+			}
+		default:
+			kept := make(Values)
+			for _, p := range s.Keep {
+				path := splitValuePath(p)
+				if val := lookupValue(v, path); val != nil {
+					setValue(kept, path, val)
+				}
+			}
+			for k := range v {
+				delete(v, k)
+			}
+			for k, val := range kept {
+				v[k] = val
+			}
+		}
+	}
+	for k := range sources {
+		if _, ok := v[k]; !ok {
+			delete(sources, k)
+		}
+	}
+	return nil
+}
+
+func (c *computeTransform) compute(v Values) (interface{}, error) {
+	if c.expr != nil {
+		return c.expr(v)
+	}
+	var buf bytes.Buffer
+	if err := c.tpl.Execute(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.String(), nil
+}
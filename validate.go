@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Validator checks the rendered content of an output before it is written.
+// The path is the output path, or "-" for STDOUT.
+type Validator func(path string, content []byte) error
+
+// builtinValidator returns the named syntax validator. Each only applies to
+// outputs with a matching extension.
+func builtinValidator(name string) (Validator, error) {
+	switch name {
+	case "json":
+		return extValidator([]string{".json"}, validateJSON), nil
+	case "yaml":
+		return extValidator([]string{".yaml", ".yml"}, validateYAML), nil
+	}
+	return nil, fmt.Errorf("unknown validator %q; must be one of: json, yaml", name)
+}
+
+func extValidator(exts []string, v Validator) Validator {
+	return func(path string, content []byte) error {
+		for _, ext := range exts {
+			if strings.EqualFold(filepath.Ext(path), ext) {
+				return v(path, content)
+			}
+		}
+		return nil
+	}
+}
+
+func validateJSON(path string, content []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+	}
+}
+
+func validateYAML(path string, content []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid YAML: %v", err)
+		}
+	}
+}
+
+// noValue is what text/template renders for a nil value.
+var noValue = []byte("<no value>")
+
+// checkNoValue fails if content contains "<no value>", which almost always
+// means a template referred to a value that was unexpectedly nil.
+func checkNoValue(content []byte) error {
+	i := bytes.Index(content, noValue)
+	if i < 0 {
+		return nil
+	}
+	line := bytes.Count(content[:i], []byte("\n")) + 1
+	return fmt.Errorf("output contains %q on line %d", noValue, line)
+}
+
+// commandValidator runs an external command against each output. The content
+// is written to a temporary file with the same extension as the output, and
+// every `{}` in the command line is replaced by that file's path. The command
+// line is split on whitespace; it is not interpreted by a shell. Temporary
+// files are created in ws.
+func commandValidator(cmdline string, ws *Workspace) (Validator, error) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("validation command must not be blank")
+	}
+	return func(path string, content []byte) error {
+		tmp, err := ws.TempFile("validate-*" + filepath.Ext(path))
+		if err != nil {
+			return err
+		}
+		tmpname := tmp.Name()
+		if !ws.keep() {
+			defer os.Remove(tmpname)
+		}
+		_, err = tmp.Write(content)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+
+		argv := make([]string, len(args))
+		for i, a := range args {
+			argv[i] = strings.Replace(a, "{}", tmpname, -1)
+		}
+		out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %v\n%s", cmdline, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}, nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 )
 
@@ -36,3 +38,80 @@ func (m *valueMapFlag) Set(value string) error {
 	(*m)[c[0]] = c[1]
 	return nil
 }
+
+type fileModeFlag os.FileMode
+
+func (m *fileModeFlag) String() string {
+	return fmt.Sprintf("%#o", os.FileMode(*m))
+}
+
+func (m *fileModeFlag) Set(value string) error {
+	n, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || n > 0777 {
+		return fmt.Errorf("Mode %q must be an octal permission such as 0644", value)
+	}
+	*m = fileModeFlag(n)
+	return nil
+}
+
+// sizeFlag is a size in bytes, which may be given with a K, M, or G suffix
+// (powers of 1024), e.g. "10M". Zero means no limit.
+type sizeFlag int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	scale  int64
+}{
+	{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+}
+
+func (s *sizeFlag) String() string {
+	n := int64(*s)
+	for _, ss := range sizeSuffixes {
+		if n != 0 && n%ss.scale == 0 {
+			return fmt.Sprintf("%d%s", n/ss.scale, ss.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func (s *sizeFlag) Set(value string) error {
+	v := strings.TrimSuffix(strings.ToUpper(value), "B")
+	scale := int64(1)
+	for _, ss := range sizeSuffixes {
+		if strings.HasSuffix(v, ss.suffix) {
+			v, scale = strings.TrimSuffix(v, ss.suffix), ss.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("Size %q must be a number of bytes, optionally followed by K, M, or G", value)
+	}
+	*s = sizeFlag(n * scale)
+	return nil
+}
+
+// backupFlag is a suffix that may be left out, e.g. both `-backup` and
+// `-backup=.orig` are accepted.
+type backupFlag string
+
+func (b *backupFlag) String() string {
+	return string(*b)
+}
+
+func (b *backupFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*b = DefaultBackupSuffix
+	case "false":
+		*b = ""
+	default:
+		*b = backupFlag(value)
+	}
+	return nil
+}
+
+func (b *backupFlag) IsBoolFlag() bool {
+	return true
+}
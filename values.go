@@ -1,11 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
-
-	yaml "gopkg.in/yaml.v2"
+	"strings"
 )
 
 // Values is the merged key-value pairs
@@ -14,33 +12,139 @@ type Values map[string]interface{}
 // LoadFile will load the contents of fname, parse it for key-value pairs,
 // and merge them into the current object.
 func (v Values) LoadFile(fname string) error {
-	if fname == "" {
-		return fmt.Errorf("Filename must not be empty")
-	}
-	log.Printf("Loading values from %s\n", fname)
-	// Slurp the data file as one byteslice
-	data, err := ioutil.ReadFile(fname)
-	if err != nil {
-		return fmt.Errorf("Cannot read file %s: %v", fname, err)
-	}
-	err = v.Load(data)
-	if err != nil {
-		return fmt.Errorf("Cannot parse values from %s: %v", fname, err)
-	}
-	return nil
+	return newValuesLoader(DefaultMaxIncludeDepth, nil).LoadInto(v, fname)
 }
 
 // Load will parse the data string for key-value pairs, and merge them into
-// the current object.
+// the current object. Included files are resolved relative to the current
+// directory.
 func (v Values) Load(data []byte) error {
-	// Parse the data file into values
-	values := make(map[string]interface{})
-	if err := yaml.Unmarshal(data, &values); err != nil {
+	doc, err := newValuesLoader(DefaultMaxIncludeDepth, nil).decode(data, ".", 0)
+	if err != nil {
 		return err
 	}
+	return v.merge("data", doc)
+}
+
+// merge copies the top-level keys of a decoded document into v.
+func (v Values) merge(src string, doc interface{}) error {
+	if doc == nil {
+		return nil
+	}
+	m, ok := doc.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot parse values from %s: expected a mapping at the top level, got %T", src, doc)
+	}
 	// Merge top level only
-	for km, vm := range values {
-		v[km] = vm
+	for km, vm := range m {
+		v[fmt.Sprintf("%v", km)] = vm
 	}
 	return nil
 }
+
+// valueMap returns data as a map of values, if it is one. A nil data is an
+// empty map.
+func valueMap(data interface{}) (map[string]interface{}, bool) {
+	switch m := data.(type) {
+	case nil:
+		return nil, true
+	case map[string]interface{}:
+		return m, true
+	case Values:
+		return m, true
+	}
+	return nil, false
+}
+
+// plainData converts typed data, such as a struct, into the maps and lists
+// it encodes to as JSON, which is how its fields are named in a schema.
+func plainData(data interface{}) (interface{}, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot convert %T to check it: %v", data, err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// splitScheme splits a values source into its scheme and the remainder. Plain
+// paths have the "file" scheme.
+func splitScheme(src string) (string, string) {
+	if i := strings.Index(src, "://"); i > 0 {
+		return src[:i], src[i+3:]
+	}
+	return "file", src
+}
+
+func joinValuePath(path, key string) string {
+	if path == "." {
+		return "." + key
+	}
+	return path + "." + key
+}
+
+// normalizeValue converts YAML-decoded values into their JSON equivalents:
+// maps are keyed by strings and all numbers are float64.
+func normalizeValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(tv))
+		for k, e := range tv {
+			m[fmt.Sprintf("%v", k)] = normalizeValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(tv))
+		for k, e := range tv {
+			m[k] = normalizeValue(e)
+		}
+		return m
+	case Values:
+		return normalizeValue(map[string]interface{}(tv))
+	case map[string]string:
+		m := make(map[string]interface{}, len(tv))
+		for k, e := range tv {
+			m[k] = e
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(tv))
+		for i, e := range tv {
+			l[i] = normalizeValue(e)
+		}
+		return l
+	case int:
+		return float64(tv)
+	case int64:
+		return float64(tv)
+	case uint64:
+		return float64(tv)
+	case float32:
+		return float64(tv)
+	}
+	return v
+}
+
+// lookupPath returns the value found by following path through nested maps.
+func lookupPath(v interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		var ok bool
+		switch m := v.(type) {
+		case Values:
+			v, ok = m[key]
+		case map[string]interface{}:
+			v, ok = m[key]
+		case map[interface{}]interface{}:
+			v, ok = m[key]
+		case map[string]string:
+			v, ok = m[key]
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
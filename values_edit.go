@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// yamlKeyPattern matches a line holding a key of a block mapping, with the
+// rest of the line after the colon.
+var yamlKeyPattern = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"{\[\-][^:#]*?|-[^\s:#][^:#]*?)\s*:(\s.*)?$`)
+
+// yamlEntry locates a key in the lines of a YAML file, along with the lines
+// of the value nested under it.
+type yamlEntry struct {
+	start, end int
+	indent     int
+	key        string
+
+	// inline is the value that follows the key on its own line, if any.
+	inline string
+}
+
+// yamlEntries lists every key of the block mappings in lines, keyed by its
+// path. Keys under list items and inside block scalars are left out, as no
+// value path can name them.
+func yamlEntries(lines []string) map[string]*yamlEntry {
+	type level struct {
+		indent int
+		key    string
+		entry  *yamlEntry
+	}
+	entries := make(map[string]*yamlEntry)
+	var stack []level
+	scalar := -1
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+		trimmed = strings.TrimRight(trimmed, " \t\r\n")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if scalar < 0 || indent <= scalar {
+			scalar = -1
+			for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		for _, l := range stack {
+			if l.entry != nil {
+				l.entry.end = i + 1
+			}
+		}
+		if scalar >= 0 {
+			continue
+		}
+		if trimmed == "---" || trimmed == "..." {
+			stack = nil
+			continue
+		}
+		m := yamlKeyPattern.FindStringSubmatch(trimmed)
+		if m == nil {
+			// A list item, or a scalar continued from the line above
+			stack = append(stack, level{indent: indent})
+			continue
+		}
+		key := m[1]
+		if len(key) > 1 && (key[0] == '"' || key[0] == '\'') {
+			key = key[1 : len(key)-1]
+		}
+		inline := strings.TrimSpace(m[2])
+		if j := strings.Index(inline, " #"); j >= 0 || strings.HasPrefix(inline, "#") {
+			if j < 0 {
+				j = 0
+			}
+			inline = strings.TrimSpace(inline[:j])
+		}
+		if strings.HasPrefix(inline, "|") || strings.HasPrefix(inline, ">") {
+			scalar = indent
+		}
+
+		path := ""
+		reachable := true
+		for _, l := range stack {
+			if l.entry == nil {
+				reachable = false
+				break
+			}
+			path += "." + l.key
+		}
+		e := &yamlEntry{start: i, end: i + 1, indent: indent, key: key, inline: inline}
+		stack = append(stack, level{indent: indent, key: key, entry: e})
+		if reachable {
+			path += "." + key
+			if _, ok := entries[path]; !ok {
+				entries[path] = e
+			}
+		}
+	}
+	return entries
+}
+
+// renameYAMLValue moves the value at the path from to the path to in the
+// lines of a YAML file, keeping its comments and formatting. It reports
+// whether the file sets the value at all.
+func renameYAMLValue(content []byte, from, to []string) ([]byte, bool, error) {
+	lines := strings.SplitAfter(string(content), "\n")
+	entries := yamlEntries(lines)
+	fromPath, toPath := "."+strings.Join(from, "."), "."+strings.Join(to, ".")
+	e, ok := entries[fromPath]
+	if !ok {
+		return content, false, nil
+	}
+	if _, ok := entries[toPath]; ok {
+		return nil, true, fmt.Errorf("cannot rename %s to %s, which is already set", fromPath, toPath)
+	}
+
+	// Renaming a key in place keeps it where it is
+	if strings.Join(from[:len(from)-1], ".") == strings.Join(to[:len(to)-1], ".") {
+		lines[e.start] = renameYAMLKey(lines[e.start], e.indent, to[len(to)-1])
+		return []byte(strings.Join(lines, "")), true, nil
+	}
+
+	// New parents are indented like the rest of the file
+	step := 0
+	for _, c := range entries {
+		if c.indent > 0 && (step == 0 || c.indent < step) {
+			step = c.indent
+		}
+	}
+	if step == 0 {
+		step = 2
+	}
+
+	// Comments right above the key go along with it, unless they head the
+	// file
+	keyAt, start := e.start, e.start
+	for start > 0 && isYAMLFiller(lines[start-1]) && strings.TrimSpace(lines[start-1]) != "" && len(lines[start-1])-len(strings.TrimLeft(lines[start-1], " ")) == e.indent {
+		start--
+	}
+	if start > 0 {
+		e.start = start
+	}
+	block := append([]string{}, lines[e.start:e.end]...)
+	lines = append(lines[:e.start:e.start], lines[e.end:]...)
+	// Parents left empty would turn into nulls
+	for k := len(from) - 1; k > 0; k-- {
+		entries = yamlEntries(lines)
+		p := entries["."+strings.Join(from[:k], ".")]
+		if p == nil || p.end > p.start+1 || p.inline != "" {
+			break
+		}
+		lines = append(lines[:p.start:p.start], lines[p.end:]...)
+	}
+
+	entries = yamlEntries(lines)
+	// Insert under the deepest parent of the new path that exists, creating
+	// the others
+	at, indent, k := len(lines), 0, len(to)-1
+	for ; k > 0; k-- {
+		p := entries["."+strings.Join(to[:k], ".")]
+		if p == nil {
+			continue
+		}
+		if p.inline != "" {
+			return nil, true, fmt.Errorf("cannot rename %s to %s, as .%s is not a map", fromPath, toPath, strings.Join(to[:k], "."))
+		}
+		// Children go as deep as those already there
+		at, indent = p.end, -1
+		for _, c := range entries {
+			if c.start > p.start && c.start < p.end && (indent < 0 || c.indent < indent) {
+				indent = c.indent
+			}
+		}
+		if indent < 0 && p.end > p.start+1 {
+			return nil, true, fmt.Errorf("cannot rename %s to %s, as .%s is not a map", fromPath, toPath, strings.Join(to[:k], "."))
+		}
+		if indent < 0 {
+			indent = p.indent + step
+		}
+		step = indent - p.indent
+		break
+	}
+	if k == 0 {
+		// Keep the blank lines and comments at the end of the file there
+		for at > 0 && isYAMLFiller(lines[at-1]) {
+			at--
+		}
+	}
+	if at > 0 && !strings.HasSuffix(lines[at-1], "\n") {
+		lines[at-1] += "\n"
+	}
+
+	var inserted []string
+	for ; k < len(to)-1; k++ {
+		inserted = append(inserted, strings.Repeat(" ", indent)+to[k]+":\n")
+		indent += step
+	}
+	block[keyAt-e.start] = renameYAMLKey(block[keyAt-e.start], e.indent, to[len(to)-1])
+	for _, line := range block {
+		switch {
+		case indent > e.indent && strings.TrimSpace(line) != "":
+			line = strings.Repeat(" ", indent-e.indent) + line
+		case indent < e.indent:
+			n := len(line) - len(strings.TrimLeft(line, " "))
+			if n > e.indent-indent {
+				n = e.indent - indent
+			}
+			line = line[n:]
+		}
+		inserted = append(inserted, line)
+	}
+	if last := len(inserted) - 1; !strings.HasSuffix(inserted[last], "\n") {
+		inserted[last] += "\n"
+	}
+	lines = append(lines[:at], append(inserted, lines[at:]...)...)
+	return []byte(strings.Join(lines, "")), true, nil
+}
+
+// renameYAMLKey replaces the key on a line of a YAML file whose indentation
+// is indent.
+func renameYAMLKey(line string, indent int, key string) string {
+	m := yamlKeyPattern.FindStringSubmatchIndex(strings.TrimRight(line[indent:], "\r\n"))
+	return line[:indent] + key + line[indent+m[3]:]
+}
+
+func isYAMLFiller(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// jsonObject is a JSON object that keeps the order of its keys, so that a
+// file can be edited and written back without shuffling it.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+
+	// raw is the object as it was parsed, until it is changed, and inline
+	// whether it was on a single line.
+	raw    []byte
+	inline bool
+}
+
+// jsonList is a JSON array, along with how it was parsed.
+type jsonList struct {
+	items  []interface{}
+	raw    []byte
+	inline bool
+}
+
+func (o *jsonObject) get(key string) (interface{}, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+// set replaces the value of key, or adds it last.
+func (o *jsonObject) set(key string, v interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = v
+	o.raw = nil
+}
+
+func (o *jsonObject) remove(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+	o.raw = nil
+}
+
+// rename changes the key of a value, keeping its place.
+func (o *jsonObject) rename(from, to string) {
+	for i, k := range o.keys {
+		if k == from {
+			o.keys[i] = to
+		}
+	}
+	o.values[to] = o.values[from]
+	delete(o.values, from)
+	o.raw = nil
+}
+
+// object returns the object at key, creating it if create is set.
+func (o *jsonObject) object(key string, create bool) *jsonObject {
+	if v, ok := o.values[key].(*jsonObject); ok {
+		return v
+	}
+	if _, ok := o.values[key]; ok || !create {
+		return nil
+	}
+	v := &jsonObject{values: make(map[string]interface{})}
+	o.set(key, v)
+	return v
+}
+
+// parseOrderedJSON decodes a JSON document, with objects as *jsonObject,
+// arrays as *jsonList, and numbers as json.Number.
+func parseOrderedJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeOrderedJSON(dec, data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the top-level value")
+	}
+	return v, nil
+}
+
+func decodeOrderedJSON(dec *json.Decoder, data []byte) (interface{}, error) {
+	start := dec.InputOffset()
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	// The offset before a value may still be before the separator from the
+	// key or value that came before it
+	raw := func() []byte {
+		return bytes.TrimLeft(data[start:dec.InputOffset()], " \t\r\n:,")
+	}
+	switch tok {
+	case json.Delim('{'):
+		o := &jsonObject{values: make(map[string]interface{})}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := decodeOrderedJSON(dec, data)
+			if err != nil {
+				return nil, err
+			}
+			o.set(key.(string), v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		o.raw = raw()
+		o.inline = bytes.IndexByte(o.raw, '\n') < 0
+		return o, nil
+	case json.Delim('['):
+		list := &jsonList{items: []interface{}{}}
+		for dec.More() {
+			v, err := decodeOrderedJSON(dec, data)
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		list.raw = raw()
+		list.inline = bytes.IndexByte(list.raw, '\n') < 0
+		return list, nil
+	}
+	return tok, nil
+}
+
+// jsonUnchanged reports whether v and everything under it are as parsed.
+func jsonUnchanged(v interface{}) bool {
+	switch tv := v.(type) {
+	case *jsonObject:
+		if tv.raw == nil {
+			return false
+		}
+		for _, key := range tv.keys {
+			if !jsonUnchanged(tv.values[key]) {
+				return false
+			}
+		}
+	case *jsonList:
+		if tv.raw == nil {
+			return false
+		}
+		for _, item := range tv.items {
+			if !jsonUnchanged(item) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// formatOrderedJSON encodes v like json.MarshalIndent does, with the keys of
+// objects in their order, and what was not changed since it was parsed as it
+// was. Objects and arrays that were on a single line stay so.
+func formatOrderedJSON(v interface{}, indent string) []byte {
+	var buf bytes.Buffer
+	writeOrderedJSON(&buf, v, indent, "\n")
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// writeOrderedJSON writes v, starting every line in it with prefix, or on a
+// single line if prefix is empty.
+func writeOrderedJSON(buf *bytes.Buffer, v interface{}, indent, prefix string) {
+	if jsonUnchanged(v) {
+		switch tv := v.(type) {
+		case *jsonObject:
+			buf.Write(tv.raw)
+			return
+		case *jsonList:
+			buf.Write(tv.raw)
+			return
+		}
+	}
+	inner, sep, end := prefix+indent, ",", prefix
+	if prefix == "" || jsonInline(v) {
+		inner, sep, end = "", ", ", ""
+	}
+	switch tv := v.(type) {
+	case *jsonObject:
+		if len(tv.keys) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+		buf.WriteByte('{')
+		for i, key := range tv.keys {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			buf.WriteString(inner)
+			writeJSONScalar(buf, key)
+			buf.WriteString(": ")
+			writeOrderedJSON(buf, tv.values[key], indent, inner)
+		}
+		buf.WriteString(end + "}")
+	case *jsonList:
+		if len(tv.items) == 0 {
+			buf.WriteString("[]")
+			return
+		}
+		buf.WriteByte('[')
+		for i, item := range tv.items {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			buf.WriteString(inner)
+			writeOrderedJSON(buf, item, indent, inner)
+		}
+		buf.WriteString(end + "]")
+	default:
+		writeJSONScalar(buf, v)
+	}
+}
+
+func jsonInline(v interface{}) bool {
+	switch tv := v.(type) {
+	case *jsonObject:
+		return tv.inline
+	case *jsonList:
+		return tv.inline
+	}
+	return false
+}
+
+func writeJSONScalar(buf *bytes.Buffer, v interface{}) {
+	var scalar bytes.Buffer
+	enc := json.NewEncoder(&scalar)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	buf.Write(bytes.TrimRight(scalar.Bytes(), "\n"))
+}
+
+// jsonIndent guesses the indentation of a JSON file from its second line,
+// defaulting to two spaces.
+func jsonIndent(data []byte) string {
+	lines := bytes.SplitN(data, []byte("\n"), 3)
+	if len(lines) > 1 {
+		if n := len(lines[1]) - len(bytes.TrimLeft(lines[1], " \t")); n > 0 {
+			return string(lines[1][:n])
+		}
+	}
+	return "  "
+}
+
+// renameJSONValue moves the value at the path from to the path to in a JSON
+// values file. It reports whether the file sets the value at all.
+func renameJSONValue(content []byte, from, to []string) ([]byte, bool, error) {
+	doc, err := parseOrderedJSON(content)
+	if err != nil {
+		return nil, false, err
+	}
+	root, ok := doc.(*jsonObject)
+	if !ok {
+		return content, false, nil
+	}
+	found, err := moveJSONPath(root, from, to)
+	if err != nil || !found {
+		return content, found, err
+	}
+	return formatOrderedJSON(root, jsonIndent(content)), true, nil
+}
+
+// moveJSONPath moves the value at the path from under the object root to
+// the path to, creating the objects it goes through.
+func moveJSONPath(root *jsonObject, from, to []string) (bool, error) {
+	fromPath, toPath := "."+strings.Join(from, "."), "."+strings.Join(to, ".")
+	parent := root
+	for _, key := range from[:len(from)-1] {
+		if parent = parent.object(key, false); parent == nil {
+			return false, nil
+		}
+	}
+	v, ok := parent.get(from[len(from)-1])
+	if !ok {
+		return false, nil
+	}
+
+	target := root
+	for i, key := range to[:len(to)-1] {
+		if target = target.object(key, true); target == nil {
+			return true, fmt.Errorf("cannot rename %s to %s, as .%s is not a map", fromPath, toPath, strings.Join(to[:i+1], "."))
+		}
+	}
+	if _, ok := target.get(to[len(to)-1]); ok {
+		return true, fmt.Errorf("cannot rename %s to %s, which is already set", fromPath, toPath)
+	}
+	if parent == target {
+		parent.rename(from[len(from)-1], to[len(to)-1])
+	} else {
+		parent.remove(from[len(from)-1])
+		target.set(to[len(to)-1], v)
+	}
+	return true, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var renameYAMLTests = []struct {
+	name     string
+	content  string
+	from, to string
+	expected string
+	found    bool
+	err      string
+}{
+	{
+		name:     "in-place",
+		content:  "# head\n\nport: 80\nname: app\n",
+		from:     ".port",
+		to:       ".listen",
+		expected: "# head\n\nlisten: 80\nname: app\n",
+		found:    true,
+	},
+	{
+		name:     "with-comment",
+		content:  "server:\n  # the port\n  port: 80\n  host: x\nname: app\n",
+		from:     ".server.port",
+		to:       ".listen.port",
+		expected: "server:\n  host: x\nname: app\nlisten:\n  # the port\n  port: 80\n",
+		found:    true,
+	},
+	{
+		name:     "empty-parent",
+		content:  "server:\n  port: 80\nname: app\n",
+		from:     ".server.port",
+		to:       ".port",
+		expected: "name: app\nport: 80\n",
+		found:    true,
+	},
+	{
+		name:     "into-parent",
+		content:  "db:\n    host: a\nport: 80\n",
+		from:     ".port",
+		to:       ".db.port",
+		expected: "db:\n    host: a\n    port: 80\n",
+		found:    true,
+	},
+	{
+		name:     "not-set",
+		content:  "name: app\n",
+		from:     ".port",
+		to:       ".listen",
+		expected: "name: app\n",
+	},
+	{name: "already-set", content: "port: 80\nname: app\n", from: ".port", to: ".name", err: "which is already set"},
+	{name: "not-a-map", content: "port: 80\nname: app\n", from: ".port", to: ".name.port", err: "as .name is not a map"},
+}
+
+func TestRenameYAMLValue(t *testing.T) {
+	for _, test := range renameYAMLTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			content, found, err := renameYAMLValue([]byte(test.content), splitValuePath(test.from), splitValuePath(test.to))
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected renaming to fail with %q, but it succeeded", test.err)
+			}
+			if found != test.found {
+				t.Errorf("Found the value: %v, expected %v", found, test.found)
+			}
+			if string(content) != test.expected {
+				t.Errorf("Renamed into %q, expected %q", content, test.expected)
+			}
+		})
+	}
+}
+
+var renameJSONTests = []struct {
+	name     string
+	content  string
+	from, to string
+	expected string
+	found    bool
+	err      string
+}{
+	{
+		name:     "in-place",
+		content:  "{\n  \"port\": 80,\n  \"name\": \"app\"\n}\n",
+		from:     ".port",
+		to:       ".listen",
+		expected: "{\n  \"listen\": 80,\n  \"name\": \"app\"\n}\n",
+		found:    true,
+	},
+	{
+		name:     "new-parent",
+		content:  "{\n    \"server\": {\"port\": 80},\n    \"name\": \"app\"\n}\n",
+		from:     ".server.port",
+		to:       ".listen.port",
+		expected: "{\n    \"server\": {},\n    \"name\": \"app\",\n    \"listen\": {\n        \"port\": 80\n    }\n}\n",
+		found:    true,
+	},
+	{name: "not-an-object", content: "[1]", from: ".port", to: ".x", expected: "[1]"},
+	{name: "already-set", content: `{"port": 80, "name": "app"}`, from: ".port", to: ".name", err: "which is already set"},
+	{name: "not-a-map", content: `{"port": 80, "name": "app"}`, from: ".port", to: ".name.x", err: "as .name is not a map"},
+}
+
+func TestRenameJSONValue(t *testing.T) {
+	for _, test := range renameJSONTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			content, found, err := renameJSONValue([]byte(test.content), splitValuePath(test.from), splitValuePath(test.to))
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected renaming to fail with %q, but it succeeded", test.err)
+			}
+			if found != test.found {
+				t.Errorf("Found the value: %v, expected %v", found, test.found)
+			}
+			if string(content) != test.expected {
+				t.Errorf("Renamed into %q, expected %q", content, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// cueTagPattern matches the `@tag(name)` attributes through which CUE files
+// take values from the command line.
+var cueTagPattern = regexp.MustCompile(`@tag\(\s*([A-Za-z_][A-Za-z0-9_]*)`)
+
+// evaluatorCommand returns the command evaluating fname into JSON, if it is a
+// Jsonnet or CUE file. Values given on the command line are passed as Jsonnet
+// external variables, e.g. `std.extVar("env")`, or as the CUE tags the file
+// declares, e.g. `env: string @tag(env)`.
+func (l *valuesLoader) evaluatorCommand(fname string) ([]string, error) {
+	keys := make(stringSorter, 0, len(l.extVars))
+	for k := range l.extVars {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".jsonnet":
+		args := []string{"jsonnet"}
+		for _, k := range keys {
+			args = append(args, "--ext-str", k+"="+l.extVars[k])
+		}
+		return append(args, fname), nil
+	case ".cue":
+		src, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read file %s: %v", fname, err)
+		}
+		tags := make(map[string]bool)
+		for _, m := range cueTagPattern.FindAllSubmatch(src, -1) {
+			tags[string(m[1])] = true
+		}
+		args := []string{"cue", "export", "--out", "json"}
+		for _, k := range keys {
+			if tags[k] {
+				args = append(args, "-t", k+"="+l.extVars[k])
+			}
+		}
+		return append(args, fname), nil
+	}
+	return nil, nil
+}
+
+// evaluate runs the evaluator args, returning the JSON it printed.
+func (l *valuesLoader) evaluate(args []string) ([]byte, error) {
+	bin, err := exec.LookPath(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("loading values from %s requires the %s CLI: %v", args[len(args)-1], args[0], err)
+	}
+	logf(l.logger, LogDebug, "Evaluating values with %q", args)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(bin, args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Cannot evaluate values from %s: %v\n%s", args[len(args)-1], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
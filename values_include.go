@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// DefaultMaxIncludeDepth bounds how deeply `!include` directives may nest.
+const DefaultMaxIncludeDepth = 10
+
+const (
+	includeSentinel      = "\x00tpl-include:"
+	includeMergeSentinel = "\x00tpl-include-merge"
+)
+
+// includeTagPattern matches the `!include path` tag a node starts with,
+// after the anchor of the node if any.
+var includeTagPattern = regexp.MustCompile(`^(?:&\S+\s+)?(!include\s+(?:"(?:[^"\\]|\\.)*"|'[^']*'|[^\s,\[\]{}#]+))`)
+
+// valuesLoader reads values files, resolving `!include` directives relative to
+// the including file.
+type valuesLoader struct {
+	maxDepth int
+	jail     *pathJail
+	stats    *RenderStats
+	secrets  *secretStore
+	logger   Logger
+
+	// extVars are passed to Jsonnet and CUE values files.
+	extVars map[string]string
+
+	// plugins maps the schemes of values sources served by plugins to their
+	// binaries.
+	plugins map[string]string
+
+	// sources maps each top-level key to the source it was last set by.
+	sources map[string]string
+
+	// health, if set, records how every load of a source went.
+	health *sourceHealth
+
+	// snapshots keeps the values last loaded from every optional source
+	// that falls back to them.
+	snapshots map[string]Values
+
+	// strictKeys fails a source mounted where another already set one of
+	// its keys, rather than letting it win; mounted maps the path of each
+	// key mounted so far to its source.
+	strictKeys bool
+	mounted    map[string]string
+}
+
+// sourceStatus is how the last load of a values source went.
+type sourceStatus struct {
+	Source     string    `json:"source"`
+	Loaded     time.Time `json:"loaded"`
+	DurationMS float64   `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// sourceHealth keeps the status of every values source loaded, for those
+// who report on them while values are loaded again.
+type sourceHealth struct {
+	mu     sync.Mutex
+	order  []string
+	status map[string]sourceStatus
+}
+
+func newSourceHealth() *sourceHealth {
+	return &sourceHealth{status: make(map[string]sourceStatus)}
+}
+
+func (h *sourceHealth) record(src string, start time.Time, err error) {
+	if h == nil {
+		return
+	}
+	st := sourceStatus{Source: src, Loaded: start, DurationMS: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.status[src]; !ok {
+		h.order = append(h.order, src)
+	}
+	h.status[src] = st
+}
+
+// statuses lists the status of every source, in the order they were first
+// loaded.
+func (h *sourceHealth) statuses() []sourceStatus {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]sourceStatus, 0, len(h.order))
+	for _, src := range h.order {
+		list = append(list, h.status[src])
+	}
+	return list
+}
+
+func newValuesLoader(maxDepth int, jail *pathJail) *valuesLoader {
+	return &valuesLoader{maxDepth: maxDepth, jail: jail, sources: make(map[string]string), snapshots: make(map[string]Values)}
+}
+
+// LoadInto loads the values source fname and merges its top-level keys into v,
+// or into the mapping it is mounted at. An optional source that fails to load
+// falls back as it asks; see splitSourceOptions.
+func (l *valuesLoader) LoadInto(v Values, fname string) error {
+	ref, opts, err := splitSourceOptions(fname)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if opts.Fallback == "" && !opts.reshapes() {
+		err := l.loadInto(v, ref, opts)
+		l.health.record(ref, start, err)
+		return err
+	}
+
+	// Nothing of a source that fails is merged, and where its keys end up
+	// is only known once it is reshaped
+	loaded, err := l.loadAside(ref, opts)
+	if err == nil {
+		err = loaded.rename(ref, opts.Renames)
+	}
+	l.health.record(ref, start, err)
+	if err != nil {
+		if opts.Fallback == "" {
+			return err
+		}
+		return l.fallBack(v, ref, opts, err)
+	}
+	if opts.Fallback == "cache" {
+		l.snapshots[ref] = loaded
+	}
+	return l.mount(v, ref, opts.Mount, loaded)
+}
+
+func (l *valuesLoader) loadInto(v Values, fname string, opts sourceOptions) error {
+	if fname == "" {
+		return fmt.Errorf("Filename must not be empty")
+	}
+	scheme, fpath := splitScheme(fname)
+	if isSecretScheme(scheme) {
+		return l.loadSecret(v, fname, opts)
+	}
+	if path, ok := l.plugins[scheme]; ok {
+		return l.loadPlugin(v, fname, path)
+	}
+	if scheme != "file" {
+		return fmt.Errorf("Unsupported values source %q", fname)
+	}
+	logf(l.logger, LogInfo, "Loading values from %s", fpath)
+	start := time.Now()
+	values, err := l.loadFile(fpath, 0)
+	if err != nil {
+		return err
+	}
+	l.stats.addSource(fname, time.Since(start))
+	if err := v.merge(fpath, values); err != nil {
+		return err
+	}
+	if m, ok := values.(map[interface{}]interface{}); ok && l.sources != nil {
+		for km := range m {
+			l.sources[fmt.Sprintf("%v", km)] = fpath
+		}
+	}
+	return nil
+}
+
+// loadSecret merges the keys of a structured secret into v, cached for as
+// long as opts asks, or else the secret store does.
+func (l *valuesLoader) loadSecret(v Values, ref string, opts sourceOptions) error {
+	if l.secrets == nil {
+		l.secrets = newSecretStore(nil)
+	}
+	logf(l.logger, LogInfo, "Loading values from %s", ref)
+	start := time.Now()
+	ttl, stale := l.secrets.ttl, l.secrets.stale
+	if opts.TTL > 0 {
+		ttl = opts.TTL
+	}
+	if opts.Stale > 0 {
+		stale = opts.Stale
+	}
+	secret, err := l.secrets.fetch(ref, ttl, stale)
+	if err != nil {
+		return err
+	}
+	m, ok := secret.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Cannot load values from %s: secret is not a JSON object", ref)
+	}
+	l.stats.addSource(ref, time.Since(start))
+	for km, vm := range m {
+		v[km] = vm
+		if l.sources != nil {
+			l.sources[km] = ref
+		}
+	}
+	return nil
+}
+
+// loadPlugin merges the keys of the values the plugin at path returns for ref
+// into v.
+func (l *valuesLoader) loadPlugin(v Values, ref, path string) error {
+	logf(l.logger, LogInfo, "Loading values from %s", ref)
+	start := time.Now()
+	m, err := loadPluginSource(path, ref)
+	if err != nil {
+		return err
+	}
+	l.stats.addSource(ref, time.Since(start))
+	for km, vm := range m {
+		v[km] = vm
+		if l.sources != nil {
+			l.sources[km] = ref
+		}
+	}
+	return nil
+}
+
+func (l *valuesLoader) loadFile(fname string, depth int) (interface{}, error) {
+	if depth > l.maxDepth {
+		return nil, fmt.Errorf("Cannot include %s: includes nested more than %d deep", fname, l.maxDepth)
+	}
+	if err := l.jail.Check(fname); err != nil {
+		return nil, err
+	}
+	if args, err := l.evaluatorCommand(fname); err != nil {
+		return nil, err
+	} else if args != nil {
+		data, err := l.evaluate(args)
+		if err != nil {
+			return nil, err
+		}
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("Cannot parse values from %s: %v", fname, err)
+		}
+		return doc, nil
+	}
+	// Slurp the data file as one byteslice
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read file %s: %v", fname, err)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(rewriteIncludes(data), &doc); err != nil {
+		return nil, fmt.Errorf("Cannot parse values from %s: %v", fname, err)
+	}
+	return l.resolve(doc, filepath.Dir(fname), depth)
+}
+
+// decode parses data as YAML, resolving includes relative to dir.
+func (l *valuesLoader) decode(data []byte, dir string, depth int) (interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(rewriteIncludes(data), &doc); err != nil {
+		return nil, err
+	}
+	return l.resolve(doc, dir, depth)
+}
+
+// rewriteIncludes replaces `!include` tags by sentinel strings that survive
+// decoding, as the YAML library drops unknown tags. The tags are found in the
+// parsed document, so that text within a scalar that only looks like one is
+// left alone.
+func rewriteIncludes(data []byte) []byte {
+	if !bytes.Contains(data, []byte("!include")) {
+		return data
+	}
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		// Left for the decoder to report
+		return data
+	}
+	lines := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	// offset returns where in data the node n starts.
+	offset := func(n *yaml3.Node) int {
+		off := lines[n.Line-1]
+		for col := 1; col < n.Column && off < len(data); col++ {
+			_, size := utf8.DecodeRune(data[off:])
+			off += size
+		}
+		return off
+	}
+
+	var edits []textEdit
+	include := func(n *yaml3.Node) {
+		off := offset(n)
+		if m := includeTagPattern.FindSubmatchIndex(data[off:]); m != nil {
+			edits = append(edits, textEdit{start: off + m[2], end: off + m[3], text: strconv.Quote(includeSentinel + n.Value)})
+		}
+	}
+	var walk func(n *yaml3.Node)
+	walk = func(n *yaml3.Node) {
+		if n.Kind == yaml3.ScalarNode && n.Tag == "!include" {
+			include(n)
+			return
+		}
+		if n.Kind != yaml3.MappingNode {
+			for _, c := range n.Content {
+				walk(c)
+			}
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Tag == "!!merge" && v.Kind == yaml3.ScalarNode && v.Tag == "!include" {
+				if off := offset(k); bytes.HasPrefix(data[off:], []byte("<<")) {
+					edits = append(edits, textEdit{start: off, end: off + 2, text: strconv.Quote(includeMergeSentinel)})
+				}
+				include(v)
+				continue
+			}
+			walk(k)
+			walk(v)
+		}
+	}
+	walk(&doc)
+	return applyEdits(data, edits)
+}
+
+// resolve replaces include sentinels within v by the contents of the files
+// they name. Keys merged in with `<<: !include` never override existing keys.
+func (l *valuesLoader) resolve(v interface{}, dir string, depth int) (interface{}, error) {
+	switch tv := v.(type) {
+	case string:
+		if !strings.HasPrefix(tv, includeSentinel) {
+			return tv, nil
+		}
+		fname := strings.TrimPrefix(tv, includeSentinel)
+		if !filepath.IsAbs(fname) {
+			fname = filepath.Join(dir, fname)
+		}
+		return l.loadFile(fname, depth+1)
+	case []interface{}:
+		for i, e := range tv {
+			r, err := l.resolve(e, dir, depth)
+			if err != nil {
+				return nil, err
+			}
+			tv[i] = r
+		}
+		return tv, nil
+	case map[interface{}]interface{}:
+		var merged map[interface{}]interface{}
+		for k, e := range tv {
+			r, err := l.resolve(e, dir, depth)
+			if err != nil {
+				return nil, err
+			}
+			if k == includeMergeSentinel {
+				m, ok := r.(map[interface{}]interface{})
+				if !ok {
+					return nil, fmt.Errorf("merge key '<<' requires an included mapping, got %T", r)
+				}
+				merged = m
+				delete(tv, k)
+				continue
+			}
+			tv[k] = r
+		}
+		for k, e := range merged {
+			if _, ok := tv[k]; !ok {
+				tv[k] = e
+			}
+		}
+		return tv, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var includeTests = []struct {
+	name     string
+	files    map[string]string
+	expected string
+	err      string
+}{
+	{
+		name: "include",
+		files: map[string]string{
+			"values.yaml":  "db: !include db/main.yaml\nlist: [!include 'db/port.yaml', &p !include \"db/port.yaml\"]\n",
+			"db/main.yaml": "host: localhost\nport: !include port.yaml\n",
+			"db/port.yaml": "5432\n",
+		},
+		expected: "map[db:map[host:localhost port:5432] list:[5432 5432]]",
+	},
+	{
+		name: "merge-key",
+		files: map[string]string{
+			"values.yaml": "app:\n  name: web\n  <<: !include base.yaml\n",
+			"base.yaml":   "name: base\nport: 80\n",
+		},
+		expected: "map[app:map[name:web port:80]]",
+	},
+	{
+		name: "merge-key-not-mapping",
+		files: map[string]string{
+			"values.yaml": "app:\n  <<: !include base.yaml\n",
+			"base.yaml":   "[1, 2]\n",
+		},
+		err: "merge key '<<' requires an included mapping",
+	},
+	{
+		name: "depth",
+		files: map[string]string{
+			"values.yaml": "a: !include 1.yaml\n",
+			"1.yaml":      "b: !include 2.yaml\n",
+			"2.yaml":      "c: !include 3.yaml\n",
+			"3.yaml":      "d: 1\n",
+		},
+		err: "Cannot include 3.yaml: includes nested more than 2 deep",
+	},
+	{
+		name: "cycle",
+		files: map[string]string{
+			"values.yaml": "a: !include a.yaml\n",
+			"a.yaml":      "b: !include values.yaml\n",
+		},
+		err: "includes nested more than 2 deep",
+	},
+	{
+		name: "missing",
+		files: map[string]string{
+			"values.yaml": "a: !include missing.yaml\n",
+		},
+		err: "Cannot read file missing.yaml",
+	},
+
+	// Text that only looks like a tag is left alone
+	{
+		name: "quoted-scalar",
+		files: map[string]string{
+			"values.yaml": "msg: \"see !include docs\"\nplain: use !include x\n",
+		},
+		expected: "map[msg:see !include docs plain:use !include x]",
+	},
+	{
+		name: "block-scalar",
+		files: map[string]string{
+			"values.yaml": "script: |\n  !include x\n  <<: !include y\ncount: 1\n",
+		},
+		expected: "map[count:1 script:!include x\n<<: !include y\n]",
+	},
+	{
+		name: "comment",
+		files: map[string]string{
+			"values.yaml": "count: 1 # or !include count.yaml\n",
+		},
+		expected: "map[count:1]",
+	},
+}
+
+func TestIncludes(t *testing.T) {
+	for _, test := range includeTests {
+		test := test // range capture
+		t.Run(test.name, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "tpl-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpdir)
+			if err := os.Chdir(tmpdir); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range test.files {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			v := Values{}
+			l := newValuesLoader(2, nil)
+			l.logger = &logRecorder{}
+			err = l.LoadInto(v, "values.yaml")
+			if err != nil {
+				if test.err == "" {
+					t.Fatalf("Unexpected error: %v", err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Different error; got %q, expected %q", err, test.err)
+				}
+				return
+			} else if test.err != "" {
+				t.Fatalf("Expected loading to fail with %q, but it succeeded", test.err)
+			}
+			if got := fmt.Sprint(map[string]interface{}(v)); got != test.expected {
+				t.Errorf("Loaded %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
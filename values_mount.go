@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// sourceRename moves the value at From, in what a values source loaded, to
+// To.
+type sourceRename struct {
+	From []string
+	To   []string
+}
+
+// reshapes reports whether the values of the source are renamed, or mounted
+// elsewhere than at the top level.
+func (o sourceOptions) reshapes() bool {
+	return len(o.Mount) > 0 || len(o.Renames) > 0
+}
+
+// splitSourceMount splits a values source ending in "@.PATH" into its
+// reference and the path its values are mounted at. An "@" that is not
+// followed by a value path is part of the reference.
+func splitSourceMount(src string) (string, []string) {
+	i := strings.LastIndex(src, "@.")
+	if i < 0 {
+		return src, nil
+	}
+	p := src[i+1:]
+	if strings.ContainsAny(p, "/\\") || strings.Contains(p, "..") || (p != "." && strings.HasSuffix(p, ".")) {
+		return src, nil
+	}
+	return src[:i], splitValuePath(p)
+}
+
+// parseSourceRename parses ".FROM:.TO" into a rename.
+func parseSourceRename(s string) (sourceRename, bool) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return sourceRename{}, false
+	}
+	from, to := splitValuePath(s[:i]), splitValuePath(s[i+1:])
+	if len(from) == 0 || len(to) == 0 {
+		return sourceRename{}, false
+	}
+	for _, key := range append(append([]string(nil), from...), to...) {
+		if key == "" {
+			return sourceRename{}, false
+		}
+	}
+	return sourceRename{From: from, To: to}, true
+}
+
+// rename applies renames, in order, to the values the source ref loaded.
+func (v Values) rename(ref string, renames []sourceRename) error {
+	for _, rn := range renames {
+		val, ok := takeValue(v, rn.From)
+		if !ok {
+			return fmt.Errorf("Cannot rename .%s of values source %s, which has no such value", strings.Join(rn.From, "."), ref)
+		}
+		setValue(v, rn.To, val)
+	}
+	return nil
+}
+
+// mount merges the keys of loaded, which the source ref loaded, into the
+// mapping at path in v, or into v itself without a path. The mappings along
+// the way are copied rather than changed, as other sources may share them.
+// With strictKeys, a key that is already at path fails the mount.
+func (l *valuesLoader) mount(v Values, ref string, path []string, loaded Values) error {
+	if len(path) == 0 {
+		for k, val := range loaded {
+			v[k] = val
+			if l.sources != nil {
+				l.sources[k] = ref
+			}
+		}
+		return nil
+	}
+	target, ok := copyMap(lookupValue(v, path))
+	if !ok {
+		target = make(map[string]interface{}, len(loaded))
+	}
+	prefix := "." + strings.Join(path, ".") + "."
+	keys := make([]string, 0, len(loaded))
+	for k := range loaded {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, taken := target[k]; taken && l.strictKeys {
+			prev := l.mounted[prefix+k]
+			if prev == "" {
+				if prev = l.sources[path[0]]; prev == "" {
+					prev = "an earlier source"
+				}
+			}
+			return fmt.Errorf("Value %s is set by both %s and %s, which is mounted at .%s; with -strict-keys, neither may win", prefix+k, prev, ref, strings.Join(path, "."))
+		}
+		target[k] = loaded[k]
+		if l.mounted == nil {
+			l.mounted = make(map[string]string)
+		}
+		l.mounted[prefix+k] = ref
+	}
+	setValue(v, path, target)
+	if l.sources != nil {
+		l.sources[path[0]] = ref
+	}
+	return nil
+}
+
+// loadAside loads the values source ref on its own, without merging it into
+// any other values, nor recording where its keys came from.
+func (l *valuesLoader) loadAside(ref string, opts sourceOptions) (Values, error) {
+	loaded := make(Values)
+	sources := l.sources
+	l.sources = nil
+	defer func() { l.sources = sources }()
+	if err := l.loadInto(loaded, ref, opts); err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// copyMap returns a copy of v, if it is a mapping.
+func copyMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			c[k] = e
+		}
+		return c, true
+	case Values:
+		return copyMap(map[string]interface{}(m))
+	case map[interface{}]interface{}:
+		c := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			c[fmt.Sprintf("%v", k)] = e
+		}
+		return c, true
+	}
+	return nil, false
+}
+
+// lookupValue returns the value at path in v, or nil if there is none.
+func lookupValue(v interface{}, path []string) interface{} {
+	for _, key := range path {
+		m, ok := copyMap(v)
+		if !ok {
+			return nil
+		}
+		if v, ok = m[key]; !ok {
+			return nil
+		}
+	}
+	return v
+}
+
+// setValue sets the value at path in m, copying the mappings along the way,
+// and replacing whatever is not a mapping.
+func setValue(m map[string]interface{}, path []string, v interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := copyMap(m[key])
+		if !ok {
+			next = make(map[string]interface{})
+		}
+		m[key] = next
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// takeValue removes the value at path from m, copying the mappings along the
+// way, and returns it.
+func takeValue(m map[string]interface{}, path []string) (interface{}, bool) {
+	v, ok := m[path[0]]
+	if !ok {
+		return nil, false
+	}
+	if len(path) == 1 {
+		delete(m, path[0])
+		return v, true
+	}
+	next, ok := copyMap(v)
+	if !ok {
+		return nil, false
+	}
+	if v, ok = takeValue(next, path[1:]); ok {
+		m[path[0]] = next
+	}
+	return v, ok
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sort"
+	"text/template"
+)
+
+// skipsMissing reports whether any of srcs may fail to load, leaving out the
+// outputs that use its values.
+func skipsMissing(srcs []string) bool {
+	for _, src := range srcs {
+		if _, opts, _ := splitSourceOptions(src); opts.Fallback == "skip" || opts.Fallback == "cache" {
+			return true
+		}
+	}
+	return false
+}
+
+// fallBack merges into v what the optional source ref falls back to, once it
+// failed to load with err. The values it last loaded are mounted where its
+// own are; another source is mounted where it asks itself.
+func (l *valuesLoader) fallBack(v Values, ref string, opts sourceOptions, err error) error {
+	fallback := opts.Fallback
+	switch fallback {
+	case "cache":
+		snapshot, ok := l.snapshots[ref]
+		if !ok {
+			logf(l.logger, LogWarn, "Cannot load values from %s, which never loaded before; leaving out the outputs that use its values: %v", ref, err)
+			return nil
+		}
+		logf(l.logger, LogWarn, "Cannot load values from %s, using those it last loaded instead: %v", ref, err)
+		return l.mount(v, ref, opts.Mount, snapshot)
+	case "skip":
+		logf(l.logger, LogWarn, "Cannot load values from %s; leaving out the outputs that use its values: %v", ref, err)
+		return nil
+	}
+	logf(l.logger, LogWarn, "Cannot load values from %s, loading %s instead: %v", ref, fallback, err)
+	fref, mount := splitSourceMount(fallback)
+	if mount == nil {
+		return l.loadInto(v, fref, sourceOptions{})
+	}
+	loaded, err := l.loadAside(fref, sourceOptions{})
+	if err != nil {
+		return err
+	}
+	return l.mount(v, fref, mount, loaded)
+}
+
+// missingValues lists the top-level values that tpl uses, sorted, which data
+// lacks.
+func missingValues(tpl *template.Template, data interface{}) []string {
+	m, ok := valueMap(data)
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var missing []string
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		for _, ref := range valueRefs(t.Tree, t.Name() == tpl.Name()) {
+			key := ref.Path[0]
+			if _, ok := m[key]; ok || seen[key] {
+				continue
+			}
+			seen[key] = true
+			missing = append(missing, "."+key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
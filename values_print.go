@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// redactedValue replaces values loaded from secrets in printed values.
+const redactedValue = "<redacted>"
+
+// printedValues formats the merged values as YAML or JSON. With sources, it
+// also shows which source set each top-level key: as a comment above the key
+// in YAML, or as a "sources" object next to the "values" in JSON. Keys set by
+// secrets are redacted.
+func printedValues(values Values, sources map[string]string, format string, showSources bool) ([]byte, error) {
+	shown := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if scheme, _ := splitScheme(sources[k]); isSecretScheme(scheme) {
+			v = redactedValue
+		}
+		shown[k] = normalizeValue(v)
+	}
+
+	switch format {
+	case "json":
+		var doc interface{} = shown
+		if showSources {
+			origins := make(map[string]string, len(shown))
+			for k := range shown {
+				origins[k] = valueSource(sources, k)
+			}
+			doc = map[string]interface{}{"values": shown, "sources": origins}
+		}
+		out, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(out, '\n'), nil
+	case "yaml":
+		if !showSources {
+			return yaml.Marshal(shown)
+		}
+		keys := make(stringSorter, 0, len(shown))
+		for k := range shown {
+			keys = append(keys, k)
+		}
+		sort.Sort(keys)
+		var buf bytes.Buffer
+		for _, k := range keys {
+			out, err := yaml.Marshal(map[string]interface{}{k: shown[k]})
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "# from %s\n%s", valueSource(sources, k), out)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("Unknown values format %q; must be yaml or json", format)
+}
+
+// valueSource names the source of the top-level key k.
+func valueSource(sources map[string]string, k string) string {
+	if src, ok := sources[k]; ok {
+		return src
+	}
+	return "unknown"
+}
+
+// runValues prints the merged values to out, or STDOUT, and returns the
+// process exit code.
+func runValues(values Values, sources map[string]string, format string, showSources bool, out string) int {
+	doc, err := printedValues(values, sources, format, showSources)
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	if out == "" || out == "-" {
+		os.Stdout.Write(doc)
+		return 0
+	}
+	if err := ioutil.WriteFile(out, doc, 0644); err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	logf(nil, LogInfo, "Wrote values to %s", out)
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sourceOptions are the options a values source may end in, after a "?" and
+// separated by "&", e.g. "vault://secret/app?ttl=5m&stale=1h&optional=cache".
+type sourceOptions struct {
+	// Fallback is what an optional source falls back to when it fails to
+	// load, or "" for a source that must load:
+	//
+	//	?optional            skip, as below
+	//	?optional=skip       leave out the outputs that use a value missing
+	//	                     without it
+	//	?optional=cache      the values it last loaded, or else skip
+	//	?optional=dev.yaml   another values source
+	Fallback string
+
+	// TTL and Stale, for remote sources, replace -cache-ttl and
+	// -cache-stale.
+	TTL   time.Duration
+	Stale time.Duration
+	// Mount is where the values of the source are merged, from a source
+	// ending in "@.PATH" before its options, or nil for the top level.
+	// Renames, from "?rename=.FROM:.TO", are applied to them before.
+	Mount   []string
+	Renames []sourceRename
+}
+
+// splitSourceOptions splits a values source into its reference and its
+// options. A "?" that is not followed by options is part of the reference.
+func splitSourceOptions(src string) (string, sourceOptions, error) {
+	ref, opts, err := splitSourceQuery(src)
+	if err != nil {
+		return "", opts, err
+	}
+	ref, opts.Mount = splitSourceMount(ref)
+	return ref, opts, nil
+}
+
+func splitSourceQuery(src string) (string, sourceOptions, error) {
+	var opts sourceOptions
+	i := strings.LastIndex(src, "?")
+	if i < 0 {
+		return src, opts, nil
+	}
+	for _, opt := range strings.Split(src[i+1:], "&") {
+		key, value := opt, ""
+		if j := strings.Index(opt, "="); j >= 0 {
+			key, value = opt[:j], opt[j+1:]
+		}
+		switch key {
+		case "optional":
+			opts.Fallback = value
+			if value == "" {
+				opts.Fallback = "skip"
+			}
+		case "ttl", "stale":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return "", opts, fmt.Errorf("Invalid %s %q of values source %s; must be a duration, e.g. 5m", key, value, src[:i])
+			}
+			if key == "ttl" {
+				opts.TTL = d
+			} else {
+				opts.Stale = d
+			}
+		case "rename":
+			rn, ok := parseSourceRename(value)
+			if !ok {
+				return "", opts, fmt.Errorf("Invalid rename %q of values source %s; must be in the form of .FROM:.TO", value, src[:i])
+			}
+			opts.Renames = append(opts.Renames, rn)
+		default:
+			return src, sourceOptions{}, nil
+		}
+	}
+	return src[:i], opts, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// readManifest reads the manifest in fname for the verify command, which,
+// unlike a run, cannot do without one.
+func readManifest(fname string) (*buildManifest, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var m buildManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Cannot parse manifest %s: %v", fname, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("Manifest %s is of version %d, rather than %d; render again to update it", fname, m.Version, manifestVersion)
+	}
+	return &m, nil
+}
+
+// verifyOutput returns how oname differs from what the manifest recorded of
+// it: "missing", "modified", or "" when it is unchanged.
+func verifyOutput(oname string, e manifestEntry) (string, error) {
+	content, err := ioutil.ReadFile(oname)
+	if os.IsNotExist(err) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != e.Output {
+		return "modified", nil
+	}
+	return "", nil
+}
+
+// runVerify checks every output recorded in the manifest in fname, or only
+// those named, against the file on disk, printing those that drifted. It
+// returns the process exit code, which is 1 when any output drifted.
+func runVerify(fname string, names []string) int {
+	if fname == "" {
+		logf(nil, LogError, "The verify command requires -manifest=FILE")
+		return 1
+	}
+	m, err := readManifest(fname)
+	if err != nil {
+		logf(nil, LogError, "%v", err)
+		return 1
+	}
+	if len(names) == 0 {
+		for oname := range m.Outputs {
+			names = append(names, oname)
+		}
+		sort.Strings(names)
+	}
+
+	drifted := 0
+	for _, oname := range names {
+		e, ok := m.Outputs[oname]
+		if !ok {
+			logf(nil, LogError, "%s is not recorded in %s", oname, fname)
+			return 1
+		}
+		status, err := verifyOutput(oname, e)
+		if err != nil {
+			logf(nil, LogError, "%v", err)
+			return 1
+		}
+		if status == "" {
+			logf(nil, LogDebug, "%s is unchanged", oname)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", status, oname)
+		drifted++
+	}
+	if drifted > 0 {
+		logf(nil, LogWarn, "%d of %d output(s) differ from %s", drifted, len(names), fname)
+		return 1
+	}
+	logf(nil, LogInfo, "All %d output(s) match %s", len(names), fname)
+	return 0
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileOwner is the user and group that outputs and created directories are
+// given, for another user to read them, as the app container reading what an
+// init container rendered into a shared volume. Either ID is -1 to keep it.
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// parseOwner parses the -owner flag, "USER[:GROUP]" or ":GROUP", where
+// either is a name or a numeric ID. Names are looked up in the user database
+// of the system tpl runs on, so that numeric IDs are what work in a container
+// whose app user only exists in another image.
+func parseOwner(s string) (*FileOwner, error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("-owner is not supported on Windows")
+	}
+	owner := &FileOwner{UID: -1, GID: -1}
+	name, group := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, group = s[:i], s[i+1:]
+	}
+	if name == "" && group == "" {
+		return nil, fmt.Errorf("Invalid -owner %q; must be USER[:GROUP]", s)
+	}
+	if name != "" {
+		uid, err := strconv.Atoi(name)
+		if err != nil {
+			u, lerr := user.Lookup(name)
+			if lerr != nil {
+				return nil, fmt.Errorf("Invalid -owner %q: %v", s, lerr)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		owner.UID = uid
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, lerr := user.LookupGroup(group)
+			if lerr != nil {
+				return nil, fmt.Errorf("Invalid -owner %q: %v", s, lerr)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		owner.GID = gid
+	}
+	if owner.UID < -1 || owner.GID < -1 {
+		return nil, fmt.Errorf("Invalid -owner %q; IDs must not be negative", s)
+	}
+	return owner, nil
+}
+
+// own gives name, a file or directory just written, the owner of the sink,
+// and the exact permissions mode, regardless of the umask, which is that of
+// the writer rather than the reader. It does nothing without an owner.
+func (s *fileSink) own(name string, mode os.FileMode) error {
+	if s.owner == nil {
+		return nil
+	}
+	if err := os.Chmod(name, mode); err != nil {
+		return fmt.Errorf("Cannot change the permissions of %q: %v", name, err)
+	}
+	if err := os.Chown(name, s.owner.UID, s.owner.GID); err != nil {
+		return fmt.Errorf("Cannot change the owner of %q: %v", name, err)
+	}
+	return nil
+}
+
+// replaceAttributes gives tmpname, written to replace the output name, the
+// permissions of the file it replaces, and when running as root, its owner
+// and group, as writing into that file would have kept them; a secret
+// rendered as 0600 stays 0600. With an owner, tmpname is given that owner
+// and mode instead. New files keep the mode they were created with.
+func (s *fileSink) replaceAttributes(tmpname, name string, mode os.FileMode) error {
+	if s.owner != nil {
+		return s.own(tmpname, mode)
+	}
+	fi, err := os.Stat(name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	if err := os.Chmod(tmpname, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("Cannot change the permissions of %q: %v", tmpname, err)
+	}
+	if uid, gid, ok := fileOwnerOf(fi); ok && os.Geteuid() == 0 {
+		if err := os.Chown(tmpname, uid, gid); err != nil {
+			return fmt.Errorf("Cannot change the owner of %q: %v", tmpname, err)
+		}
+	}
+	return nil
+}
+
+// ownLink gives the symbolic link name itself the owner of the sink.
+func (s *fileSink) ownLink(name string) error {
+	if s.owner == nil {
+		return nil
+	}
+	if err := os.Lchown(name, s.owner.UID, s.owner.GID); err != nil {
+		return fmt.Errorf("Cannot change the owner of %q: %v", name, err)
+	}
+	return nil
+}
+
+// mkdirAll creates dir with its missing parents, like os.MkdirAll, and then
+// gives each directory it created the owner of the sink. Every directory an
+// entry was added to is remembered, to be synced.
+func (s *fileSink) mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, s.dirMode); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := s.own(missing[i], s.dirMode); err != nil {
+			return err
+		}
+		s.synced(filepath.Dir(missing[i]))
+	}
+	return nil
+}
+
+// synced remembers that an entry was added to, or replaced in, dir.
+func (s *fileSink) synced(dir string) {
+	if !s.sync {
+		return
+	}
+	if s.unsynced == nil {
+		s.unsynced = make(map[string]bool)
+	}
+	s.unsynced[dir] = true
+}
+
+// syncDirs flushes every directory entries were added to or replaced in to
+// disk, deepest first, so that outputs renamed into place survive a crash of
+// the machine, and are all there for a reader started after tpl exits.
+func (s *fileSink) syncDirs() error {
+	dirs := make([]string, 0, len(s.unsynced))
+	for dir := range s.unsynced {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		f, err := os.Open(dir)
+		if err == nil {
+			err = f.Sync()
+			f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot sync directory %q: %v", dir, err)
+		}
+		delete(s.unsynced, dir)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// walkConcurrency bounds the number of directories read at the same time.
+const walkConcurrency = 16
+
+// renderJob is a single output of a run: an input rendered as a template, or
+// copied verbatim when copy is set.
+type renderJob struct {
+	input    string
+	output   string
+	defaults map[string]interface{}
+	copy     bool
+	mode     os.FileMode
+
+	// link is set to the target of a symlink that is reproduced, rather
+	// than followed.
+	link string
+
+	// fromDir is set for files found by walking a directory, as opposed to
+	// those named on the command line.
+	fromDir bool
+}
+
+// plan expands directories in inputs into the jobs that render them, in
+// order. Inputs keep their command line order, while the entries of each
+// directory are sorted by name. Directories are read in parallel.
+func (r *Renderer) plan(inputs []string, out string) ([]renderJob, error) {
+	w := &walker{r: r, sem: make(chan struct{}, walkConcurrency)}
+	for _, fn := range r.PreloadFiles {
+		if err := r.jail.Check(fn); err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkInputSize(fn, fi.Size()); err != nil {
+			return nil, err
+		}
+	}
+
+	jobs := []renderJob{}
+	for _, fn := range inputs {
+		if err := r.jail.Check(fn); err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if err := r.checkInputSize(fn, fi.Size()); err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, renderJob{input: fn, output: r.getOutputPath(out, filepath.Base(fn))})
+			continue
+		}
+		nested, err := w.walk(fn, out, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, nested...)
+	}
+	for _, m := range r.Mappings {
+		if err := r.jail.Check(m.Input); err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(m.Input)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return nil, fmt.Errorf("Cannot map the directory %s to an output; map each of its templates", m.Input)
+		}
+		if err := r.checkInputSize(m.Input, fi.Size()); err != nil {
+			return nil, err
+		}
+		output := m.Output
+		if strings.HasSuffix(output, "/") {
+			output = filepath.Join(output, r.outputName(filepath.Base(m.Input)))
+		}
+		jobs = append(jobs, renderJob{input: m.Input, output: output})
+	}
+	return jobs, nil
+}
+
+// OutputMapping renders a template into an output of its own, rather than
+// one under the output path of the run.
+type OutputMapping struct {
+	Input  string
+	Output string
+}
+
+// parseOutputMapping parses a mapping in the form of input=output.
+func parseOutputMapping(s string) (OutputMapping, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return OutputMapping{}, fmt.Errorf("Invalid mapping %q; must be in the form of input=output", s)
+	}
+	return OutputMapping{Input: s[:i], Output: s[i+1:]}, nil
+}
+
+type walker struct {
+	r   *Renderer
+	sem chan struct{}
+}
+
+// walk plans the jobs for every file under dir, recursing into
+// subdirectories concurrently. The results of each entry are kept in their
+// own slot, so that the order does not depend on scheduling. parents lists
+// the directories being walked above dir, to detect symlink loops.
+func (w *walker) walk(dir, out string, defaults map[string]interface{}, parents []string) ([]renderJob, error) {
+	w.sem <- struct{}{}
+	entries, err := os.ReadDir(dir)
+	<-w.sem
+	if err != nil {
+		if w.r.SkipUnreadable && os.IsPermission(err) {
+			w.r.logf(LogWarn, "skipping unreadable directory %s: %v", dir, err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	r := w.r
+	if r.DirDefaults {
+		if defaults, err = r.loadDirDefaults(dir, defaults); err != nil {
+			return nil, err
+		}
+	}
+
+	outpath := out
+	if strings.HasSuffix(out, "/") {
+		outpath = outpath + filepath.Base(dir) + "/"
+	}
+
+	parents = append(parents[:len(parents):len(parents)], dir)
+	results := make([][]renderJob, len(entries))
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		name := e.Name()
+		if r.DirDefaults && isDirDefaultsFile(name) {
+			continue
+		}
+		fn := filepath.Join(dir, name)
+		if err := r.jail.Check(fn); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		// Only symlinks need another stat to learn what they point at; the
+		// type of every other entry comes with the directory listing.
+		isDir := e.IsDir()
+		var fi os.FileInfo
+		if e.Type()&os.ModeSymlink != 0 {
+			switch r.Symlinks {
+			case "skip":
+				r.logf(LogInfo, "Skipping symlink %s", fn)
+				continue
+			case "preserve":
+				target, err := os.Readlink(fn)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				if !filepath.IsAbs(target) {
+					target = r.getOutputPath(filepath.Dir(target)+"/", filepath.Base(target))
+				}
+				results[i] = []renderJob{{input: fn, output: r.getOutputPath(outpath, name), link: target, fromDir: true}}
+				continue
+			}
+			if fi, err = os.Stat(fn); err != nil {
+				errs[i] = err
+				continue
+			}
+			isDir = fi.IsDir()
+			if isDir {
+				if loop, err := symlinkLoop(fn, parents); err != nil || loop != "" {
+					if err == nil {
+						r.logf(LogWarn, "skipping symlink %s, which loops back to %s", fn, loop)
+					}
+					errs[i] = err
+					continue
+				}
+			}
+		}
+
+		if !isDir && r.SkipUnreadable && !readable(fn) {
+			r.logf(LogWarn, "skipping unreadable file %s", fn)
+			continue
+		}
+
+		copy := r.CopyNonTemplates && !r.isTemplateFile(name) && !r.isPage(name)
+		if !isDir && !copy && r.BinaryFiles != "render" {
+			binary, err := isBinaryFile(fn)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			if binary && r.BinaryFiles == "skip" {
+				r.logf(LogWarn, "skipping binary file %s", fn)
+				continue
+			}
+			copy = binary
+		}
+
+		switch {
+		case isDir:
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = w.walk(fn, outpath, defaults, parents)
+			}(i)
+		case copy:
+			if fi == nil {
+				if fi, err = e.Info(); err != nil {
+					errs[i] = err
+					continue
+				}
+			}
+			results[i] = []renderJob{{input: fn, output: r.getOutputPath(outpath, name), copy: true, mode: fi.Mode().Perm(), fromDir: true}}
+		default:
+			if r.MaxInputSize > 0 {
+				if fi == nil {
+					if fi, err = e.Info(); err != nil {
+						errs[i] = err
+						continue
+					}
+				}
+				if errs[i] = r.checkInputSize(fn, fi.Size()); errs[i] != nil {
+					continue
+				}
+			}
+			results[i] = []renderJob{{input: fn, output: r.getOutputPath(outpath, name), defaults: defaults, fromDir: true}}
+		}
+	}
+	wg.Wait()
+
+	jobs := []renderJob{}
+	for i := range entries {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		jobs = append(jobs, results[i]...)
+	}
+	return jobs, nil
+}
+
+// symlinkLoop returns the directory among parents that the symlink fn points
+// back to, if any.
+func symlinkLoop(fn string, parents []string) (string, error) {
+	target, err := filepath.EvalSymlinks(fn)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range parents {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return "", err
+		}
+		if real == target {
+			return p, nil
+		}
+	}
+	return "", nil
+}
+
+// checkInputSize returns an error if the template fn, of the given size, is
+// larger than MaxInputSize.
+func (r *Renderer) checkInputSize(fn string, size int64) error {
+	if r.MaxInputSize > 0 && size > r.MaxInputSize {
+		limit := sizeFlag(r.MaxInputSize)
+		return fmt.Errorf("Template %s is %d bytes, which is more than the limit of %s; raise -max-input-size if it really is a template", fn, size, limit.String())
+	}
+	return nil
+}
+
+// readable reports whether fn may be opened for reading. Errors other than
+// a denied permission are left to be reported when fn is rendered.
+func readable(fn string) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		return !os.IsPermission(err)
+	}
+	f.Close()
+	return true
+}
+
+// checkPlan verifies that every output of a plan may be written, and that no
+// two files found in directories would be written to the same output. Files
+// named on the command line may still share an output, into which they are
+// concatenated in order.
+func (r *Renderer) checkPlan(jobs []renderJob, out string) error {
+	owners := make(map[string]renderJob)
+	for _, job := range jobs {
+		if job.output == "-" {
+			continue
+		}
+		if err := r.sink.Check(job.output); err != nil {
+			return err
+		}
+		if job.link != "" && !r.canLink {
+			return fmt.Errorf("Cannot preserve symlink %s: symlinks can only be written to a directory", job.input)
+		}
+		name := filepath.Clean(job.output)
+		if prev, ok := owners[name]; ok {
+			if (prev.fromDir || job.fromDir) && name != filepath.Clean(out) {
+				return fmt.Errorf("Conflicting outputs: both %s and %s would be written to %s", prev.input, job.input, job.output)
+			}
+			continue
+		}
+		owners[name] = job
+	}
+
+	// An output cannot also be the parent directory of another output
+	for _, job := range jobs {
+		if job.output == "-" {
+			continue
+		}
+		name := filepath.Clean(job.output)
+		for dir := filepath.Dir(name); dir != name; name, dir = dir, filepath.Dir(dir) {
+			if prev, ok := owners[dir]; ok {
+				return fmt.Errorf("Conflicting outputs: %s would be written to %s, which %s needs to be a directory", prev.input, prev.output, job.input)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// whenTag starts a condition header, a template comment on the first line of
+// a template, or the first line after its front matter:
+//
+//	{{/* tpl:when .features.metrics */}}
+//
+// The template is left out of the run unless the condition, a pipeline as in
+// an if action, holds for the values.
+const whenTag = "tpl:when "
+
+// splitWhen returns the condition of the header of data, if any, and data
+// with the line ending of the header moved into its comment, so that the
+// header leaves neither a blank line in the output nor line numbers off.
+func splitWhen(data []byte, left, right string) (string, []byte) {
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	start := 0
+	if fm, _ := splitFrontMatter(data); fm != nil {
+		for start = 1; !bytes.Equal(bytes.TrimRight(lines[start], "\r\n"), frontMatterDelim); start++ {
+		}
+		start++
+	}
+	if start >= len(lines) {
+		return "", data
+	}
+	line := lines[start]
+	text := bytes.TrimRight(line, "\r\n")
+	comment := strings.TrimSpace(string(text))
+	if !strings.HasPrefix(comment, left) || !strings.HasSuffix(comment, right) {
+		return "", data
+	}
+	// The header may trim spaces around it, as any comment
+	inner := strings.TrimSuffix(strings.TrimPrefix(comment, left), right)
+	inner = strings.TrimSuffix(strings.TrimPrefix(inner, "- "), " -")
+	if !strings.HasPrefix(inner, "/*") || !strings.HasSuffix(inner, "*/") {
+		return "", data
+	}
+	inner = strings.TrimSpace(inner[2 : len(inner)-2])
+	if !strings.HasPrefix(inner, whenTag) {
+		return "", data
+	}
+	cond := strings.TrimSpace(strings.TrimPrefix(inner, whenTag))
+
+	var body bytes.Buffer
+	body.Write(bytes.Join(lines[:start], nil))
+	body.WriteString(left + "/* " + inner + " " + string(line[len(text):]) + "*/" + right)
+	body.Write(bytes.Join(lines[start+1:], nil))
+	return cond, body.Bytes()
+}
+
+// evalWhen tells whether cond, the condition of iname, holds for values.
+// Missing values do not hold, rather than failing the run.
+func (r *Renderer) evalWhen(cond, iname string, values interface{}) (bool, error) {
+	left, right := r.LeftDelim, r.RightDelim
+	if left == "" {
+		left = "{{"
+	}
+	if right == "" {
+		right = "}}"
+	}
+	tpl := template.New(iname).Delims(left, right).Funcs(r.templateFuncs()).Option("missingkey=zero")
+	if _, err := tpl.Parse(left + "if " + cond + right + "true" + left + "end" + right); err != nil {
+		return false, fmt.Errorf("Invalid condition %q of %s: %v", cond, iname, err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, values); err != nil {
+		if strings.Contains(err.Error(), "nil pointer evaluating") {
+			return false, nil
+		}
+		return false, fmt.Errorf("Cannot evaluate condition %q of %s: %v", cond, iname, err)
+	}
+	return buf.Len() > 0, nil
+}
+
+// conditionalJobs leaves the jobs of templates whose condition headers do not
+// hold out of jobs, before any template is parsed.
+func (r *Renderer) conditionalJobs(jobs []renderJob, values interface{}) ([]renderJob, error) {
+	kept := jobs[:0]
+	for _, job := range jobs {
+		if job.copy || job.link != "" || r.isPage(job.input) {
+			kept = append(kept, job)
+			continue
+		}
+		data, err := ioutil.ReadFile(job.input)
+		if err != nil {
+			return nil, err
+		}
+		cond, _ := splitWhen(data, r.LeftDelim, r.RightDelim)
+		if cond == "" {
+			kept = append(kept, job)
+			continue
+		}
+		ok, err := r.evalWhen(cond, job.input, r.jobValues(values, job))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			r.logf(LogInfo, "Leaving out %s, as %s is false", job.input, cond)
+			continue
+		}
+		kept = append(kept, job)
+	}
+	return kept, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Workspace is a directory holding the intermediate files of a run, such as
+// outputs handed to validation commands. It is created on first use, and
+// removed by Close. A nil Workspace uses the system temporary directory.
+type Workspace struct {
+	// Keep leaves the directory in place on Close, for debugging.
+	Keep bool
+
+	mu  sync.Mutex
+	dir string
+}
+
+func NewWorkspace(keep bool) *Workspace {
+	return &Workspace{Keep: keep}
+}
+
+// Dir returns the workspace directory, creating it if needed.
+func (w *Workspace) Dir() (string, error) {
+	if w == nil {
+		return os.TempDir(), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dir == "" {
+		dir, err := ioutil.TempDir("", "tpl-run-")
+		if err != nil {
+			return "", err
+		}
+		w.dir = dir
+		logf(nil, LogDebug, "Created workspace %s", dir)
+	}
+	return w.dir, nil
+}
+
+// TempFile creates a new file in the workspace, named after pattern as with
+// ioutil.TempFile.
+func (w *Workspace) TempFile(pattern string) (*os.File, error) {
+	dir, err := w.Dir()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, pattern)
+}
+
+// TempDir creates a new directory in the workspace, named after pattern as
+// with ioutil.TempDir.
+func (w *Workspace) TempDir(pattern string) (string, error) {
+	dir, err := w.Dir()
+	if err != nil {
+		return "", err
+	}
+	return ioutil.TempDir(dir, pattern)
+}
+
+// keep reports whether files in the workspace should be kept.
+func (w *Workspace) keep() bool {
+	return w != nil && w.Keep
+}
+
+// Close removes the workspace and everything in it, unless Keep is set.
+func (w *Workspace) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dir == "" {
+		return nil
+	}
+	if w.Keep {
+		logf(nil, LogInfo, "Keeping workspace %s", w.dir)
+		return nil
+	}
+	err := os.RemoveAll(w.dir)
+	w.dir = ""
+	return err
+}
+
+// CloseOnSignal closes the workspace and exits when the process is
+// interrupted or terminated.
+func (w *Workspace) CloseOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		logf(nil, LogWarn, "Received %v, cleaning up", sig)
+		w.Close()
+		os.Exit(1)
+	}()
+}